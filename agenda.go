@@ -0,0 +1,254 @@
+package main
+
+import (
+	"fmt"
+	"github.com/flothe/pinboard/clock"
+	"github.com/flothe/pinboard/config"
+	"github.com/flothe/pinboard/grafic2d"
+	"github.com/flothe/pinboard/web"
+	"log"
+	"sort"
+	"time"
+)
+
+// Agenda is a message that lists the upcoming events of the calendars, one
+// event per row with day, time, title and location. Events drop off when
+// they have ended, an agenda without events is not shown.
+type Agenda struct {
+	events            []*web.MessageData
+	cfg               *config.Config
+	clock             clock.Clock
+	gfx               *grafic2d.GFXServer
+	isReady           bool
+	timerMessageShown grafic2d.Timer
+}
+
+// NewAgenda returns an empty agenda. The look is taken from cfg, if nil the
+// defaults are used. The ended events are found with clk.
+func NewAgenda(cfg *config.Config, clk clock.Clock) *Agenda {
+	if cfg == nil {
+		cfg = config.Default()
+	}
+	clk = clock.Or(clk)
+	agenda := &Agenda{cfg: cfg, clock: clk}
+	agenda.timerMessageShown.Clock = clk
+	return agenda
+}
+
+// SetEvent adds the event or replaces the one with the same ID. An event that
+// has already ended is removed, so calendar crawlers remove deleted events by
+// sending them with ShowUntil now.
+func (agenda *Agenda) SetEvent(data *web.MessageData) {
+	var events []*web.MessageData
+	for _, e := range agenda.events {
+		if e.ID != data.ID {
+			events = append(events, e)
+		}
+	}
+	if agenda.isCurrent(data, agenda.clock.Now()) {
+		events = append(events, data)
+	} else {
+		log.Printf("Removed event %v from the agenda\n", data.ID)
+	}
+	sort.SliceStable(events, func(i, j int) bool { return events[i].EventStart.Before(events[j].EventStart) })
+	agenda.events = events
+}
+
+// isCurrent tells if the event has not ended at t
+func (agenda *Agenda) isCurrent(e *web.MessageData, t time.Time) bool {
+	return e.IsShown(t) && e.EventEnd.After(t)
+}
+
+// current returns the events that have not ended at t
+func (agenda *Agenda) current(t time.Time) []*web.MessageData {
+	var events []*web.MessageData
+	for _, e := range agenda.events {
+		if agenda.isCurrent(e, t) {
+			events = append(events, e)
+		}
+	}
+	return events
+}
+
+func (agenda *Agenda) IsShown(t time.Time) bool {
+	return len(agenda.current(t)) > 0
+}
+
+func (agenda *Agenda) IsReadyToEnd() bool {
+	return agenda.timerMessageShown.TimeSinceStart() >= agenda.cfg.Agenda.ShowTime.Millis()
+}
+
+// Files returns nil, the agenda has no images
+func (agenda *Agenda) Files() []string {
+	return nil
+}
+
+func (agenda *Agenda) IsReady() bool {
+	return agenda.isReady
+}
+
+func (agenda *Agenda) GetMsgShowTime() int {
+	return agenda.timerMessageShown.TimeSinceStart()
+}
+
+// SetConfig changes the look at once
+func (agenda *Agenda) SetConfig(cfg *config.Config) {
+	agenda.cfg = cfg
+}
+
+func (agenda *Agenda) Begin(gfx *grafic2d.GFXServer) error {
+	agenda.gfx = gfx
+	// the ended events are forgotten
+	agenda.events = agenda.current(agenda.clock.Now())
+	agenda.isReady = true
+	agenda.timerMessageShown.Start()
+	return nil
+}
+
+func (agenda *Agenda) End() error {
+	agenda.isReady = false
+	agenda.timerMessageShown.Reset()
+	return nil
+}
+
+func (agenda *Agenda) Destroy() error {
+	return nil
+}
+
+func (agenda *Agenda) Update(ms int) error {
+	if !agenda.isReady {
+		err := fmt.Errorf("Agenda is not ready for update")
+		log.Println(err)
+		return err
+	}
+	return nil
+}
+
+func (agenda *Agenda) Draw() error {
+	if !agenda.isReady {
+		err := fmt.Errorf("Agenda is not ready for draw")
+		log.Println(err)
+		return err
+	}
+
+	gfx := agenda.gfx
+	style := agenda.cfg.TickerStyle()
+	acfg := agenda.cfg.Agenda
+	w := grafic2d.VGfloat(gfx.DisplayWidth)
+	h := grafic2d.VGfloat(gfx.DisplayHeight)
+	// the text grows with the display
+	fs := gfx.DisplayHeight / 24
+	if fs < 10 {
+		fs = 10
+	}
+	size := grafic2d.VGfloat(fs)
+	margin := size
+
+	// title bar
+	gfx.Fill(style.PrefixBackgroundColor)
+	gfx.Rect(0, h-3*size, w, 3*size)
+	gfx.Fill(style.TextColor)
+	gfx.Text(margin, h-2*size, acfg.Title, style.Font, int(size*1.5))
+
+	now := agenda.clock.Now()
+	events := agenda.current(now)
+	rowHeight := 2 * size
+	top := h - 3.5*size
+	rows := int((top - margin) / rowHeight)
+	if rows < 1 {
+		return nil
+	}
+	more := 0
+	if len(events) > rows {
+		// the last row tells how many are left out
+		more = len(events) - rows + 1
+		events = events[:rows-1]
+	}
+
+	dateWidth := gfx.TextWidth(now.Format(acfg.DateFormat), style.Font, fs) + size
+	// all rows have the same columns
+	timeWidth := gfx.TextWidth(now.Format(acfg.TimeFormat)+" - "+now.Format(acfg.TimeFormat), style.Font, fs)
+	for _, e := range events {
+		if tw := gfx.TextWidth(agenda.timeText(e), style.Font, fs); tw > timeWidth {
+			timeWidth = tw
+		}
+	}
+	timeWidth += size
+	locationSize := int(size * 0.8)
+
+	lastDate := ""
+	for i, e := range events {
+		y := top - grafic2d.VGfloat(i+1)*rowHeight
+		if i%2 == 0 {
+			gfx.Fill(style.BackgroundColor)
+			gfx.Rect(0, y, w, rowHeight)
+		}
+		// running events are highlighted
+		if !e.EventStart.After(now) {
+			gfx.Fill(style.InfoBackgroundColor)
+			gfx.Rect(0, y, w, rowHeight)
+		}
+		baseline := y + rowHeight/2 - size*0.35
+		gfx.Fill(style.TextColor)
+
+		// the day is only written for its first event
+		start := e.EventStart.In(time.Local)
+		if date := start.Format(acfg.DateFormat); date != lastDate {
+			gfx.Text(margin, baseline, date, style.Font, fs)
+			lastDate = date
+		}
+		gfx.Text(margin+dateWidth, baseline, agenda.timeText(e), style.Font, fs)
+
+		x := margin + dateWidth + timeWidth
+		titleWidth := w - x - margin
+		if e.Location != "" {
+			location := fitText(gfx, e.Location, style.Font, locationSize, (w-x)/3)
+			locationWidth := gfx.TextWidth(location, style.Font, locationSize)
+			gfx.TextEnd(w-margin, baseline, location, style.Font, locationSize)
+			titleWidth -= locationWidth + size
+		}
+		gfx.Text(x, baseline, fitText(gfx, e.ShortText, style.Font, fs, titleWidth), style.Font, fs)
+	}
+	if more > 0 {
+		y := top - grafic2d.VGfloat(len(events)+1)*rowHeight
+		gfx.Fill(style.TextColor)
+		gfx.Text(margin+dateWidth, y+rowHeight/2-size*0.35, fmt.Sprintf("+ %v", more), style.Font, fs)
+	}
+	return nil
+}
+
+// timeText returns the time of the event as shown in the agenda
+func (agenda *Agenda) timeText(e *web.MessageData) string {
+	acfg := agenda.cfg.Agenda
+	start, end := e.EventStart.In(time.Local), e.EventEnd.In(time.Local)
+	if e.AllDay {
+		// the end is the day after the event
+		last := end.AddDate(0, 0, -1)
+		if last.After(start) {
+			return start.Format(acfg.DateFormat) + " - " + last.Format(acfg.DateFormat)
+		}
+		return acfg.AllDayText
+	}
+	if end.Equal(start) {
+		return start.Format(acfg.TimeFormat)
+	}
+	if end.YearDay() != start.YearDay() || end.Year() != start.Year() {
+		return start.Format(acfg.TimeFormat) + " - " + end.Format(acfg.DateFormat+" "+acfg.TimeFormat)
+	}
+	return start.Format(acfg.TimeFormat) + " - " + end.Format(acfg.TimeFormat)
+}
+
+// fitText shortens s with "..." until it is not wider than width
+func fitText(gfx *grafic2d.GFXServer, s, font string, size int, width grafic2d.VGfloat) string {
+	if gfx.TextWidth(s, font, size) <= width {
+		return s
+	}
+	r := []rune(s)
+	for len(r) > 0 {
+		r = r[:len(r)-1]
+		if t := string(r) + "..."; gfx.TextWidth(t, font, size) <= width {
+			return t
+		}
+	}
+	return ""
+}
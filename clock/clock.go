@@ -0,0 +1,116 @@
+// Package clock abstracts the time source, so the render loop and the
+// crawlers can run on a simulated clock.
+package clock
+
+import (
+	"sync"
+	"time"
+)
+
+// Clock tells the time and waits.
+type Clock interface {
+	// Now returns the current time
+	Now() time.Time
+	// Since returns the time elapsed since t
+	Since(t time.Time) time.Duration
+	// After waits for the duration to elapse and then sends the current time
+	After(d time.Duration) <-chan time.Time
+	// Sleep pauses the current goroutine for the duration
+	Sleep(d time.Duration)
+}
+
+// Real is the clock of the system. Durations are measured with the monotonic
+// clock, so they do not jump when the wall clock is adjusted.
+var Real Clock = realClock{}
+
+type realClock struct{}
+
+// Or returns clk, or Real if clk is nil.
+func Or(clk Clock) Clock {
+	if clk == nil {
+		return Real
+	}
+	return clk
+}
+
+func (realClock) Now() time.Time {
+	return time.Now()
+}
+
+func (realClock) Since(t time.Time) time.Duration {
+	return time.Since(t)
+}
+
+func (realClock) After(d time.Duration) <-chan time.Time {
+	return time.After(d)
+}
+
+func (realClock) Sleep(d time.Duration) {
+	time.Sleep(d)
+}
+
+// Fake is a clock that only moves when Advance is called.
+type Fake struct {
+	mu      sync.Mutex
+	now     time.Time
+	waiters []fakeWaiter
+}
+
+type fakeWaiter struct {
+	until time.Time
+	c     chan time.Time
+}
+
+// NewFake returns a fake clock set to t.
+func NewFake(t time.Time) *Fake {
+	return &Fake{now: t}
+}
+
+func (f *Fake) Now() time.Time {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.now
+}
+
+func (f *Fake) Since(t time.Time) time.Duration {
+	return f.Now().Sub(t)
+}
+
+func (f *Fake) After(d time.Duration) <-chan time.Time {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	c := make(chan time.Time, 1)
+	if d <= 0 {
+		c <- f.now
+		return c
+	}
+	f.waiters = append(f.waiters, fakeWaiter{until: f.now.Add(d), c: c})
+	return c
+}
+
+func (f *Fake) Sleep(d time.Duration) {
+	<-f.After(d)
+}
+
+// Advance moves the clock forward and wakes up all waiters whose time has come.
+func (f *Fake) Advance(d time.Duration) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.now = f.now.Add(d)
+	waiting := f.waiters[:0]
+	for _, w := range f.waiters {
+		if w.until.After(f.now) {
+			waiting = append(waiting, w)
+		} else {
+			w.c <- f.now
+		}
+	}
+	f.waiters = waiting
+}
+
+// Waiters returns the number of goroutines waiting for the clock to advance.
+func (f *Fake) Waiters() int {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return len(f.waiters)
+}
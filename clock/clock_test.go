@@ -0,0 +1,61 @@
+package clock
+
+import (
+	"testing"
+	"time"
+)
+
+func TestFakeAfter(t *testing.T) {
+	start := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+	f := NewFake(start)
+	short, long := f.After(time.Second), f.After(time.Minute)
+	select {
+	case <-f.After(0):
+	default:
+		t.Errorf("After(0) does not fire at once")
+	}
+	if n := f.Waiters(); n != 2 {
+		t.Errorf("%v waiters, want 2", n)
+	}
+
+	f.Advance(999 * time.Millisecond)
+	select {
+	case <-short:
+		t.Fatal("the waiter fired too early")
+	default:
+	}
+	f.Advance(time.Millisecond)
+	if now := <-short; !now.Equal(start.Add(time.Second)) {
+		t.Errorf("the waiter got %v", now)
+	}
+	if n := f.Waiters(); n != 1 {
+		t.Errorf("%v waiters, want 1", n)
+	}
+
+	// a big step wakes up all waiters on the way
+	f.Advance(time.Hour)
+	if now := <-long; !now.Equal(start.Add(time.Hour + time.Second)) {
+		t.Errorf("the waiter got %v", now)
+	}
+	if d := f.Since(start); d != time.Hour+time.Second {
+		t.Errorf("Since returned %v", d)
+	}
+}
+
+func TestFakeSleep(t *testing.T) {
+	f := NewFake(time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC))
+	done := make(chan bool)
+	go func() {
+		f.Sleep(time.Minute)
+		close(done)
+	}()
+	for f.Waiters() == 0 {
+		time.Sleep(time.Millisecond)
+	}
+	f.Advance(time.Minute)
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("Sleep did not return")
+	}
+}
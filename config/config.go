@@ -0,0 +1,523 @@
+// Package config reads the TOML configuration file of a pinboard. The
+// configuration covers everything that differs between the boards of the
+// locations: the data directory, the crawler sources, the timings and the
+// look of the messages.
+package config
+
+import (
+	"fmt"
+	"github.com/BurntSushi/toml"
+	"github.com/flothe/pinboard/grafic2d"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+type Config struct {
+	// directory of the messages and images, relative paths are relative to the config file
+	DataDir string       `toml:"data_dir"`
+	Images  ImagesConfig `toml:"images"`
+	Motion  MotionConfig `toml:"motion"`
+	Slides  SlidesConfig `toml:"slides"`
+	Cache   CacheConfig  `toml:"cache"`
+	Ticker  TickerConfig `toml:"ticker"`
+	Intro   IntroConfig  `toml:"intro"`
+	Agenda  AgendaConfig `toml:"agenda"`
+	Debug   DebugConfig  `toml:"debug"`
+	Sources []Source     `toml:"source"`
+}
+
+// ImagesConfig limits the size of the images saved by the crawlers
+type ImagesConfig struct {
+	MaxWidth  uint `toml:"max_width"`
+	MaxHeight uint `toml:"max_height"`
+	// larger downloads of images, clips and feeds fail
+	MaxDownloadMB int `toml:"max_download_mb"`
+}
+
+// MotionConfig limits the clips saved from animated GIFs and videos, all
+// frames of a clip are kept in memory while it is shown
+type MotionConfig struct {
+	MaxWidth  uint `toml:"max_width"`
+	MaxHeight uint `toml:"max_height"`
+	// frames per second taken from videos
+	FPS int `toml:"fps"`
+	// longer clips are cut
+	MaxDuration Duration `toml:"max_duration"`
+	// binary that decodes the videos, searched in PATH without a path. If
+	// empty videos are not saved.
+	FFmpeg string `toml:"ffmpeg"`
+}
+
+// SlidesConfig contains the timings of the photo slider of a message
+type SlidesConfig struct {
+	// how long a photo is shown
+	SlideTime Duration `toml:"slide_time"`
+	// how long a message is shown at least
+	MinShowTime Duration `toml:"min_show_time"`
+}
+
+// CacheConfig limits the images kept in memory. The images of the next
+// message are loaded ahead while the current one is shown, the ones of the
+// recently shown messages stay in the cache.
+type CacheConfig struct {
+	// size of the cache in MB, the images shown and loaded ahead are kept anyway
+	SizeMB int `toml:"size_mb"`
+	// how long creating the images loaded ahead may take per frame
+	UploadBudget Duration `toml:"upload_budget"`
+}
+
+// TickerConfig defines the text and the look of the news ticker
+type TickerConfig struct {
+	Prefix     string `toml:"prefix"`
+	DateFormat string `toml:"date_format"`
+	Font       string `toml:"font"`
+	FontSize   int    `toml:"font_size"`
+	// baseline of the ticker text in pixel from the bottom
+	Y int `toml:"y"`
+	// pixel per second
+	Speed                 int    `toml:"speed"`
+	TextColor             string `toml:"text_color"`
+	BackgroundColor       string `toml:"background_color"`
+	PrefixBackgroundColor string `toml:"prefix_background_color"`
+	InfoBackgroundColor   string `toml:"info_background_color"`
+}
+
+// IntroConfig contains the GIFs shown before each message
+type IntroConfig struct {
+	// GIF files relative to the data directory, one is chosen randomly
+	Gifs []string `toml:"gifs"`
+	// how long the last frame of the GIF is shown
+	WaitForEnd Duration `toml:"wait_for_end"`
+}
+
+// AgendaConfig defines the list of the upcoming calendar events. Fonts and
+// colors are the ones of the ticker.
+type AgendaConfig struct {
+	Title string `toml:"title"`
+	// layouts of time.Format for the day and the time of the events
+	DateFormat string `toml:"date_format"`
+	TimeFormat string `toml:"time_format"`
+	// shown instead of the time for events that last whole days
+	AllDayText string `toml:"all_day_text"`
+	// how long the agenda is shown
+	ShowTime Duration `toml:"show_time"`
+}
+
+type DebugConfig struct {
+	// show fps and message info
+	Overlay bool   `toml:"overlay"`
+	Font    string `toml:"font"`
+}
+
+// Source is a crawler source of messages
+type Source struct {
+	// type of the crawler: "pop3", "imap", "twitter", "feed", "mastodon",
+	// "webhook", "directory" or "calendar"
+	Type string `toml:"type"`
+	Name string `toml:"name"`
+	// address of the server, for twitter the base URL of the API (optional),
+	// for mastodon the instance, e.g. https://social.example.com
+	URL string `toml:"url"`
+	// login, for feeds HTTP basic auth (optional)
+	User     string `toml:"user"`
+	Password string `toml:"password"`
+	// time between two crawls, default 1m. IMAP servers push new mails, so
+	// the interval is only the fallback.
+	Interval Duration `toml:"interval"`
+	// IMAP folder that is crawled, default INBOX
+	Folder string `toml:"folder"`
+	// crawled IMAP mails are moved to this folder, if empty they are marked as seen
+	MoveTo string `toml:"move_to"`
+	// crawled POP3 mails are deleted after this many days, if 0 they are kept
+	DeleteAfterDays int `toml:"delete_after_days"`
+	// POP3 connection: "tls" (default), "starttls" or "none"
+	Security string `toml:"security"`
+	// POP3 login: "user", "apop", "plain" or "xoauth2", default is the best the server supports
+	Auth string `toml:"auth"`
+	// PEM file of an additional CA, e.g. of the company
+	CAFile string `toml:"ca_file"`
+	// name in the certificate of the server, if it differs from the host in url
+	ServerName string `toml:"server_name"`
+	// deadline of each POP3 command, default 1m
+	Timeout Duration `toml:"timeout"`
+	// credentials of the Twitter app, mastodon only needs the access token
+	// and only for accounts that are not public
+	ConsumerKey       string `toml:"consumer_key"`
+	ConsumerSecret    string `toml:"consumer_secret"`
+	AccessToken       string `toml:"access_token"`
+	AccessTokenSecret string `toml:"access_token_secret"`
+	// crawled Twitter timeline, one of: list as "owner/slug" or id, search
+	// query or the tweets of a user
+	List       string `toml:"list"`
+	Search     string `toml:"search"`
+	ScreenName string `toml:"screen_name"`
+	// URLs of the RSS and Atom feeds
+	Feeds []string `toml:"feeds"`
+	// older feed items are not shown, no limit if 0
+	MaxAge Duration `toml:"max_age"`
+	// only the newest items of each feed are shown, all if 0
+	MaxItems int `toml:"max_items"`
+	// crawled Mastodon timeline, one of: hashtag without # or account as
+	// "user" or "user@domain"
+	Hashtag string `toml:"hashtag"`
+	Account string `toml:"account"`
+	// listen to the Mastodon streaming API of the hashtag, so new statuses
+	// are shown at once
+	Streaming bool `toml:"streaming"`
+	// address the webhook listens on, e.g. ":8080"
+	Listen string `toml:"listen"`
+	// bearer tokens that may post pins to the webhook
+	Tokens []string `toml:"tokens"`
+	// TLS certificate and key of the webhook, plain HTTP if empty
+	CertFile string `toml:"cert_file"`
+	KeyFile  string `toml:"key_file"`
+	// directory that is watched for dropped files, relative paths are
+	// relative to the config file
+	Path string `toml:"path"`
+	// crawled files are moved here, default "archive", relative to path
+	Archive string `toml:"archive"`
+	// time without changes before dropped files are crawled, default 10s
+	SettleTime Duration `toml:"settle_time"`
+	// iCalendar files as http(s) or webcal URLs or file names, relative
+	// file names are relative to the config file
+	Calendars []string `toml:"calendars"`
+	// the calendars are CalDAV collections
+	CalDAV bool `toml:"caldav"`
+	// events of the next days are shown, default 7
+	Days int `toml:"days"`
+}
+
+// Duration is a time.Duration that is written as "90s" or "1m30s" in the config file
+type Duration struct {
+	time.Duration
+}
+
+func (d *Duration) UnmarshalText(text []byte) error {
+	var err error
+	d.Duration, err = time.ParseDuration(string(text))
+	return err
+}
+
+func (d Duration) MarshalText() ([]byte, error) {
+	return []byte(d.Duration.String()), nil
+}
+
+// Millis returns the duration in whole milliseconds
+func (d Duration) Millis() int {
+	return int(d.Duration / time.Millisecond)
+}
+
+// source types known by the pinboard
+var sourceTypes = []string{"pop3", "imap", "twitter", "feed", "mastodon", "webhook", "directory", "calendar"}
+
+// fonts known by the renderers
+var fonts = []string{"sans", "serif", "mono"}
+
+// Default returns the configuration the pinboard used before there was a config file
+func Default() *Config {
+	return &Config{
+		DataDir: "data",
+		Images:  ImagesConfig{MaxWidth: 1920, MaxHeight: 1080, MaxDownloadMB: 32},
+		Motion: MotionConfig{
+			MaxWidth:    480,
+			MaxHeight:   270,
+			FPS:         10,
+			MaxDuration: Duration{10 * time.Second},
+			FFmpeg:      "ffmpeg",
+		},
+		Slides: SlidesConfig{
+			SlideTime:   Duration{10 * time.Second},
+			MinShowTime: Duration{9 * time.Second},
+		},
+		Cache: CacheConfig{
+			SizeMB:       128,
+			UploadBudget: Duration{4 * time.Millisecond},
+		},
+		Ticker: TickerConfig{
+			Prefix:                "NEWS",
+			DateFormat:            "2. Jan 06 - 15:04",
+			Font:                  "sans",
+			FontSize:              20,
+			Y:                     100,
+			Speed:                 150,
+			TextColor:             "white",
+			BackgroundColor:       "rgba(0,0,64,0.8)",
+			PrefixBackgroundColor: "rgb(0,0,128)",
+			InfoBackgroundColor:   "rgba(0,0,64,0.95)",
+		},
+		Intro: IntroConfig{
+			Gifs:       []string{"internal/m1.gif", "internal/m2.gif", "internal/m3.gif", "internal/m4.gif", "internal/m5.gif"},
+			WaitForEnd: Duration{time.Second},
+		},
+		Agenda: AgendaConfig{
+			Title:      "TERMINE",
+			DateFormat: "02.01.",
+			TimeFormat: "15:04",
+			AllDayText: "ganztägig",
+			ShowTime:   Duration{15 * time.Second},
+		},
+		Debug: DebugConfig{Overlay: true, Font: "serif"},
+	}
+}
+
+// Load reads the config file. Values missing in the file keep their default.
+// The config is not validated, call Validate for that.
+func Load(filename string) (*Config, error) {
+	cfg := Default()
+	md, err := toml.DecodeFile(filename, cfg)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to read config file %v: %v", filename, err)
+	}
+	// typos should not go unnoticed
+	if undecoded := md.Undecoded(); len(undecoded) > 0 {
+		keys := make([]string, len(undecoded))
+		for i, k := range undecoded {
+			keys[i] = k.String()
+		}
+		return nil, fmt.Errorf("Unknown keys in config file %v: %v", filename, strings.Join(keys, ", "))
+	}
+	for i := range cfg.Sources {
+		if cfg.Sources[i].Interval.Duration == 0 {
+			cfg.Sources[i].Interval.Duration = time.Minute
+		}
+		if cfg.Sources[i].Type == "imap" && cfg.Sources[i].Folder == "" {
+			cfg.Sources[i].Folder = "INBOX"
+		}
+		if cfg.Sources[i].Type == "calendar" && cfg.Sources[i].Days == 0 {
+			cfg.Sources[i].Days = 7
+		}
+		for j, c := range cfg.Sources[i].Calendars {
+			if !strings.Contains(c, "://") && !filepath.IsAbs(c) {
+				cfg.Sources[i].Calendars[j] = filepath.Join(filepath.Dir(filename), c)
+			}
+		}
+		for _, fn := range []*string{&cfg.Sources[i].CAFile, &cfg.Sources[i].CertFile, &cfg.Sources[i].KeyFile, &cfg.Sources[i].Path} {
+			if *fn != "" && !filepath.IsAbs(*fn) {
+				*fn = filepath.Join(filepath.Dir(filename), *fn)
+			}
+		}
+	}
+	if !filepath.IsAbs(cfg.DataDir) {
+		cfg.DataDir = filepath.Join(filepath.Dir(filename), cfg.DataDir)
+	}
+	return cfg, nil
+}
+
+// Validate checks the whole config and returns all problems at once
+func (cfg *Config) Validate() error {
+	var errs []string
+	check := func(ok bool, format string, a ...interface{}) {
+		if !ok {
+			errs = append(errs, fmt.Sprintf(format, a...))
+		}
+	}
+
+	fi, err := os.Stat(cfg.DataDir)
+	check(err == nil && fi.IsDir(), "data_dir %q is not a directory", cfg.DataDir)
+
+	check(cfg.Images.MaxWidth > 0 && cfg.Images.MaxHeight > 0, "images: max_width and max_height must be greater than 0")
+	check(cfg.Images.MaxDownloadMB > 0, "images: max_download_mb must be greater than 0")
+
+	check(cfg.Motion.MaxWidth > 0 && cfg.Motion.MaxHeight > 0, "motion: max_width and max_height must be greater than 0")
+	check(cfg.Motion.FPS > 0 && cfg.Motion.FPS <= 60, "motion: fps must be between 1 and 60")
+	check(cfg.Motion.MaxDuration.Duration > 0 && cfg.Motion.MaxDuration.Duration <= time.Minute, "motion: max_duration must be greater than 0 and at most 1m")
+
+	check(cfg.Slides.SlideTime.Duration > 0, "slides: slide_time must be greater than 0")
+	check(cfg.Slides.MinShowTime.Duration >= 0, "slides: min_show_time must not be negative")
+
+	check(cfg.Cache.SizeMB >= 0, "cache: size_mb must not be negative")
+	check(cfg.Cache.UploadBudget.Duration > 0, "cache: upload_budget must be greater than 0")
+
+	check(isOneOf(cfg.Ticker.Font, fonts), "ticker: unknown font %q, use one of %v", cfg.Ticker.Font, fonts)
+	check(cfg.Ticker.FontSize > 0, "ticker: font_size must be greater than 0")
+	check(cfg.Ticker.Speed > 0, "ticker: speed must be greater than 0")
+	check(cfg.Ticker.DateFormat != "", "ticker: date_format must not be empty")
+	for _, c := range []struct{ key, value string }{
+		{"text_color", cfg.Ticker.TextColor},
+		{"background_color", cfg.Ticker.BackgroundColor},
+		{"prefix_background_color", cfg.Ticker.PrefixBackgroundColor},
+		{"info_background_color", cfg.Ticker.InfoBackgroundColor},
+	} {
+		_, err := grafic2d.ParseColor(c.value)
+		check(err == nil, "ticker: %v: %v", c.key, err)
+	}
+
+	check(len(cfg.Intro.Gifs) > 0, "intro: at least one GIF is needed")
+	for _, fn := range cfg.Intro.Gifs {
+		if !filepath.IsAbs(fn) {
+			fn = filepath.Join(cfg.DataDir, fn)
+		}
+		_, err := os.Stat(fn)
+		check(err == nil, "intro: GIF %v not found", fn)
+	}
+	check(cfg.Intro.WaitForEnd.Duration >= 0, "intro: wait_for_end must not be negative")
+
+	check(cfg.Agenda.DateFormat != "" && cfg.Agenda.TimeFormat != "", "agenda: date_format and time_format must not be empty")
+	check(cfg.Agenda.ShowTime.Duration > 0, "agenda: show_time must be greater than 0")
+
+	check(isOneOf(cfg.Debug.Font, fonts), "debug: unknown font %q, use one of %v", cfg.Debug.Font, fonts)
+
+	names := make(map[string]bool)
+	for i, s := range cfg.Sources {
+		name := s.Name
+		if name == "" {
+			name = fmt.Sprintf("#%v", i+1)
+		}
+		check(!names[name], "source %v: name is used twice", name)
+		names[name] = true
+		check(isOneOf(s.Type, sourceTypes), "source %v: unknown type %q, use one of %v", name, s.Type, sourceTypes)
+		switch s.Type {
+		case "pop3", "imap":
+			check(s.URL != "", "source %v: url is missing", name)
+			check(s.User != "", "source %v: user is missing", name)
+		case "twitter":
+			check(s.ConsumerKey != "" && s.ConsumerSecret != "" && s.AccessToken != "" && s.AccessTokenSecret != "",
+				"source %v: consumer_key, consumer_secret, access_token and access_token_secret are needed", name)
+			timelines := 0
+			for _, t := range []string{s.List, s.Search, s.ScreenName} {
+				if t != "" {
+					timelines++
+				}
+			}
+			check(timelines == 1, "source %v: set one of list, search and screen_name", name)
+			check(s.User == "" && s.Password == "" && s.CAFile == "" && s.ServerName == "",
+				"source %v: user, password, ca_file and server_name are not used by twitter", name)
+		case "feed":
+			check(len(s.Feeds) > 0, "source %v: feeds are missing", name)
+			for _, f := range s.Feeds {
+				u, err := url.Parse(f)
+				check(err == nil && (u.Scheme == "http" || u.Scheme == "https") && u.Host != "",
+					"source %v: feed %q is not a http or https URL", name, f)
+			}
+			check(s.URL == "", "source %v: url is not used by feed, use feeds", name)
+			check(s.MaxAge.Duration >= 0, "source %v: max_age must not be negative", name)
+			check(s.MaxItems >= 0, "source %v: max_items must not be negative", name)
+		case "mastodon":
+			u, err := url.Parse(s.URL)
+			check(err == nil && (u.Scheme == "http" || u.Scheme == "https") && u.Host != "",
+				"source %v: url %q is not a http or https URL", name, s.URL)
+			check((s.Hashtag == "") != (s.Account == ""), "source %v: set one of hashtag and account", name)
+			check(!strings.HasPrefix(s.Hashtag, "#"), "source %v: hashtag must not start with #", name)
+			check(!s.Streaming || s.Hashtag != "", "source %v: streaming needs a hashtag", name)
+			check(s.User == "" && s.Password == "", "source %v: user and password are not used by mastodon, use access_token", name)
+		case "webhook":
+			check(s.Listen != "", "source %v: listen is missing", name)
+			check(len(s.Tokens) > 0, "source %v: at least one token is needed", name)
+			for _, t := range s.Tokens {
+				check(len(t) >= 16, "source %v: tokens must have at least 16 characters", name)
+			}
+			check((s.CertFile == "") == (s.KeyFile == ""), "source %v: set both cert_file and key_file or none", name)
+			for _, fn := range []string{s.CertFile, s.KeyFile} {
+				if fn != "" {
+					_, err := os.Stat(fn)
+					check(err == nil, "source %v: %v not found", name, fn)
+				}
+			}
+			check(s.URL == "" && s.User == "" && s.Password == "" && s.CAFile == "" && s.ServerName == "",
+				"source %v: url, user, password, ca_file and server_name are not used by webhook", name)
+		case "directory":
+			fi, err := os.Stat(s.Path)
+			check(err == nil && fi.IsDir(), "source %v: path %q is not a directory", name, s.Path)
+			check(s.SettleTime.Duration >= 0, "source %v: settle_time must not be negative", name)
+			check(s.URL == "" && s.User == "" && s.Password == "" && s.CAFile == "" && s.ServerName == "",
+				"source %v: url, user, password, ca_file and server_name are not used by directory", name)
+		case "calendar":
+			check(len(s.Calendars) > 0, "source %v: calendars are missing", name)
+			for _, c := range s.Calendars {
+				if strings.Contains(c, "://") {
+					u, err := url.Parse(c)
+					ok := err == nil && u.Host != "" && isOneOf(u.Scheme, []string{"http", "https", "webcal", "webcals"})
+					check(ok, "source %v: calendar %q is not a http, https or webcal URL", name, c)
+					check(!ok || !s.CalDAV || u.Scheme == "http" || u.Scheme == "https",
+						"source %v: caldav needs a http or https URL, not %q", name, c)
+				} else {
+					_, err := os.Stat(c)
+					check(err == nil, "source %v: calendar file %v not found", name, c)
+					check(!s.CalDAV, "source %v: caldav cannot be used with the calendar file %v", name, c)
+				}
+			}
+			check(s.Days > 0 && s.Days <= 366, "source %v: days must be between 1 and 366", name)
+			check(s.URL == "", "source %v: url is not used by calendar, use calendars", name)
+		}
+		if s.Type != "twitter" {
+			check(s.ConsumerKey == "" && s.ConsumerSecret == "" && s.AccessTokenSecret == "" &&
+				s.List == "" && s.Search == "" && s.ScreenName == "",
+				"source %v: the twitter keys are only used by twitter", name)
+			check(s.Type == "mastodon" || s.AccessToken == "", "source %v: access_token is only used by twitter and mastodon", name)
+		}
+		if s.Type != "mastodon" {
+			check(s.Hashtag == "" && s.Account == "" && !s.Streaming,
+				"source %v: hashtag, account and streaming are only used by mastodon", name)
+		}
+		if s.Type != "webhook" {
+			check(s.Listen == "" && len(s.Tokens) == 0 && s.CertFile == "" && s.KeyFile == "",
+				"source %v: listen, tokens, cert_file and key_file are only used by webhook", name)
+		}
+		if s.Type != "directory" {
+			check(s.Path == "" && s.Archive == "" && s.SettleTime.Duration == 0,
+				"source %v: path, archive and settle_time are only used by directory", name)
+		}
+		if s.Type != "calendar" {
+			check(len(s.Calendars) == 0 && !s.CalDAV && s.Days == 0,
+				"source %v: calendars, caldav and days are only used by calendar", name)
+		}
+		if s.Type != "feed" {
+			check(len(s.Feeds) == 0 && s.MaxAge.Duration == 0 && s.MaxItems == 0,
+				"source %v: feeds, max_age and max_items are only used by feed", name)
+		}
+		check(s.Interval.Duration >= time.Second, "source %v: interval must be at least 1s", name)
+		check(s.DeleteAfterDays >= 0, "source %v: delete_after_days must not be negative", name)
+		check(s.Timeout.Duration >= 0, "source %v: timeout must not be negative", name)
+		if s.CAFile != "" {
+			_, err := os.Stat(s.CAFile)
+			check(err == nil, "source %v: ca_file %v not found", name, s.CAFile)
+		}
+		if s.Type == "pop3" {
+			check(isOneOf(s.Security, []string{"", "tls", "starttls", "none"}), "source %v: unknown security %q", name, s.Security)
+			check(isOneOf(s.Auth, []string{"", "user", "apop", "plain", "xoauth2"}), "source %v: unknown auth %q", name, s.Auth)
+		} else {
+			check(s.DeleteAfterDays == 0 && s.Security == "" && s.Auth == "" && s.Timeout.Duration == 0,
+				"source %v: delete_after_days, security, auth and timeout are only used by pop3", name)
+		}
+		if s.Type == "imap" {
+			check(s.MoveTo != s.Folder, "source %v: move_to must differ from folder", name)
+		} else {
+			check(s.Folder == "" && s.MoveTo == "", "source %v: folder and move_to are only used by imap", name)
+		}
+	}
+
+	if len(errs) > 0 {
+		return fmt.Errorf("Invalid config:\n  %v", strings.Join(errs, "\n  "))
+	}
+	return nil
+}
+
+// TickerStyle returns the look of the ticker. The colors must have been validated.
+func (cfg *Config) TickerStyle() grafic2d.TickerStyle {
+	color := func(s string) grafic2d.Color {
+		c, _ := grafic2d.ParseColor(s)
+		return c
+	}
+	return grafic2d.TickerStyle{
+		Font:                  cfg.Ticker.Font,
+		FontSize:              cfg.Ticker.FontSize,
+		Y:                     grafic2d.VGfloat(cfg.Ticker.Y),
+		Speed:                 cfg.Ticker.Speed,
+		TextColor:             color(cfg.Ticker.TextColor),
+		BackgroundColor:       color(cfg.Ticker.BackgroundColor),
+		PrefixBackgroundColor: color(cfg.Ticker.PrefixBackgroundColor),
+		InfoBackgroundColor:   color(cfg.Ticker.InfoBackgroundColor),
+	}
+}
+
+func isOneOf(s string, list []string) bool {
+	for _, l := range list {
+		if s == l {
+			return true
+		}
+	}
+	return false
+}
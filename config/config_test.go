@@ -0,0 +1,271 @@
+package config
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+// writeConfig writes the config file into dir and returns its name
+func writeConfig(t *testing.T, dir, content string) string {
+	fn := filepath.Join(dir, "pinboard.toml")
+	if err := ioutil.WriteFile(fn, []byte(content), 0644); err != nil {
+		t.Fatal(err)
+	}
+	return fn
+}
+
+// validConfig returns the default config with a data directory that has the
+// intro GIFs
+func validConfig(t *testing.T) *Config {
+	cfg := Default()
+	cfg.DataDir = t.TempDir()
+	for _, fn := range cfg.Intro.Gifs {
+		fn = filepath.Join(cfg.DataDir, fn)
+		if err := os.MkdirAll(filepath.Dir(fn), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(fn, []byte("GIF89a"), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return cfg
+}
+
+func TestLoadExample(t *testing.T) {
+	cfg, err := Load("../pinboard.example.toml")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var types []string
+	for _, s := range cfg.Sources {
+		if !isOneOf(s.Type, types) {
+			types = append(types, s.Type)
+		}
+	}
+	// the example shows every type of source
+	if len(types) != len(sourceTypes) {
+		t.Errorf("the example has the sources %v, want all of %v", types, sourceTypes)
+	}
+}
+
+func TestLoadDefaults(t *testing.T) {
+	dir := t.TempDir()
+	cfg, err := Load(writeConfig(t, dir, `
+[ticker]
+prefix = "INFO"
+
+[[source]]
+type = "imap"
+url = "imap.example.com:993"
+
+[[source]]
+type = "calendar"
+calendars = ["https://example.com/team.ics"]
+interval = "5m"
+`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := Default()
+	want.Ticker.Prefix = "INFO"
+	want.DataDir = filepath.Join(dir, "data")
+	if !reflect.DeepEqual(cfg.Ticker, want.Ticker) || !reflect.DeepEqual(cfg.Images, want.Images) || cfg.DataDir != want.DataDir {
+		t.Errorf("got %+v %+v in %v, want the defaults", cfg.Ticker, cfg.Images, cfg.DataDir)
+	}
+	imap, cal := cfg.Sources[0], cfg.Sources[1]
+	if imap.Interval.Duration != time.Minute || imap.Folder != "INBOX" || imap.Days != 0 {
+		t.Errorf("imap: interval %v, folder %q, days %v", imap.Interval, imap.Folder, imap.Days)
+	}
+	if cal.Interval.Duration != 5*time.Minute || cal.Folder != "" || cal.Days != 7 {
+		t.Errorf("calendar: interval %v, folder %q, days %v", cal.Interval, cal.Folder, cal.Days)
+	}
+}
+
+func TestLoadUnknownKeys(t *testing.T) {
+	fn := writeConfig(t, t.TempDir(), `
+[ticker]
+font_sise = 20
+
+[[source]]
+type = "feed"
+feed = ["https://example.com/feed.xml"]
+`)
+	_, err := Load(fn)
+	if err == nil {
+		t.Fatal("unknown keys are accepted")
+	}
+	for _, key := range []string{"ticker.font_sise", "source.feed"} {
+		if !strings.Contains(err.Error(), key) {
+			t.Errorf("%q is not reported: %v", key, err)
+		}
+	}
+
+	if _, err := Load(writeConfig(t, t.TempDir(), "[ticker]\nfont_size = \"groß\"\n")); err == nil {
+		t.Error("a string is accepted as font_size")
+	}
+	if _, err := Load(filepath.Join(t.TempDir(), "fehlt.toml")); err == nil {
+		t.Error("a missing file is accepted")
+	}
+}
+
+func TestLoadRelativePaths(t *testing.T) {
+	dir := filepath.Join(t.TempDir(), "etc")
+	if err := os.Mkdir(dir, 0755); err != nil {
+		t.Fatal(err)
+	}
+	abs := filepath.Join(t.TempDir(), "abs")
+	cfg, err := Load(writeConfig(t, dir, `
+data_dir = "../daten"
+
+[[source]]
+type = "directory"
+path = "drop"
+archive = "erledigt"
+
+[[source]]
+type = "calendar"
+calendars = ["team.ics", "`+abs+`.ics", "webcal://example.com/feiertage.ics"]
+ca_file = "certs/ca.pem"
+
+[[source]]
+type = "webhook"
+listen = ":8080"
+tokens = ["0123456789abcdef"]
+cert_file = "`+abs+`.crt"
+key_file = "tls.key"
+`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := filepath.Join(dir, "..", "daten"); cfg.DataDir != want {
+		t.Errorf("data_dir %v, want %v", cfg.DataDir, want)
+	}
+	d, c, w := cfg.Sources[0], cfg.Sources[1], cfg.Sources[2]
+	// archive is relative to path, not to the config file
+	if d.Path != filepath.Join(dir, "drop") || d.Archive != "erledigt" {
+		t.Errorf("directory: path %v, archive %v", d.Path, d.Archive)
+	}
+	if want := []string{filepath.Join(dir, "team.ics"), abs + ".ics", "webcal://example.com/feiertage.ics"}; !reflect.DeepEqual(c.Calendars, want) {
+		t.Errorf("calendars %v, want %v", c.Calendars, want)
+	}
+	if c.CAFile != filepath.Join(dir, "certs", "ca.pem") {
+		t.Errorf("ca_file %v", c.CAFile)
+	}
+	if w.CertFile != abs+".crt" || w.KeyFile != filepath.Join(dir, "tls.key") {
+		t.Errorf("webhook: cert_file %v, key_file %v", w.CertFile, w.KeyFile)
+	}
+
+	// an absolute data_dir is kept
+	cfg, err = Load(writeConfig(t, dir, `data_dir = "`+abs+`"`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cfg.DataDir != abs {
+		t.Errorf("data_dir %v, want %v", cfg.DataDir, abs)
+	}
+}
+
+func TestValidate(t *testing.T) {
+	if err := validConfig(t).Validate(); err != nil {
+		t.Fatalf("the default config is invalid: %v", err)
+	}
+
+	dir := t.TempDir()
+	ics := filepath.Join(dir, "team.ics")
+	if err := ioutil.WriteFile(ics, []byte("BEGIN:VCALENDAR\r\nEND:VCALENDAR\r\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	minute := Duration{time.Minute}
+	// valid sources of every type
+	valid := map[string]Source{
+		"pop3": {Type: "pop3", URL: "pop.example.com:995", User: "pinboard", Security: "starttls", Auth: "apop", Interval: minute},
+		"imap": {Type: "imap", URL: "imap.example.com:993", User: "pinboard", Folder: "INBOX", MoveTo: "Pinned", Interval: minute},
+		"twitter": {Type: "twitter", ConsumerKey: "k", ConsumerSecret: "s", AccessToken: "t", AccessTokenSecret: "ts",
+			Search: "#pinboard", Interval: minute},
+		"feed":      {Type: "feed", Feeds: []string{"https://example.com/feed.xml"}, MaxAge: Duration{time.Hour}, MaxItems: 5, Interval: minute},
+		"mastodon":  {Type: "mastodon", URL: "https://social.example.com", Hashtag: "pinboard", Streaming: true, Interval: minute},
+		"webhook":   {Type: "webhook", Listen: ":8080", Tokens: []string{"0123456789abcdef"}, Interval: minute},
+		"directory": {Type: "directory", Path: dir, Archive: "archiv", SettleTime: Duration{time.Second}, Interval: minute},
+		"calendar":  {Type: "calendar", Calendars: []string{ics, "webcals://example.com/a.ics"}, Days: 14, Interval: minute},
+	}
+	for typ, s := range valid {
+		cfg := validConfig(t)
+		cfg.Sources = []Source{s}
+		if err := cfg.Validate(); err != nil {
+			t.Errorf("%v: %v", typ, err)
+		}
+	}
+
+	for _, c := range []struct {
+		name string
+		// typ is the valid source that is changed, none if empty
+		typ    string
+		change func(*Config, *Source)
+		want   string
+	}{
+		{"data_dir", "", func(cfg *Config, s *Source) { cfg.DataDir = filepath.Join(dir, "fehlt") }, "is not a directory"},
+		{"intro", "", func(cfg *Config, s *Source) { cfg.Intro.Gifs = []string{"fehlt.gif"} }, "intro: GIF"},
+		{"font", "", func(cfg *Config, s *Source) { cfg.Ticker.Font = "comic" }, `unknown font "comic"`},
+		{"color", "", func(cfg *Config, s *Source) { cfg.Ticker.TextColor = "blau" }, "ticker: text_color"},
+		{"fps", "", func(cfg *Config, s *Source) { cfg.Motion.FPS = 61 }, "fps must be between 1 and 60"},
+		{"unknown type", "feed", func(cfg *Config, s *Source) { s.Type = "fax" }, `unknown type "fax"`},
+		{"pop3 user", "pop3", func(cfg *Config, s *Source) { s.User = "" }, "user is missing"},
+		{"pop3 auth", "pop3", func(cfg *Config, s *Source) { s.Auth = "kerberos" }, `unknown auth "kerberos"`},
+		{"imap move_to", "imap", func(cfg *Config, s *Source) { s.MoveTo = "INBOX" }, "move_to must differ from folder"},
+		{"imap security", "imap", func(cfg *Config, s *Source) { s.Security = "tls" }, "only used by pop3"},
+		{"twitter timelines", "twitter", func(cfg *Config, s *Source) { s.List = "team/news" }, "set one of list, search and screen_name"},
+		{"twitter password", "twitter", func(cfg *Config, s *Source) { s.Password = "x" }, "not used by twitter"},
+		{"feed scheme", "feed", func(cfg *Config, s *Source) { s.Feeds = []string{"ftp://example.com/feed"} }, "is not a http or https URL"},
+		{"feed url", "feed", func(cfg *Config, s *Source) { s.URL = "https://example.com" }, "use feeds"},
+		{"feed max_items", "feed", func(cfg *Config, s *Source) { s.MaxItems = -1 }, "max_items must not be negative"},
+		{"mastodon both", "mastodon", func(cfg *Config, s *Source) { s.Account = "team" }, "set one of hashtag and account"},
+		{"mastodon #", "mastodon", func(cfg *Config, s *Source) { s.Hashtag = "#pinboard" }, "must not start with #"},
+		{"mastodon streaming", "mastodon", func(cfg *Config, s *Source) { s.Hashtag, s.Account = "", "team" }, "streaming needs a hashtag"},
+		{"webhook token", "webhook", func(cfg *Config, s *Source) { s.Tokens = []string{"kurz"} }, "at least 16 characters"},
+		{"webhook cert", "webhook", func(cfg *Config, s *Source) { s.CertFile = ics }, "set both cert_file and key_file"},
+		{"webhook feeds", "webhook", func(cfg *Config, s *Source) { s.MaxAge = Duration{time.Hour} }, "only used by feed"},
+		{"directory path", "directory", func(cfg *Config, s *Source) { s.Path = ics }, "is not a directory"},
+		{"directory hashtag", "directory", func(cfg *Config, s *Source) { s.Hashtag = "x" }, "only used by mastodon"},
+		{"calendar file", "calendar", func(cfg *Config, s *Source) { s.Calendars = []string{filepath.Join(dir, "fehlt.ics")} }, "not found"},
+		{"calendar scheme", "calendar", func(cfg *Config, s *Source) { s.Calendars = []string{"ftp://example.com/a.ics"} }, "is not a http, https or webcal URL"},
+		{"calendar caldav", "calendar", func(cfg *Config, s *Source) { s.CalDAV = true }, "caldav"},
+		{"calendar days", "calendar", func(cfg *Config, s *Source) { s.Days = 400 }, "days must be between 1 and 366"},
+		{"pop3 days", "pop3", func(cfg *Config, s *Source) { s.Days = 7 }, "only used by calendar"},
+		{"interval", "feed", func(cfg *Config, s *Source) { s.Interval = Duration{time.Millisecond} }, "interval must be at least 1s"},
+	} {
+		cfg := validConfig(t)
+		if c.typ != "" {
+			s := valid[c.typ]
+			c.change(cfg, &s)
+			cfg.Sources = []Source{s}
+		} else {
+			c.change(cfg, nil)
+		}
+		err := cfg.Validate()
+		if err == nil || !strings.Contains(err.Error(), c.want) {
+			t.Errorf("%v: got %v, want %q", c.name, err, c.want)
+		}
+	}
+
+	// all problems are reported at once, sources by name or number
+	cfg := validConfig(t)
+	cfg.Ticker.FontSize = 0
+	cfg.Sources = []Source{valid["feed"], valid["feed"], valid["pop3"]}
+	cfg.Sources[0].Name = "news"
+	cfg.Sources[1].Name = "news"
+	cfg.Sources[2].URL = ""
+	err := cfg.Validate()
+	if err == nil {
+		t.Fatal("the invalid config is accepted")
+	}
+	for _, want := range []string{"font_size must be greater than 0", "source news: name is used twice", "source #3: url is missing"} {
+		if !strings.Contains(err.Error(), want) {
+			t.Errorf("%q is not reported: %v", want, err)
+		}
+	}
+}
@@ -0,0 +1,66 @@
+package main
+
+import (
+	"fmt"
+	"github.com/flothe/pinboard/clock"
+	"github.com/flothe/pinboard/config"
+	"github.com/flothe/pinboard/web"
+	"time"
+)
+
+// newCrawler creates the crawler of the source
+func newCrawler(s config.Source, limits web.ImageLimits) (web.Crawler, error) {
+	tlsConfig, err := web.NewTLSConfig(s.CAFile, s.ServerName)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to create TLS config: %v", err)
+	}
+	var crawler web.Crawler
+	switch s.Type {
+	case "pop3":
+		opts := web.MailOptions{
+			Security:    s.Security,
+			Auth:        s.Auth,
+			TLSConfig:   tlsConfig,
+			Timeout:     s.Timeout.Duration,
+			DeleteAfter: time.Duration(s.DeleteAfterDays) * 24 * time.Hour,
+		}
+		crawler = web.NewMailCrawler(s.URL, s.User, s.Password, opts, limits, clock.Real)
+	case "imap":
+		imapCrawler := web.NewIMAPCrawler(s.URL, s.User, s.Password, s.Folder, s.MoveTo, limits, clock.Real)
+		imapCrawler.TLSConfig = tlsConfig
+		crawler = imapCrawler
+	case "twitter":
+		timeline := web.TwitterTimeline{List: s.List, Search: s.Search, ScreenName: s.ScreenName}
+		twitterCrawler := web.NewTwitterCrawler(s.ConsumerKey, s.ConsumerSecret, s.AccessToken, s.AccessTokenSecret, timeline, limits, clock.Real)
+		twitterCrawler.BaseURL = s.URL
+		crawler = twitterCrawler
+	case "feed":
+		opts := web.FeedOptions{MaxAge: s.MaxAge.Duration, MaxItems: s.MaxItems, User: s.User, Password: s.Password}
+		feedCrawler := web.NewFeedCrawler(s.Feeds, opts, limits, clock.Real)
+		feedCrawler.TLSConfig = tlsConfig
+		crawler = feedCrawler
+	case "mastodon":
+		timeline := web.MastodonTimeline{Hashtag: s.Hashtag, Account: s.Account}
+		mastodonCrawler := web.NewMastodonCrawler(s.URL, s.AccessToken, timeline, limits, clock.Real)
+		mastodonCrawler.TLSConfig = tlsConfig
+		mastodonCrawler.Streaming = s.Streaming
+		crawler = mastodonCrawler
+	case "webhook":
+		webhookCrawler := web.NewWebhookCrawler(s.Listen, s.Tokens, limits, clock.Real)
+		webhookCrawler.CertFile = s.CertFile
+		webhookCrawler.KeyFile = s.KeyFile
+		crawler = webhookCrawler
+	case "directory":
+		directoryCrawler := web.NewDirectoryCrawler(s.Path, s.Archive, limits, clock.Real)
+		directoryCrawler.SettleTime = s.SettleTime.Duration
+		crawler = directoryCrawler
+	case "calendar":
+		opts := web.CalendarOptions{Days: s.Days, User: s.User, Password: s.Password, CalDAV: s.CalDAV}
+		calendarCrawler := web.NewCalendarCrawler(s.Calendars, opts, clock.Real)
+		calendarCrawler.TLSConfig = tlsConfig
+		crawler = calendarCrawler
+	default:
+		return nil, fmt.Errorf("Unknown type %v", s.Type)
+	}
+	return crawler, nil
+}
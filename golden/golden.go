@@ -0,0 +1,157 @@
+// Package golden renders render objects off-screen and compares the frames
+// with stored golden PNG images.
+package golden
+
+import (
+	"fmt"
+	"github.com/flothe/pinboard/grafic2d"
+	"image"
+	"image/color"
+	"image/png"
+	"log"
+	"os"
+	"path/filepath"
+)
+
+// Harness compares rendered frames with the golden images in Dir.
+type Harness struct {
+	// directory of the golden images
+	Dir string
+	// maximum difference of a color channel that still counts as equal
+	Tolerance int
+	// fraction of the pixels that may differ
+	MaxMismatch float64
+	// write the rendered frames as new golden images instead of comparing them
+	Update bool
+}
+
+// NewHarness returns a harness with a small default tolerance.
+func NewHarness(dir string, update bool) *Harness {
+	return &Harness{Dir: dir, Tolerance: 8, MaxMismatch: 0.001, Update: update}
+}
+
+// Render creates a render object with newObj on a software renderer of
+// width x height pixels, begins it and draws a frame at each of the
+// timestamps (in ms since Begin, ascending). newObj is called after the
+// renderer has been initialized, so it may already create images.
+func Render(newObj func() grafic2d.RenderObject, width, height int, times []int) ([]*image.RGBA, error) {
+	r := grafic2d.NewSoftwareRenderer(width, height)
+	gfx := grafic2d.NewGFXServer(r)
+	gfx.Init()
+	defer gfx.Finish()
+
+	obj := newObj()
+	if err := obj.Begin(gfx); err != nil {
+		return nil, err
+	}
+	defer obj.End()
+
+	var frames []*image.RGBA
+	now := 0
+	for _, t := range times {
+		obj.Update(t - now)
+		now = t
+
+		gfx.Start(0, 0)
+		gfx.Background(0, 0, 0)
+		obj.Draw()
+		gfx.End()
+
+		frame := image.NewRGBA(r.Image().Bounds())
+		copy(frame.Pix, r.Image().Pix)
+		frames = append(frames, frame)
+	}
+	return frames, nil
+}
+
+// Check compares the frames rendered at the timestamps with the golden images
+// of the name. On a mismatch the rendered frame and a diff image are written
+// next to the golden image.
+func (h *Harness) Check(name string, frames []*image.RGBA, times []int) error {
+	if h.Update {
+		if err := os.MkdirAll(h.Dir, 0755); err != nil {
+			return err
+		}
+	}
+	var failed []string
+	for i, frame := range frames {
+		fn := filepath.Join(h.Dir, fmt.Sprintf("%s-%05dms.png", name, times[i]))
+		if h.Update {
+			if err := savePNG(fn, frame); err != nil {
+				return err
+			}
+			log.Printf("Updated golden image %v\n", fn)
+			continue
+		}
+
+		want, err := loadPNG(fn)
+		if err != nil {
+			return fmt.Errorf("Failed to load golden image %v: %v", fn, err)
+		}
+		mismatch, diff := Compare(frame, want, h.Tolerance)
+		if mismatch > h.MaxMismatch {
+			base := fn[:len(fn)-len(".png")]
+			savePNG(base+".got.png", frame)
+			savePNG(base+".diff.png", diff)
+			failed = append(failed, fmt.Sprintf("%v (%.3f%% of the pixels differ)", fn, mismatch*100))
+		}
+	}
+	if len(failed) > 0 {
+		return fmt.Errorf("%v: frames differ from the golden images: %v", name, failed)
+	}
+	return nil
+}
+
+// Compare returns the fraction of pixels whose color channels differ by more
+// than tolerance, and an image that shows these pixels in red on a dimmed copy
+// of want. Images of different size differ completely.
+func Compare(got, want image.Image, tolerance int) (float64, *image.RGBA) {
+	gb, wb := got.Bounds(), want.Bounds()
+	diff := image.NewRGBA(image.Rect(0, 0, wb.Dx(), wb.Dy()))
+	if gb.Dx() != wb.Dx() || gb.Dy() != wb.Dy() {
+		return 1, diff
+	}
+
+	differ := 0
+	for y := 0; y < wb.Dy(); y++ {
+		for x := 0; x < wb.Dx(); x++ {
+			gr, gg, gbl, ga := got.At(gb.Min.X+x, gb.Min.Y+y).RGBA()
+			wr, wg, wbl, wa := want.At(wb.Min.X+x, wb.Min.Y+y).RGBA()
+			if channelDiff(gr, wr) > tolerance || channelDiff(gg, wg) > tolerance ||
+				channelDiff(gbl, wbl) > tolerance || channelDiff(ga, wa) > tolerance {
+				differ++
+				diff.SetRGBA(x, y, color.RGBA{255, 0, 0, 255})
+			} else {
+				diff.SetRGBA(x, y, color.RGBA{uint8(wr >> 10), uint8(wg >> 10), uint8(wbl >> 10), 255})
+			}
+		}
+	}
+	return float64(differ) / float64(wb.Dx()*wb.Dy()), diff
+}
+
+// channelDiff returns the difference of two 16 bit color channels in 8 bit
+func channelDiff(a, b uint32) int {
+	d := int(a>>8) - int(b>>8)
+	if d < 0 {
+		return -d
+	}
+	return d
+}
+
+func loadPNG(filename string) (image.Image, error) {
+	f, err := os.Open(filename)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return png.Decode(f)
+}
+
+func savePNG(filename string, img image.Image) error {
+	f, err := os.Create(filename)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	return png.Encode(f, img)
+}
@@ -0,0 +1,187 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"github.com/flothe/pinboard/clock"
+	"github.com/flothe/pinboard/golden"
+	"github.com/flothe/pinboard/grafic2d"
+	"github.com/flothe/pinboard/web"
+	"image"
+	"image/color"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// goldenCase is a render object that is rendered at fixed timestamps and
+// display resolutions and compared with golden images
+type goldenCase struct {
+	name        string
+	newObj      func() grafic2d.RenderObject
+	resolutions [][2]int
+	times       []int
+}
+
+// resolutions of the displays used for the golden images
+var goldenResolutions = [][2]int{{320, 240}, {640, 360}, {800, 480}}
+
+// goldenCases returns the layouts checked against the golden images. The
+// photos of the slider are generated into dir.
+func goldenCases(dir string) ([]goldenCase, error) {
+	photos, err := saveGoldenPhotos(dir)
+	if err != nil {
+		return nil, err
+	}
+	timestamp := time.Date(2014, time.May, 15, 12, 30, 0, 0, time.UTC)
+
+	var cases []goldenCase
+	// the intro GIF sprites
+	for i := 1; i <= 5; i++ {
+		fn := fmt.Sprintf("data/internal/m%v.gif", i)
+		res := goldenResolutions[1:2]
+		if i == 1 {
+			res = goldenResolutions
+		}
+		cases = append(cases, goldenCase{
+			name:        fmt.Sprintf("intro-m%v", i),
+			newObj:      func() grafic2d.RenderObject { return NewIntroFromGif(fn, 1000, nil) },
+			resolutions: res,
+			times:       []int{40, 800},
+		})
+	}
+	cases = append(cases,
+		goldenCase{
+			name: "ticker",
+			newObj: func() grafic2d.RenderObject {
+				return grafic2d.NewTextTicker("Kuchen in der Kaffeeküche", "NEWS", timestamp.Format("2. Jan 06 - 15:04"), "Pinboard <pinboard@example.com>")
+			},
+			resolutions: goldenResolutions,
+			times:       []int{40, 2000},
+		},
+		goldenCase{
+			name:        "photoslider",
+			newObj:      func() grafic2d.RenderObject { return grafic2d.NewPhotoSlider(photos, 1000, 900) },
+			resolutions: goldenResolutions,
+			times:       []int{40, 1100},
+		},
+		goldenCase{
+			name: "message",
+			newObj: func() grafic2d.RenderObject {
+				return NewMessage("Kuchen in der Kaffeeküche", "Pinboard <pinboard@example.com>", timestamp, photos, nil, nil)
+			},
+			resolutions: goldenResolutions[1:2],
+			times:       []int{40, 1100},
+		})
+	cases = append(cases, goldenCase{
+		name: "agenda",
+		newObj: func() grafic2d.RenderObject {
+			return goldenAgenda(timestamp)
+		},
+		resolutions: goldenResolutions,
+		times:       []int{40},
+	})
+	return cases, nil
+}
+
+// goldenAgenda returns an agenda at now with a running, an ended, an all-day,
+// a multi-day and a too long event and more events than fit on small displays.
+// The times are local, so the images do not depend on the time zone.
+func goldenAgenda(now time.Time) *Agenda {
+	at := func(day, hour, min int) time.Time {
+		return time.Date(2014, time.May, day, hour, min, 0, 0, time.Local)
+	}
+	agenda := NewAgenda(nil, clock.NewFake(at(now.Day(), now.Hour(), now.Minute())))
+	events := []web.MessageData{
+		{ShortText: "Sprint-Review", Location: "Raum Elbe", EventStart: at(15, 12, 0), EventEnd: at(15, 13, 0)},
+		{ShortText: "Frühstück", EventStart: at(15, 8, 0), EventEnd: at(15, 9, 0)},
+		{ShortText: "Kuchen in der Kaffeeküche", EventStart: at(15, 15, 0), EventEnd: at(15, 15, 30)},
+		{ShortText: "Betriebsausflug", EventStart: at(16, 0, 0), EventEnd: at(17, 0, 0), AllDay: true},
+		{ShortText: "Messe", Location: "Hannover", EventStart: at(19, 0, 0), EventEnd: at(22, 0, 0), AllDay: true},
+		{ShortText: "Infoveranstaltung zur neuen Reisekostenrichtlinie mit anschließender Fragerunde",
+			Location: "Großer Konferenzraum im Erdgeschoss", EventStart: at(20, 10, 0), EventEnd: at(20, 11, 30)},
+	}
+	for day := 16; day <= 22; day++ {
+		events = append(events, web.MessageData{ShortText: "Stand-up", EventStart: at(day, 9, 30), EventEnd: at(day, 9, 45)})
+	}
+	for i := range events {
+		events[i].ID = fmt.Sprintf("event-%v", i)
+		events[i].Type = web.EVENT
+		events[i].ShowUntil = events[i].EventEnd
+		agenda.SetEvent(&events[i])
+	}
+	return agenda
+}
+
+// saveGoldenPhotos creates a landscape and a portrait photo for the slider
+func saveGoldenPhotos(dir string) ([]string, error) {
+	landscape := image.NewNRGBA(image.Rect(0, 0, 400, 300))
+	for y := 0; y < 300; y++ {
+		for x := 0; x < 400; x++ {
+			landscape.SetNRGBA(x, y, color.NRGBA{uint8(x * 255 / 400), uint8(y * 255 / 300), 128, 255})
+		}
+	}
+	portrait := image.NewNRGBA(image.Rect(0, 0, 200, 400))
+	for y := 0; y < 400; y++ {
+		for x := 0; x < 200; x++ {
+			c := color.NRGBA{240, 240, 240, 255}
+			if (x/25+y/25)%2 == 0 {
+				c = color.NRGBA{200, 30, 30, 255}
+			}
+			portrait.SetNRGBA(x, y, c)
+		}
+	}
+
+	var fns []string
+	for name, img := range map[string]image.Image{"landscape.pbi": landscape, "portrait.pbi": portrait} {
+		fn := filepath.Join(dir, name)
+		if err := grafic2d.SaveVGImage(img, fn); err != nil {
+			return nil, err
+		}
+		fns = append(fns, fn)
+	}
+	// the map has no order, but the slider has
+	if filepath.Base(fns[0]) != "landscape.pbi" {
+		fns[0], fns[1] = fns[1], fns[0]
+	}
+	return fns, nil
+}
+
+var update = flag.Bool("update", false, "regenerate the golden images in testdata/golden")
+
+func TestMain(m *testing.M) {
+	flag.Parse()
+	if !testing.Verbose() {
+		log.SetOutput(ioutil.Discard)
+	}
+	os.Exit(m.Run())
+}
+
+// TestGolden renders all golden cases and compares them with the golden
+// images in testdata/golden. With -update the golden images are regenerated.
+func TestGolden(t *testing.T) {
+	cases, err := goldenCases(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	h := golden.NewHarness("testdata/golden", *update)
+	for _, c := range cases {
+		for _, res := range c.resolutions {
+			c, res := c, res
+			name := fmt.Sprintf("%s-%vx%v", c.name, res[0], res[1])
+			t.Run(name, func(t *testing.T) {
+				frames, err := golden.Render(c.newObj, res[0], res[1], c.times)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if err := h.Check(name, frames, c.times); err != nil {
+					t.Error(err)
+				}
+			})
+		}
+	}
+}
@@ -0,0 +1,124 @@
+package grafic2d
+
+import (
+	"bytes"
+	"encoding/binary"
+)
+
+// exifOrientation returns the EXIF orientation of the JPEG, PNG or WebP
+// image in buf, 1 (upright) if there is none
+func exifOrientation(buf []byte) int {
+	var tiff []byte
+	switch {
+	case bytes.HasPrefix(buf, []byte("\xff\xd8")):
+		tiff = jpegExif(buf)
+	case bytes.HasPrefix(buf, []byte("\x89PNG\r\n\x1a\n")):
+		tiff = pngExif(buf)
+	case len(buf) >= 12 && string(buf[:4]) == "RIFF" && string(buf[8:12]) == "WEBP":
+		tiff = webpExif(buf)
+	}
+	// some writers keep the header of the JPEG segment
+	tiff = bytes.TrimPrefix(tiff, []byte("Exif\x00\x00"))
+	if o := tiffOrientation(tiff); o >= 1 && o <= 8 {
+		return o
+	}
+	return 1
+}
+
+// jpegExif returns the TIFF data of the APP1 segment
+func jpegExif(buf []byte) []byte {
+	i := 2
+	for i+4 <= len(buf) {
+		if buf[i] != 0xff {
+			return nil
+		}
+		marker := buf[i+1]
+		// start of scan, the segments are over
+		if marker == 0xda || marker == 0xd9 {
+			return nil
+		}
+		n := int(binary.BigEndian.Uint16(buf[i+2:]))
+		if n < 2 || i+2+n > len(buf) {
+			return nil
+		}
+		seg := buf[i+4 : i+2+n]
+		if marker == 0xe1 && bytes.HasPrefix(seg, []byte("Exif\x00\x00")) {
+			return seg
+		}
+		i += 2 + n
+	}
+	return nil
+}
+
+// pngExif returns the data of the eXIf chunk
+func pngExif(buf []byte) []byte {
+	i := 8
+	for i+12 <= len(buf) {
+		n := int(binary.BigEndian.Uint32(buf[i:]))
+		typ := string(buf[i+4 : i+8])
+		if n < 0 || n > len(buf)-i-12 {
+			return nil
+		}
+		if typ == "eXIf" {
+			return buf[i+8 : i+8+n]
+		}
+		if typ == "IDAT" || typ == "IEND" {
+			return nil
+		}
+		i += 12 + n
+	}
+	return nil
+}
+
+// webpExif returns the data of the EXIF chunk
+func webpExif(buf []byte) []byte {
+	i := 12
+	for i+8 <= len(buf) {
+		n := int(binary.LittleEndian.Uint32(buf[i+4:]))
+		if n < 0 || n > len(buf)-i-8 {
+			return nil
+		}
+		if string(buf[i:i+4]) == "EXIF" {
+			return buf[i+8 : i+8+n]
+		}
+		// chunks are padded to an even size
+		i += 8 + n + n%2
+	}
+	return nil
+}
+
+// tiffOrientation returns the orientation tag of the first IFD, 0 if there
+// is none
+func tiffOrientation(tiff []byte) int {
+	if len(tiff) < 8 {
+		return 0
+	}
+	var order binary.ByteOrder
+	switch string(tiff[:2]) {
+	case "II":
+		order = binary.LittleEndian
+	case "MM":
+		order = binary.BigEndian
+	default:
+		return 0
+	}
+	if order.Uint16(tiff[2:]) != 42 {
+		return 0
+	}
+	ifd := int(order.Uint32(tiff[4:]))
+	if ifd < 8 || ifd+2 > len(tiff) {
+		return 0
+	}
+	count := int(order.Uint16(tiff[ifd:]))
+	for k := 0; k < count; k++ {
+		e := ifd + 2 + 12*k
+		if e+12 > len(tiff) {
+			return 0
+		}
+		// the orientation is a SHORT
+		if order.Uint16(tiff[e:]) == 0x0112 && order.Uint16(tiff[e+2:]) == 3 {
+			return int(order.Uint16(tiff[e+8:]))
+		}
+	}
+	return 0
+}
@@ -1,18 +1,8 @@
-// High-level 2D vector graphics library built on OpenVG
+// High-level 2D vector graphics library. The drawing is done by a Renderer,
+// either OpenVG on the Raspberry PI (build tag openvg) or a pure-Go software
+// rasterizer that renders into an in-memory image.
 package grafic2d
 
-/*
-#cgo CFLAGS:   -I/opt/vc/include -I/opt/vc/include/interface/vmcs_host/linux -I/opt/vc/include/interface/vcos/pthreads
-#cgo LDFLAGS:  -L/opt/vc/lib -lGLESv2 -ljpeg
-#include <stdlib.h>
-#include "VG/openvg.h"
-#include "VG/vgu.h"
-#include "EGL/egl.h"
-#include "GLES/gl.h"
-#include "fontinfo.h" // font information
-#include "shapes.h"   // C API
-*/
-import "C"
 import (
 	"fmt"
 	"image"
@@ -20,9 +10,7 @@ import (
 	_ "image/png"
 	"log"
 	"os"
-	"runtime"
 	"strings"
-	"unsafe"
 )
 
 type RenderObject interface {
@@ -32,9 +20,11 @@ type RenderObject interface {
 	Draw() error
 }
 
-// RGB defines the red, green, blue triple that makes up colors.
+// GFXServer is the drawing API used by all render objects. It forwards all
+// calls to its Renderer.
 type GFXServer struct {
 	DisplayWidth, DisplayHeight int
+	Renderer                    Renderer
 	isDebugMode                 bool
 }
 
@@ -43,12 +33,17 @@ type RGB struct {
 	Red, Green, Blue uint8
 }
 
+// Color is a RGB triple with an alpha value ranging from 0..1
+type Color struct {
+	RGB
+	Alpha VGfloat
+}
+
 // VGfloat defines the basic type for coordinates, dimensions and other values
-type VGfloat C.VGfloat
-type VGint C.VGint
-type VGImage C.VGImage
-type VGImageFormat C.VGImageFormat
-type VGImageQuality C.VGImageQuality
+type VGfloat float32
+type VGint int32
+type VGImageFormat int32
+type VGImageQuality int32
 
 // Offcolor defines the offset, color and alpha values used in gradients
 // the Offset ranges from 0..1, colors as RGB triples, alpha ranges from 0..1
@@ -209,30 +204,40 @@ var colornames = map[string]RGB{
 	"yellowgreen":          {154, 205, 50},
 }
 
+// NewGFXServer returns a gfx server that draws with the given renderer.
+// If r is nil the default renderer of the build is used.
+func NewGFXServer(r Renderer) *GFXServer {
+	return &GFXServer{Renderer: r}
+}
+
 // Initialize tne gfx server
 func (gfx *GFXServer) Init() (int, int) {
-	runtime.LockOSThread()
-	var rh, rw C.int
-	C.init(&rw, &rh)
-	gfx.DisplayWidth = int(rw)
-	gfx.DisplayHeight = int(rh)
-	return int(rw), int(rh)
+	if gfx.Renderer == nil {
+		gfx.Renderer = NewDefaultRenderer()
+	}
+	activeRenderer = gfx.Renderer
+	w, h := gfx.Renderer.Init()
+	gfx.DisplayWidth = w
+	gfx.DisplayHeight = h
+	return w, h
 }
 
 // Shut down the gfx server
 func (gfx *GFXServer) Finish() {
-	C.finish()
-	runtime.UnlockOSThread()
+	gfx.Renderer.Finish()
+	if activeRenderer == gfx.Renderer {
+		activeRenderer = nil
+	}
 }
 
 // Background clears the screen with the specified solid background color using RGB triples
 func (gfx *GFXServer) Background(r, g, b uint8) {
-	C.Background(C.uint(r), C.uint(g), C.uint(b))
+	gfx.Renderer.Background(r, g, b)
 }
 
 // BackgroundRGB clears the screen with the specified background color using a RGBA quad
 func (gfx *GFXServer) BackgroundRGB(r, g, b uint8, alpha VGfloat) {
-	C.BackgroundRGB(C.uint(r), C.uint(g), C.uint(b), C.VGfloat(alpha))
+	gfx.Renderer.BackgroundRGB(r, g, b, alpha)
 }
 
 // BackgroundColor sets the background color
@@ -245,72 +250,69 @@ func (gfx *GFXServer) BackgroundColor(s string, alpha ...VGfloat) {
 	}
 }
 
-// makestops prepares the color/stop vector
-func (gfx *GFXServer) makeramp(r []Offcolor) (*C.VGfloat, C.int) {
-	lr := len(r)
-	nr := lr * 5
-	cs := make([]C.VGfloat, nr)
-	j := 0
-	for i := 0; i < lr; i++ {
-		cs[j] = C.VGfloat(r[i].Offset)
-		j++
-		cs[j] = C.VGfloat(VGfloat(r[i].Red) / 255.0)
-		j++
-		cs[j] = C.VGfloat(VGfloat(r[i].Green) / 255.0)
-		j++
-		cs[j] = C.VGfloat(VGfloat(r[i].Blue) / 255.0)
-		j++
-		cs[j] = C.VGfloat(r[i].Alpha)
-		j++
-	}
-	return &cs[0], C.int(lr)
-}
-
 // FillLinearGradient sets up a linear gradient between (x1,y2) and (x2, y2)
 // using the specified offsets and colors in ramp
 func (gfx *GFXServer) FillLinearGradient(x1, y1, x2, y2 VGfloat, ramp []Offcolor) {
-	cr, nr := gfx.makeramp(ramp)
-	C.FillLinearGradient(C.VGfloat(x1), C.VGfloat(y1), C.VGfloat(x2), C.VGfloat(y2), cr, nr)
+	gfx.Renderer.FillLinearGradient(x1, y1, x2, y2, ramp)
 }
 
 // FillRadialGradient sets up a radial gradient centered at (cx, cy), radius r,
 // with a focal point at (fx, fy) using the specified offsets and colors in ramp
 func (gfx *GFXServer) FillRadialGradient(cx, cy, fx, fy, radius VGfloat, ramp []Offcolor) {
-	cr, nr := gfx.makeramp(ramp)
-	C.FillRadialGradient(C.VGfloat(cx), C.VGfloat(cy), C.VGfloat(fx), C.VGfloat(fy), C.VGfloat(radius), cr, nr)
+	gfx.Renderer.FillRadialGradient(cx, cy, fx, fy, radius, ramp)
 }
 
 // FillRGB sets the fill color, using RGB triples and alpha values
 func (gfx *GFXServer) FillRGB(r, g, b uint8, alpha VGfloat) {
-	C.Fill(C.uint(r), C.uint(g), C.uint(b), C.VGfloat(alpha))
+	gfx.Renderer.FillRGB(r, g, b, alpha)
 }
 
 // StrokeRGB sets the stroke color, using RGB triples
 func (gfx *GFXServer) StrokeRGB(r, g, b uint8, alpha VGfloat) {
-	C.Stroke(C.uint(r), C.uint(g), C.uint(b), C.VGfloat(alpha))
+	gfx.Renderer.StrokeRGB(r, g, b, alpha)
 }
 
 // StrokeWidth sets the stroke width
 func (gfx *GFXServer) StrokeWidth(w VGfloat) {
-	C.StrokeWidth(C.VGfloat(w))
+	gfx.Renderer.StrokeWidth(w)
+}
+
+// Fill sets the fill color
+func (gfx *GFXServer) Fill(c Color) {
+	gfx.FillRGB(c.Red, c.Green, c.Blue, c.Alpha)
 }
 
 // colorlookup returns a RGB triple corresponding to the named color,
 // or "rgb(r,g,b)" string. On error, return black.
 func (gfx *GFXServer) colorlookup(s string) RGB {
-	var rcolor = RGB{0, 0, 0}
-	color, ok := colornames[s]
+	c, err := ParseColor(s)
+	if err != nil {
+		return RGB{0, 0, 0}
+	}
+	return c.RGB
+}
+
+// ParseColor parses a SVG color name, a "rgb(r,g,b)" or a "rgba(r,g,b,a)"
+// string with the alpha value ranging from 0..1
+func ParseColor(s string) (Color, error) {
+	var c = Color{RGB{0, 0, 0}, 1}
+	rgb, ok := colornames[s]
 	if ok {
-		return color
+		c.RGB = rgb
+		return c, nil
 	}
+	var n int
+	var err error
 	if strings.HasPrefix(s, "rgb(") {
-		n, err := fmt.Sscanf(s[3:], "(%d,%d,%d)", &rcolor.Red, &rcolor.Green, &rcolor.Blue)
-		if n != 3 || err != nil {
-			return RGB{0, 0, 0}
-		}
-		return rcolor
+		n, err = fmt.Sscanf(s[3:], "(%d,%d,%d)", &c.Red, &c.Green, &c.Blue)
+		n++
+	} else if strings.HasPrefix(s, "rgba(") {
+		n, err = fmt.Sscanf(s[4:], "(%d,%d,%d,%g)", &c.Red, &c.Green, &c.Blue, &c.Alpha)
 	}
-	return rcolor
+	if n != 4 || err != nil || c.Alpha < 0 || c.Alpha > 1 {
+		return Color{RGB{0, 0, 0}, 1}, fmt.Errorf("Invalid color: %q", s)
+	}
+	return c, nil
 }
 
 // FillColor sets the fill color using names to specify the color, optionally applying alpha.
@@ -335,7 +337,7 @@ func (gfx *GFXServer) StrokeColor(s string, alpha ...VGfloat) {
 
 // Start begins a picture
 func (gfx *GFXServer) Start(w, h int, color ...uint8) {
-	C.Start(C.int(w), C.int(h))
+	gfx.Renderer.Start(w, h)
 	if len(color) == 3 {
 		gfx.Background(color[0], color[1], color[2])
 	}
@@ -343,20 +345,18 @@ func (gfx *GFXServer) Start(w, h int, color ...uint8) {
 
 // Startcolor begins the picture with the specified color background
 func (gfx *GFXServer) StartColor(w, h int, color string, alpha ...VGfloat) {
-	C.Start(C.int(w), C.int(h))
+	gfx.Renderer.Start(w, h)
 	gfx.BackgroundColor(color, alpha...)
 }
 
 // End ends the picture
 func (gfx *GFXServer) End() {
-	C.End()
+	gfx.Renderer.End()
 }
 
 // SaveEnd ends the picture, saving the raw raster
 func (gfx *GFXServer) SaveEnd(filename string) {
-	s := C.CString(filename)
-	defer C.free(unsafe.Pointer(s))
-	C.SaveEnd(s)
+	gfx.Renderer.SaveEnd(filename)
 }
 
 
@@ -365,14 +365,16 @@ func (gfx *GFXServer) CreateImage(filename string) VGImage {
 	t.Start()
 
 	stream, err := os.Open(filename)
-	defer stream.Close()
 	if err != nil {
 		log.Printf("Loading file %v failed. Error: %v\n", filename, err)
+		return nil
 	}
+	defer stream.Close()
 
 	img, _, err := image.Decode(stream)
 	if err != nil {
 		log.Printf("Decoding file %v failed. Error: %v\n", filename, err)
+		return nil
 	}
 	r := img.Bounds()
 	log.Printf("Loaded & Decoded image %v (%v px) in %v ms.", filename, r.Dx()*r.Dy(), t.TimeSinceLastCall())
@@ -387,188 +389,146 @@ func (gfx *GFXServer) convGO2VGImage(img image.Image) VGImage {
 
 	// get image parameters
 	bounds := img.Bounds()
-	minx := C.VGint(bounds.Min.X)
-	maxx := C.VGint(bounds.Max.X)
-	miny := C.VGint(bounds.Min.Y)
-	maxy := C.VGint(bounds.Max.Y)
-	w := C.VGint(bounds.Dx())
-	h := C.VGint(bounds.Dy())
-
-	// create empty OpenVG image
-	vgImage := C.vgCreateImage(C.VG_sABGR_8888, w, h, C.VG_IMAGE_QUALITY_FASTER)
-
-	// convert the GO image to a openVG conform RGBA representation in memory
-	data := make([]C.VGubyte, w*h*4)
+	w := bounds.Dx()
+	h := bounds.Dy()
+
+	// convert the GO image to a openVG conform RGBA representation in memory,
+	// the colors of Go are premultiplied
+	data := make([]byte, w*h*4)
 	n := 0
 	var r, g, b, a uint32
-	for yp := miny; yp < maxy; yp++ {
-		for xp := minx; xp < maxx; xp++ {
-			r, g, b, a = img.At(int(xp), int((maxy-1)-yp)).RGBA()
-			//fmt.Printf("%v,%v,%v,%v ", r,g,b,a)
-			data[n] = C.VGubyte(r >> 8)
+	for yp := bounds.Max.Y - 1; yp >= bounds.Min.Y; yp-- {
+		for xp := bounds.Min.X; xp < bounds.Max.X; xp++ {
+			r, g, b, a = img.At(xp, yp).RGBA()
+			data[n] = byte(r >> 8)
 			n++
-			data[n] = C.VGubyte(g >> 8)
+			data[n] = byte(g >> 8)
 			n++
-			data[n] = C.VGubyte(b >> 8)
+			data[n] = byte(b >> 8)
 			n++
-			data[n] = C.VGubyte(a >> 8)
+			data[n] = byte(a >> 8)
 			n++
 		}
 	}
 
-	// initialize the OpenVG image with the data from memory
-	C.vgImageSubData(vgImage, unsafe.Pointer(&data[0]), w*4, C.VG_sABGR_8888, minx, miny, w, h)
-
-	return VGImage(vgImage)
+	// initialize the image of the renderer with the data from memory
+	vgImage, err := gfx.Renderer.NewImage(w, h, data)
+	if err != nil {
+		log.Printf("Failed to create image (%vx%v px): %v\n", w, h, err)
+		return nil
+	}
+	return vgImage
 }
 
 // Line draws a line between two points
 func (gfx *GFXServer) Line(x1, y1, x2, y2 VGfloat, style ...string) {
-	C.Line(C.VGfloat(x1), C.VGfloat(y1), C.VGfloat(x2), C.VGfloat(y2))
+	gfx.Renderer.Line(x1, y1, x2, y2)
 }
 
 // Rect draws a rectangle at (x,y) with dimesions (w,h)
 func (gfx *GFXServer) Rect(x, y, w, h VGfloat, style ...string) {
-	C.Rect(C.VGfloat(x), C.VGfloat(y), C.VGfloat(w), C.VGfloat(h))
+	gfx.Renderer.Rect(x, y, w, h)
 }
 
 // Rect draws a rounded rectangle at (x,y) with dimesions (w,h).
 // the corner radii are at (rw, rh)
 func (gfx *GFXServer) Roundrect(x, y, w, h, rw, rh VGfloat, style ...string) {
-	C.Roundrect(C.VGfloat(x), C.VGfloat(y), C.VGfloat(w), C.VGfloat(h), C.VGfloat(rw), C.VGfloat(rh))
+	gfx.Renderer.Roundrect(x, y, w, h, rw, rh)
 }
 
 // Ellipse draws an ellipse at (x,y) with dimensions (w,h)
 func (gfx *GFXServer) Ellipse(x, y, w, h VGfloat, style ...string) {
-	C.Ellipse(C.VGfloat(x), C.VGfloat(y), C.VGfloat(w), C.VGfloat(h))
+	gfx.Renderer.Ellipse(x, y, w, h)
 }
 
 // Circle draws a circle centered at (x,y), with radius r
 func (gfx *GFXServer) Circle(x, y, r VGfloat, style ...string) {
-	C.Circle(C.VGfloat(x), C.VGfloat(y), C.VGfloat(r))
+	gfx.Renderer.Circle(x, y, r)
 }
 
 // Qbezier draws a quadratic bezier curve with extrema (sx, sy) and (ex, ey)
 // Control points are at (cx, cy)
 func (gfx *GFXServer) Qbezier(sx, sy, cx, cy, ex, ey VGfloat, style ...string) {
-	C.Qbezier(C.VGfloat(sx), C.VGfloat(sy), C.VGfloat(cx), C.VGfloat(cy), C.VGfloat(ex), C.VGfloat(ey))
+	gfx.Renderer.Qbezier(sx, sy, cx, cy, ex, ey)
 }
 
 // Cbezier draws a cubic bezier curve with extrema (sx, sy) and (ex, ey).
 // Control points at (cx, cy) and (px, py)
 func (gfx *GFXServer) Cbezier(sx, sy, cx, cy, px, py, ex, ey VGfloat, style ...string) {
-	C.Cbezier(C.VGfloat(sx), C.VGfloat(sy), C.VGfloat(cx), C.VGfloat(cy), C.VGfloat(px), C.VGfloat(py), C.VGfloat(ex), C.VGfloat(ey))
+	gfx.Renderer.Cbezier(sx, sy, cx, cy, px, py, ex, ey)
 }
 
 // Arc draws an arc at (x,y) with dimensions (w,h).
 // the arc starts at the angle sa, extended to aext
 func (gfx *GFXServer) Arc(x, y, w, h, sa, aext VGfloat, style ...string) {
-	C.Arc(C.VGfloat(x), C.VGfloat(y), C.VGfloat(w), C.VGfloat(h), C.VGfloat(sa), C.VGfloat(aext))
-}
-
-// poly converts coordinate slices
-func (gfx *GFXServer) poly(x, y []VGfloat) (*C.VGfloat, *C.VGfloat, C.VGint) {
-	size := len(x)
-	if size != len(y) {
-		return nil, nil, 0
-	}
-	px := make([]C.VGfloat, size)
-	py := make([]C.VGfloat, size)
-	for i := 0; i < size; i++ {
-		px[i] = C.VGfloat(x[i])
-		py[i] = C.VGfloat(y[i])
-	}
-	return &px[0], &py[0], C.VGint(size)
+	gfx.Renderer.Arc(x, y, w, h, sa, aext)
 }
 
 // Polygon draws a polygon with coordinate in x,y
 func (gfx *GFXServer) Polygon(x, y []VGfloat, style ...string) {
-	px, py, np := gfx.poly(x, y)
-	if np > 0 {
-		C.Polygon(px, py, np)
+	if len(x) > 0 && len(x) == len(y) {
+		gfx.Renderer.Polygon(x, y)
 	}
 }
 
 // Polyline draws a polyline with coordinates in x, y
 func (gfx *GFXServer) Polyline(x, y []VGfloat, style ...string) {
-	px, py, np := gfx.poly(x, y)
-	if np > 0 {
-		C.Polyline(px, py, np)
-	}
-}
-
-// selectfont specifies the font by generic name
-func (gfx *GFXServer) selectfont(s string) C.Fontinfo {
-	switch s {
-	case "sans":
-		return C.SansTypeface
-	case "serif":
-		return C.SerifTypeface
-	case "mono":
-		return C.MonoTypeface
+	if len(x) > 0 && len(x) == len(y) {
+		gfx.Renderer.Polyline(x, y)
 	}
-	return C.SerifTypeface
 }
 
 // Text draws text whose aligment begins (x,y)
 func (gfx *GFXServer) Text(x, y VGfloat, s string, font string, size int, style ...string) {
-	t := C.CString(s)
-	C.Text(C.VGfloat(x), C.VGfloat(y), t, gfx.selectfont(font), C.int(size))
-	C.free(unsafe.Pointer(t))
+	gfx.Renderer.Text(x, y, s, font, size)
 }
 
 // TextMid draws text centered at (x,y)
 func (gfx *GFXServer) TextMid(x, y VGfloat, s string, font string, size int, style ...string) {
-	t := C.CString(s)
-	C.TextMid(C.VGfloat(x), C.VGfloat(y), t, gfx.selectfont(font), C.int(size))
-	C.free(unsafe.Pointer(t))
+	gfx.Renderer.Text(x-gfx.TextWidth(s, font, size)/2.0, y, s, font, size)
 }
 
 // TextEnd draws text end-aligned at (x,y)
 func (gfx *GFXServer) TextEnd(x, y VGfloat, s string, font string, size int, style ...string) {
-	t := C.CString(s)
-	C.TextEnd(C.VGfloat(x), C.VGfloat(y), t, gfx.selectfont(font), C.int(size))
-	C.free(unsafe.Pointer(t))
+	gfx.Renderer.Text(x-gfx.TextWidth(s, font, size), y, s, font, size)
 }
 
 // TextWidth returns the length of text at a specified font and size
 func (gfx *GFXServer) TextWidth(s string, font string, size int) VGfloat {
-	t := C.CString(s)
-	defer C.free(unsafe.Pointer(t))
-	return VGfloat(C.TextWidth(t, gfx.selectfont(font), C.int(size)))
+	return gfx.Renderer.TextWidth(s, font, size)
 }
 
 // Translate translates the coordinate system to (x,y)
 func (gfx *GFXServer) Translate(x, y VGfloat) {
-	C.Translate(C.VGfloat(x), C.VGfloat(y))
+	gfx.Renderer.Translate(x, y)
 }
 
 // Rotate rotates the coordinate system around the specifed angle
 func (gfx *GFXServer) Rotate(r VGfloat) {
-	C.Rotate(C.VGfloat(r))
+	gfx.Renderer.Rotate(r)
 }
 
 // Shear warps the coordinate system by (x,y)
 func (gfx *GFXServer) Shear(x, y VGfloat) {
-	C.Shear(C.VGfloat(x), C.VGfloat(y))
+	gfx.Renderer.Shear(x, y)
 }
 
 // Scale scales the coordinate system by (x,y)
 func (gfx *GFXServer) Scale(x, y VGfloat) {
-	C.Scale(C.VGfloat(x), C.VGfloat(y))
+	gfx.Renderer.Scale(x, y)
 }
 
 // SaveTerm saves terminal settings
 func (gfx *GFXServer) SaveTerm() {
-	C.saveterm()
+	gfx.Renderer.SaveTerm()
 }
 
 // RestoreTerm retores terminal settings
 func (gfx *GFXServer) RestoreTerm() {
-	C.restoreterm()
+	gfx.Renderer.RestoreTerm()
 }
 
 // func RawTerm() sets the terminal to raw mode
 func (gfx *GFXServer) RawTerm() {
-	C.rawterm()
+	gfx.Renderer.RawTerm()
 }
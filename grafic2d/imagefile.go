@@ -0,0 +1,284 @@
+package grafic2d
+
+import (
+	"bytes"
+	"compress/flate"
+	"crypto/sha256"
+	"encoding/binary"
+	"fmt"
+	"github.com/flothe/pinboard/internal/atomicfile"
+	"hash/crc32"
+	"io"
+	"io/ioutil"
+	"log"
+)
+
+// The images of the messages are saved scaled in an image file, so they do
+// not have to be decoded and scaled again when they are shown. The file
+// starts with a header of 76 bytes, all numbers little endian:
+//
+//	 0  magic "\x89PBI\r\n\x1a\n"
+//	 8  version uint16
+//	10  pixel format uint8, see PixelRGBAPre
+//	11  compression of the pixels uint8, see CompressNone
+//	12  width, height uint32
+//	20  max width, max height uint32 the image was scaled to, 0 if unscaled
+//	28  length of the pixel data in the file uint64
+//	36  CRC-32 (IEEE) of the uncompressed pixels uint32
+//	40  SHA-256 of the source file, zero if there is none
+//	72  CRC-32 (IEEE) of the bytes 0 to 71 uint32
+//
+// The pixel data follows the header. The original image is kept in the
+// source file next to it, see SourceFile, so a broken image file can be
+// derived again.
+const (
+	ImageFileExt     = "pbi"
+	ImageFileVersion = 1
+	imageHeaderSize  = 76
+	// larger images are refused, a broken header must not allocate gigabytes
+	maxImagePixels = 1 << 26
+	// limits of images derived again without a readable header, full HD like
+	// the default limits of the crawlers
+	fallbackMaxWidth  = 1920
+	fallbackMaxHeight = 1080
+)
+
+var imageMagic = []byte("\x89PBI\r\n\x1a\n")
+
+// pixel formats
+const (
+	// 8 bit red, green, blue and alpha, not premultiplied, starting with the
+	// bottom row, the layout of VG_sABGR_8888. It is premultiplied when read.
+	PixelRGBA = 1
+	// like PixelRGBA, but the colors are premultiplied by alpha, the layout
+	// of VG_sABGR_8888_PRE
+	PixelRGBAPre = 2
+)
+
+// compressions of the pixel data
+const (
+	CompressNone    = 0
+	CompressDeflate = 1
+)
+
+// ImageFileCompression is the compression of the image files written
+var ImageFileCompression = CompressDeflate
+
+// SourceFile returns the name of the source of the image file fn
+func SourceFile(fn string) string {
+	return fn + ".src"
+}
+
+// imageHeader is the header of an image file
+type imageHeader struct {
+	Version             uint16
+	PixelFormat         uint8
+	Compression         uint8
+	Width, Height       uint32
+	MaxWidth, MaxHeight uint32
+	PayloadLength       uint64
+	PixelCRC            uint32
+	SourceHash          [32]byte
+}
+
+// writeImageFile writes the pixels of a w x h image in the layout of
+// PixelRGBAPre with the header. The file is replaced atomically.
+func writeImageFile(fn string, w, h int, data []byte, maxWidth, maxHeight uint, sourceHash [32]byte) error {
+	buf, err := encodeImageFile(w, h, data, maxWidth, maxHeight, sourceHash)
+	if err != nil {
+		return fmt.Errorf("Image %v: %v", fn, err)
+	}
+	if err := atomicfile.WriteFile(fn, buf, 0644); err != nil {
+		return err
+	}
+	log.Printf("Written image %v (%vx%v px, %v bytes)\n", fn, w, h, len(buf))
+	return nil
+}
+
+// encodeImageFile returns the content of the image file
+func encodeImageFile(w, h int, data []byte, maxWidth, maxHeight uint, sourceHash [32]byte) ([]byte, error) {
+	if len(data) != 4*w*h {
+		return nil, fmt.Errorf("%v bytes instead of %v for %vx%v px", len(data), 4*w*h, w, h)
+	}
+	payload := data
+	if ImageFileCompression == CompressDeflate {
+		b := new(bytes.Buffer)
+		zw, err := flate.NewWriter(b, flate.BestSpeed)
+		if err != nil {
+			return nil, err
+		}
+		zw.Write(data)
+		if err := zw.Close(); err != nil {
+			return nil, err
+		}
+		payload = b.Bytes()
+	}
+
+	hdr := imageHeader{
+		Version:       ImageFileVersion,
+		PixelFormat:   PixelRGBAPre,
+		Compression:   uint8(ImageFileCompression),
+		Width:         uint32(w),
+		Height:        uint32(h),
+		MaxWidth:      uint32(maxWidth),
+		MaxHeight:     uint32(maxHeight),
+		PayloadLength: uint64(len(payload)),
+		PixelCRC:      crc32.ChecksumIEEE(data),
+		SourceHash:    sourceHash,
+	}
+	b := new(bytes.Buffer)
+	b.Write(imageMagic)
+	binary.Write(b, binary.LittleEndian, hdr)
+	binary.Write(b, binary.LittleEndian, crc32.ChecksumIEEE(b.Bytes()))
+	b.Write(payload)
+	return b.Bytes(), nil
+}
+
+// readImageHeader reads and checks the header at the start of buf
+func readImageHeader(buf []byte) (*imageHeader, error) {
+	if len(buf) < imageHeaderSize {
+		return nil, fmt.Errorf("Image file too short: %v bytes", len(buf))
+	}
+	if !bytes.Equal(buf[:len(imageMagic)], imageMagic) {
+		return nil, fmt.Errorf("Not an image file")
+	}
+	crc := binary.LittleEndian.Uint32(buf[imageHeaderSize-4:])
+	if crc32.ChecksumIEEE(buf[:imageHeaderSize-4]) != crc {
+		return nil, fmt.Errorf("Broken header")
+	}
+	hdr := new(imageHeader)
+	binary.Read(bytes.NewReader(buf[len(imageMagic):]), binary.LittleEndian, hdr)
+	if hdr.Version > ImageFileVersion || hdr.Version == 0 {
+		return nil, fmt.Errorf("Unsupported version %v", hdr.Version)
+	}
+	if hdr.PixelFormat != PixelRGBA && hdr.PixelFormat != PixelRGBAPre {
+		return nil, fmt.Errorf("Unsupported pixel format %v", hdr.PixelFormat)
+	}
+	if hdr.Compression != CompressNone && hdr.Compression != CompressDeflate {
+		return nil, fmt.Errorf("Unsupported compression %v", hdr.Compression)
+	}
+	if hdr.Width == 0 || hdr.Height == 0 || uint64(hdr.Width)*uint64(hdr.Height) > maxImagePixels {
+		return nil, fmt.Errorf("Invalid dimension %vx%v", hdr.Width, hdr.Height)
+	}
+	return hdr, nil
+}
+
+// decodeImageFile checks the image file and returns its dimension and pixels
+// in the layout of PixelRGBAPre
+func decodeImageFile(buf []byte) (*imageHeader, []byte, error) {
+	hdr, err := readImageHeader(buf)
+	if err != nil {
+		return nil, nil, err
+	}
+	payload := buf[imageHeaderSize:]
+	if uint64(len(payload)) != hdr.PayloadLength {
+		return hdr, nil, fmt.Errorf("Pixel data has %v bytes instead of %v", len(payload), hdr.PayloadLength)
+	}
+
+	size := 4 * int(hdr.Width) * int(hdr.Height)
+	data := payload
+	if hdr.Compression == CompressDeflate {
+		zr := flate.NewReader(bytes.NewReader(payload))
+		defer zr.Close()
+		data = make([]byte, size)
+		if _, err := io.ReadFull(zr, data); err != nil {
+			return hdr, nil, fmt.Errorf("Failed to decompress the pixels: %v", err)
+		}
+		if n, _ := zr.Read(make([]byte, 1)); n > 0 {
+			return hdr, nil, fmt.Errorf("More pixels than %vx%v", hdr.Width, hdr.Height)
+		}
+	}
+	if len(data) != size {
+		return hdr, nil, fmt.Errorf("Pixel data has %v bytes instead of %v", len(data), size)
+	}
+	if crc32.ChecksumIEEE(data) != hdr.PixelCRC {
+		return hdr, nil, fmt.Errorf("Checksum of the pixels does not match")
+	}
+	if hdr.PixelFormat == PixelRGBA {
+		premultiplyPixels(data)
+	}
+	return hdr, data, nil
+}
+
+// premultiplyPixels multiplies the colors of the RGBA pixels by alpha
+func premultiplyPixels(data []byte) {
+	for i := 0; i+3 < len(data); i += 4 {
+		if a := data[i+3]; a < 255 {
+			data[i] = premultiply(data[i], a)
+			data[i+1] = premultiply(data[i+1], a)
+			data[i+2] = premultiply(data[i+2], a)
+		}
+	}
+}
+
+// premultiply returns the color c multiplied by alpha a
+func premultiply(c, a uint8) uint8 {
+	return uint8((uint32(c)*uint32(a) + 127) / 255)
+}
+
+// decodeLegacyImageFile reads the headerless files of older versions: width
+// and height as uint64 followed by the pixels like PixelRGBA. The size of the
+// file has to match the dimension. The pixels are returned premultiplied.
+func decodeLegacyImageFile(buf []byte) (int, int, []byte, error) {
+	if len(buf) < 16 {
+		return 0, 0, nil, fmt.Errorf("Image file too short: %v bytes", len(buf))
+	}
+	w := binary.LittleEndian.Uint64(buf)
+	h := binary.LittleEndian.Uint64(buf[8:])
+	if w == 0 || h == 0 || w > maxImagePixels || h > maxImagePixels || w*h > maxImagePixels {
+		return 0, 0, nil, fmt.Errorf("Invalid dimension %vx%v", w, h)
+	}
+	if uint64(len(buf)-16) != 4*w*h {
+		return 0, 0, nil, fmt.Errorf("Pixel data has %v bytes instead of %v for %vx%v px", len(buf)-16, 4*w*h, w, h)
+	}
+	premultiplyPixels(buf[16:])
+	return int(w), int(h), buf[16:], nil
+}
+
+// readImageFile reads the image file, or a headerless file of an older
+// version, and returns its dimension and pixels
+func readImageFile(fn string) (int, int, []byte, error) {
+	buf, err := ioutil.ReadFile(fn)
+	if err != nil {
+		return 0, 0, nil, err
+	}
+	if !bytes.HasPrefix(buf, imageMagic) {
+		return decodeLegacyImageFile(buf)
+	}
+	hdr, data, err := decodeImageFile(buf)
+	if err != nil {
+		return 0, 0, nil, err
+	}
+	return int(hdr.Width), int(hdr.Height), data, nil
+}
+
+// rederiveImage scales the source of the image file fn again and replaces
+// the image file. The limits and the hash of the source are taken from the
+// header if it can be read.
+func rederiveImage(fn string) (int, int, []byte, error) {
+	src, err := ioutil.ReadFile(SourceFile(fn))
+	if err != nil {
+		return 0, 0, nil, fmt.Errorf("No source to derive image %v again: %v", fn, err)
+	}
+	sum := sha256.Sum256(src)
+	maxWidth, maxHeight := uint(fallbackMaxWidth), uint(fallbackMaxHeight)
+	if buf, err := ioutil.ReadFile(fn); err == nil {
+		if hdr, err := readImageHeader(buf); err == nil {
+			if hdr.SourceHash != ([32]byte{}) && hdr.SourceHash != sum {
+				return 0, 0, nil, fmt.Errorf("Source of image %v has changed", fn)
+			}
+			maxWidth, maxHeight = uint(hdr.MaxWidth), uint(hdr.MaxHeight)
+		}
+	}
+
+	w, h, data, err := scaleImage(src, maxWidth, maxHeight, fn)
+	if err != nil {
+		return 0, 0, nil, err
+	}
+	if err := writeImageFile(fn, w, h, data, maxWidth, maxHeight, sum); err != nil {
+		// the image can be shown anyway
+		log.Printf("Failed to replace image %v: %v\n", fn, err)
+	}
+	log.Printf("Derived image %v again from its source\n", fn)
+	return w, h, data, nil
+}
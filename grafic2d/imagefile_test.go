@@ -0,0 +1,146 @@
+package grafic2d
+
+import (
+	"bytes"
+	"encoding/binary"
+	"hash/crc32"
+	"image"
+	"image/color"
+	"image/png"
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+)
+
+func TestDecodeImageFilePremultipliesRGBA(t *testing.T) {
+	fn := filepath.Join(t.TempDir(), "a."+ImageFileExt)
+	data := []byte{200, 100, 50, 255, 200, 100, 50, 128, 200, 100, 50, 0}
+	if err := writeImageFile(fn, 3, 1, append([]byte(nil), data...), 0, 0, [32]byte{}); err != nil {
+		t.Fatal(err)
+	}
+	buf, err := ioutil.ReadFile(fn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	hdr, got, err := decodeImageFile(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if hdr.PixelFormat != PixelRGBAPre || !bytes.Equal(got, data) {
+		t.Errorf("format %v, pixels %v, want the written ones %v", hdr.PixelFormat, got, data)
+	}
+
+	// a file with alpha not premultiplied
+	buf[10] = PixelRGBA
+	binary.LittleEndian.PutUint32(buf[imageHeaderSize-4:], crc32.ChecksumIEEE(buf[:imageHeaderSize-4]))
+	_, got, err = decodeImageFile(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []byte{200, 100, 50, 255, 100, 50, 25, 128, 0, 0, 0, 0}
+	if !bytes.Equal(got, want) {
+		t.Errorf("pixels %v, want %v", got, want)
+	}
+}
+
+func TestScaleImagePremultiplied(t *testing.T) {
+	img := image.NewNRGBA(image.Rect(0, 0, 2, 1))
+	img.SetNRGBA(0, 0, color.NRGBA{255, 255, 255, 255})
+	img.SetNRGBA(1, 0, color.NRGBA{255, 255, 255, 51})
+	var b bytes.Buffer
+	png.Encode(&b, img)
+
+	w, h, data, err := scaleImage(b.Bytes(), 0, 0, "test.png")
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []byte{255, 255, 255, 255, 51, 51, 51, 51}
+	if w != 2 || h != 1 || !bytes.Equal(data, want) {
+		t.Errorf("%vx%v px %v, want 2x1 px %v", w, h, data, want)
+	}
+}
+
+func TestLoadImageDataRederives(t *testing.T) {
+	img := image.NewNRGBA(image.Rect(0, 0, 100, 60))
+	for x := 0; x < 100; x++ {
+		img.SetNRGBA(x, x%60, color.NRGBA{uint8(2 * x), 100, 50, 255})
+	}
+	var b bytes.Buffer
+	png.Encode(&b, img)
+	src := b.Bytes()
+
+	dir := t.TempDir()
+	fn := filepath.Join(dir, "good."+ImageFileExt)
+	if err := SaveScaledVGImage(src, 50, 50, fn); err != nil {
+		t.Fatal(err)
+	}
+	good, err := ioutil.ReadFile(fn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, _, want, err := readImageFile(fn)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, c := range []struct {
+		name    string
+		corrupt func([]byte) []byte
+		// the limits of a broken header are not known, the source is small
+		// enough for the fallback limits
+		w, h int
+	}{
+		{"truncated pixels", func(buf []byte) []byte { return buf[:len(buf)-10] }, 50, 30},
+		{"truncated header", func(buf []byte) []byte { return buf[:20] }, 100, 60},
+		{"bad pixel CRC", func(buf []byte) []byte {
+			buf[36]++
+			binary.LittleEndian.PutUint32(buf[imageHeaderSize-4:], crc32.ChecksumIEEE(buf[:imageHeaderSize-4]))
+			return buf
+		}, 50, 30},
+		{"bad header CRC", func(buf []byte) []byte { buf[12]++; return buf }, 100, 60},
+		{"wrong magic", func(buf []byte) []byte { buf[1] = 'X'; return buf }, 100, 60},
+	} {
+		fn := filepath.Join(dir, "broken."+ImageFileExt)
+		if err := ioutil.WriteFile(SourceFile(fn), src, 0644); err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(fn, c.corrupt(append([]byte(nil), good...)), 0644); err != nil {
+			t.Fatal(err)
+		}
+		if _, _, _, err := readImageFile(fn); err == nil {
+			t.Errorf("%v: the broken file can be read", c.name)
+			continue
+		}
+		w, h, data, err := loadImageData(fn)
+		if err != nil {
+			t.Errorf("%v: %v", c.name, err)
+			continue
+		}
+		if w != c.w || h != c.h || len(data) != 4*w*h {
+			t.Errorf("%v: got %vx%v px with %v bytes, want %vx%v px", c.name, w, h, len(data), c.w, c.h)
+		}
+		if c.w == 50 && !bytes.Equal(data, want) {
+			t.Errorf("%v: the pixels differ from the ones saved", c.name)
+		}
+		// the image file has been replaced
+		if rw, rh, _, err := readImageFile(fn); err != nil || rw != w || rh != h {
+			t.Errorf("%v: the file has not been replaced: %vx%v px, %v", c.name, rw, rh, err)
+		}
+	}
+
+	// without the source or with a changed one the image is lost
+	fn = filepath.Join(dir, "lost."+ImageFileExt)
+	broken := append([]byte(nil), good[:len(good)-10]...)
+	if err := ioutil.WriteFile(fn, broken, 0644); err != nil {
+		t.Fatal(err)
+	}
+	if _, _, _, err := loadImageData(fn); err == nil {
+		t.Error("derived again without a source")
+	}
+	if err := ioutil.WriteFile(SourceFile(fn), append(src[:len(src):len(src)], 0), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if _, _, _, err := loadImageData(fn); err == nil {
+		t.Error("derived again from a changed source")
+	}
+}
@@ -0,0 +1,235 @@
+package grafic2d
+
+import (
+	"bytes"
+	"fmt"
+	"image"
+	"image/draw"
+	_ "image/gif"
+	_ "image/jpeg"
+	_ "image/png"
+	"log"
+	"math"
+	"sync"
+
+	xdraw "golang.org/x/image/draw"
+	_ "golang.org/x/image/webp"
+)
+
+// scaleImage decodes the JPEG, PNG, GIF (first frame) or WebP image in buf,
+// turns it upright by its EXIF orientation and scales it down to maxWidth x
+// maxHeight, 0 is no limit. The pixels are scaled in linear light with
+// premultiplied alpha, so neither the colors get darker nor transparent edges
+// get dark fringes. It returns the dimension and the pixels in the layout of
+// PixelRGBAPre: sRGB premultiplied by alpha as VG_sABGR_8888_PRE expects.
+func scaleImage(buf []byte, maxWidth, maxHeight uint, fn string) (int, int, []byte, error) {
+	var t Timer
+	t.Start()
+
+	cfg, format, err := image.DecodeConfig(bytes.NewReader(buf))
+	if err != nil {
+		return 0, 0, nil, fmt.Errorf("Failed to read image %v: %v", fn, err)
+	}
+	if cfg.Width <= 0 || cfg.Height <= 0 || int64(cfg.Width)*int64(cfg.Height) > maxImagePixels {
+		return 0, 0, nil, fmt.Errorf("Image %v is too large: %vx%v px", fn, cfg.Width, cfg.Height)
+	}
+	img, _, err := image.Decode(bytes.NewReader(buf))
+	if err != nil {
+		return 0, 0, nil, fmt.Errorf("Failed to decode %v image %v: %v", format, fn, err)
+	}
+	orientation := exifOrientation(buf)
+	log.Printf("Loaded & Decoded %v image %v (%vx%v px, orientation %v) in %v ms.\n", format, fn, cfg.Width, cfg.Height, orientation, t.TimeSinceLastCall())
+
+	w, h, data := scaleDecoded(img, orientation, maxWidth, maxHeight)
+	if w*h != cfg.Width*cfg.Height {
+		log.Printf("Resized image %v %vx%v --> %vx%v in %v ms.\n", fn, cfg.Width, cfg.Height, w, h, t.TimeSinceLastCall())
+	}
+	return w, h, data, nil
+}
+
+// scaleDecoded turns the decoded image upright and scales it down like
+// scaleImage
+func scaleDecoded(img image.Image, orientation int, maxWidth, maxHeight uint) (int, int, []byte) {
+	src := linearImage(img)
+	sw, sh := src.Bounds().Dx(), src.Bounds().Dy()
+	// the orientations from 5 on turn the image by 90 degrees
+	w, h := fitSize(sw, sh, maxWidth, maxHeight)
+	if orientation >= 5 {
+		h, w = fitSize(sh, sw, maxWidth, maxHeight)
+	}
+	if w != sw || h != sh {
+		dst := image.NewRGBA64(image.Rect(0, 0, w, h))
+		xdraw.CatmullRom.Scale(dst, dst.Bounds(), src, src.Bounds(), xdraw.Src, nil)
+		src = dst
+	}
+	return orientedPixels(src, orientation)
+}
+
+// fitSize returns the size of a w x h image scaled down to fit into
+// maxWidth x maxHeight, keeping the aspect ratio
+func fitSize(w, h int, maxWidth, maxHeight uint) (int, int) {
+	factor := 1.0
+	if maxWidth > 0 && w > int(maxWidth) {
+		factor = float64(maxWidth) / float64(w)
+	}
+	if maxHeight > 0 && h > int(maxHeight) {
+		factor = math.Min(factor, float64(maxHeight)/float64(h))
+	}
+	if factor == 1 {
+		return w, h
+	}
+	return maxInt(1, int(factor*float64(w))), maxInt(1, int(factor*float64(h)))
+}
+
+func maxInt(a, b int) int {
+	if a > b {
+		return a
+	}
+	return b
+}
+
+// conversion tables between sRGB and linear light, built on first use
+var (
+	gammaOnce  sync.Once
+	toLinear   [256]uint16
+	fromLinear []uint8
+)
+
+func initGamma() {
+	for i := range toLinear {
+		c := float64(i) / 255
+		if c <= 0.04045 {
+			c /= 12.92
+		} else {
+			c = math.Pow((c+0.055)/1.055, 2.4)
+		}
+		toLinear[i] = uint16(c*0xffff + 0.5)
+	}
+	fromLinear = make([]uint8, 0x10000)
+	for i := range fromLinear {
+		l := float64(i) / 0xffff
+		if l <= 0.0031308 {
+			l *= 12.92
+		} else {
+			l = 1.055*math.Pow(l, 1/2.4) - 0.055
+		}
+		fromLinear[i] = uint8(l*255 + 0.5)
+	}
+}
+
+// linearImage converts the sRGB image to linear light with premultiplied
+// alpha, the origin of the result is 0,0
+func linearImage(img image.Image) *image.RGBA64 {
+	gammaOnce.Do(initGamma)
+	b := img.Bounds()
+	dst := image.NewRGBA64(image.Rect(0, 0, b.Dx(), b.Dy()))
+
+	// the pixels are read from a NRGBA or RGBA image, the standard library
+	// converts the others fast
+	var pix []uint8
+	var stride int
+	premultiplied := false
+	switch src := img.(type) {
+	case *image.NRGBA:
+		pix, stride = src.Pix[src.PixOffset(b.Min.X, b.Min.Y):], src.Stride
+	case *image.RGBA:
+		pix, stride, premultiplied = src.Pix[src.PixOffset(b.Min.X, b.Min.Y):], src.Stride, true
+	default:
+		rgba := image.NewRGBA(image.Rect(0, 0, b.Dx(), b.Dy()))
+		draw.Draw(rgba, rgba.Bounds(), img, b.Min, draw.Src)
+		pix, stride, premultiplied = rgba.Pix, rgba.Stride, true
+	}
+
+	for y := 0; y < b.Dy(); y++ {
+		s := pix[y*stride:]
+		d := dst.Pix[y*dst.Stride:]
+		for x := 0; x < b.Dx(); x++ {
+			r, g, bl, a := uint32(s[4*x]), uint32(s[4*x+1]), uint32(s[4*x+2]), uint32(s[4*x+3])
+			if a == 0 {
+				continue
+			}
+			if premultiplied && a < 255 {
+				r, g, bl = minUint32(r*255/a, 255), minUint32(g*255/a, 255), minUint32(bl*255/a, 255)
+			}
+			a16 := a * 0x101
+			putUint16s(d[8*x:],
+				uint32(toLinear[r])*a16/0xffff,
+				uint32(toLinear[g])*a16/0xffff,
+				uint32(toLinear[bl])*a16/0xffff,
+				a16)
+		}
+	}
+	return dst
+}
+
+func minUint32(a, b uint32) uint32 {
+	if a < b {
+		return a
+	}
+	return b
+}
+
+func putUint16s(d []uint8, v ...uint32) {
+	for i, c := range v {
+		d[2*i] = uint8(c >> 8)
+		d[2*i+1] = uint8(c)
+	}
+}
+
+// orientedPixels turns the image upright by the EXIF orientation and returns
+// its dimension and the pixels in the layout of PixelRGBAPre, starting with
+// the bottom row
+func orientedPixels(src *image.RGBA64, orientation int) (int, int, []byte) {
+	gammaOnce.Do(initGamma)
+	sw, sh := src.Bounds().Dx(), src.Bounds().Dy()
+	w, h := sw, sh
+	if orientation >= 5 {
+		w, h = sh, sw
+	}
+	data := make([]byte, 0, 4*w*h)
+	for y := h - 1; y >= 0; y-- {
+		for x := 0; x < w; x++ {
+			sx, sy := orientedSource(orientation, x, y, sw, sh)
+			p := src.Pix[src.PixOffset(sx, sy):]
+			r := uint32(p[0])<<8 | uint32(p[1])
+			g := uint32(p[2])<<8 | uint32(p[3])
+			b := uint32(p[4])<<8 | uint32(p[5])
+			a := uint32(p[6])<<8 | uint32(p[7])
+			if a == 0 {
+				data = append(data, 0, 0, 0, 0)
+				continue
+			}
+			a8 := uint8((a + 128) / 257)
+			if a < 0xffff {
+				// to sRGB unpremultiplied, then premultiplied again
+				r, g, b = minUint32(r*0xffff/a, 0xffff), minUint32(g*0xffff/a, 0xffff), minUint32(b*0xffff/a, 0xffff)
+				data = append(data, premultiply(fromLinear[r], a8), premultiply(fromLinear[g], a8), premultiply(fromLinear[b], a8), a8)
+				continue
+			}
+			data = append(data, fromLinear[r], fromLinear[g], fromLinear[b], a8)
+		}
+	}
+	return w, h, data
+}
+
+// orientedSource returns the pixel of the sw x sh source that is shown at
+// x, y of the upright image
+func orientedSource(orientation, x, y, sw, sh int) (int, int) {
+	switch orientation {
+	case 2: // mirrored
+		return sw - 1 - x, y
+	case 3: // turned by 180 degrees
+		return sw - 1 - x, sh - 1 - y
+	case 4: // upside down
+		return x, sh - 1 - y
+	case 5: // transposed
+		return y, x
+	case 6: // turned counterclockwise, shown clockwise
+		return y, sh - 1 - x
+	case 7: // transversed
+		return sw - 1 - y, sh - 1 - x
+	case 8: // turned clockwise, shown counterclockwise
+		return sw - 1 - y, x
+	}
+	return x, y
+}
@@ -1,3 +1,6 @@
+//go:build openvg
+// +build openvg
+
 //
 // libshapes: high-level OpenVG API
 // Anthony Starks (ajstarks@gmail.com)
@@ -0,0 +1,489 @@
+package grafic2d
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"github.com/flothe/pinboard/internal/atomicfile"
+	"hash/crc32"
+	"image"
+	"image/draw"
+	"image/gif"
+	"image/png"
+	"io"
+	"io/ioutil"
+	"log"
+	"os"
+	"os/exec"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Animated GIFs and short videos are saved as motion file, a sequence of
+// frames that is played in a loop. The file starts with a header of 76 bytes,
+// all numbers little endian:
+//
+//	 0  magic "\x89PBV\r\n\x1a\n"
+//	 8  version uint16
+//	10  reserved uint16, 0
+//	12  number of frames uint32
+//	16  width, height of the frames uint32
+//	24  max width, max height uint32 the frames were scaled to
+//	32  frames per second videos are decoded with uint32
+//	36  max duration in ms uint32 the clip was cut to
+//	40  SHA-256 of the source file
+//	72  CRC-32 (IEEE) of the bytes 0 to 71 uint32
+//
+// Each frame follows as its duration in ms uint32, its length uint32 and the
+// frame as complete image file. Like for the image files the source is kept
+// next to the motion file, see SourceFile.
+const (
+	MotionFileExt     = "pbv"
+	MotionFileVersion = 1
+	motionHeaderSize  = 76
+	// all frames of a clip together must not be larger than a single image
+	maxMotionPixels = maxImagePixels
+	maxMotionFrames = 1000
+	// shorter GIF delays are played as 100 ms like the browsers do
+	minGifDelayMs     = 20
+	defaultGifDelayMs = 100
+	// ffmpeg has to decode a video within this time
+	ffmpegTimeout = 2 * time.Minute
+)
+
+var motionMagic = []byte("\x89PBV\r\n\x1a\n")
+
+// ErrNotAnimated is returned by SaveMotion for GIFs with a single frame, they
+// are saved as image
+var ErrNotAnimated = errors.New("GIF is not animated")
+
+// MotionLimits limits the clips saved from animated GIFs and videos
+type MotionLimits struct {
+	MaxWidth, MaxHeight uint
+	// frames per second taken from videos
+	FPS int
+	// longer clips are cut
+	MaxDuration time.Duration
+}
+
+// DefaultMotionLimits keeps the clips small, all frames of a clip are in
+// memory while it is shown
+var DefaultMotionLimits = MotionLimits{MaxWidth: 480, MaxHeight: 270, FPS: 10, MaxDuration: 10 * time.Second}
+
+var ffmpeg = struct {
+	sync.Mutex
+	path string
+}{path: "ffmpeg"}
+
+// SetFFmpeg sets the ffmpeg binary that decodes the videos, a name without
+// path is searched in PATH. If it is empty videos are refused.
+func SetFFmpeg(path string) {
+	ffmpeg.Lock()
+	defer ffmpeg.Unlock()
+	ffmpeg.path = path
+}
+
+func ffmpegPath() string {
+	ffmpeg.Lock()
+	defer ffmpeg.Unlock()
+	return ffmpeg.path
+}
+
+// IsMotionFile tells by the extension if fn is a motion file
+func IsMotionFile(fn string) bool {
+	return strings.HasSuffix(fn, "."+MotionFileExt)
+}
+
+// motionHeader is the header of a motion file
+type motionHeader struct {
+	Version             uint16
+	Reserved            uint16
+	Frames              uint32
+	Width, Height       uint32
+	MaxWidth, MaxHeight uint32
+	FPS                 uint32
+	MaxDurationMs       uint32
+	SourceHash          [32]byte
+}
+
+// motionFrame is a frame of a clip with the pixels in the layout of
+// PixelRGBAPre
+type motionFrame struct {
+	data []byte
+	ms   int
+}
+
+func isGif(buf []byte) bool {
+	return bytes.HasPrefix(buf, []byte("GIF8"))
+}
+
+// SaveMotion saves the animated GIF or the video in buf scaled to limits as
+// motion file fn, buf is kept as its source. GIFs with a single frame are not
+// saved, ErrNotAnimated is returned for them.
+func SaveMotion(buf []byte, limits MotionLimits, fn string) error {
+	var t Timer
+	t.Start()
+
+	// ffmpeg reads the video from the source file
+	if err := atomicfile.WriteFile(SourceFile(fn), buf, 0644); err != nil {
+		return err
+	}
+	w, h, frames, err := decodeMotion(buf, SourceFile(fn), limits, fn)
+	if err == nil {
+		err = writeMotionFile(fn, w, h, frames, limits, sha256.Sum256(buf))
+	}
+	if err != nil {
+		os.Remove(SourceFile(fn))
+		return err
+	}
+	log.Printf("Saved motion %v (%v frames, %vx%v px) in %v ms.\n", fn, len(frames), w, h, t.TimeSinceStart())
+	return nil
+}
+
+// decodeMotion decodes the GIF in buf or the video in the file src
+func decodeMotion(buf []byte, src string, limits MotionLimits, fn string) (int, int, []motionFrame, error) {
+	if isGif(buf) {
+		return decodeGif(buf, limits, fn)
+	}
+	return decodeVideo(src, limits, fn)
+}
+
+// decodeGif composes the frames of the GIF like a browser shows them and
+// scales them to limits
+func decodeGif(buf []byte, limits MotionLimits, fn string) (int, int, []motionFrame, error) {
+	cfg, err := gif.DecodeConfig(bytes.NewReader(buf))
+	if err != nil {
+		return 0, 0, nil, fmt.Errorf("Failed to read GIF %v: %v", fn, err)
+	}
+	if cfg.Width <= 0 || cfg.Height <= 0 || int64(cfg.Width)*int64(cfg.Height) > maxImagePixels {
+		return 0, 0, nil, fmt.Errorf("GIF %v is too large: %vx%v px", fn, cfg.Width, cfg.Height)
+	}
+	g, err := gif.DecodeAll(bytes.NewReader(buf))
+	if err != nil {
+		return 0, 0, nil, fmt.Errorf("Failed to decode GIF %v: %v", fn, err)
+	}
+	if len(g.Image) < 2 {
+		return 0, 0, nil, ErrNotAnimated
+	}
+	if len(g.Image) != len(g.Delay) {
+		return 0, 0, nil, fmt.Errorf("%v contains more images (%v) than delay times (%v).", fn, len(g.Image), len(g.Delay))
+	}
+
+	maxMs := int(limits.MaxDuration / time.Millisecond)
+	canvas := image.NewRGBA(image.Rect(0, 0, cfg.Width, cfg.Height))
+	var frames []motionFrame
+	var w, h, ms int
+	for i, frame := range g.Image {
+		disposal := byte(0)
+		if i < len(g.Disposal) {
+			disposal = g.Disposal[i]
+		}
+		var previous *image.RGBA
+		if disposal == gif.DisposalPrevious {
+			previous = image.NewRGBA(canvas.Rect)
+			copy(previous.Pix, canvas.Pix)
+		}
+		draw.Draw(canvas, frame.Bounds(), frame, frame.Bounds().Min, draw.Over)
+
+		delay := 10 * g.Delay[i]
+		if delay < minGifDelayMs {
+			delay = defaultGifDelayMs
+		}
+		if maxMs > 0 && ms+delay > maxMs {
+			delay = maxMs - ms
+		}
+		var data []byte
+		w, h, data = scaleDecoded(canvas, 1, limits.MaxWidth, limits.MaxHeight)
+		frames = append(frames, motionFrame{data, delay})
+		ms += delay
+		if maxMs > 0 && ms >= maxMs || !motionFits(len(frames)+1, w, h) {
+			if i < len(g.Image)-1 {
+				log.Printf("Cut GIF %v after %v of %v frames, %v ms\n", fn, len(frames), len(g.Image), ms)
+			}
+			break
+		}
+
+		switch disposal {
+		case gif.DisposalBackground:
+			// the background is transparent, as in the browsers
+			draw.Draw(canvas, frame.Bounds(), image.Transparent, image.Point{}, draw.Src)
+		case gif.DisposalPrevious:
+			canvas = previous
+		}
+	}
+	return w, h, frames, nil
+}
+
+// motionFits tells if a clip of n frames with w x h px is within the limits
+func motionFits(n, w, h int) bool {
+	return n <= maxMotionFrames && int64(n)*int64(w)*int64(h) <= maxMotionPixels
+}
+
+// decodeVideo lets ffmpeg decode the video file src into frames scaled to
+// limits
+func decodeVideo(src string, limits MotionLimits, fn string) (int, int, []motionFrame, error) {
+	path := ffmpegPath()
+	if path == "" {
+		return 0, 0, nil, fmt.Errorf("Video %v is not saved, there is no ffmpeg", fn)
+	}
+	fps := limits.FPS
+	if fps <= 0 {
+		fps = DefaultMotionLimits.FPS
+	}
+	maxWidth, maxHeight := limits.MaxWidth, limits.MaxHeight
+	if maxWidth == 0 || maxHeight == 0 {
+		maxWidth, maxHeight = DefaultMotionLimits.MaxWidth, DefaultMotionLimits.MaxHeight
+	}
+
+	args := []string{"-v", "error", "-nostdin", "-i", src}
+	if limits.MaxDuration > 0 {
+		args = append(args, "-t", fmt.Sprintf("%.3f", limits.MaxDuration.Seconds()))
+	}
+	// the frames are only scaled down, the PNGs follow each other on stdout
+	args = append(args, "-an",
+		"-vf", fmt.Sprintf("fps=%v,scale='min(%v,iw)':'min(%v,ih)':force_original_aspect_ratio=decrease", fps, maxWidth, maxHeight),
+		"-f", "image2pipe", "-vcodec", "png", "pipe:1")
+
+	ctx, cancel := context.WithTimeout(context.Background(), ffmpegTimeout)
+	defer cancel()
+	cmd := exec.CommandContext(ctx, path, args...)
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		return 0, 0, nil, err
+	}
+	if err := cmd.Start(); err != nil {
+		return 0, 0, nil, fmt.Errorf("Failed to start %v for video %v: %v", path, fn, err)
+	}
+
+	r := bufio.NewReader(stdout)
+	var frames []motionFrame
+	var w, h int
+	var decodeErr error
+	cut := false
+	for {
+		if _, err := r.Peek(1); err == io.EOF {
+			break
+		}
+		img, err := png.Decode(r)
+		if err != nil {
+			decodeErr = fmt.Errorf("Failed to decode frame %v of video %v: %v", len(frames)+1, fn, err)
+			break
+		}
+		fw, fh, data := scaleDecoded(img, 1, maxWidth, maxHeight)
+		if len(frames) == 0 {
+			w, h = fw, fh
+		} else if fw != w || fh != h {
+			decodeErr = fmt.Errorf("Frame %v of video %v has %vx%v px instead of %vx%v", len(frames)+1, fn, fw, fh, w, h)
+			break
+		}
+		frames = append(frames, motionFrame{data, 1000 / fps})
+		if !motionFits(len(frames)+1, w, h) {
+			log.Printf("Cut video %v after %v frames\n", fn, len(frames))
+			cut = true
+			break
+		}
+	}
+	if decodeErr != nil || cut {
+		// ffmpeg must not block on the pipe
+		cancel()
+	}
+	err = cmd.Wait()
+	if decodeErr != nil {
+		return 0, 0, nil, decodeErr
+	}
+	if err != nil && !cut {
+		return 0, 0, nil, fmt.Errorf("%v failed on video %v: %v %v", path, fn, err, strings.TrimSpace(stderr.String()))
+	}
+	if len(frames) == 0 {
+		return 0, 0, nil, fmt.Errorf("Video %v has no frames", fn)
+	}
+	return w, h, frames, nil
+}
+
+// writeMotionFile writes the w x h frames with the header. The file is
+// replaced atomically.
+func writeMotionFile(fn string, w, h int, frames []motionFrame, limits MotionLimits, sourceHash [32]byte) error {
+	hdr := motionHeader{
+		Version:       MotionFileVersion,
+		Frames:        uint32(len(frames)),
+		Width:         uint32(w),
+		Height:        uint32(h),
+		MaxWidth:      uint32(limits.MaxWidth),
+		MaxHeight:     uint32(limits.MaxHeight),
+		FPS:           uint32(limits.FPS),
+		MaxDurationMs: uint32(limits.MaxDuration / time.Millisecond),
+		SourceHash:    sourceHash,
+	}
+	b := new(bytes.Buffer)
+	b.Write(motionMagic)
+	binary.Write(b, binary.LittleEndian, hdr)
+	binary.Write(b, binary.LittleEndian, crc32.ChecksumIEEE(b.Bytes()))
+	for i, f := range frames {
+		buf, err := encodeImageFile(w, h, f.data, limits.MaxWidth, limits.MaxHeight, [32]byte{})
+		if err != nil {
+			return fmt.Errorf("Frame %v of motion %v: %v", i+1, fn, err)
+		}
+		binary.Write(b, binary.LittleEndian, uint32(f.ms))
+		binary.Write(b, binary.LittleEndian, uint32(len(buf)))
+		b.Write(buf)
+	}
+	if err := atomicfile.WriteFile(fn, b.Bytes(), 0644); err != nil {
+		return err
+	}
+	log.Printf("Written motion %v (%v frames, %vx%v px, %v bytes)\n", fn, len(frames), w, h, b.Len())
+	return nil
+}
+
+// readMotionHeader reads and checks the header at the start of buf
+func readMotionHeader(buf []byte) (*motionHeader, error) {
+	if len(buf) < motionHeaderSize {
+		return nil, fmt.Errorf("Motion file too short: %v bytes", len(buf))
+	}
+	if !bytes.Equal(buf[:len(motionMagic)], motionMagic) {
+		return nil, fmt.Errorf("Not a motion file")
+	}
+	crc := binary.LittleEndian.Uint32(buf[motionHeaderSize-4:])
+	if crc32.ChecksumIEEE(buf[:motionHeaderSize-4]) != crc {
+		return nil, fmt.Errorf("Broken header")
+	}
+	hdr := new(motionHeader)
+	binary.Read(bytes.NewReader(buf[len(motionMagic):]), binary.LittleEndian, hdr)
+	if hdr.Version > MotionFileVersion || hdr.Version == 0 {
+		return nil, fmt.Errorf("Unsupported version %v", hdr.Version)
+	}
+	if hdr.Width == 0 || hdr.Height == 0 || hdr.Frames == 0 || !motionFits(int(hdr.Frames), int(hdr.Width), int(hdr.Height)) {
+		return nil, fmt.Errorf("Invalid dimension %v frames of %vx%v", hdr.Frames, hdr.Width, hdr.Height)
+	}
+	return hdr, nil
+}
+
+// decodeMotionFile checks the motion file and returns its header and frames
+func decodeMotionFile(buf []byte) (*motionHeader, []motionFrame, error) {
+	hdr, err := readMotionHeader(buf)
+	if err != nil {
+		return nil, nil, err
+	}
+	rest := buf[motionHeaderSize:]
+	frames := make([]motionFrame, 0, hdr.Frames)
+	for i := 0; i < int(hdr.Frames); i++ {
+		if len(rest) < 8 {
+			return hdr, nil, fmt.Errorf("Frame %v is missing", i+1)
+		}
+		ms := binary.LittleEndian.Uint32(rest)
+		n := binary.LittleEndian.Uint32(rest[4:])
+		rest = rest[8:]
+		if uint64(n) > uint64(len(rest)) {
+			return hdr, nil, fmt.Errorf("Frame %v has %v bytes instead of %v", i+1, len(rest), n)
+		}
+		fhdr, data, err := decodeImageFile(rest[:n])
+		if err != nil {
+			return hdr, nil, fmt.Errorf("Frame %v: %v", i+1, err)
+		}
+		if fhdr.Width != hdr.Width || fhdr.Height != hdr.Height {
+			return hdr, nil, fmt.Errorf("Frame %v has %vx%v px instead of %vx%v", i+1, fhdr.Width, fhdr.Height, hdr.Width, hdr.Height)
+		}
+		frames = append(frames, motionFrame{data, int(ms)})
+		rest = rest[n:]
+	}
+	if len(rest) > 0 {
+		return hdr, nil, fmt.Errorf("%v bytes after the last frame", len(rest))
+	}
+	return hdr, frames, nil
+}
+
+// readMotionFile reads the motion file and returns the dimension and the
+// frames
+func readMotionFile(fn string) (int, int, []motionFrame, error) {
+	buf, err := ioutil.ReadFile(fn)
+	if err != nil {
+		return 0, 0, nil, err
+	}
+	hdr, frames, err := decodeMotionFile(buf)
+	if err != nil {
+		return 0, 0, nil, err
+	}
+	return int(hdr.Width), int(hdr.Height), frames, nil
+}
+
+// rederiveMotion decodes the source of the motion file fn again and replaces
+// the motion file. The limits and the hash of the source are taken from the
+// header if it can be read.
+func rederiveMotion(fn string) (int, int, []motionFrame, error) {
+	src, err := ioutil.ReadFile(SourceFile(fn))
+	if err != nil {
+		return 0, 0, nil, fmt.Errorf("No source to derive motion %v again: %v", fn, err)
+	}
+	sum := sha256.Sum256(src)
+	limits := DefaultMotionLimits
+	if buf, err := ioutil.ReadFile(fn); err == nil {
+		if hdr, err := readMotionHeader(buf); err == nil {
+			if hdr.SourceHash != sum {
+				return 0, 0, nil, fmt.Errorf("Source of motion %v has changed", fn)
+			}
+			limits = MotionLimits{
+				MaxWidth:    uint(hdr.MaxWidth),
+				MaxHeight:   uint(hdr.MaxHeight),
+				FPS:         int(hdr.FPS),
+				MaxDuration: time.Duration(hdr.MaxDurationMs) * time.Millisecond,
+			}
+		}
+	}
+
+	w, h, frames, err := decodeMotion(src, SourceFile(fn), limits, fn)
+	if err != nil {
+		return 0, 0, nil, err
+	}
+	if err := writeMotionFile(fn, w, h, frames, limits, sum); err != nil {
+		// the clip can be shown anyway
+		log.Printf("Failed to replace motion %v: %v\n", fn, err)
+	}
+	log.Printf("Derived motion %v again from its source\n", fn)
+	return w, h, frames, nil
+}
+
+// LoadMotionSprite loads the motion file fn as sprite that plays the clip in
+// a loop. If the file is broken the clip is derived again from its source.
+func LoadMotionSprite(fn string) (*Sprite, error) {
+	w, h, frames, err := loadMotionData(fn)
+	if err != nil {
+		return nil, err
+	}
+
+	s := NewSprite()
+	ms := 0
+	for _, f := range frames {
+		img, err := newVGImage(w, h, f.data)
+		if err != nil {
+			s.Destroy()
+			return nil, err
+		}
+		s.AddImg(img, ms)
+		ms += f.ms
+	}
+	s.AnimDuration = ms
+	log.Printf("Loaded motion %v: %v frames of %vx%v, %v ms", fn, len(frames), w, h, ms)
+	return s, nil
+}
+
+// loadMotionData reads the frames of the motion file fn like
+// LoadMotionSprite without creating the images, so it can run on any
+// goroutine
+func loadMotionData(fn string) (int, int, []motionFrame, error) {
+	w, h, frames, err := readMotionFile(fn)
+	if err != nil {
+		log.Printf("Failed to read motion %v: %v\n", fn, err)
+		w, h, frames, err = rederiveMotion(fn)
+		if err != nil {
+			log.Printf("Failed to derive motion %v again: %v\n", fn, err)
+			return 0, 0, nil, err
+		}
+	}
+	return w, h, frames, nil
+}
@@ -1,3 +1,6 @@
+//go:build openvg
+// +build openvg
+
 #include "EGL/egl.h"
 #include "GLES/gl.h"
 #include "eglstate.h"
@@ -9,11 +9,14 @@ import (
 type PhotoSlider struct {
 	filenames []string
 	images []*Sprite
+	durations []int // how long each image is shown in milliseconds
 	gfx *GFXServer
 	time int	
 	slideTimeMs int // how long is a image shown in milliseconds
 	minShowTimeMs int // how long should this slider be shown at least in milliseconds
 	imageIndex int
+	// if set the images are taken from its cache and released again by End
+	Resources *ResourceManager
 }
 
 func NewPhotoSlider(fn []string, slideTimeMs, minShowTimeMs int) *PhotoSlider {
@@ -26,8 +29,17 @@ func (ps *PhotoSlider) IsReadyToEnd() bool {
 	if ps.time < ps.minShowTimeMs {
 		return false
 	}
-	// return true if all images have been shown for ps.slideTimeMs
-	return int(ps.time / ps.slideTimeMs) >= len(ps.images)
+	// return true if all images have been shown for their duration
+	return ps.time >= ps.totalDuration()
+}
+
+// totalDuration returns the time it takes to show all images once
+func (ps *PhotoSlider) totalDuration() int {
+	total := 0
+	for _, d := range ps.durations {
+		total += d
+	}
+	return total
 }
 
 
@@ -44,17 +56,20 @@ func (ps *PhotoSlider) Begin(gfx *GFXServer) error {
 
 	var t Timer
 	t.Start()
-	// load the images
+	// load the images, clips are played in a loop and shown at least once
 	for _, fn := range ps.filenames {
-		vgImg, err := LoadVGImage(fn)
+		s, err := ps.load(fn)
 		if err != nil {
 			return err
 		}
-		s := NewSprite()
-		s.AddImg(vgImg, 0)	
+		ps.images = append(ps.images, s)	
+		if IsMotionFile(fn) {
+			ps.durations = append(ps.durations, int(math.Max(float64(ps.slideTimeMs), float64(s.AnimDuration))))
+			continue
+		}
 		s.AnimDuration = ps.slideTimeMs
 		s.DoNotLoop = true
-		ps.images = append(ps.images, s)	
+		ps.durations = append(ps.durations, ps.slideTimeMs)
 	}
 	log.Printf("Loaded %v images in %v ms.\n", len(ps.images), t.TimeSinceStart())
 	
@@ -64,15 +79,37 @@ func (ps *PhotoSlider) Begin(gfx *GFXServer) error {
 	return nil
 }
 
+// load returns a sprite of the image or clip fn
+func (ps *PhotoSlider) load(fn string) (*Sprite, error) {
+	if ps.Resources != nil {
+		return ps.Resources.Sprite(fn)
+	}
+	if IsMotionFile(fn) {
+		return LoadMotionSprite(fn)
+	}
+	vgImg, err := LoadVGImage(fn)
+	if err != nil {
+		return nil, err
+	}
+	s := NewSprite()
+	s.AddImg(vgImg, 0)	
+	return s, nil
+}
+
 func (ps *PhotoSlider) End() error {
-	// free all space used by the images
+	// free all space used by the images, the cache keeps them for the next time
 	var t Timer
 	t.Start()
-	for _, img := range ps.images {
+	for i, img := range ps.images {
+		if ps.Resources != nil {
+			ps.Resources.Release(ps.filenames[i])
+			continue
+		}
 		img.Destroy()
 	}
 	log.Printf("Destroyed %v images in %v ms.\n", len(ps.images), t.TimeSinceStart())
 	ps.images = nil
+	ps.durations = nil
 	
 	return nil
 }
@@ -107,11 +144,15 @@ func (ps *PhotoSlider) updateImageIndex() {
 		return		
 	}
 
-	if(ps.slideTimeMs==0) {
+	total := ps.totalDuration()
+	if(total==0) {
 		return		
 	}
 	
-	ix := int(ps.time / ps.slideTimeMs) % len(ps.images)
+	ix := 0
+	for t := ps.time % total; t >= ps.durations[ix]; ix++ {
+		t -= ps.durations[ix]
+	}
 	if ix != ps.imageIndex {
 		ps.images[ps.imageIndex].Reset()
 		log.Printf("Switch images %v --> %v \n",ps.imageIndex, ix)		
@@ -0,0 +1,70 @@
+package grafic2d
+
+import (
+	"github.com/flothe/pinboard/clock"
+	"image"
+	"image/color"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// newTestGFX returns a graphics server with the software renderer
+func newTestGFX(t *testing.T) *GFXServer {
+	gfx := NewGFXServer(NewSoftwareRenderer(320, 240))
+	gfx.Init()
+	t.Cleanup(gfx.Finish)
+	return gfx
+}
+
+// saveTestPhotos saves n small photos of different colors to dir
+func saveTestPhotos(t *testing.T, dir string, n int) []string {
+	var fns []string
+	for i := 0; i < n; i++ {
+		img := image.NewNRGBA(image.Rect(0, 0, 40, 30))
+		for y := 0; y < 30; y++ {
+			for x := 0; x < 40; x++ {
+				img.SetNRGBA(x, y, color.NRGBA{uint8(100 * i), 80, 200, 255})
+			}
+		}
+		fn := filepath.Join(dir, string('a'+rune(i))+"."+ImageFileExt)
+		if err := SaveVGImage(img, fn); err != nil {
+			t.Fatal(err)
+		}
+		fns = append(fns, fn)
+	}
+	return fns
+}
+
+func TestPhotoSliderTiming(t *testing.T) {
+	gfx := newTestGFX(t)
+	ps := NewPhotoSlider(saveTestPhotos(t, t.TempDir(), 2), 1000, 2500)
+	if err := ps.Begin(gfx); err != nil {
+		t.Fatal(err)
+	}
+	defer ps.End()
+
+	// 25 frames per second like the render loop, on the fake clock
+	clk := clock.NewFake(time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC))
+	var timer Timer
+	timer.Clock = clk
+	timer.Start()
+	for ms := 40; ms <= 3000; ms += 40 {
+		clk.Advance(40 * time.Millisecond)
+		if err := ps.Update(timer.TimeSinceLastCall()); err != nil {
+			t.Fatal(err)
+		}
+		if err := ps.Draw(); err != nil {
+			t.Fatal(err)
+		}
+
+		// each photo is shown for a second, then the slider starts again
+		if want := (ms / 1000) % 2; ps.imageIndex != want {
+			t.Errorf("at %v ms photo %v is shown, want %v", ms, ps.imageIndex, want)
+		}
+		// the photos have been shown after 2s, but the minimum time is longer
+		if want := ms >= 2500; ps.IsReadyToEnd() != want {
+			t.Errorf("at %v ms IsReadyToEnd is %v", ms, !want)
+		}
+	}
+}
@@ -0,0 +1,80 @@
+package grafic2d
+
+// Renderer is the backend that does the actual drawing for a GFXServer.
+// The coordinate system is the one of OpenVG: the origin is in the lower
+// left corner of the screen and y grows upwards.
+type Renderer interface {
+	// Init initializes the renderer and returns the display width and height
+	Init() (int, int)
+	// Finish frees all resources of the renderer
+	Finish()
+
+	// Start begins a picture, End finishes and shows it.
+	Start(w, h int)
+	End()
+	// SaveEnd ends the picture and dumps the raw raster to filename (stdout if empty)
+	SaveEnd(filename string)
+
+	Background(r, g, b uint8)
+	BackgroundRGB(r, g, b uint8, alpha VGfloat)
+
+	// paint and stroke settings
+	FillRGB(r, g, b uint8, alpha VGfloat)
+	StrokeRGB(r, g, b uint8, alpha VGfloat)
+	StrokeWidth(w VGfloat)
+	FillLinearGradient(x1, y1, x2, y2 VGfloat, ramp []Offcolor)
+	FillRadialGradient(cx, cy, fx, fy, radius VGfloat, ramp []Offcolor)
+
+	// shapes
+	Line(x1, y1, x2, y2 VGfloat)
+	Rect(x, y, w, h VGfloat)
+	Roundrect(x, y, w, h, rw, rh VGfloat)
+	Ellipse(x, y, w, h VGfloat)
+	Circle(x, y, r VGfloat)
+	Qbezier(sx, sy, cx, cy, ex, ey VGfloat)
+	Cbezier(sx, sy, cx, cy, px, py, ex, ey VGfloat)
+	Arc(x, y, w, h, sa, aext VGfloat)
+	Polygon(x, y []VGfloat)
+	Polyline(x, y []VGfloat)
+
+	// text
+	Text(x, y VGfloat, s string, font string, size int)
+	TextWidth(s string, font string, size int) VGfloat
+
+	// transformations of the coordinate system used for shapes and text
+	Translate(x, y VGfloat)
+	Rotate(r VGfloat)
+	Shear(x, y VGfloat)
+	Scale(x, y VGfloat)
+
+	// NewImage creates an image of w x h pixels. data holds the pixels in the
+	// VG_sABGR_8888_PRE memory layout (R, G, B, A bytes, the colors
+	// premultiplied by alpha), starting with the bottom row.
+	NewImage(w, h int, data []byte) (VGImage, error)
+
+	// terminal handling
+	SaveTerm()
+	RestoreTerm()
+	RawTerm()
+}
+
+// VGImage is an image created by a Renderer.
+type VGImage interface {
+	Destroy()
+	Width() VGint
+	Height() VGint
+	Format() VGImageFormat
+	// Draw draws the image translated by (tx, ty), scaled by (sx, sy) and
+	// rotated by rdeg degrees around the image center moved by (rx, ry).
+	Draw(tx, ty, sx, sy, rx, ry, rdeg VGfloat)
+}
+
+// pixel formats of images, VG_sABGR_8888_PRE is used for all images
+const (
+	VG_sABGR_8888     VGImageFormat = 1 | (1 << 6) | (1 << 7)
+	VG_sABGR_8888_PRE VGImageFormat = 2 | (1 << 6) | (1 << 7)
+)
+
+// activeRenderer is the renderer of the last initialized GFXServer. Like the
+// OpenVG context it is global, so images can be created without a GFXServer.
+var activeRenderer Renderer
@@ -0,0 +1,10 @@
+//go:build !openvg
+// +build !openvg
+
+package grafic2d
+
+// NewDefaultRenderer returns the renderer used if a GFXServer has none.
+// Without the openvg build tag this is a full HD software renderer.
+func NewDefaultRenderer() Renderer {
+	return NewSoftwareRenderer(1920, 1080)
+}
@@ -0,0 +1,294 @@
+//go:build openvg
+// +build openvg
+
+package grafic2d
+
+/*
+#cgo CFLAGS:   -I/opt/vc/include -I/opt/vc/include/interface/vmcs_host/linux -I/opt/vc/include/interface/vcos/pthreads
+#cgo LDFLAGS:  -L/opt/vc/lib -lGLESv2 -ljpeg
+#include <stdlib.h>
+#include "VG/openvg.h"
+#include "VG/vgu.h"
+#include "EGL/egl.h"
+#include "GLES/gl.h"
+#include "fontinfo.h" // font information
+#include "shapes.h"   // C API
+*/
+import "C"
+import (
+	"fmt"
+	"runtime"
+	"unsafe"
+)
+
+// OpenVGRenderer draws with OpenVG/EGL on the Raspberry PI.
+type OpenVGRenderer struct {
+}
+
+// openVGImage is a handle of an OpenVG image
+type openVGImage C.VGImage
+
+// NewDefaultRenderer returns the renderer used if a GFXServer has none.
+func NewDefaultRenderer() Renderer {
+	return new(OpenVGRenderer)
+}
+
+// Init initializes OpenVG and EGL
+func (r *OpenVGRenderer) Init() (int, int) {
+	runtime.LockOSThread()
+	var rh, rw C.int
+	C.init(&rw, &rh)
+	return int(rw), int(rh)
+}
+
+// Finish shuts down OpenVG and EGL
+func (r *OpenVGRenderer) Finish() {
+	C.finish()
+	runtime.UnlockOSThread()
+}
+
+func (r *OpenVGRenderer) Background(red, g, b uint8) {
+	C.Background(C.uint(red), C.uint(g), C.uint(b))
+}
+
+func (r *OpenVGRenderer) BackgroundRGB(red, g, b uint8, alpha VGfloat) {
+	C.BackgroundRGB(C.uint(red), C.uint(g), C.uint(b), C.VGfloat(alpha))
+}
+
+// makeramp prepares the color/stop vector
+func (r *OpenVGRenderer) makeramp(ramp []Offcolor) (*C.VGfloat, C.int) {
+	lr := len(ramp)
+	nr := lr * 5
+	cs := make([]C.VGfloat, nr)
+	j := 0
+	for i := 0; i < lr; i++ {
+		cs[j] = C.VGfloat(ramp[i].Offset)
+		j++
+		cs[j] = C.VGfloat(VGfloat(ramp[i].Red) / 255.0)
+		j++
+		cs[j] = C.VGfloat(VGfloat(ramp[i].Green) / 255.0)
+		j++
+		cs[j] = C.VGfloat(VGfloat(ramp[i].Blue) / 255.0)
+		j++
+		cs[j] = C.VGfloat(ramp[i].Alpha)
+		j++
+	}
+	return &cs[0], C.int(lr)
+}
+
+func (r *OpenVGRenderer) FillLinearGradient(x1, y1, x2, y2 VGfloat, ramp []Offcolor) {
+	cr, nr := r.makeramp(ramp)
+	C.FillLinearGradient(C.VGfloat(x1), C.VGfloat(y1), C.VGfloat(x2), C.VGfloat(y2), cr, nr)
+}
+
+func (r *OpenVGRenderer) FillRadialGradient(cx, cy, fx, fy, radius VGfloat, ramp []Offcolor) {
+	cr, nr := r.makeramp(ramp)
+	C.FillRadialGradient(C.VGfloat(cx), C.VGfloat(cy), C.VGfloat(fx), C.VGfloat(fy), C.VGfloat(radius), cr, nr)
+}
+
+func (r *OpenVGRenderer) FillRGB(red, g, b uint8, alpha VGfloat) {
+	C.Fill(C.uint(red), C.uint(g), C.uint(b), C.VGfloat(alpha))
+}
+
+func (r *OpenVGRenderer) StrokeRGB(red, g, b uint8, alpha VGfloat) {
+	C.Stroke(C.uint(red), C.uint(g), C.uint(b), C.VGfloat(alpha))
+}
+
+func (r *OpenVGRenderer) StrokeWidth(w VGfloat) {
+	C.StrokeWidth(C.VGfloat(w))
+}
+
+func (r *OpenVGRenderer) Start(w, h int) {
+	C.Start(C.int(w), C.int(h))
+}
+
+func (r *OpenVGRenderer) End() {
+	C.End()
+}
+
+func (r *OpenVGRenderer) SaveEnd(filename string) {
+	s := C.CString(filename)
+	defer C.free(unsafe.Pointer(s))
+	C.SaveEnd(s)
+}
+
+func (r *OpenVGRenderer) Line(x1, y1, x2, y2 VGfloat) {
+	C.Line(C.VGfloat(x1), C.VGfloat(y1), C.VGfloat(x2), C.VGfloat(y2))
+}
+
+func (r *OpenVGRenderer) Rect(x, y, w, h VGfloat) {
+	C.Rect(C.VGfloat(x), C.VGfloat(y), C.VGfloat(w), C.VGfloat(h))
+}
+
+func (r *OpenVGRenderer) Roundrect(x, y, w, h, rw, rh VGfloat) {
+	C.Roundrect(C.VGfloat(x), C.VGfloat(y), C.VGfloat(w), C.VGfloat(h), C.VGfloat(rw), C.VGfloat(rh))
+}
+
+func (r *OpenVGRenderer) Ellipse(x, y, w, h VGfloat) {
+	C.Ellipse(C.VGfloat(x), C.VGfloat(y), C.VGfloat(w), C.VGfloat(h))
+}
+
+func (r *OpenVGRenderer) Circle(x, y, radius VGfloat) {
+	C.Circle(C.VGfloat(x), C.VGfloat(y), C.VGfloat(radius))
+}
+
+func (r *OpenVGRenderer) Qbezier(sx, sy, cx, cy, ex, ey VGfloat) {
+	C.Qbezier(C.VGfloat(sx), C.VGfloat(sy), C.VGfloat(cx), C.VGfloat(cy), C.VGfloat(ex), C.VGfloat(ey))
+}
+
+func (r *OpenVGRenderer) Cbezier(sx, sy, cx, cy, px, py, ex, ey VGfloat) {
+	C.Cbezier(C.VGfloat(sx), C.VGfloat(sy), C.VGfloat(cx), C.VGfloat(cy), C.VGfloat(px), C.VGfloat(py), C.VGfloat(ex), C.VGfloat(ey))
+}
+
+func (r *OpenVGRenderer) Arc(x, y, w, h, sa, aext VGfloat) {
+	C.Arc(C.VGfloat(x), C.VGfloat(y), C.VGfloat(w), C.VGfloat(h), C.VGfloat(sa), C.VGfloat(aext))
+}
+
+// poly converts coordinate slices
+func (r *OpenVGRenderer) poly(x, y []VGfloat) (*C.VGfloat, *C.VGfloat, C.VGint) {
+	size := len(x)
+	if size != len(y) {
+		return nil, nil, 0
+	}
+	px := make([]C.VGfloat, size)
+	py := make([]C.VGfloat, size)
+	for i := 0; i < size; i++ {
+		px[i] = C.VGfloat(x[i])
+		py[i] = C.VGfloat(y[i])
+	}
+	return &px[0], &py[0], C.VGint(size)
+}
+
+func (r *OpenVGRenderer) Polygon(x, y []VGfloat) {
+	px, py, np := r.poly(x, y)
+	if np > 0 {
+		C.Polygon(px, py, np)
+	}
+}
+
+func (r *OpenVGRenderer) Polyline(x, y []VGfloat) {
+	px, py, np := r.poly(x, y)
+	if np > 0 {
+		C.Polyline(px, py, np)
+	}
+}
+
+// selectfont specifies the font by generic name
+func (r *OpenVGRenderer) selectfont(s string) C.Fontinfo {
+	switch s {
+	case "sans":
+		return C.SansTypeface
+	case "serif":
+		return C.SerifTypeface
+	case "mono":
+		return C.MonoTypeface
+	}
+	return C.SerifTypeface
+}
+
+func (r *OpenVGRenderer) Text(x, y VGfloat, s string, font string, size int) {
+	t := C.CString(s)
+	C.Text(C.VGfloat(x), C.VGfloat(y), t, r.selectfont(font), C.int(size))
+	C.free(unsafe.Pointer(t))
+}
+
+func (r *OpenVGRenderer) TextWidth(s string, font string, size int) VGfloat {
+	t := C.CString(s)
+	defer C.free(unsafe.Pointer(t))
+	return VGfloat(C.TextWidth(t, r.selectfont(font), C.int(size)))
+}
+
+func (r *OpenVGRenderer) Translate(x, y VGfloat) {
+	C.Translate(C.VGfloat(x), C.VGfloat(y))
+}
+
+func (r *OpenVGRenderer) Rotate(deg VGfloat) {
+	C.Rotate(C.VGfloat(deg))
+}
+
+func (r *OpenVGRenderer) Shear(x, y VGfloat) {
+	C.Shear(C.VGfloat(x), C.VGfloat(y))
+}
+
+func (r *OpenVGRenderer) Scale(x, y VGfloat) {
+	C.Scale(C.VGfloat(x), C.VGfloat(y))
+}
+
+func (r *OpenVGRenderer) SaveTerm() {
+	C.saveterm()
+}
+
+func (r *OpenVGRenderer) RestoreTerm() {
+	C.restoreterm()
+}
+
+func (r *OpenVGRenderer) RawTerm() {
+	C.rawterm()
+}
+
+// NewImage creates an OpenVG image and initializes it with data
+func (r *OpenVGRenderer) NewImage(w, h int, data []byte) (VGImage, error) {
+	if w <= 0 || h <= 0 || len(data) < w*h*4 {
+		return nil, fmt.Errorf("Invalid image data: %vx%v px, %v bytes", w, h, len(data))
+	}
+	// create empty OpenVG image
+	vgImage := C.vgCreateImage(C.VG_sABGR_8888_PRE, C.VGint(w), C.VGint(h), C.VG_IMAGE_QUALITY_FASTER)
+	if vgImage == C.VG_INVALID_HANDLE {
+		return nil, fmt.Errorf("vgCreateImage failed for %vx%v px: %v", w, h, C.vgGetError())
+	}
+	// initialize the OpenVG image with the data from memory
+	C.vgImageSubData(vgImage, unsafe.Pointer(&data[0]), C.VGint(w*4), C.VG_sABGR_8888_PRE, 0, 0, C.VGint(w), C.VGint(h))
+	return openVGImage(vgImage), nil
+}
+
+func (img openVGImage) Destroy() {
+	C.vgDestroyImage(C.VGImage(img))
+}
+
+func (img openVGImage) Width() VGint {
+	return VGint(C.vgGetParameteri(C.VGHandle(img), C.VG_IMAGE_WIDTH))
+}
+
+func (img openVGImage) Height() VGint {
+	return VGint(C.vgGetParameteri(C.VGHandle(img), C.VG_IMAGE_HEIGHT))
+}
+
+func (img openVGImage) Format() VGImageFormat {
+	return VGImageFormat(C.vgGetParameteri(C.VGHandle(img), C.VG_IMAGE_FORMAT))
+}
+
+func (img openVGImage) Draw(tx, ty, sx, sy, rx, ry, rdeg VGfloat) {
+	//	w, h := C.VGint(img.Width()), C.VGint(img.Height())
+	//	C.vgSetPixels(C.VGint(tx), C.VGint(ty), C.VGImage(*img), 0, 0, w, h)
+
+	// store the current transformation
+	var oldmatrix [9]C.VGfloat
+	C.vgGetMatrix(&oldmatrix[0])
+	oldImgMode := C.vgGeti(C.VG_IMAGE_MODE)
+	oldMatMode := C.vgGeti(C.VG_MATRIX_MODE)
+
+	// set the transformation for this image
+	C.vgSeti(C.VG_IMAGE_MODE, C.VG_DRAW_IMAGE_NORMAL)
+	C.vgSeti(C.VG_MATRIX_MODE, C.VG_MATRIX_IMAGE_USER_TO_SURFACE)
+
+	C.vgLoadIdentity()
+	if rdeg != 0 {
+		C.vgTranslate(C.VGfloat(VGfloat(img.Width()/2)+rx), C.VGfloat(VGfloat(img.Height()/2)+ry))
+		C.vgRotate(C.VGfloat(rdeg))
+		C.vgTranslate(C.VGfloat(VGfloat(-img.Width()/2)-rx), C.VGfloat(VGfloat(-img.Height()/2)-ry))
+	}
+	if tx != 0 || ty != 0 {
+		C.vgTranslate(C.VGfloat(tx), C.VGfloat(ty))
+	}
+	if sx != 1 || sy != 1 {
+		C.vgScale(C.VGfloat(sx), C.VGfloat(sy))
+	}
+
+	// draw the image to the current drawing surface
+	C.vgDrawImage(C.VGImage(img))
+
+	// restore the old transormation
+	C.vgSeti(C.VG_IMAGE_MODE, oldImgMode)
+	C.vgSeti(C.VG_MATRIX_MODE, oldMatMode)
+	C.vgLoadMatrix(&oldmatrix[0])
+}
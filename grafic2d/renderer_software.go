@@ -0,0 +1,774 @@
+package grafic2d
+
+import (
+	"bufio"
+	"fmt"
+	"image"
+	"image/color"
+	"io"
+	"math"
+	"os"
+	"sync"
+
+	xdraw "golang.org/x/image/draw"
+	"golang.org/x/image/font"
+	"golang.org/x/image/font/gofont/gomono"
+	"golang.org/x/image/font/gofont/goregular"
+	"golang.org/x/image/font/sfnt"
+	"golang.org/x/image/math/f64"
+	"golang.org/x/image/math/fixed"
+	"golang.org/x/image/vector"
+)
+
+// SoftwareRenderer is a pure-Go renderer that rasterizes into an in-memory
+// image. It follows the semantics of the OpenVG renderer (libshapes), so
+// everything that is drawn on the PI can be drawn off-screen as well.
+type SoftwareRenderer struct {
+	Width, Height int
+	surface       *image.RGBA
+	raster        vector.Rasterizer
+	matrix        affine
+	fill, stroke  paint
+	strokeWidth   float64
+	fontBuf       sfnt.Buffer
+}
+
+// softwareImage is an image created by the SoftwareRenderer, premultiplied
+// like the data
+type softwareImage struct {
+	pix *image.RGBA
+	r   *SoftwareRenderer
+}
+
+// paint types
+const (
+	paintColor = iota
+	paintLinearGradient
+	paintRadialGradient
+)
+
+// paint is the fill or stroke paint
+type paint struct {
+	kind   int
+	color  color.NRGBA
+	coords [5]float64
+	ramp   []Offcolor
+}
+
+// NewSoftwareRenderer returns a renderer for a display of w x h pixels.
+func NewSoftwareRenderer(w, h int) *SoftwareRenderer {
+	return &SoftwareRenderer{Width: w, Height: h}
+}
+
+// Image returns the surface the renderer draws into.
+func (r *SoftwareRenderer) Image() *image.RGBA {
+	return r.surface
+}
+
+func (r *SoftwareRenderer) Init() (int, int) {
+	if r.Width <= 0 || r.Height <= 0 {
+		r.Width, r.Height = 1920, 1080
+	}
+	r.surface = image.NewRGBA(image.Rect(0, 0, r.Width, r.Height))
+	r.reset()
+	return r.Width, r.Height
+}
+
+func (r *SoftwareRenderer) Finish() {
+	r.surface = nil
+}
+
+// reset sets the paint, stroke and transformation to the values used by Start
+func (r *SoftwareRenderer) reset() {
+	r.fill = paint{kind: paintColor, color: color.NRGBA{0, 0, 0, 255}}
+	r.stroke = paint{kind: paintColor, color: color.NRGBA{0, 0, 0, 255}}
+	r.strokeWidth = 0
+	r.matrix = identity
+}
+
+// Start clears the lower left w x h pixels to white, like libshapes does
+func (r *SoftwareRenderer) Start(w, h int) {
+	area := image.Rect(0, r.Height-h, w, r.Height).Intersect(r.surface.Bounds())
+	white := color.RGBA{255, 255, 255, 255}
+	for y := area.Min.Y; y < area.Max.Y; y++ {
+		for x := area.Min.X; x < area.Max.X; x++ {
+			r.surface.SetRGBA(x, y, white)
+		}
+	}
+	r.reset()
+}
+
+func (r *SoftwareRenderer) End() {
+}
+
+// SaveEnd dumps the raster in the VG_sABGR_8888 layout, bottom row first
+func (r *SoftwareRenderer) SaveEnd(filename string) {
+	var out io.Writer = os.Stdout
+	if filename != "" {
+		f, err := os.Create(filename)
+		if err != nil {
+			return
+		}
+		defer f.Close()
+		out = f
+	}
+	w := bufio.NewWriter(out)
+	for y := r.Height - 1; y >= 0; y-- {
+		for x := 0; x < r.Width; x++ {
+			c := color.NRGBAModel.Convert(r.surface.RGBAAt(x, y)).(color.NRGBA)
+			w.Write([]byte{c.R, c.G, c.B, c.A})
+		}
+	}
+	w.Flush()
+}
+
+func (r *SoftwareRenderer) Background(red, g, b uint8) {
+	r.FillRGB(red, g, b, 1)
+	r.Rect(0, 0, VGfloat(r.Width), VGfloat(r.Height))
+}
+
+func (r *SoftwareRenderer) BackgroundRGB(red, g, b uint8, alpha VGfloat) {
+	r.FillRGB(red, g, b, alpha)
+	r.Rect(0, 0, VGfloat(r.Width), VGfloat(r.Height))
+}
+
+// rgba returns the color for the RGBA quad, out of range alpha values become 1
+func rgba(red, g, b uint8, alpha VGfloat) color.NRGBA {
+	if alpha < 0 || alpha > 1 {
+		alpha = 1
+	}
+	return color.NRGBA{red, g, b, uint8(alpha*255 + 0.5)}
+}
+
+func (r *SoftwareRenderer) FillRGB(red, g, b uint8, alpha VGfloat) {
+	r.fill = paint{kind: paintColor, color: rgba(red, g, b, alpha)}
+}
+
+func (r *SoftwareRenderer) StrokeRGB(red, g, b uint8, alpha VGfloat) {
+	r.stroke = paint{kind: paintColor, color: rgba(red, g, b, alpha)}
+}
+
+func (r *SoftwareRenderer) StrokeWidth(w VGfloat) {
+	r.strokeWidth = float64(w)
+}
+
+func (r *SoftwareRenderer) FillLinearGradient(x1, y1, x2, y2 VGfloat, ramp []Offcolor) {
+	r.fill = paint{kind: paintLinearGradient, ramp: ramp,
+		coords: [5]float64{float64(x1), float64(y1), float64(x2), float64(y2)}}
+}
+
+func (r *SoftwareRenderer) FillRadialGradient(cx, cy, fx, fy, radius VGfloat, ramp []Offcolor) {
+	r.fill = paint{kind: paintRadialGradient, ramp: ramp,
+		coords: [5]float64{float64(cx), float64(cy), float64(fx), float64(fy), float64(radius)}}
+}
+
+func (r *SoftwareRenderer) Line(x1, y1, x2, y2 VGfloat) {
+	var p path
+	p.moveTo(float64(x1), float64(y1))
+	p.lineTo(float64(x2), float64(y2))
+	r.strokePath(&p)
+}
+
+func (r *SoftwareRenderer) Rect(x, y, w, h VGfloat) {
+	var p path
+	p.rect(float64(x), float64(y), float64(w), float64(h))
+	r.drawPath(&p)
+}
+
+func (r *SoftwareRenderer) Roundrect(x, y, w, h, rw, rh VGfloat) {
+	var p path
+	p.roundrect(float64(x), float64(y), float64(w), float64(h), float64(rw), float64(rh))
+	r.drawPath(&p)
+}
+
+func (r *SoftwareRenderer) Ellipse(x, y, w, h VGfloat) {
+	var p path
+	p.arc(float64(x), float64(y), float64(w), float64(h), 0, 360)
+	p.close()
+	r.drawPath(&p)
+}
+
+// Circle draws a circle centered at (x,y). Like libshapes r is the diameter.
+func (r *SoftwareRenderer) Circle(x, y, radius VGfloat) {
+	r.Ellipse(x, y, radius, radius)
+}
+
+func (r *SoftwareRenderer) Qbezier(sx, sy, cx, cy, ex, ey VGfloat) {
+	var p path
+	p.moveTo(float64(sx), float64(sy))
+	p.quadTo(float64(cx), float64(cy), float64(ex), float64(ey))
+	r.drawPath(&p)
+}
+
+func (r *SoftwareRenderer) Cbezier(sx, sy, cx, cy, px, py, ex, ey VGfloat) {
+	var p path
+	p.moveTo(float64(sx), float64(sy))
+	p.cubeTo(float64(cx), float64(cy), float64(px), float64(py), float64(ex), float64(ey))
+	r.drawPath(&p)
+}
+
+func (r *SoftwareRenderer) Arc(x, y, w, h, sa, aext VGfloat) {
+	var p path
+	p.arc(float64(x), float64(y), float64(w), float64(h), float64(sa), float64(aext))
+	r.drawPath(&p)
+}
+
+func (r *SoftwareRenderer) Polygon(x, y []VGfloat) {
+	var p path
+	p.poly(x, y)
+	p.close()
+	r.fillPath(&p, &r.fill)
+}
+
+func (r *SoftwareRenderer) Polyline(x, y []VGfloat) {
+	var p path
+	p.poly(x, y)
+	r.strokePath(&p)
+}
+
+// the Go fonts have no serif face, serif text is drawn with Go Regular
+var (
+	softFonts     map[string]*sfnt.Font
+	softFontsOnce sync.Once
+)
+
+// selectfont specifies the font by generic name
+func (r *SoftwareRenderer) selectfont(s string) *sfnt.Font {
+	softFontsOnce.Do(func() {
+		softFonts = make(map[string]*sfnt.Font)
+		for name, ttf := range map[string][]byte{"sans": goregular.TTF, "mono": gomono.TTF} {
+			f, err := sfnt.Parse(ttf)
+			if err != nil {
+				panic(err)
+			}
+			softFonts[name] = f
+		}
+		softFonts["serif"] = softFonts["sans"]
+	})
+	if f, ok := softFonts[s]; ok {
+		return f
+	}
+	return softFonts["serif"]
+}
+
+// Text draws the glyph outlines of s with the fill paint. Like in libshapes
+// size is the height of an em in user coordinates.
+func (r *SoftwareRenderer) Text(x, y VGfloat, s string, fontName string, size int) {
+	f := r.selectfont(fontName)
+	ppem := fixed.I(size)
+	xx, yy := float64(x), float64(y)
+	var p path
+	for _, c := range s {
+		idx, err := f.GlyphIndex(&r.fontBuf, c)
+		if err != nil || idx == 0 {
+			continue // glyph is undefined
+		}
+		segs, err := f.LoadGlyph(&r.fontBuf, idx, ppem, nil)
+		if err == nil {
+			// glyph coordinates are in pixels, y grows downwards
+			pt := func(q fixed.Point26_6) (float64, float64) {
+				return xx + float64(q.X)/64, yy - float64(q.Y)/64
+			}
+			for _, seg := range segs {
+				switch seg.Op {
+				case sfnt.SegmentOpMoveTo:
+					p.close()
+					p.moveTo(pt(seg.Args[0]))
+				case sfnt.SegmentOpLineTo:
+					p.lineTo(pt(seg.Args[0]))
+				case sfnt.SegmentOpQuadTo:
+					cx, cy := pt(seg.Args[0])
+					ex, ey := pt(seg.Args[1])
+					p.quadTo(cx, cy, ex, ey)
+				case sfnt.SegmentOpCubeTo:
+					cx, cy := pt(seg.Args[0])
+					dx, dy := pt(seg.Args[1])
+					ex, ey := pt(seg.Args[2])
+					p.cubeTo(cx, cy, dx, dy, ex, ey)
+				}
+			}
+			p.close()
+		}
+		adv, err := f.GlyphAdvance(&r.fontBuf, idx, ppem, font.HintingNone)
+		if err == nil {
+			xx += float64(adv) / 64
+		}
+	}
+	r.fillPath(&p, &r.fill)
+}
+
+func (r *SoftwareRenderer) TextWidth(s string, fontName string, size int) VGfloat {
+	f := r.selectfont(fontName)
+	ppem := fixed.I(size)
+	var tw fixed.Int26_6
+	for _, c := range s {
+		idx, err := f.GlyphIndex(&r.fontBuf, c)
+		if err != nil || idx == 0 {
+			continue // glyph is undefined
+		}
+		adv, err := f.GlyphAdvance(&r.fontBuf, idx, ppem, font.HintingNone)
+		if err == nil {
+			tw += adv
+		}
+	}
+	return VGfloat(float64(tw) / 64)
+}
+
+func (r *SoftwareRenderer) Translate(x, y VGfloat) {
+	r.matrix = r.matrix.translate(float64(x), float64(y))
+}
+
+func (r *SoftwareRenderer) Rotate(deg VGfloat) {
+	r.matrix = r.matrix.rotate(float64(deg))
+}
+
+func (r *SoftwareRenderer) Shear(x, y VGfloat) {
+	r.matrix = r.matrix.shear(float64(x), float64(y))
+}
+
+func (r *SoftwareRenderer) Scale(x, y VGfloat) {
+	r.matrix = r.matrix.scale(float64(x), float64(y))
+}
+
+// there is no terminal to handle
+func (r *SoftwareRenderer) SaveTerm()    {}
+func (r *SoftwareRenderer) RestoreTerm() {}
+func (r *SoftwareRenderer) RawTerm()     {}
+
+// NewImage creates an image, flipping the bottom-up rows of data
+func (r *SoftwareRenderer) NewImage(w, h int, data []byte) (VGImage, error) {
+	if w <= 0 || h <= 0 || len(data) < w*h*4 {
+		return nil, fmt.Errorf("Invalid image data: %vx%v px, %v bytes", w, h, len(data))
+	}
+	pix := image.NewRGBA(image.Rect(0, 0, w, h))
+	for y := 0; y < h; y++ {
+		copy(pix.Pix[(h-1-y)*pix.Stride:], data[y*w*4:(y+1)*w*4])
+	}
+	return &softwareImage{pix: pix, r: r}, nil
+}
+
+func (img *softwareImage) Destroy() {
+	img.pix = nil
+}
+
+func (img *softwareImage) Width() VGint {
+	if img.pix == nil {
+		return 0
+	}
+	return VGint(img.pix.Rect.Dx())
+}
+
+func (img *softwareImage) Height() VGint {
+	if img.pix == nil {
+		return 0
+	}
+	return VGint(img.pix.Rect.Dy())
+}
+
+func (img *softwareImage) Format() VGImageFormat {
+	return VG_sABGR_8888_PRE
+}
+
+// Draw uses the same image-user-to-surface transformation as the OpenVG image
+func (img *softwareImage) Draw(tx, ty, sx, sy, rx, ry, rdeg VGfloat) {
+	if img.pix == nil || img.r.surface == nil {
+		return
+	}
+	m := identity
+	if rdeg != 0 {
+		m = m.translate(float64(VGfloat(img.Width()/2)+rx), float64(VGfloat(img.Height()/2)+ry))
+		m = m.rotate(float64(rdeg))
+		m = m.translate(float64(VGfloat(-img.Width()/2)-rx), float64(VGfloat(-img.Height()/2)-ry))
+	}
+	m = m.translate(float64(tx), float64(ty))
+	m = m.scale(float64(sx), float64(sy))
+
+	// source pixels are stored top-down, OpenVG images are bottom-up, and so
+	// is the surface: (u, v) -> (u, h-v) -> m -> (X, H-Y)
+	h := float64(img.Height())
+	H := float64(img.r.Height)
+	s2d := f64.Aff3{
+		m[0], -m[1], m[1]*h + m[2],
+		-m[3], m[4], H - m[4]*h - m[5],
+	}
+	xdraw.NearestNeighbor.Transform(img.r.surface, s2d, img.pix, img.pix.Bounds(), xdraw.Over, nil)
+}
+
+// drawPath fills and strokes the path
+func (r *SoftwareRenderer) drawPath(p *path) {
+	r.fillPath(p, &r.fill)
+	r.strokePath(p)
+}
+
+// strokePath strokes the flattened path with butt caps and without joins
+func (r *SoftwareRenderer) strokePath(p *path) {
+	if r.strokeWidth <= 0 || (r.stroke.kind == paintColor && r.stroke.color.A == 0) {
+		return
+	}
+	hw := r.strokeWidth / 2
+	var sp path
+	for _, line := range p.flatten() {
+		for i := 1; i < len(line); i++ {
+			a, b := line[i-1], line[i]
+			dx, dy := b.x-a.x, b.y-a.y
+			l := math.Hypot(dx, dy)
+			if l == 0 {
+				continue
+			}
+			nx, ny := -dy/l*hw, dx/l*hw
+			sp.moveTo(a.x+nx, a.y+ny)
+			sp.lineTo(b.x+nx, b.y+ny)
+			sp.lineTo(b.x-nx, b.y-ny)
+			sp.lineTo(a.x-nx, a.y-ny)
+			sp.close()
+		}
+	}
+	r.fillPath(&sp, &r.stroke)
+}
+
+// fillPath rasterizes the path with the given paint
+func (r *SoftwareRenderer) fillPath(p *path, pt *paint) {
+	if len(p.segs) == 0 || r.surface == nil {
+		return
+	}
+	if pt.kind == paintColor && pt.color.A == 0 {
+		return
+	}
+
+	// transform the path to raster coordinates and find its bounds
+	H := float64(r.Height)
+	toRaster := func(q point) point {
+		x, y := r.matrix.apply(q.x, q.y)
+		return point{x, H - y}
+	}
+	segs := make([]pathSeg, len(p.segs))
+	minX, minY, maxX, maxY := math.Inf(1), math.Inf(1), math.Inf(-1), math.Inf(-1)
+	for i, s := range p.segs {
+		segs[i].op = s.op
+		for j := 0; j < s.op.points(); j++ {
+			q := toRaster(s.p[j])
+			segs[i].p[j] = q
+			minX, minY = math.Min(minX, q.x), math.Min(minY, q.y)
+			maxX, maxY = math.Max(maxX, q.x), math.Max(maxY, q.y)
+		}
+	}
+	bounds := image.Rect(int(math.Floor(minX)), int(math.Floor(minY)), int(math.Ceil(maxX)), int(math.Ceil(maxY)))
+	bounds = bounds.Intersect(r.surface.Bounds())
+	if bounds.Empty() {
+		return
+	}
+
+	// rasterize relative to the bounds
+	ox, oy := float32(bounds.Min.X), float32(bounds.Min.Y)
+	r.raster.Reset(bounds.Dx(), bounds.Dy())
+	for _, s := range segs {
+		switch s.op {
+		case opMoveTo:
+			r.raster.MoveTo(float32(s.p[0].x)-ox, float32(s.p[0].y)-oy)
+		case opLineTo:
+			r.raster.LineTo(float32(s.p[0].x)-ox, float32(s.p[0].y)-oy)
+		case opQuadTo:
+			r.raster.QuadTo(float32(s.p[0].x)-ox, float32(s.p[0].y)-oy,
+				float32(s.p[1].x)-ox, float32(s.p[1].y)-oy)
+		case opCubeTo:
+			r.raster.CubeTo(float32(s.p[0].x)-ox, float32(s.p[0].y)-oy,
+				float32(s.p[1].x)-ox, float32(s.p[1].y)-oy,
+				float32(s.p[2].x)-ox, float32(s.p[2].y)-oy)
+		case opClose:
+			r.raster.ClosePath()
+		}
+	}
+	r.raster.ClosePath()
+	r.raster.Draw(r.surface, bounds, r.paintSource(pt), bounds.Min)
+}
+
+// paintSource returns the paint as source image in raster coordinates
+func (r *SoftwareRenderer) paintSource(pt *paint) image.Image {
+	if pt.kind == paintColor {
+		return image.NewUniform(pt.color)
+	}
+	return &gradient{paint: pt, inv: r.matrix.invert(), height: float64(r.Height)}
+}
+
+// gradient is a linear or radial gradient paint. The gradient coordinates are
+// user coordinates, the colors are repeated beyond the ramp.
+type gradient struct {
+	paint  *paint
+	inv    affine
+	height float64
+}
+
+func (g *gradient) ColorModel() color.Model {
+	return color.NRGBAModel
+}
+
+func (g *gradient) Bounds() image.Rectangle {
+	return image.Rect(-1e9, -1e9, 1e9, 1e9)
+}
+
+func (g *gradient) At(px, py int) color.Color {
+	x, y := g.inv.apply(float64(px)+0.5, g.height-(float64(py)+0.5))
+	c := g.paint.coords
+	var t float64
+	if g.paint.kind == paintLinearGradient {
+		dx, dy := c[2]-c[0], c[3]-c[1]
+		d := dx*dx + dy*dy
+		if d > 0 {
+			t = ((x-c[0])*dx + (y-c[1])*dy) / d
+		}
+	} else {
+		// focal point relative to the center and point relative to the focal point
+		fx, fy := c[2]-c[0], c[3]-c[1]
+		dx, dy := x-c[2], y-c[3]
+		r2 := c[4] * c[4]
+		den := r2 - (fx*fx + fy*fy)
+		if den != 0 {
+			root := r2*(dx*dx+dy*dy) - (dx*fy-dy*fx)*(dx*fy-dy*fx)
+			t = (dx*fx + dy*fy + math.Sqrt(math.Max(root, 0))) / den
+		}
+	}
+	return rampColor(g.paint.ramp, t-math.Floor(t))
+}
+
+// rampColor interpolates the color at offset t in the ramp
+func rampColor(ramp []Offcolor, t float64) color.NRGBA {
+	if len(ramp) == 0 {
+		return color.NRGBA{}
+	}
+	conv := func(o Offcolor) [4]float64 {
+		return [4]float64{float64(o.Red), float64(o.Green), float64(o.Blue), float64(o.Alpha) * 255}
+	}
+	c := conv(ramp[len(ramp)-1])
+	if t <= float64(ramp[0].Offset) {
+		c = conv(ramp[0])
+	} else {
+		for i := 1; i < len(ramp); i++ {
+			o0, o1 := float64(ramp[i-1].Offset), float64(ramp[i].Offset)
+			if t <= o1 {
+				f := 0.0
+				if o1 > o0 {
+					f = (t - o0) / (o1 - o0)
+				}
+				c0, c1 := conv(ramp[i-1]), conv(ramp[i])
+				for j := range c {
+					c[j] = c0[j] + f*(c1[j]-c0[j])
+				}
+				break
+			}
+		}
+	}
+	return color.NRGBA{uint8(c[0] + 0.5), uint8(c[1] + 0.5), uint8(c[2] + 0.5), uint8(math.Min(c[3], 255) + 0.5)}
+}
+
+// affine is a 2D affine transformation in the layout of the first two rows
+// of an OpenVG matrix: x' = m0*x + m1*y + m2, y' = m3*x + m4*y + m5
+type affine [6]float64
+
+var identity = affine{1, 0, 0, 0, 1, 0}
+
+// mul returns m * n, so n is applied first like in OpenVG
+func (m affine) mul(n affine) affine {
+	return affine{
+		m[0]*n[0] + m[1]*n[3], m[0]*n[1] + m[1]*n[4], m[0]*n[2] + m[1]*n[5] + m[2],
+		m[3]*n[0] + m[4]*n[3], m[3]*n[1] + m[4]*n[4], m[3]*n[2] + m[4]*n[5] + m[5],
+	}
+}
+
+func (m affine) translate(x, y float64) affine {
+	return m.mul(affine{1, 0, x, 0, 1, y})
+}
+
+func (m affine) scale(x, y float64) affine {
+	return m.mul(affine{x, 0, 0, 0, y, 0})
+}
+
+func (m affine) rotate(deg float64) affine {
+	s, c := math.Sincos(deg * math.Pi / 180)
+	return m.mul(affine{c, -s, 0, s, c, 0})
+}
+
+func (m affine) shear(x, y float64) affine {
+	return m.mul(affine{1, x, 0, y, 1, 0})
+}
+
+func (m affine) apply(x, y float64) (float64, float64) {
+	return m[0]*x + m[1]*y + m[2], m[3]*x + m[4]*y + m[5]
+}
+
+func (m affine) invert() affine {
+	det := m[0]*m[4] - m[1]*m[3]
+	if det == 0 {
+		return identity
+	}
+	return affine{
+		m[4] / det, -m[1] / det, (m[1]*m[5] - m[2]*m[4]) / det,
+		-m[3] / det, m[0] / det, (m[2]*m[3] - m[0]*m[5]) / det,
+	}
+}
+
+// path segment operations
+type pathOp int
+
+const (
+	opMoveTo pathOp = iota
+	opLineTo
+	opQuadTo
+	opCubeTo
+	opClose
+)
+
+// points returns the number of points used by the operation
+func (op pathOp) points() int {
+	switch op {
+	case opMoveTo, opLineTo:
+		return 1
+	case opQuadTo:
+		return 2
+	case opCubeTo:
+		return 3
+	}
+	return 0
+}
+
+type point struct {
+	x, y float64
+}
+
+type pathSeg struct {
+	op pathOp
+	p  [3]point
+}
+
+// path is a vector path in user coordinates
+type path struct {
+	segs []pathSeg
+}
+
+func (p *path) moveTo(x, y float64) {
+	p.segs = append(p.segs, pathSeg{op: opMoveTo, p: [3]point{{x, y}}})
+}
+
+func (p *path) lineTo(x, y float64) {
+	p.segs = append(p.segs, pathSeg{op: opLineTo, p: [3]point{{x, y}}})
+}
+
+func (p *path) quadTo(cx, cy, x, y float64) {
+	p.segs = append(p.segs, pathSeg{op: opQuadTo, p: [3]point{{cx, cy}, {x, y}}})
+}
+
+func (p *path) cubeTo(cx, cy, dx, dy, x, y float64) {
+	p.segs = append(p.segs, pathSeg{op: opCubeTo, p: [3]point{{cx, cy}, {dx, dy}, {x, y}}})
+}
+
+// close closes the current sub path, if there is one
+func (p *path) close() {
+	if len(p.segs) > 0 && p.segs[len(p.segs)-1].op != opClose {
+		p.segs = append(p.segs, pathSeg{op: opClose})
+	}
+}
+
+func (p *path) rect(x, y, w, h float64) {
+	p.moveTo(x, y)
+	p.lineTo(x+w, y)
+	p.lineTo(x+w, y+h)
+	p.lineTo(x, y+h)
+	p.close()
+}
+
+// roundrect adds a rounded rectangle, rw and rh are the dimensions of the
+// corner ellipses like in vguRoundRect
+func (p *path) roundrect(x, y, w, h, rw, rh float64) {
+	rw = math.Min(math.Abs(rw), math.Abs(w)) / 2
+	rh = math.Min(math.Abs(rh), math.Abs(h)) / 2
+	k := 0.5522847498 // control point distance of a quarter circle
+	p.moveTo(x+rw, y)
+	p.lineTo(x+w-rw, y)
+	p.cubeTo(x+w-rw+k*rw, y, x+w, y+rh-k*rh, x+w, y+rh)
+	p.lineTo(x+w, y+h-rh)
+	p.cubeTo(x+w, y+h-rh+k*rh, x+w-rw+k*rw, y+h, x+w-rw, y+h)
+	p.lineTo(x+rw, y+h)
+	p.cubeTo(x+rw-k*rw, y+h, x, y+h-rh+k*rh, x, y+h-rh)
+	p.lineTo(x, y+rh)
+	p.cubeTo(x, y+rh-k*rh, x+rw-k*rw, y, x+rw, y)
+	p.close()
+}
+
+// arc adds an open elliptical arc centered at (cx, cy) with the dimensions
+// (w, h), starting at sa degrees and extending aext degrees
+func (p *path) arc(cx, cy, w, h, sa, aext float64) {
+	n := int(math.Ceil(math.Abs(aext) / 5))
+	if n < 1 {
+		n = 1
+	}
+	for i := 0; i <= n; i++ {
+		a := (sa + aext*float64(i)/float64(n)) * math.Pi / 180
+		x, y := cx+math.Cos(a)*w/2, cy+math.Sin(a)*h/2
+		if i == 0 {
+			p.moveTo(x, y)
+		} else {
+			p.lineTo(x, y)
+		}
+	}
+}
+
+func (p *path) poly(x, y []VGfloat) {
+	for i := 0; i < len(x) && i < len(y); i++ {
+		if i == 0 {
+			p.moveTo(float64(x[i]), float64(y[i]))
+		} else {
+			p.lineTo(float64(x[i]), float64(y[i]))
+		}
+	}
+}
+
+// flatten returns the sub paths as poly lines, curves are approximated by
+// line segments and closed sub paths end at their first point
+func (p *path) flatten() [][]point {
+	const steps = 16
+	var lines [][]point
+	var cur []point
+	for _, s := range p.segs {
+		switch s.op {
+		case opMoveTo:
+			if len(cur) > 1 {
+				lines = append(lines, cur)
+			}
+			cur = []point{s.p[0]}
+		case opLineTo:
+			cur = append(cur, s.p[0])
+		case opQuadTo:
+			if len(cur) == 0 {
+				continue
+			}
+			a := cur[len(cur)-1]
+			for i := 1; i <= steps; i++ {
+				t := float64(i) / steps
+				u := 1 - t
+				cur = append(cur, point{
+					u*u*a.x + 2*u*t*s.p[0].x + t*t*s.p[1].x,
+					u*u*a.y + 2*u*t*s.p[0].y + t*t*s.p[1].y})
+			}
+		case opCubeTo:
+			if len(cur) == 0 {
+				continue
+			}
+			a := cur[len(cur)-1]
+			for i := 1; i <= steps; i++ {
+				t := float64(i) / steps
+				u := 1 - t
+				cur = append(cur, point{
+					u*u*u*a.x + 3*u*u*t*s.p[0].x + 3*u*t*t*s.p[1].x + t*t*t*s.p[2].x,
+					u*u*u*a.y + 3*u*u*t*s.p[0].y + 3*u*t*t*s.p[1].y + t*t*t*s.p[2].y})
+			}
+		case opClose:
+			if len(cur) > 1 {
+				lines = append(lines, append(cur, cur[0]))
+			}
+			cur = nil
+		}
+	}
+	if len(cur) > 1 {
+		lines = append(lines, cur)
+	}
+	return lines
+}
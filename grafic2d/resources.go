@@ -0,0 +1,364 @@
+package grafic2d
+
+import (
+	"container/list"
+	"fmt"
+	"image/gif"
+	"log"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ResourceManager loads the images, clips and GIFs of the messages ahead, so
+// beginning a message does not stall the rendering. A worker goroutine reads
+// and decodes the files, the images are created on the render thread by
+// Upload within a time budget per frame. The images of the recently shown
+// messages stay in an LRU cache.
+//
+// Except for the worker all methods have to be called on the render thread.
+type ResourceManager struct {
+	// the cache keeps at most this many bytes of pixels, the images in use
+	// and the ones loaded ahead are kept anyway
+	MaxBytes int64
+	// Upload creates images for this time per frame, at least one image
+	UploadBudget time.Duration
+
+	// shared with the worker
+	mu       sync.Mutex
+	queue    []string
+	decoding string
+	decoded  []*decodedResource
+	wake     chan struct{}
+	done     chan struct{}
+
+	// the files of the next messages, they are not evicted
+	wanted map[string]bool
+	// the most recently used resource at the front
+	lru      *list.List
+	resident map[string]*list.Element
+	bytes    int64
+}
+
+// resourceFrame is an image of a resource with the pixels in the layout of
+// PixelRGBAPre
+type resourceFrame struct {
+	w, h int
+	data []byte
+	// how long the frame is shown
+	ms int
+}
+
+// decodedResource is a file decoded by the worker
+type decodedResource struct {
+	fn     string
+	frames []resourceFrame
+}
+
+// resource is a file in the cache, the frames are created as images one by
+// one
+type resource struct {
+	fn     string
+	frames []resourceFrame
+	images []VGImage
+	// number of sprites in use
+	users int
+	bytes int64
+}
+
+// NewResourceManager returns a resource manager and starts its worker
+func NewResourceManager(maxBytes int64, uploadBudget time.Duration) *ResourceManager {
+	rm := &ResourceManager{
+		MaxBytes:     maxBytes,
+		UploadBudget: uploadBudget,
+		wake:         make(chan struct{}, 1),
+		done:         make(chan struct{}),
+		wanted:       make(map[string]bool),
+		lru:          list.New(),
+		resident:     make(map[string]*list.Element),
+	}
+	go rm.work()
+	return rm
+}
+
+// Preload loads the files ahead, they replace the files of the last call.
+// Files that are not needed anymore are not decoded, but stay in the cache.
+func (rm *ResourceManager) Preload(filenames []string) {
+	rm.wanted = make(map[string]bool)
+	for _, fn := range filenames {
+		rm.wanted[fn] = true
+	}
+
+	rm.mu.Lock()
+	var decoded []*decodedResource
+	queued := make(map[string]bool)
+	for _, d := range rm.decoded {
+		if rm.wanted[d.fn] {
+			decoded = append(decoded, d)
+			queued[d.fn] = true
+		}
+	}
+	rm.decoded = decoded
+	rm.queue = nil
+	for _, fn := range filenames {
+		if rm.resident[fn] == nil && !queued[fn] && fn != rm.decoding {
+			rm.queue = append(rm.queue, fn)
+			queued[fn] = true
+		}
+	}
+	rm.mu.Unlock()
+
+	select {
+	case rm.wake <- struct{}{}:
+	default:
+	}
+}
+
+// work decodes the queued files until the manager is closed
+func (rm *ResourceManager) work() {
+	for {
+		select {
+		case <-rm.done:
+			return
+		case <-rm.wake:
+		}
+		for {
+			rm.mu.Lock()
+			if len(rm.queue) == 0 {
+				rm.mu.Unlock()
+				break
+			}
+			fn := rm.queue[0]
+			rm.queue = rm.queue[1:]
+			rm.decoding = fn
+			rm.mu.Unlock()
+
+			var t Timer
+			t.Start()
+			frames, err := decodeResource(fn)
+			if err != nil {
+				log.Printf("Failed to load %v ahead: %v\n", fn, err)
+			} else {
+				log.Printf("Loaded %v ahead in %v ms.\n", fn, t.TimeSinceStart())
+			}
+
+			rm.mu.Lock()
+			rm.decoding = ""
+			if err == nil {
+				rm.decoded = append(rm.decoded, &decodedResource{fn, frames})
+			}
+			rm.mu.Unlock()
+		}
+	}
+}
+
+// Upload creates the images of the decoded files until the time budget is
+// used up. It is called once per frame.
+func (rm *ResourceManager) Upload() {
+	start := time.Now()
+	for n := 0; n == 0 || time.Since(start) < rm.UploadBudget; n++ {
+		r := rm.nextUpload()
+		if r == nil {
+			break
+		}
+		if err := rm.uploadFrame(r); err != nil {
+			log.Printf("Failed to create image of %v: %v\n", r.fn, err)
+			rm.remove(rm.resident[r.fn])
+		}
+	}
+	rm.evict()
+}
+
+// nextUpload returns the resource with images still to create, a decoded
+// file is put into the cache for that
+func (rm *ResourceManager) nextUpload() *resource {
+	for e := rm.lru.Front(); e != nil; e = e.Next() {
+		if r := e.Value.(*resource); len(r.images) < len(r.frames) {
+			return r
+		}
+	}
+	for {
+		rm.mu.Lock()
+		if len(rm.decoded) == 0 {
+			rm.mu.Unlock()
+			return nil
+		}
+		d := rm.decoded[0]
+		rm.decoded = rm.decoded[1:]
+		rm.mu.Unlock()
+		// loaded by Sprite in the meantime
+		if rm.resident[d.fn] == nil {
+			return rm.add(d.fn, d.frames)
+		}
+	}
+}
+
+// add puts the decoded frames of fn into the cache
+func (rm *ResourceManager) add(fn string, frames []resourceFrame) *resource {
+	r := &resource{fn: fn, frames: frames}
+	for _, f := range frames {
+		r.bytes += int64(4 * f.w * f.h)
+	}
+	rm.resident[fn] = rm.lru.PushFront(r)
+	rm.bytes += r.bytes
+	return r
+}
+
+// uploadFrame creates the next image of the resource, the pixels in memory
+// are not needed anymore
+func (rm *ResourceManager) uploadFrame(r *resource) error {
+	f := &r.frames[len(r.images)]
+	img, err := newVGImage(f.w, f.h, f.data)
+	if err != nil {
+		return err
+	}
+	r.images = append(r.images, img)
+	f.data = nil
+	return nil
+}
+
+// Sprite returns a sprite of the image, clip or GIF fn. If the file has not
+// been loaded ahead it is loaded now. The images belong to the manager, call
+// Release instead of destroying the sprite.
+func (rm *ResourceManager) Sprite(fn string) (*Sprite, error) {
+	e := rm.resident[fn]
+	if e == nil {
+		var frames []resourceFrame
+		rm.mu.Lock()
+		for i, d := range rm.decoded {
+			if d.fn == fn {
+				frames = d.frames
+				rm.decoded = append(rm.decoded[:i], rm.decoded[i+1:]...)
+				break
+			}
+		}
+		rm.mu.Unlock()
+		if frames == nil {
+			log.Printf("%v has not been loaded ahead\n", fn)
+			var err error
+			frames, err = decodeResource(fn)
+			if err != nil {
+				return nil, err
+			}
+		}
+		rm.add(fn, frames)
+		e = rm.resident[fn]
+	}
+	r := e.Value.(*resource)
+	for len(r.images) < len(r.frames) {
+		if err := rm.uploadFrame(r); err != nil {
+			rm.remove(e)
+			return nil, err
+		}
+	}
+	r.users++
+	rm.lru.MoveToFront(e)
+
+	s := NewSprite()
+	ms := 0
+	for i, img := range r.images {
+		s.AddImg(img, ms)
+		ms += r.frames[i].ms
+	}
+	s.AnimDuration = ms
+	return s, nil
+}
+
+// Release tells that a sprite of fn is not used anymore, its images stay in
+// the cache as long as there is space
+func (rm *ResourceManager) Release(fn string) {
+	e := rm.resident[fn]
+	if e == nil {
+		return
+	}
+	r := e.Value.(*resource)
+	if r.users > 0 {
+		r.users--
+	}
+	rm.lru.MoveToFront(e)
+	rm.evict()
+}
+
+// evict destroys the least recently used images until the cache fits into
+// MaxBytes
+func (rm *ResourceManager) evict() {
+	for e := rm.lru.Back(); e != nil && rm.bytes > rm.MaxBytes; {
+		prev := e.Prev()
+		r := e.Value.(*resource)
+		if r.users == 0 && !rm.wanted[r.fn] {
+			log.Printf("Evicted %v from the cache\n", r.fn)
+			rm.remove(e)
+		}
+		e = prev
+	}
+}
+
+// remove destroys the images of the resource and takes it out of the cache
+func (rm *ResourceManager) remove(e *list.Element) {
+	r := e.Value.(*resource)
+	for _, img := range r.images {
+		img.Destroy()
+	}
+	rm.lru.Remove(e)
+	delete(rm.resident, r.fn)
+	rm.bytes -= r.bytes
+}
+
+// Close stops the worker and destroys all images
+func (rm *ResourceManager) Close() {
+	select {
+	case <-rm.done:
+		return
+	default:
+	}
+	close(rm.done)
+	for rm.lru.Len() > 0 {
+		rm.remove(rm.lru.Front())
+	}
+}
+
+// decodeResource reads the frames of the file: an intro GIF, a clip or an
+// image
+func decodeResource(fn string) ([]resourceFrame, error) {
+	switch {
+	case strings.HasSuffix(strings.ToLower(fn), ".gif"):
+		return decodeGifFile(fn)
+	case IsMotionFile(fn):
+		w, h, frames, err := loadMotionData(fn)
+		if err != nil {
+			return nil, err
+		}
+		res := make([]resourceFrame, len(frames))
+		for i, f := range frames {
+			res[i] = resourceFrame{w, h, f.data, f.ms}
+		}
+		return res, nil
+	}
+	w, h, data, err := loadImageData(fn)
+	if err != nil {
+		return nil, err
+	}
+	return []resourceFrame{{w, h, data, 0}}, nil
+}
+
+// decodeGifFile reads the frames of the GIF like NewSpriteFromGif
+func decodeGifFile(fn string) ([]resourceFrame, error) {
+	f, err := os.Open(fn)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	g, err := gif.DecodeAll(f)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to decode GIF %v: %v", fn, err)
+	}
+	if len(g.Image) != len(g.Delay) {
+		return nil, fmt.Errorf("%v contains more images (%v) than delay times (%v).", fn, len(g.Image), len(g.Delay))
+	}
+	frames := make([]resourceFrame, len(g.Image))
+	for i, img := range g.Image {
+		frames[i] = resourceFrame{img.Rect.Dx(), img.Rect.Dy(), palettedPixels(img), g.Delay[i] * 10}
+	}
+	return frames, nil
+}
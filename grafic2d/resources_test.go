@@ -0,0 +1,228 @@
+package grafic2d
+
+import (
+	"image"
+	"image/color"
+	"image/gif"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+)
+
+// bytes of a test photo of saveTestPhotos
+const testPhotoBytes = 4 * 40 * 30
+
+func newTestResources(t *testing.T, maxBytes int64, budget time.Duration) *ResourceManager {
+	newTestGFX(t)
+	rm := NewResourceManager(maxBytes, budget)
+	t.Cleanup(rm.Close)
+	return rm
+}
+
+// residentFiles returns the sorted names of the files in the cache without
+// directory and extension
+func residentFiles(rm *ResourceManager) []string {
+	var names []string
+	for fn := range rm.resident {
+		names = append(names, strings.TrimSuffix(filepath.Base(fn), "."+ImageFileExt))
+	}
+	sort.Strings(names)
+	return names
+}
+
+// waitDecoded waits until the worker has decoded n files
+func waitDecoded(t *testing.T, rm *ResourceManager, n int) {
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		rm.mu.Lock()
+		done := len(rm.decoded) >= n
+		rm.mu.Unlock()
+		if done {
+			return
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("%v files have not been decoded", n)
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+// useSprite gets a sprite of fn and releases it
+func useSprite(t *testing.T, rm *ResourceManager, fn string) {
+	if _, err := rm.Sprite(fn); err != nil {
+		t.Fatal(err)
+	}
+	rm.Release(fn)
+}
+
+func TestResourceManagerEvictsLRU(t *testing.T) {
+	rm := newTestResources(t, 2*testPhotoBytes, time.Second)
+	fns := saveTestPhotos(t, t.TempDir(), 4)
+
+	useSprite(t, rm, fns[0])
+	first := rm.resident[fns[0]].Value.(*resource).images[0]
+	useSprite(t, rm, fns[1])
+	useSprite(t, rm, fns[2])
+	if got, want := residentFiles(rm), []string{"b", "c"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("cached %v, want %v", got, want)
+	}
+	if first.Width() != 0 {
+		t.Error("the image of the evicted file has not been destroyed")
+	}
+	if rm.bytes != 2*testPhotoBytes {
+		t.Errorf("%v bytes cached, want %v", rm.bytes, 2*testPhotoBytes)
+	}
+
+	// using b again makes c the least recently used
+	useSprite(t, rm, fns[1])
+	useSprite(t, rm, fns[3])
+	if got, want := residentFiles(rm), []string{"b", "d"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("cached %v, want %v", got, want)
+	}
+}
+
+func TestResourceManagerRefCount(t *testing.T) {
+	rm := newTestResources(t, 0, time.Second)
+	fns := saveTestPhotos(t, t.TempDir(), 1)
+
+	s1, err := rm.Sprite(fns[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	s2, err := rm.Sprite(fns[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	// both sprites share the image
+	if s1.calcImage(0) != s2.calcImage(0) {
+		t.Error("the sprites of the same file have different images")
+	}
+	r := rm.resident[fns[0]].Value.(*resource)
+	if r.users != 2 {
+		t.Errorf("%v users, want 2", r.users)
+	}
+
+	// the cache is full, but the file is in use
+	rm.Release(fns[0])
+	if rm.resident[fns[0]] == nil || r.users != 1 || r.images[0].Width() == 0 {
+		t.Fatalf("evicted with %v users", r.users)
+	}
+	rm.Release(fns[0])
+	if rm.resident[fns[0]] != nil || r.images[0].Width() != 0 {
+		t.Error("not evicted after the last release")
+	}
+	// releasing again or an unknown file does nothing
+	rm.Release(fns[0])
+	rm.Release("unbekannt." + ImageFileExt)
+}
+
+func TestResourceManagerPinsPreloaded(t *testing.T) {
+	rm := newTestResources(t, 0, time.Second)
+	fns := saveTestPhotos(t, t.TempDir(), 3)
+
+	// the files of the next message are decoded ahead and kept
+	rm.Preload(fns[1:])
+	waitDecoded(t, rm, 2)
+	rm.Upload()
+	if got, want := residentFiles(rm), []string{"b", "c"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("cached %v, want the preloaded files %v", got, want)
+	}
+	useSprite(t, rm, fns[0])
+	if got, want := residentFiles(rm), []string{"b", "c"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("cached %v, want %v", got, want)
+	}
+	// a preloaded file is used without decoding it again
+	r := rm.resident[fns[1]].Value.(*resource)
+	if err := os.Remove(fns[1]); err != nil {
+		t.Fatal(err)
+	}
+	useSprite(t, rm, fns[1])
+	if rm.resident[fns[1]].Value.(*resource) != r {
+		t.Error("the preloaded file has been loaded again")
+	}
+
+	// the next preload unpins them
+	rm.Preload(fns[:1])
+	waitDecoded(t, rm, 1)
+	rm.Upload()
+	if got, want := residentFiles(rm), []string{"a"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("cached %v, want %v", got, want)
+	}
+}
+
+// saveTestGif saves a GIF with n frames of 20x10 px to dir
+func saveTestGif(t *testing.T, dir string, n int) string {
+	g := &gif.GIF{}
+	for i := 0; i < n; i++ {
+		img := image.NewPaletted(image.Rect(0, 0, 20, 10), color.Palette{color.Black, color.White})
+		img.SetColorIndex(i, 0, 1)
+		g.Image = append(g.Image, img)
+		g.Delay = append(g.Delay, 10)
+	}
+	fn := filepath.Join(dir, "intro.gif")
+	f, err := os.Create(fn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	if err := gif.EncodeAll(f, g); err != nil {
+		t.Fatal(err)
+	}
+	return fn
+}
+
+func TestResourceManagerUploadBudget(t *testing.T) {
+	rm := newTestResources(t, 1<<20, 0)
+	dir := t.TempDir()
+	fn := saveTestGif(t, dir, 3)
+	photos := saveTestPhotos(t, dir, 1)
+
+	// without budget one image is created per frame
+	rm.Preload([]string{fn, photos[0]})
+	waitDecoded(t, rm, 2)
+	for i, want := range []int{1, 2, 3} {
+		rm.Upload()
+		if n := len(rm.resident[fn].Value.(*resource).images); n != want {
+			t.Errorf("frame %v: %v images, want %v", i+1, n, want)
+		}
+		if rm.resident[photos[0]] != nil {
+			t.Errorf("frame %v: the photo is uploaded before the GIF", i+1)
+		}
+	}
+	rm.Upload()
+	if r := rm.resident[photos[0]]; r == nil || len(r.Value.(*resource).images) != 1 {
+		t.Error("the photo has not been uploaded in the fourth frame")
+	}
+	// the pixels in memory are dropped after the upload
+	for _, f := range rm.resident[fn].Value.(*resource).frames {
+		if f.data != nil {
+			t.Error("the pixels of an uploaded frame are kept")
+		}
+	}
+
+	// with budget all are created at once
+	rm.UploadBudget = time.Minute
+	other := saveTestPhotos(t, t.TempDir(), 2)
+	rm.Preload(other)
+	waitDecoded(t, rm, 2)
+	rm.Upload()
+	for _, fn := range other {
+		if r := rm.resident[fn]; r == nil || len(r.Value.(*resource).images) != 1 {
+			t.Errorf("%v has not been uploaded", filepath.Base(fn))
+		}
+	}
+
+	// a sprite of a GIF has all frames
+	s, err := rm.Sprite(fn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if s.AnimDuration != 300 {
+		t.Errorf("animation of %v ms, want 300", s.AnimDuration)
+	}
+	rm.Release(fn)
+}
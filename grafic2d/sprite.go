@@ -197,11 +197,11 @@ func (s *Sprite) IsAnimationEnded() bool {
 }
 
 
-func (s *Sprite) calcImage(ms int) *VGImage {
+func (s *Sprite) calcImage(ms int) VGImage {
 
 	if s.AnimDuration == 0 {
 		log.Printf("0 ")
-		return &s.images[0].img
+		return s.images[0].img
 	}
 	
 	millis := ms
@@ -219,5 +219,5 @@ func (s *Sprite) calcImage(ms int) *VGImage {
 		}
 	}
 
-	return &s.images[numImg].img
+	return s.images[numImg].img
 }
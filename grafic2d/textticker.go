@@ -20,19 +20,64 @@ type TextTicker struct {
 	
 	dateText string
 	sourceText string
+	style TickerStyle
 	gfx *GFXServer
 	time int	
 }
 
+// TickerStyle defines the look of a TextTicker
+type TickerStyle struct {
+	Font     string
+	FontSize int
+	// baseline of the ticker text
+	Y VGfloat
+	// pixel per second
+	Speed                 int
+	TextColor             Color
+	BackgroundColor       Color
+	PrefixBackgroundColor Color
+	InfoBackgroundColor   Color
+}
+
+// DefaultTickerStyle is white sans text on dark blue
+var DefaultTickerStyle = TickerStyle{
+	Font:                  "sans",
+	FontSize:              20,
+	Y:                     100,
+	Speed:                 150,
+	TextColor:             Color{RGB{255, 255, 255}, 1.0},
+	BackgroundColor:       Color{RGB{0, 0, 64}, 0.8},
+	PrefixBackgroundColor: Color{RGB{0, 0, 128}, 1.0},
+	InfoBackgroundColor:   Color{RGB{0, 0, 64}, 0.95},
+}
+
 func NewTextTicker(tickerText, tickerPrefix, dateText, sourceText string) *TextTicker {
+	return NewStyledTextTicker(tickerText, tickerPrefix, dateText, sourceText, DefaultTickerStyle)
+}
+
+func NewStyledTextTicker(tickerText, tickerPrefix, dateText, sourceText string, style TickerStyle) *TextTicker {
 	tt := TextTicker{tickerText:tickerText + "   +++   ", tickerPrefix:tickerPrefix, dateText:dateText, sourceText:sourceText}
-	tt.font = "sans"
-	tt.fontSize = 20
-	tt.tickerTextY = 100
-	tt.tickerTextSpeed = 150
+	tt.style = style
+	tt.font = style.Font
+	tt.fontSize = style.FontSize
+	tt.tickerTextY = style.Y
+	tt.tickerTextSpeed = style.Speed
 	return &tt
 }
 
+// SetStyle changes the look and the speed of the ticker, also while it is
+// running. A running ticker starts again if the font changes.
+func (tt *TextTicker) SetStyle(style TickerStyle) {
+	remeasure := tt.gfx != nil && (style.Font != tt.font || style.FontSize != tt.fontSize)
+	tt.style = style
+	tt.font = style.Font
+	tt.fontSize = style.FontSize
+	tt.tickerTextY = style.Y
+	tt.tickerTextSpeed = style.Speed
+	if remeasure {
+		tt.Begin(tt.gfx)
+	}
+}
 
 func (tt *TextTicker) Begin(gfx *GFXServer) error {
 	tt.gfx = gfx
@@ -77,12 +122,12 @@ func (tt *TextTicker) Update(ms int) error {
 func (tt *TextTicker) Draw() error {
 	
 	// draw ticker background
-	tt.gfx.FillRGB(0,0,64,0.8)
+	tt.gfx.Fill(tt.style.BackgroundColor)
 	height := 3.0*VGfloat(tt.fontSize)
 	bottom := tt.tickerTextY-VGfloat(tt.fontSize)
 	tt.gfx.Rect(0.0, bottom, VGfloat(tt.gfx.DisplayWidth), height)
 
-	tt.gfx.FillRGB(255,255,255,1.0)	
+	tt.gfx.Fill(tt.style.TextColor)
 	// if visible render ticker text 1
 	if(tt.tickerTextPos1 < VGfloat(tt.gfx.DisplayWidth)) {
 		tt.gfx.Text(tt.tickerTextPos1, tt.tickerTextY ,tt.tickerText, tt.font, tt.fontSize)		
@@ -93,9 +138,9 @@ func (tt *TextTicker) Draw() error {
 	}
 
 	// draw prefix
-	tt.gfx.FillRGB(0,0,128,1.0)
+	tt.gfx.Fill(tt.style.PrefixBackgroundColor)
 	tt.gfx.Rect(0.0, bottom, tt.tickerPrefixWidth + 40, height)
-	tt.gfx.FillRGB(255,255,255,1.0)	
+	tt.gfx.Fill(tt.style.TextColor)
 	tt.gfx.Text(20, tt.tickerTextY - 0.25 * VGfloat(tt.fontSize) ,tt.tickerPrefix, tt.font, int(VGfloat(tt.fontSize) * 1.5))		
 	
 	// draw date and author background
@@ -103,10 +148,10 @@ func (tt *TextTicker) Draw() error {
 	height = 3*VGfloat(fs)
 	bottom = bottom - height
 	textY := bottom + height/2.0 - VGfloat(fs)/2.0
-	tt.gfx.FillRGB(0,0,64,0.95)
+	tt.gfx.Fill(tt.style.InfoBackgroundColor)
 	tt.gfx.Rect(0.0, bottom, VGfloat(tt.gfx.DisplayWidth), height)
 	// draw date and author
-	tt.gfx.FillRGB(255,255,255,1.0)	
+	tt.gfx.Fill(tt.style.TextColor)
 	tt.gfx.Text(20, textY ,tt.dateText, tt.font, fs)		
 	tt.gfx.TextEnd(VGfloat(tt.gfx.DisplayWidth-20), textY ,tt.sourceText, tt.font, fs)		
 	
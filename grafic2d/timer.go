@@ -1,23 +1,33 @@
 package grafic2d
 
 import (
-	"syscall"
+	"github.com/flothe/pinboard/clock"
+	"time"
 )
 
 type Timer struct {
-	start      int64
-	lastCall   int64
-	fpsBase    int64
+	// Clock is the time source of the timer, nil is clock.Real
+	Clock      clock.Clock
+	start      time.Time
+	lastCall   time.Time
+	fpsBase    time.Time
 	fpsCounter int
 	fps        int
 	isStarted  bool
 }
 
+func (t *Timer) now() time.Time {
+	return clock.Or(t.Clock).Now()
+}
+
+// millis returns the whole milliseconds between from and to
+func millis(from, to time.Time) int {
+	return int(to.Sub(from) / time.Millisecond)
+}
+
 func (t *Timer) Start() {
 	t.isStarted = true
-	now := syscall.Timeval{0.0, 0.0}
-	syscall.Gettimeofday(&now)
-	t.start = (int64(now.Sec)*1e3 + int64(now.Usec)/1e3)
+	t.start = t.now()
 	t.lastCall = t.start
 	t.fpsBase = t.start
 	t.fpsCounter = 0
@@ -25,9 +35,9 @@ func (t *Timer) Start() {
 
 func (t *Timer) Reset() {
 	t.isStarted = false
-	t.start = 0
-	t.lastCall = 0
-	t.fpsBase = 0
+	t.start = time.Time{}
+	t.lastCall = time.Time{}
+	t.fpsBase = time.Time{}
 	t.fpsCounter = 0
 }
 
@@ -37,12 +47,9 @@ func (t *Timer) TimeSinceLastCall() int {
 		return 0
 	}
 
-	// calc timing stuff
-	n := syscall.Timeval{0.0, 0.0}
-	syscall.Gettimeofday(&n)
-	now := (int64(n.Sec)*1e3 + int64(n.Usec)/1e3)
-	diff := int(now - t.lastCall)
-	t.lastCall = now
+	// calc timing stuff, the remainder below a millisecond is kept for the next call
+	diff := millis(t.lastCall, t.now())
+	t.lastCall = t.lastCall.Add(time.Duration(diff) * time.Millisecond)
 
 	return diff
 }
@@ -52,11 +59,7 @@ func (t *Timer) TimeSinceStart() int {
 		return 0
 	}
 
-	n := syscall.Timeval{0.0, 0.0}
-	syscall.Gettimeofday(&n)
-	now := (int64(n.Sec)*1e3 + int64(n.Usec)/1e3)
-	diff := int(now - t.start)
-	return diff
+	return millis(t.start, t.now())
 }
 
 func (t *Timer) CallsPerSec() int {
@@ -64,17 +67,14 @@ func (t *Timer) CallsPerSec() int {
 		return 0
 	}
 
-	// calc timing stuff
-	n := syscall.Timeval{0.0, 0.0}
-	syscall.Gettimeofday(&n)
-	now := (int64(n.Sec)*1e3 + int64(n.Usec)/1e3)
-
 	// calc fps stuff
+	now := t.now()
 	t.fpsCounter++
-	if now-t.fpsBase > 1000 {
-		t.fps = (t.fpsCounter * 1000) / int(now-t.fpsBase)
+	if diff := millis(t.fpsBase, now); diff > 1000 {
+		t.fps = (t.fpsCounter * 1000) / diff
 		t.fpsBase = now
+		t.fpsCounter = 0
 	}
-	
+
 	return t.fps
 }
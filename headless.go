@@ -0,0 +1,185 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"github.com/flothe/pinboard/clock"
+	"github.com/flothe/pinboard/config"
+	"github.com/flothe/pinboard/grafic2d"
+	"image"
+	"image/color/palette"
+	"image/draw"
+	"image/gif"
+	"image/png"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// an animated GIF gets at most this many frames, a playlist is cut
+const maxGIFFrames = 3000
+
+// renderHeadless renders frames of the pinboard configured by cfg with the
+// software renderer and a simulated clock running at fps frames per second.
+// If frames is 0 the whole playlist is rendered once. The frames are written as PNG files to the
+// directory out, or as an animated GIF if out ends with ".gif".
+func renderHeadless(cfg *config.Config, frames, fps, width, height int, out string) (err error) {
+	if fps <= 0 {
+		return fmt.Errorf("Invalid frame rate: %v", fps)
+	}
+	isGIF := strings.HasSuffix(strings.ToLower(out), ".gif")
+	if isGIF && frames > maxGIFFrames {
+		return fmt.Errorf("Too many frames for an animated GIF: %v, at most %v", frames, maxGIFFrames)
+	}
+	r := grafic2d.NewSoftwareRenderer(width, height)
+	gfx := grafic2d.NewGFXServer(r)
+	gfx.Init()
+	defer gfx.Finish()
+
+	// create the pinboard on a simulated clock and load the playlist from disk
+	clk := clock.NewFake(time.Now())
+	pb := NewPinboard(cfg, clk)
+	st, err := openStore(clk)
+	if err != nil {
+		return err
+	}
+	pb.LoadMessages(st)
+	pb.Begin(gfx)
+	defer pb.End()
+
+	// the frames of a GIF are written one by one, not kept in memory
+	var anim *gifWriter
+	if isGIF {
+		f, err := os.Create(out)
+		if err != nil {
+			return err
+		}
+		anim = newGIFWriter(f, width, height)
+		defer func() {
+			if cerr := anim.Close(); err == nil {
+				err = cerr
+			}
+			if cerr := f.Close(); err == nil {
+				err = cerr
+			}
+			if err == nil {
+				log.Printf("Saved %v frames to %v\n", anim.frames, out)
+			}
+		}()
+	} else if err := os.MkdirAll(out, 0755); err != nil {
+		return err
+	}
+
+	// a playlist is rendered at most for one hour
+	maxFrames := frames
+	if frames == 0 {
+		maxFrames = fps * 3600
+		if isGIF && maxFrames > maxGIFFrames {
+			maxFrames = maxGIFFrames
+		}
+		if len(pb.msgs) == 0 {
+			maxFrames = 1
+		}
+	}
+
+	frameDuration := time.Second / time.Duration(fps)
+	var t grafic2d.Timer
+	t.Clock = clk
+	t.Start()
+	for i := 0; i < maxFrames; i++ {
+		if frames == 0 && pb.playlistLoops > 0 {
+			break
+		}
+		clk.Advance(frameDuration)
+		pb.Update(t.TimeSinceLastCall())
+		pb.Draw()
+
+		img := r.Image()
+		if anim != nil {
+			p := image.NewPaletted(img.Bounds(), palette.Plan9)
+			draw.FloydSteinberg.Draw(p, img.Bounds(), img, image.Point{})
+			if err := anim.WriteFrame(p, int(frameDuration/(10*time.Millisecond))); err != nil {
+				return err
+			}
+		} else if err := savePNG(filepath.Join(out, fmt.Sprintf("frame-%05d.png", i)), img); err != nil {
+			return err
+		}
+		if i%fps == 0 {
+			log.Printf("Rendered frame %v (message %v of %v).\n", i, pb.msgIndex+1, len(pb.msgs))
+		}
+	}
+	if frames == 0 && isGIF && pb.playlistLoops == 0 && len(pb.msgs) > 0 {
+		log.Printf("The playlist is longer than %v frames, the GIF is cut\n", maxGIFFrames)
+	}
+	return nil
+}
+
+func savePNG(filename string, img image.Image) error {
+	f, err := os.Create(filename)
+	if err != nil {
+		return err
+	}
+	err = png.Encode(f, img)
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	return err
+}
+
+// gifWriter writes an animated GIF that loops forever frame by frame. The
+// frames are encoded by image/gif as GIFs of their own with a local palette,
+// their image blocks are copied.
+type gifWriter struct {
+	w      *bufio.Writer
+	err    error
+	frames int
+	buf    bytes.Buffer
+}
+
+// newGIFWriter writes the header of a GIF of the size to w
+func newGIFWriter(w io.Writer, width, height int) *gifWriter {
+	g := &gifWriter{w: bufio.NewWriter(w)}
+	// logical screen without global palette
+	g.w.WriteString("GIF89a")
+	g.w.Write([]byte{byte(width), byte(width >> 8), byte(height), byte(height >> 8), 0, 0, 0})
+	// loop forever
+	g.w.Write([]byte{0x21, 0xff, 0x0b})
+	g.w.WriteString("NETSCAPE2.0")
+	g.w.Write([]byte{0x03, 0x01, 0x00, 0x00, 0x00})
+	return g
+}
+
+// WriteFrame appends the image, shown for delay hundredths of a second
+func (g *gifWriter) WriteFrame(p *image.Paletted, delay int) error {
+	if g.err != nil {
+		return g.err
+	}
+	g.buf.Reset()
+	g.err = gif.EncodeAll(&g.buf, &gif.GIF{Image: []*image.Paletted{p}, Delay: []int{delay}})
+	if g.err != nil {
+		return g.err
+	}
+	// header and logical screen (13 bytes), the frame, the trailer
+	b := g.buf.Bytes()
+	if len(b) < 14 || string(b[:6]) != "GIF89a" || b[10]&0x80 != 0 || b[len(b)-1] != 0x3b {
+		g.err = errors.New("Unexpected output of the GIF encoder")
+		return g.err
+	}
+	_, g.err = g.w.Write(b[13 : len(b)-1])
+	g.frames++
+	return g.err
+}
+
+// Close writes the trailer, it does not close the underlying writer
+func (g *gifWriter) Close() error {
+	if g.err != nil {
+		return g.err
+	}
+	g.w.WriteByte(0x3b)
+	return g.w.Flush()
+}
@@ -1,7 +1,10 @@
 package main
 
 import (
+	"github.com/flothe/pinboard/config"
+	"github.com/flothe/pinboard/clock"
 	"github.com/flothe/pinboard/grafic2d"
+	"time"
 )
 
 type Intro struct {
@@ -11,14 +14,15 @@ type Intro struct {
 	waitForEndMillis int
 	timerMessageShown grafic2d.Timer
 	isReady bool
-	
+	// if set the GIF is taken from its cache
+	resources *grafic2d.ResourceManager
 }
 
-func NewIntroFromGif(filename string, waitForEndMillis int) *Intro {
+func NewIntroFromGif(filename string, waitForEndMillis int, clk clock.Clock) *Intro {
 	intro := Intro{}
+	intro.timerMessageShown.Clock = clk
 	intro.filename = filename
 	intro.waitForEndMillis = waitForEndMillis
-	intro.load()
 	intro.isReady = false
 	return &intro
 }
@@ -30,26 +34,57 @@ func (intro *Intro) IsReadyToEnd() bool {
 	return intro.sprite.IsAnimationEnded()
 }
 
+// IsShown is always true, the intro is shown together with its message.
+func (intro *Intro) IsShown(t time.Time) bool {
+	return true
+}
+
 func (intro *Intro) IsReady() bool {
 	return intro.isReady
 }
 
+// Files returns the GIF, it is loaded ahead
+func (intro *Intro) Files() []string {
+	return []string{intro.filename}
+}
+
+// load decodes the GIF on first use, with a resource manager it is loaded
+// for each Begin from the cache
 func (intro *Intro) load() error {
 	var err error
 	if intro.sprite == nil {
-		intro.sprite, err = grafic2d.NewSpriteFromGif(intro.filename)
+		if intro.resources != nil {
+			intro.sprite, err = intro.resources.Sprite(intro.filename)
+		} else {
+			intro.sprite, err = grafic2d.NewSpriteFromGif(intro.filename)
+		}
+		if err != nil {
+			return err
+		}
 		intro.sprite.AnimDuration = intro.sprite.AnimDuration + intro.waitForEndMillis				
 		intro.sprite.DoNotLoop = true
 	}
 	return err
 }
 
+// SetConfig changes how long the last frame is shown, if the intro has not begun yet
+func (intro *Intro) SetConfig(cfg *config.Config) {
+	if intro.isReady {
+		return
+	}
+	waitForEndMillis := cfg.Intro.WaitForEnd.Millis()
+	if intro.sprite != nil {
+		intro.sprite.AnimDuration = intro.sprite.AnimDuration - intro.waitForEndMillis + waitForEndMillis
+	}
+	intro.waitForEndMillis = waitForEndMillis
+}
+
 func (intro *Intro) Begin(gfx *grafic2d.GFXServer) error {
 	var err error
 	intro.isReady = true
 	intro.gfx = gfx
 	intro.timerMessageShown.Start()
-	intro.load()
+	err = intro.load()
 	if intro.sprite != nil {
 		intro.sprite.DoNotLoop = true
 		intro.sprite.CenterAndFitToScreen(gfx.DisplayWidth, gfx.DisplayHeight)
@@ -60,14 +95,22 @@ func (intro *Intro) Begin(gfx *grafic2d.GFXServer) error {
 
 func (intro *Intro) End() error {
 	intro.isReady = false
-	intro.sprite.Reset()
+	if intro.resources != nil && intro.sprite != nil {
+		intro.resources.Release(intro.filename)
+		intro.sprite = nil
+	} else if intro.sprite != nil {
+		intro.sprite.Reset()
+	}
 	intro.timerMessageShown.Reset()
 	return nil
 }
 
 
 func (intro *Intro) Destroy() error {
-	if intro.sprite != nil {
+	if intro.resources != nil && intro.sprite != nil {
+		intro.resources.Release(intro.filename)
+		intro.sprite = nil
+	} else if intro.sprite != nil {
 		intro.sprite.Destroy()		
 	}
 	intro.isReady = false
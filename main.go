@@ -1,45 +1,148 @@
 package main
 
 import (
+	"github.com/flothe/pinboard/clock"
+	"github.com/flothe/pinboard/config"
 	"github.com/flothe/pinboard/grafic2d"
-	"github.com/flothe/pinboard/web"
+	"github.com/flothe/pinboard/store"
 	"time"
 	"bufio"
+	"flag"
+	"fmt"
 	"os"
 	"log"
 	"math/rand"
+	"path/filepath"
+)
+
+var (
+	configFile      = flag.String("config", "", "config file of the pinboard, without one the defaults and ./data are used")
+	checkConfig     = flag.Bool("check-config", false, "validate the config file and quit")
+	renderFrames    = flag.Int("render-frames", -1, "render N frames without display and quit, 0 renders the whole playlist once")
+	renderFps       = flag.Int("fps", 25, "frames per second of the simulated clock used by -render-frames")
+	renderOut       = flag.String("out", "frames", "directory for the PNG frames of -render-frames, or a .gif file for an animated GIF")
+	renderWidth     = flag.Int("width", 1920, "display width used by -render-frames")
+	renderHeight    = flag.Int("height", 1080, "display height used by -render-frames")
+	shutdownTimeout = flag.Duration("shutdown-timeout", 10*time.Second, "how long to wait for the crawlers on SIGTERM, SIGINT or Enter")
 )
 
 func main() {
 	
+	flag.Parse()
 	log.SetFlags(log.Ldate|log.Ltime|log.Lshortfile)
-	os.Chdir("./data")
+
+	// the config is reloaded after the change of the directory
+	if *configFile != "" {
+		*configFile, _ = filepath.Abs(*configFile)
+	}
+	cfg, err := loadConfig()
+	if err != nil {
+		if *checkConfig {
+			fmt.Println(err)
+			os.Exit(1)
+		}
+		log.Fatalln(err)
+	}
+	if *checkConfig {
+		fmt.Println("Config is valid.")
+		return
+	}
+
+	// the output path is relative to the start directory
+	out, _ := filepath.Abs(*renderOut)
+	os.Chdir(cfg.DataDir)
+	grafic2d.SetFFmpeg(cfg.Motion.FFmpeg)
 	rand.Seed(time.Now().UTC().UnixNano())
+
+	// pinboard migrate converts the messages to the current format
+	if flag.Arg(0) == "migrate" {
+		if err := migrateMessages(cfg.DataDir); err != nil {
+			log.Fatalln("Migration failed:", err)
+		}
+		return
+	}
 	
+	if *renderFrames >= 0 {
+		err := renderHeadless(cfg, *renderFrames, *renderFps, *renderWidth, *renderHeight, out)
+		if err != nil {
+			log.Fatalln("Failed to render frames:", err)
+		}
+		return
+	}
 	
 	gfx := new(grafic2d.GFXServer)
 	width, height := gfx.Init() // OpenGL, etc initialization
-	defer gfx.Finish() // Graphics cleanup
+	gfx.SaveTerm()
 	log.Printf("Screen dimension = %vx%v\n", width, height)
 	//spritetest(gfx)
-	var url, user, pw string 
-	if len(os.Args) > 3 {
-		// os.Args[0] holds the programm name
-		url = os.Args[1]
-		user = os.Args[2]
-		pw = os.Args[3]
-	}
-	
-	showPinboard(gfx, url, user, pw)
 	
+	code := showPinboard(gfx, cfg)
+
+	// os.Exit skips deferred calls
+	gfx.Finish() // Graphics cleanup
+	gfx.RestoreTerm()
+	log.Printf("Pinboard has stopped with exit code %v\n", code)
+	os.Exit(code)
 }
 
+// loadConfig reads the config file, or uses the defaults if there is none,
+// and adds the POP3 account of the command line. The config is validated.
+func loadConfig() (*config.Config, error) {
+	cfg := config.Default()
+	if *configFile != "" {
+		var err error
+		cfg, err = config.Load(*configFile)
+		if err != nil {
+			return nil, err
+		}
+	}
+	cfg.DataDir, _ = filepath.Abs(cfg.DataDir)
+	// POP3 account given on the command line
+	if args := flag.Args(); len(args) > 2 {
+		cfg.Sources = append(cfg.Sources, config.Source{Type: "pop3", Name: "command line", URL: args[0], User: args[1], Password: args[2], Interval: config.Duration{Duration: time.Minute}})
+	}
+	if err := cfg.Validate(); err != nil {
+		return nil, err
+	}
+	return cfg, nil
+}
+
+// openStore opens the message store in the data directory. When it is
+// created, the .cmsg files of older versions are imported, later only by
+// the migrate command.
+func openStore(clk clock.Clock) (*store.Store, error) {
+	_, err := os.Stat(storeDir)
+	firstRun := os.IsNotExist(err)
+	st, err := store.Open(storeDir, clk)
+	if err != nil {
+		return nil, err
+	}
+	files, _ := filepath.Glob("*.cmsg")
+	if firstRun {
+		st.ImportFiles(files)
+	} else if len(files) > 0 {
+		log.Printf("%v .cmsg files are not in the store, import them with the migrate command\n", len(files))
+	}
+	return st, nil
+}
 
-func showPinboard(gfx *grafic2d.GFXServer, url, user, pw string) {
+// showPinboard runs the render loop until a key is pressed or a signal is
+// received and returns the exit code
+func showPinboard(gfx *grafic2d.GFXServer, cfg *config.Config) int {
 	// create the pinboard
-	pb := new(Pinboard)
+	pb := NewPinboard(cfg, clock.Real)
 	// load messages from disk
-	pb.LoadMessages()
+	st, err := openStore(clock.Real)
+	if err != nil {
+		log.Printf("Failed to open the message store: %v\n", err)
+		return exitStore
+	}
+	pb.LoadMessages(st)
+	// continue where the last run stopped
+	if err := pb.LoadState(stateFile); err != nil {
+		log.Printf("Failed to load the state: %v\n", err)
+	}
+	shutdown := notifyShutdown(gfx)
 	
 	
 	var t grafic2d.Timer
@@ -49,15 +152,22 @@ func showPinboard(gfx *grafic2d.GFXServer, url, user, pw string) {
 	keyPressed := make(chan bool)
 	go func() {
 		reader := bufio.NewReader(os.Stdin)
-		reader.ReadString('\n')
-		keyPressed <- true
+		// without a terminal, e.g. as a service, stdin is empty
+		if _, err := reader.ReadString('\n'); err == nil {
+			keyPressed <- true
+		}
 	}()
 
-	// Start the crawler
-	entries := make(chan web.MessageData)
-	quit := make(chan bool)
-	crawler := web.NewMailCrawler(url, user, pw)
-	go crawler.Crawl(entries, quit, time.Minute)
+	// Start the crawlers
+	sup := NewSupervisor(clock.Real)
+	sup.Update(cfg)
+	pb.SetSourceStatus(sup.Status)
+
+	// watch the config file for changes
+	configs := make(chan *config.Config)
+	if *configFile != "" {
+		go watchConfig(*configFile, configs)
+	}
 
 	// begin the pinboard
 	pb.Begin(gfx)
@@ -70,19 +180,42 @@ func showPinboard(gfx *grafic2d.GFXServer, url, user, pw string) {
 
 		select {
 		case _ = <-keyPressed:
-			// send quit message to the crawler
-			log.Println("Send quit message to crawler")
-			quit <- true			
-			// wait for the channel to be closed by the crawler
-			<-entries			
-			log.Println("Crawler has closed the channel, now we quit")
-			loop = false				
-		case e := <-entries:
-			log.Printf("New entry received: %v, %v, %v\n", e.SenderName, e.ShortText, e.ImageNames)
-			e.Save(e.CreateFilename())
-			pb.AddMessageData(&e)			
+			log.Println("Key pressed, shutting down")
+			// the current frame is finished first
+			loop = false
+		case <-shutdown:
+			loop = false
+		case newCfg := <-configs:
+			// the messages on disk are not reloaded
+			if newCfg.DataDir != cfg.DataDir {
+				log.Printf("Changing data_dir needs a restart, keeping %v\n", cfg.DataDir)
+				newCfg.DataDir = cfg.DataDir
+			}
+			cfg = newCfg
+			pb.SetConfig(cfg)
+			grafic2d.SetFFmpeg(cfg.Motion.FFmpeg)
+			sup.Update(cfg)
+			log.Println("Applied the new config")
 		default:
-			// no entry in the channel
+			// no key pressed
+		}
+
+		// collect the entries of all crawlers
+		for collect := loop; collect; {
+			select {
+			case e := <-sup.Entries():
+				log.Printf("New entry received from %v: %v, %v, %v\n", e.Source, e.SenderName, e.ShortText, e.ImageNames)
+				_, err := st.Put(&e)
+				if err != nil {
+					log.Printf("Failed to store the entry: %v\n", err)
+				}
+				// the mail crawlers mark the mail as crawled now
+				e.Stored(err)
+				pb.AddMessageData(&e)
+			default:
+				// no entry in the channel
+				collect = false
+			}
 		}
 
 
@@ -91,6 +224,5 @@ func showPinboard(gfx *grafic2d.GFXServer, url, user, pw string) {
 	}
 	
 	// end the pinboard
-	pb.End()
-	
+	return shutdownPinboard(pb, sup, st, *shutdownTimeout)
 }
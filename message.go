@@ -1,6 +1,8 @@
 package main
 
 import (
+	"github.com/flothe/pinboard/clock"
+	"github.com/flothe/pinboard/config"
 	"github.com/flothe/pinboard/grafic2d"
 	"log"
 	"time"
@@ -10,18 +12,30 @@ import (
 type Message struct {
 	photos   *grafic2d.PhotoSlider
 	text     *grafic2d.TextTicker
+	tickerText string
+	from     string
+	fnPhotos []string
+	cfg      *config.Config
 	timestamp time.Time
+	// display window, a zero time is no limit
+	showFrom, showUntil time.Time
 	time     int
 	gfx      *grafic2d.GFXServer
 	isReady bool
 	timerMessageShown grafic2d.Timer
+	// if set the photos are taken from its cache
+	resources *grafic2d.ResourceManager
 }
 
-func NewMessage(text, from string, timestamp time.Time, fnPhotos []string) *Message {
-	msg := Message{}
-	
-	msg.photos = grafic2d.NewPhotoSlider(fnPhotos, 10000, 9000)
-	msg.text = grafic2d.NewTextTicker(text, "NEWS", timestamp.Format("2. Jan 06 - 15:04"), from)
+// NewMessage returns a message with a photo slider and a news ticker. The
+// timings and the look are taken from cfg when the message begins, if cfg is
+// nil the defaults are used.
+func NewMessage(text, from string, timestamp time.Time, fnPhotos []string, cfg *config.Config, clk clock.Clock) *Message {
+	if cfg == nil {
+		cfg = config.Default()
+	}
+	msg := Message{tickerText: text, from: from, timestamp: timestamp, fnPhotos: fnPhotos, cfg: cfg}
+	msg.timerMessageShown.Clock = clk
 	return &msg
 }
 
@@ -33,6 +47,21 @@ func (msg *Message) IsReadyToEnd() bool {
 }
 
 
+// SetDisplayWindow limits when the message is shown, a zero time is no limit.
+func (msg *Message) SetDisplayWindow(from, until time.Time) {
+	msg.showFrom = from
+	msg.showUntil = until
+}
+
+func (msg *Message) IsShown(t time.Time) bool {
+	return (msg.showFrom.IsZero() || !t.Before(msg.showFrom)) && (msg.showUntil.IsZero() || t.Before(msg.showUntil))
+}
+
+// Files returns the photos and clips, they are loaded ahead
+func (msg *Message) Files() []string {
+	return msg.fnPhotos
+}
+
 func (msg *Message) IsReady() bool {
 	return msg.isReady
 }
@@ -42,9 +71,22 @@ func (msg *Message) GetMsgShowTime() int {
 }
 
 
+// SetConfig sets the config used by the next Begin. The ticker of a running
+// message takes over the new look at once.
+func (msg *Message) SetConfig(cfg *config.Config) {
+	msg.cfg = cfg
+	if msg.isReady && msg.text != nil {
+		msg.text.SetStyle(cfg.TickerStyle())
+	}
+}
+
 func (msg *Message) Begin(gfx *grafic2d.GFXServer) error {
 	var err error
 	msg.gfx = gfx
+	// create slider and ticker with the current config
+	msg.photos = grafic2d.NewPhotoSlider(msg.fnPhotos, msg.cfg.Slides.SlideTime.Millis(), msg.cfg.Slides.MinShowTime.Millis())
+	msg.photos.Resources = msg.resources
+	msg.text = grafic2d.NewStyledTextTicker(msg.tickerText, msg.cfg.Ticker.Prefix, msg.timestamp.Format(msg.cfg.Ticker.DateFormat), msg.from, msg.cfg.TickerStyle())
 	if msg.photos != nil {
 		err = msg.photos.Begin(gfx)			
 	}
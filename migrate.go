@@ -0,0 +1,39 @@
+package main
+
+import (
+	"fmt"
+	"github.com/flothe/pinboard/clock"
+	"github.com/flothe/pinboard/store"
+	"log"
+	"path/filepath"
+	"time"
+)
+
+// migrateMessages converts the gob message files in the data directory, the
+// .cmsg files of older versions and the files of the store, to the current
+// format. The originals are kept in a backup directory in the data directory.
+// Afterwards the .cmsg files are imported into the store. The pinboard must
+// not run meanwhile.
+func migrateMessages(dataDir string) error {
+	backup := filepath.Join(dataDir, "backup-gob-"+time.Now().Format("20060102-150405"))
+	cmsgs, _ := filepath.Glob(filepath.Join(dataDir, "*.cmsg"))
+	files := append(cmsgs, store.MessageFiles(filepath.Join(dataDir, storeDir))...)
+	n, err := store.Migrate(dataDir, backup, files)
+	if n > 0 {
+		log.Printf("Migrated %v of %v message files, the originals are in %v\n", n, len(files), backup)
+	} else {
+		log.Printf("No gob message files among %v files, nothing to migrate\n", len(files))
+	}
+	if err != nil || len(cmsgs) == 0 {
+		return err
+	}
+
+	st, err := store.Open(filepath.Join(dataDir, storeDir), clock.Real)
+	if err != nil {
+		return err
+	}
+	if n := st.ImportFiles(cmsgs); n < len(cmsgs) {
+		return fmt.Errorf("%v of %v .cmsg files could not be imported", len(cmsgs)-n, len(cmsgs))
+	}
+	return nil
+}
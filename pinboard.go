@@ -1,15 +1,21 @@
 package main
 
 import (
+	"github.com/flothe/pinboard/clock"
+	"github.com/flothe/pinboard/config"
 	"github.com/flothe/pinboard/grafic2d"
+	"github.com/flothe/pinboard/internal/atomicfile"
+	"github.com/flothe/pinboard/store"
 	"github.com/flothe/pinboard/web"
+	"fmt"
+	"encoding/json"
+	"io/ioutil"
 	"os"
-	"strings"
 	"log"
 	"strconv"
 	"bytes"
 	"math/rand"
-	"fmt"
+	"time"
 )
 
 type PinMessage interface {
@@ -28,57 +34,187 @@ type PinMessage interface {
 	GetMsgShowTime() int
 	// is called when the PinMessage is discarded to clean up
 	Destroy() error
+	// apply a changed config
+	SetConfig(cfg *config.Config)
+	// is the message shown at t, a message may have a display window
+	IsShown(t time.Time) bool
+	// the images of the message, they are loaded ahead
+	Files() []string
 }
 
 
 type Pinboard struct {
 	msgs []PinMessage
+	// key of each pair of intro and message, the id of the message
+	keys []string
 	msgIndex int
+	playlistLoops int // how often the whole playlist has been shown
 	gfx *grafic2d.GFXServer	
 	s *grafic2d.Sprite	
 	debugTimerFps grafic2d.Timer
+	cfg *config.Config
+	clock clock.Clock
+	// the events of all calendars, nil until the first event
+	agenda *Agenda
+	// health of the crawlers for the debug overlay, may be nil
+	sourceStatus func() []SourceStatus
+	// loads the images of the next messages ahead and caches them
+	resources *grafic2d.ResourceManager
+}
+
+// NewPinboard returns an empty pinboard configured by cfg, if nil the defaults
+// are used. All timing of the pinboard and its messages is measured with clk.
+func NewPinboard(cfg *config.Config, clk clock.Clock) *Pinboard {
+	if cfg == nil {
+		cfg = config.Default()
+	}
+	clk = clock.Or(clk)
+	pb := &Pinboard{cfg: cfg, clock: clk}
+	pb.debugTimerFps.Clock = clk
+	pb.resources = grafic2d.NewResourceManager(int64(cfg.Cache.SizeMB)<<20, cfg.Cache.UploadBudget.Duration)
+	return pb
 }
 
 func (pb *Pinboard) AddMessage(msg PinMessage) {
+	pb.addMessage(msg, "")
+}
+
+// addMessage adds the message with an intro, the key finds it again after a
+// restart
+func (pb *Pinboard) addMessage(msg PinMessage, key string) {
 	// add intro and message
-	filename := fmt.Sprintf("internal/m%v.gif", (rand.Int()%5)+1)
-	pb.msgs = append(pb.msgs, PinMessage(NewIntroFromGif(filename, 1000)), msg)
+	filename := pb.cfg.Intro.Gifs[rand.Intn(len(pb.cfg.Intro.Gifs))]
+	intro := NewIntroFromGif(filename, pb.cfg.Intro.WaitForEnd.Millis(), pb.clock)
+	intro.resources = pb.resources
+	pb.msgs = append(pb.msgs, PinMessage(intro), msg)
+	pb.keys = append(pb.keys, key)
 }
 
 func (pb *Pinboard) AddMessageData(data *web.MessageData) {
-	m := PinMessage(NewMessage(data.ShortText, data.SenderName, data.Timestamp, data.ImageNames))
-	pb.AddMessage(m)
-}
-
-func (pb *Pinboard) LoadMessages() error {
-	// open directory
-	 d, err := os.Open("." + string(os.PathSeparator))
-     if err != nil {
-		 log.Println("Failed to open base directory: ", err)
-		 return err
-     }
-     defer d.Close()
-	 // read all entries in the directory
-     fi, err := d.Readdir(-1)
-     if err != nil {
-		 log.Println("Failed to read content of base directory: ", err)
-		 return err
-     }
-	 // cylce over all directory entries and load the .cmsg files
-     for _, fi := range fi {
-         if fi.Mode().IsRegular() && strings.HasSuffix(fi.Name(), ".cmsg") {
-		 	data := new(web.MessageData)
-		 	err := data.Load(fi.Name())
-			if err != nil {
-				 log.Println("Failed to load message from file: ", fi)
-				 return err
-		     }
-			 log.Println("Loaded message from file: ", data)	
-		 	m := PinMessage(NewMessage(data.ShortText, data.SenderName, data.Timestamp, data.ImageNames))
-			pb.AddMessage(m)		 
-         }
-     }
-	 return nil
+	// the events are listed together in the agenda
+	if data.Type == web.EVENT {
+		if pb.agenda == nil {
+			pb.agenda = NewAgenda(pb.cfg, pb.clock)
+			pb.addMessage(pb.agenda, "agenda")
+		}
+		pb.agenda.SetEvent(data)
+		return
+	}
+	// the clips are shown after the images
+	media := append(append([]string(nil), data.ImageNames...), data.VideoNames...)
+	m := NewMessage(data.ShortText, data.SenderName, data.Timestamp, media, pb.cfg, pb.clock)
+	m.SetDisplayWindow(data.ShowFrom, data.ShowUntil)
+	m.resources = pb.resources
+	// a message crawled again replaces the old one at its place
+	for i, key := range pb.keys {
+		if data.ID != "" && key == data.ID {
+			pb.replaceMessage(2*i+1, PinMessage(m))
+			return
+		}
+	}
+	pb.addMessage(PinMessage(m), data.ID)
+}
+
+// replaceMessage puts msg at index i, the old message is ended if it is shown
+func (pb *Pinboard) replaceMessage(i int, msg PinMessage) {
+	if i == pb.msgIndex && pb.msgs[i].IsReady() {
+		pb.msgs[i].End()
+	}
+	pb.msgs[i] = msg
+}
+
+// pinboardState is the position in the playlist, it is saved on shutdown
+type pinboardState struct {
+	// key of the current message
+	Current       string    `json:"current"`
+	PlaylistLoops int       `json:"playlist_loops"`
+	Saved         time.Time `json:"saved"`
+}
+
+// SaveState writes the position in the playlist to the file atomically, so
+// the old state stays intact if writing fails.
+func (pb *Pinboard) SaveState(filename string) error {
+	state := pinboardState{PlaylistLoops: pb.playlistLoops, Saved: pb.clock.Now()}
+	if pb.msgIndex < len(pb.msgs) {
+		state.Current = pb.keys[pb.msgIndex/2]
+	}
+	buf, err := json.MarshalIndent(state, "", "  ")
+	if err != nil {
+		return err
+	}
+	err = atomicfile.WriteFile(filename, buf, 0600)
+	if err != nil {
+		log.Printf("Failed to save the state to %v: %v\n", filename, err)
+		return err
+	}
+	log.Printf("Saved the state to %v: message %v, %v loops\n", filename, state.Current, state.PlaylistLoops)
+	return nil
+}
+
+// LoadState continues the playlist at the position saved by SaveState, with
+// the intro of the message that was shown. The messages have to be loaded
+// before. If the file does not exist the playlist starts at the beginning.
+func (pb *Pinboard) LoadState(filename string) error {
+	buf, err := ioutil.ReadFile(filename)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	var state pinboardState
+	if err := json.Unmarshal(buf, &state); err != nil {
+		return fmt.Errorf("Invalid state in %v: %v", filename, err)
+	}
+	pb.playlistLoops = state.PlaylistLoops
+	for i, key := range pb.keys {
+		if key != "" && key == state.Current {
+			pb.msgIndex = 2 * i
+			log.Printf("Continuing with message %v\n", key)
+			return nil
+		}
+	}
+	log.Printf("Message %v of the saved state is gone, starting at the beginning\n", state.Current)
+	return nil
+}
+
+// LoadMessages adds the active messages of the store, oldest first. A message
+// that cannot be read is skipped, the store moves it to the quarantine.
+func (pb *Pinboard) LoadMessages(st *store.Store) error {
+	for _, e := range st.Query(store.Query{States: []store.State{store.Active}}) {
+		data, err := st.Load(e.ID)
+		if err != nil {
+			log.Printf("Failed to load message %v: %v\n", e.ID, err)
+			continue
+		}
+		log.Println("Loaded message: ", data)
+		// events that have ended are not shown anymore
+		if data.Type == web.EVENT && !data.IsShown(pb.clock.Now()) {
+			log.Println("Expired ended event: ", e.ID)
+			st.SetState(e.ID, store.Expired)
+			continue
+		}
+		pb.AddMessageData(data)
+	}
+	return nil
+}
+
+// SetConfig applies a changed config to the pinboard and all messages. The
+// look of the ticker changes at once, the timings apply to the messages that
+// have not begun yet.
+func (pb *Pinboard) SetConfig(cfg *config.Config) {
+	pb.cfg = cfg
+	pb.resources.MaxBytes = int64(cfg.Cache.SizeMB) << 20
+	pb.resources.UploadBudget = cfg.Cache.UploadBudget.Duration
+	for _, m := range pb.msgs {
+		m.SetConfig(cfg)
+	}
+}
+
+// SetSourceStatus sets the function that tells the health of the crawlers,
+// the debug overlay shows the sources that are not running or failed last
+func (pb *Pinboard) SetSourceStatus(f func() []SourceStatus) {
+	pb.sourceStatus = f
 }
 
 func (pb *Pinboard) Begin(gfx *grafic2d.GFXServer) error {
@@ -94,9 +230,14 @@ func (pb *Pinboard) Update(ms int) error {
 		return nil
 	}
 	
-	// if the current message is not ready: call begin
+	// if the current message is not ready: call begin. It may have left its
+	// display window while waiting.
 	if !pb.msgs[pb.msgIndex].IsReady() {
+		if !pb.isShown(pb.msgIndex) && !pb.advance() {
+			return nil
+		}
 		pb.msgs[pb.msgIndex].Begin(pb.gfx)
+		pb.preload()
 	}
 		
 	// if the current message is finished
@@ -105,18 +246,73 @@ func (pb *Pinboard) Update(ms int) error {
 		log.Printf("Presentation of message %v is finished.", pb.msgIndex)
 		pb.msgs[pb.msgIndex].End()
 		// get the next message and begin it
-		pb.msgIndex++
-		pb.msgIndex = pb.msgIndex % len(pb.msgs)
-		log.Printf("Switch to message %v.\n", pb.msgIndex)
+		if !pb.advance() {
+			return nil
+		}
 		pb.msgs[pb.msgIndex].Begin(pb.gfx)
+		pb.preload()
 	}
 	
 	// update the current message
 	pb.msgs[pb.msgIndex].Update(ms)
+
+	// create the images loaded ahead, a bit in each frame
+	pb.resources.Upload()
 	
 	return nil
 }
 
+// preload loads the images of the next two messages ahead, the intro and
+// the message that follow the current one
+func (pb *Pinboard) preload() {
+	var files []string
+	i := pb.msgIndex
+	for n := 0; n < 2; n++ {
+		if i = pb.nextShown(i); i < 0 || i == pb.msgIndex {
+			break
+		}
+		files = append(files, pb.msgs[i].Files()...)
+	}
+	pb.resources.Preload(files)
+}
+
+// isShown tells if the message at i is shown now. The messages are added as
+// pairs of intro and message, so an intro is shown if its message is.
+func (pb *Pinboard) isShown(i int) bool {
+	now := pb.clock.Now()
+	if i%2 == 0 && i+1 < len(pb.msgs) && !pb.msgs[i+1].IsShown(now) {
+		return false
+	}
+	return pb.msgs[i].IsShown(now)
+}
+
+// advance switches to the next message that is shown. If there is none, the
+// index stays and false is returned.
+func (pb *Pinboard) advance() bool {
+	i := pb.nextShown(pb.msgIndex)
+	if i < 0 {
+		return false
+	}
+	if i <= pb.msgIndex {
+		pb.playlistLoops++
+	}
+	pb.msgIndex = i
+	log.Printf("Switch to message %v.\n", pb.msgIndex)
+	return true
+}
+
+// nextShown returns the index of the next message after i that is shown, -1
+// if there is none
+func (pb *Pinboard) nextShown(i int) int {
+	for n := 1; n <= len(pb.msgs); n++ {
+		j := (i + n) % len(pb.msgs)
+		if pb.isShown(j) {
+			return j
+		}
+	}
+	return -1
+}
+
 func (pb *Pinboard) Draw() error {
 
 	var w, h int
@@ -124,12 +320,14 @@ func (pb *Pinboard) Draw() error {
 	pb.gfx.Background(0, 0, 0)
 
 
-	// paint the current message
-	if(pb.msgIndex<len(pb.msgs)) {
+	// paint the current message, if none is shown the screen stays black
+	if(pb.msgIndex<len(pb.msgs) && pb.msgs[pb.msgIndex].IsReady()) {
 		pb.msgs[pb.msgIndex].Draw()
 	}
 	
-	pb.drawDebugInfo()
+	if pb.cfg.Debug.Overlay {
+		pb.drawDebugInfo()
+	}
 	
 	pb.gfx.End()
 	
@@ -144,7 +342,7 @@ func (pb *Pinboard) drawDebugInfo() {
 	buffer.WriteString("fps=")
 	buffer.WriteString(strconv.Itoa(pb.debugTimerFps.CallsPerSec()))
 	pb.gfx.FillColor("white")       // White text
-	pb.gfx.Text(20, grafic2d.VGfloat(pb.gfx.DisplayHeight-30), buffer.String(), "serif", 20)
+	pb.gfx.Text(20, grafic2d.VGfloat(pb.gfx.DisplayHeight-30), buffer.String(), pb.cfg.Debug.Font, 20)
 	buffer.Reset()	
 
 	// draw message info
@@ -157,9 +355,28 @@ func (pb *Pinboard) drawDebugInfo() {
 		buffer.WriteString(strconv.Itoa(pb.msgs[pb.msgIndex].GetMsgShowTime()))
 		buffer.WriteString(" ms")	
 		pb.gfx.FillColor("white")       // White text
-		pb.gfx.Text(20, grafic2d.VGfloat(pb.gfx.DisplayHeight-60), buffer.String(), "serif", 20)
+		pb.gfx.Text(20, grafic2d.VGfloat(pb.gfx.DisplayHeight-60), buffer.String(), pb.cfg.Debug.Font, 20)
 		buffer.Reset()	
 	}
+
+	// draw the sources with problems
+	if pb.sourceStatus == nil {
+		return
+	}
+	y := pb.gfx.DisplayHeight - 90
+	for _, st := range pb.sourceStatus() {
+		if st.State == SourceRunning && !st.LastErrorTime.After(st.LastSuccess) {
+			continue
+		}
+		buffer.WriteString(fmt.Sprintf("%v (%v): %v, %v items, %v restarts", st.Name, st.Type, st.State, st.Items, st.Restarts))
+		if st.LastError != "" {
+			buffer.WriteString(fmt.Sprintf(", %v: %v", st.LastErrorTime.Format("15:04:05"), st.LastError))
+		}
+		pb.gfx.FillColor("red")
+		pb.gfx.Text(20, grafic2d.VGfloat(y), buffer.String(), pb.cfg.Debug.Font, 20)
+		buffer.Reset()
+		y -= 30
+	}
 }
 
 
@@ -168,6 +385,7 @@ func (pb *Pinboard) End() {
 	if(pb.msgIndex<len(pb.msgs)) {
 		pb.msgs[pb.msgIndex].Destroy()
 	}
-	
+	// stop loading ahead and free the cache
+	pb.resources.Close()
 }
 
@@ -0,0 +1,149 @@
+package main
+
+import (
+	"github.com/flothe/pinboard/clock"
+	"github.com/flothe/pinboard/config"
+	"github.com/flothe/pinboard/grafic2d"
+	"github.com/flothe/pinboard/web"
+	"reflect"
+	"testing"
+	"time"
+)
+
+// switchAt is a switch of the pinboard to the message at index
+type switchAt struct {
+	index int
+	at    time.Duration
+}
+
+// newTestPinboard returns a pinboard on the fake clock that begins with the
+// software renderer. The photos of a message are shown for 2s each, but at
+// least 3s in all.
+func newTestPinboard(t *testing.T, clk clock.Clock) *Pinboard {
+	cfg := config.Default()
+	cfg.Intro.Gifs = []string{"data/internal/m1.gif"}
+	cfg.Slides.SlideTime.Duration = 2 * time.Second
+	cfg.Slides.MinShowTime.Duration = 3 * time.Second
+	gfx := grafic2d.NewGFXServer(grafic2d.NewSoftwareRenderer(160, 120))
+	gfx.Init()
+	t.Cleanup(gfx.Finish)
+
+	pb := NewPinboard(cfg, clk)
+	pb.Begin(gfx)
+	t.Cleanup(pb.End)
+	return pb
+}
+
+// playPinboard runs the pinboard like the render loop at 25 frames per second
+// for d and returns the switches between the messages
+func playPinboard(pb *Pinboard, clk *clock.Fake, d time.Duration) []switchAt {
+	var switches []switchAt
+	var timer grafic2d.Timer
+	timer.Clock = clk
+	timer.Start()
+	last := -1
+	for at := 40 * time.Millisecond; at <= d; at += 40 * time.Millisecond {
+		clk.Advance(40 * time.Millisecond)
+		pb.Update(timer.TimeSinceLastCall())
+		pb.Draw()
+		if pb.msgIndex != last {
+			switches = append(switches, switchAt{pb.msgIndex, at})
+			last = pb.msgIndex
+		}
+	}
+	return switches
+}
+
+func TestPinboardRotation(t *testing.T) {
+	photos, err := saveGoldenPhotos(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	clk := clock.NewFake(time.Date(2014, time.May, 15, 12, 30, 0, 0, time.UTC))
+	pb := newTestPinboard(t, clk)
+	pb.AddMessageData(&web.MessageData{ID: "a", Type: web.EMAIL, ShortText: "Zwei Fotos", ImageNames: photos})
+	pb.AddMessageData(&web.MessageData{ID: "b", Type: web.EMAIL, ShortText: "Ein Foto", ImageNames: photos[:1]})
+
+	switches := playPinboard(pb, clk, time.Minute)
+	var order []int
+	for _, s := range switches[:8] {
+		order = append(order, s.index)
+	}
+	if want := []int{0, 1, 2, 3, 0, 1, 2, 3}; !reflect.DeepEqual(order, want) {
+		t.Fatalf("messages shown in the order %v, want %v", order, want)
+	}
+	if pb.playlistLoops == 0 {
+		t.Errorf("the playlist has not been shown completely")
+	}
+	// both photos for 2s, one photo for the minimum time
+	shown := map[int]time.Duration{1: 4 * time.Second, 3: 3 * time.Second}
+	for i, s := range switches[:len(switches)-1] {
+		if want, ok := shown[s.index]; ok {
+			if d := switches[i+1].at - s.at; d != want {
+				t.Errorf("message %v shown for %v, want %v", s.index, d, want)
+			}
+		}
+	}
+}
+
+func TestPinboardReplacesMessage(t *testing.T) {
+	photos, err := saveGoldenPhotos(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	clk := clock.NewFake(time.Date(2014, time.May, 15, 12, 30, 0, 0, time.UTC))
+	pb := newTestPinboard(t, clk)
+	pb.AddMessageData(&web.MessageData{ID: "a", Type: web.EMAIL, ShortText: "Alt", ImageNames: photos})
+	pb.AddMessageData(&web.MessageData{ID: "b", Type: web.EMAIL, ShortText: "Ein Foto", ImageNames: photos[:1]})
+	// play until the intro is over
+	for n := 0; pb.msgIndex != 1; n++ {
+		if n == 1000 {
+			t.Fatalf("message %v is shown, want the first one", pb.msgIndex)
+		}
+		playPinboard(pb, clk, 40*time.Millisecond)
+	}
+
+	// the message crawled again replaces the shown one, it begins anew
+	pb.AddMessageData(&web.MessageData{ID: "a", Type: web.EMAIL, ShortText: "Neu", ImageNames: photos[:1]})
+	if len(pb.msgs) != 4 || !reflect.DeepEqual(pb.keys, []string{"a", "b"}) {
+		t.Fatalf("%v messages with the keys %v, want 4 with a and b", len(pb.msgs), pb.keys)
+	}
+	if m := pb.msgs[1].(*Message); m.tickerText != "Neu" || m.IsReady() {
+		t.Errorf("message %q, ready %v, want the new one not begun", m.tickerText, m.IsReady())
+	}
+	playPinboard(pb, clk, time.Second)
+	if !pb.msgs[1].IsReady() {
+		t.Errorf("the new message has not begun")
+	}
+}
+
+func TestPinboardDisplayWindow(t *testing.T) {
+	photos, err := saveGoldenPhotos(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	start := time.Date(2014, time.May, 15, 12, 30, 0, 0, time.UTC)
+	clk := clock.NewFake(start)
+	pb := newTestPinboard(t, clk)
+	pb.AddMessageData(&web.MessageData{ID: "a", Type: web.EMAIL, ShortText: "Immer", ImageNames: photos[:1]})
+	pb.AddMessageData(&web.MessageData{ID: "b", Type: web.EMAIL, ShortText: "Nur kurz", ImageNames: photos[:1],
+		ShowUntil: start.Add(15 * time.Second)})
+	pb.AddMessageData(&web.MessageData{ID: "c", Type: web.EMAIL, ShortText: "Später", ImageNames: photos[:1],
+		ShowFrom: start.Add(30 * time.Second)})
+
+	seen := make(map[int]bool)
+	for _, s := range playPinboard(pb, clk, time.Minute) {
+		switch {
+		case s.index >= 2 && s.index <= 3 && s.at > 15*time.Second:
+			t.Errorf("message %v shown at %v after the end of its window", s.index, s.at)
+		case s.index >= 4 && s.at < 30*time.Second:
+			t.Errorf("message %v shown at %v before its window", s.index, s.at)
+		}
+		seen[s.index] = true
+	}
+	for i := 0; i < 6; i++ {
+		if !seen[i] {
+			t.Errorf("message %v has never been shown", i)
+		}
+	}
+}
@@ -0,0 +1,66 @@
+package main
+
+import (
+	"github.com/flothe/pinboard/config"
+	"github.com/fsnotify/fsnotify"
+	"log"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"syscall"
+	"time"
+)
+
+// editors write a file in several steps, so we wait for the last change
+const configSettleTime = 500 * time.Millisecond
+
+// watchConfig reloads the config file each time it changes or the process
+// receives SIGHUP and sends the new config to configs. An invalid config is
+// logged and not sent, so the board keeps running with the old one.
+func watchConfig(filename string, configs chan<- *config.Config) {
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+
+	// the directory is watched, because editors replace the file by renaming
+	var events <-chan fsnotify.Event
+	var errors <-chan error
+	watcher, err := fsnotify.NewWatcher()
+	if err == nil {
+		err = watcher.Add(filepath.Dir(filename))
+	}
+	if err != nil {
+		log.Printf("Failed to watch config file %v, reload with SIGHUP only: %v\n", filename, err)
+	} else {
+		defer watcher.Close()
+		events = watcher.Events
+		errors = watcher.Errors
+	}
+
+	var settled <-chan time.Time
+	for {
+		select {
+		case <-hup:
+			log.Println("Received SIGHUP, reloading config")
+			reloadConfig(configs)
+		case e := <-events:
+			if filepath.Clean(e.Name) == filename && e.Op&(fsnotify.Write|fsnotify.Create|fsnotify.Rename) != 0 {
+				settled = time.After(configSettleTime)
+			}
+		case err := <-errors:
+			log.Printf("Error while watching config file %v: %v\n", filename, err)
+		case <-settled:
+			settled = nil
+			log.Printf("Config file %v has changed, reloading config\n", filename)
+			reloadConfig(configs)
+		}
+	}
+}
+
+func reloadConfig(configs chan<- *config.Config) {
+	cfg, err := loadConfig()
+	if err != nil {
+		log.Printf("Rejected the new config, keeping the old one: %v\n", err)
+		return
+	}
+	configs <- cfg
+}
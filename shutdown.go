@@ -0,0 +1,90 @@
+package main
+
+import (
+	"github.com/flothe/pinboard/grafic2d"
+	"github.com/flothe/pinboard/store"
+	"log"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+)
+
+// exit codes of the pinboard, a second signal quits with 128 + the signal
+// number like a shell
+const (
+	exitOK = 0
+	// the crawlers did not stop within the shutdown timeout
+	exitTimeout = 3
+	// the position in the playlist could not be saved
+	exitStateLost = 4
+	// the message store could not be opened
+	exitStore = 5
+)
+
+// file of the position in the playlist and directory of the message store,
+// in the data directory
+const (
+	stateFile = ".pinboard.state"
+	storeDir  = "store"
+)
+
+// notifyShutdown returns a channel that receives SIGINT and SIGTERM. The
+// render loop shuts down gracefully on the first signal, a second signal
+// quits at once.
+func notifyShutdown(gfx *grafic2d.GFXServer) <-chan os.Signal {
+	signals := make(chan os.Signal, 2)
+	signal.Notify(signals, syscall.SIGINT, syscall.SIGTERM)
+	shutdown := make(chan os.Signal, 1)
+	go func() {
+		sig := <-signals
+		log.Printf("Received %v, shutting down\n", sig)
+		shutdown <- sig
+		sig = <-signals
+		log.Printf("Received %v while shutting down, quitting at once\n", sig)
+		gfx.RestoreTerm()
+		code := 1
+		if s, ok := sig.(syscall.Signal); ok {
+			code = 128 + int(s)
+		}
+		os.Exit(code)
+	}()
+	return shutdown
+}
+
+// shutdownPinboard stops the crawlers and waits for them at most timeout,
+// the entries they still send are put into the store. Then the position in the playlist
+// is saved and the pinboard ended. It returns the exit code.
+func shutdownPinboard(pb *Pinboard, sup *Supervisor, st *store.Store, timeout time.Duration) int {
+	code := exitOK
+	sup.Stop()
+	deadline := time.After(timeout)
+	for waiting := true; waiting; {
+		select {
+		case e, ok := <-sup.Entries():
+			if !ok {
+				log.Println("All crawlers have stopped")
+				waiting = false
+				continue
+			}
+			// the last entries are shown after the next start
+			log.Printf("New entry received from %v: %v, %v, %v\n", e.Source, e.SenderName, e.ShortText, e.ImageNames)
+			_, err := st.Put(&e)
+			if err != nil {
+				log.Printf("Failed to store the entry: %v\n", err)
+			}
+			// the mail crawlers mark the mail as crawled now
+			e.Stored(err)
+		case <-deadline:
+			log.Printf("Crawlers did not stop within %v, quitting anyway\n", timeout)
+			code = exitTimeout
+			waiting = false
+		}
+	}
+
+	if err := pb.SaveState(stateFile); err != nil && code == exitOK {
+		code = exitStateLost
+	}
+	pb.End()
+	return code
+}
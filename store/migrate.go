@@ -0,0 +1,76 @@
+package store
+
+import (
+	"fmt"
+	"github.com/flothe/pinboard/internal/atomicfile"
+	"github.com/flothe/pinboard/web"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+)
+
+// Migrate converts the message files written as gob by older versions to the
+// current version of the format, in place. The original files are copied to
+// backupDir first, under their path relative to baseDir. Files that are
+// already JSON are left alone. It returns the number of converted files, the
+// files that could not be converted stay as they are and are returned in the
+// error.
+func Migrate(baseDir, backupDir string, filenames []string) (int, error) {
+	n := 0
+	var failed []string
+	for _, fn := range filenames {
+		converted, err := migrateFile(baseDir, backupDir, fn)
+		if err != nil {
+			log.Printf("Failed to migrate %v: %v\n", fn, err)
+			failed = append(failed, fn)
+			continue
+		}
+		if converted {
+			log.Printf("Migrated %v\n", fn)
+			n++
+		}
+	}
+	if len(failed) > 0 {
+		return n, fmt.Errorf("%v files could not be migrated: %v", len(failed), failed)
+	}
+	return n, nil
+}
+
+func migrateFile(baseDir, backupDir, fn string) (bool, error) {
+	buf, err := ioutil.ReadFile(fn)
+	if err != nil {
+		return false, err
+	}
+	if !web.IsLegacyMessage(buf) {
+		return false, nil
+	}
+	data, err := web.DecodeMessage(buf)
+	if err != nil {
+		return false, err
+	}
+	out, err := data.Encode()
+	if err != nil {
+		return false, err
+	}
+
+	rel, err := filepath.Rel(baseDir, fn)
+	if err != nil {
+		return false, err
+	}
+	backup := filepath.Join(backupDir, rel)
+	if err := os.MkdirAll(filepath.Dir(backup), 0755); err != nil {
+		return false, err
+	}
+	if err := atomicfile.WriteFile(backup, buf, 0600); err != nil {
+		return false, err
+	}
+	return true, atomicfile.WriteFile(fn, out, 0600)
+}
+
+// MessageFiles returns the message files of the store in dir without opening
+// it
+func MessageFiles(dir string) []string {
+	files, _ := filepath.Glob(filepath.Join(dir, messagesDir, "*"+messageFileExt))
+	return files
+}
@@ -0,0 +1,431 @@
+// Package store keeps the messages of the pinboard on disk. Every message has
+// a stable id and is saved in its own file, an index holds the source, the
+// time it was received, its state and its images, so the messages can be
+// queried without reading them. Files are written atomically, a corrupt
+// message is moved to the quarantine and does not stop the others.
+package store
+
+import (
+	"crypto/sha1"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/flothe/pinboard/clock"
+	"github.com/flothe/pinboard/grafic2d"
+	"github.com/flothe/pinboard/internal/atomicfile"
+	"github.com/flothe/pinboard/web"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// State is the state of a message in the store
+type State string
+
+const (
+	// the message is in the playlist
+	Active State = "active"
+	// the message is not shown anymore, e.g. an event that has ended
+	Expired State = "expired"
+)
+
+// files and directories of the store
+const (
+	indexFile      = "index.json"
+	messagesDir    = "messages"
+	quarantineDir  = "quarantine"
+	messageFileExt = ".msg"
+)
+
+// ErrNotFound is returned for an id that is not in the store
+var ErrNotFound = errors.New("Message not found")
+
+// Entry is the index entry of a message
+type Entry struct {
+	ID     string              `json:"id"`
+	Source string              `json:"source,omitempty"`
+	Type   web.MessageDataType `json:"type"`
+	// when the message was put into the store
+	Received time.Time `json:"received"`
+	// time of the message, e.g. when the mail was sent
+	Timestamp time.Time `json:"timestamp"`
+	State     State     `json:"state"`
+	// image files and clips of the message
+	Images []string `json:"images,omitempty"`
+}
+
+// Query selects entries of the store. Fields that are not set do not
+// restrict the result.
+type Query struct {
+	States []State
+	Source string
+	// entries received in [From, Until)
+	From, Until time.Time
+}
+
+// Store is a directory of messages with their index. It may be used by
+// several goroutines.
+type Store struct {
+	dir   string
+	clock clock.Clock
+	mu    sync.Mutex
+	index map[string]*Entry
+}
+
+// Open opens the store in dir and creates it if needed. A missing or corrupt
+// index is rebuilt from the messages, messages that cannot be read are moved
+// to the quarantine. The time a message is received is taken from clk.
+func Open(dir string, clk clock.Clock) (*Store, error) {
+	clk = clock.Or(clk)
+	for _, d := range []string{dir, filepath.Join(dir, messagesDir), filepath.Join(dir, quarantineDir)} {
+		if err := os.MkdirAll(d, 0755); err != nil {
+			return nil, err
+		}
+	}
+	s := &Store{dir: dir, clock: clk, index: make(map[string]*Entry)}
+
+	buf, err := ioutil.ReadFile(filepath.Join(dir, indexFile))
+	if err == nil {
+		var entries []*Entry
+		err = json.Unmarshal(buf, &entries)
+		for _, e := range entries {
+			s.index[e.ID] = e
+		}
+	}
+	if err != nil && !os.IsNotExist(err) {
+		log.Printf("Failed to read the index of the store %v, rebuilding it: %v\n", dir, err)
+		s.index = make(map[string]*Entry)
+	}
+	if err := s.check(); err != nil {
+		return nil, err
+	}
+	log.Printf("Opened store %v with %v messages\n", dir, len(s.index))
+	return s, nil
+}
+
+// check makes the index match the message files. Entries without a file are
+// dropped, files without an entry, e.g. after a crash between writing the
+// message and the index, are added.
+func (s *Store) check() error {
+	infos, err := ioutil.ReadDir(filepath.Join(s.dir, messagesDir))
+	if err != nil {
+		return err
+	}
+	files := make(map[string]bool)
+	changed := false
+	for _, fi := range infos {
+		if !strings.HasSuffix(fi.Name(), messageFileExt) {
+			continue
+		}
+		id := strings.TrimSuffix(fi.Name(), messageFileExt)
+		files[id] = true
+		if s.index[id] != nil {
+			continue
+		}
+		data, err := s.read(id)
+		if isNewer(err) {
+			log.Printf("Skipping message %v: %v\n", id, err)
+			continue
+		}
+		if err != nil {
+			s.quarantine(id, err)
+			continue
+		}
+		log.Printf("Adding message %v to the index of the store\n", id)
+		s.index[id] = newEntry(id, data, fi.ModTime(), Active)
+		changed = true
+	}
+	for id := range s.index {
+		if !files[id] {
+			log.Printf("Removing message %v without file from the index of the store\n", id)
+			delete(s.index, id)
+			changed = true
+		}
+	}
+	if changed {
+		return s.saveIndex()
+	}
+	return nil
+}
+
+func newEntry(id string, data *web.MessageData, received time.Time, state State) *Entry {
+	return &Entry{
+		ID:        id,
+		Source:    data.Source,
+		Type:      data.Type,
+		Received:  received,
+		Timestamp: data.Timestamp,
+		State:     state,
+		Images:    append(append([]string(nil), data.ImageNames...), data.VideoNames...),
+	}
+}
+
+// StableID returns the id of a message without one. It is derived from the
+// message, so the same message crawled again gets the same id.
+func StableID(data *web.MessageData) string {
+	h := sha1.New()
+	fmt.Fprintf(h, "%v\x00%v\x00%v\x00%v\x00%v", data.Source, int(data.Type), data.Timestamp.UnixNano(), data.SenderName, data.ShortText)
+	return hex.EncodeToString(h.Sum(nil)[:8])
+}
+
+// Put saves the message as active. A message without ID gets a stable one,
+// a message with the ID of a stored one replaces it, its images that are not
+// used anymore are removed.
+func (s *Store) Put(data *web.MessageData) (*Entry, error) {
+	if data.ID == "" {
+		data.ID = StableID(data)
+	}
+	if !validID(data.ID) {
+		return nil, fmt.Errorf("Invalid message id %q", data.ID)
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	buf, err := data.Encode()
+	if err != nil {
+		return nil, err
+	}
+	// the message is written first, a crash before the index is written
+	// is repaired by check
+	if err := atomicfile.WriteFile(s.messageFile(data.ID), buf, 0600); err != nil {
+		return nil, err
+	}
+	old := s.index[data.ID]
+	e := newEntry(data.ID, data, s.clock.Now(), Active)
+	s.index[data.ID] = e
+	if err := s.saveIndex(); err != nil {
+		return nil, err
+	}
+	if old != nil {
+		s.removeImages(old.Images)
+	}
+	log.Printf("Stored message %v from %v: %v, %v\n", data.ID, data.Source, data.ShortText, data.ImageNames)
+	entry := *e
+	return &entry, nil
+}
+
+// Load reads the message. A message that cannot be decoded is moved to the
+// quarantine and removed from the index, one of a newer version of the
+// format stays untouched.
+func (s *Store) Load(id string) (*web.MessageData, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.index[id] == nil {
+		return nil, ErrNotFound
+	}
+	data, err := s.read(id)
+	if err != nil && !isNewer(err) {
+		s.quarantine(id, err)
+		delete(s.index, id)
+		s.saveIndex()
+	}
+	return data, err
+}
+
+// SetState changes the state of the message
+func (s *Store) SetState(id string, state State) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	e := s.index[id]
+	if e == nil {
+		return ErrNotFound
+	}
+	if e.State == state {
+		return nil
+	}
+	e.State = state
+	return s.saveIndex()
+}
+
+// Delete removes the message and its images
+func (s *Store) Delete(id string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	e := s.index[id]
+	if e == nil {
+		return ErrNotFound
+	}
+	delete(s.index, id)
+	if err := s.saveIndex(); err != nil {
+		return err
+	}
+	s.removeImages(e.Images)
+	if err := os.Remove(s.messageFile(id)); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	log.Printf("Deleted message %v\n", id)
+	return nil
+}
+
+// Query returns the entries that match q, oldest received first
+func (s *Store) Query(q Query) []Entry {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var entries []Entry
+	for _, e := range s.index {
+		if q.matches(e) {
+			entries = append(entries, *e)
+		}
+	}
+	sort.Slice(entries, func(i, j int) bool {
+		if !entries[i].Received.Equal(entries[j].Received) {
+			return entries[i].Received.Before(entries[j].Received)
+		}
+		return entries[i].ID < entries[j].ID
+	})
+	return entries
+}
+
+func (q *Query) matches(e *Entry) bool {
+	if len(q.States) > 0 {
+		found := false
+		for _, st := range q.States {
+			found = found || st == e.State
+		}
+		if !found {
+			return false
+		}
+	}
+	if q.Source != "" && q.Source != e.Source {
+		return false
+	}
+	if !q.From.IsZero() && e.Received.Before(q.From) {
+		return false
+	}
+	if !q.Until.IsZero() && !e.Received.Before(q.Until) {
+		return false
+	}
+	return true
+}
+
+// ImportedExt is appended to the name of an imported file
+const ImportedExt = ".imported"
+
+// ImportFiles puts the messages of the files into the store, e.g. the .cmsg
+// files of older versions. They are received at the time of the file. When a
+// message and the index are written, the file is renamed with ImportedExt,
+// otherwise it stays for the next import. Files that cannot be read are
+// moved to the quarantine.
+func (s *Store) ImportFiles(filenames []string) int {
+	n := 0
+	for _, fn := range filenames {
+		buf, err := ioutil.ReadFile(fn)
+		var data *web.MessageData
+		if err == nil {
+			data, err = web.DecodeMessage(buf)
+		}
+		if isNewer(err) {
+			log.Printf("Skipping message %v: %v\n", fn, err)
+			continue
+		}
+		if err != nil {
+			log.Printf("Failed to import message %v: %v\n", fn, err)
+			s.mu.Lock()
+			s.quarantineFile(fn, err)
+			s.mu.Unlock()
+			continue
+		}
+		fi, err := os.Stat(fn)
+		if err != nil {
+			continue
+		}
+		if _, err := s.Put(data); err != nil {
+			log.Printf("Failed to import message %v: %v\n", fn, err)
+			continue
+		}
+		s.mu.Lock()
+		s.index[data.ID].Received = fi.ModTime()
+		err = s.saveIndex()
+		s.mu.Unlock()
+		if err != nil {
+			log.Printf("Failed to import message %v: %v\n", fn, err)
+			continue
+		}
+		if err := os.Rename(fn, fn+ImportedExt); err != nil {
+			log.Printf("Failed to rename the imported message %v: %v\n", fn, err)
+		}
+		n++
+	}
+	if n > 0 {
+		log.Printf("Imported %v messages into the store\n", n)
+	}
+	return n
+}
+
+func (s *Store) messageFile(id string) string {
+	return filepath.Join(s.dir, messagesDir, id+messageFileExt)
+}
+
+func (s *Store) read(id string) (*web.MessageData, error) {
+	buf, err := ioutil.ReadFile(s.messageFile(id))
+	if err != nil {
+		return nil, err
+	}
+	return web.DecodeMessage(buf)
+}
+
+// saveIndex writes the index, sorted by id so it can be compared
+func (s *Store) saveIndex() error {
+	entries := make([]*Entry, 0, len(s.index))
+	for _, e := range s.index {
+		entries = append(entries, e)
+	}
+	sort.Slice(entries, func(i, j int) bool { return entries[i].ID < entries[j].ID })
+	buf, err := json.MarshalIndent(entries, "", "  ")
+	if err != nil {
+		return err
+	}
+	err = atomicfile.WriteFile(filepath.Join(s.dir, indexFile), buf, 0600)
+	if err != nil {
+		log.Printf("Failed to write the index of the store %v: %v\n", s.dir, err)
+	}
+	return err
+}
+
+// quarantine moves the file of a message that cannot be read out of the way
+func (s *Store) quarantine(id string, err error) {
+	s.quarantineFile(s.messageFile(id), err)
+}
+
+func (s *Store) quarantineFile(fn string, reason error) {
+	dst := filepath.Join(s.dir, quarantineDir, s.clock.Now().Format("20060102-150405-")+filepath.Base(fn))
+	log.Printf("Moving corrupt message %v to %v: %v\n", fn, dst, reason)
+	if err := os.Rename(fn, dst); err != nil {
+		log.Printf("Failed to move %v to the quarantine: %v\n", fn, err)
+	}
+}
+
+// removeImages deletes the images that no message of the index uses, with
+// their sources
+func (s *Store) removeImages(images []string) {
+	used := make(map[string]bool)
+	for _, e := range s.index {
+		for _, fn := range e.Images {
+			used[fn] = true
+		}
+	}
+	for _, fn := range images {
+		if !used[fn] {
+			os.Remove(fn)
+			os.Remove(grafic2d.SourceFile(fn))
+		}
+	}
+}
+
+// isNewer tells if err is a file of a newer version of the format, it is
+// not corrupt and left for the newer pinboard
+func isNewer(err error) bool {
+	_, ok := err.(*web.NewerFormatError)
+	return ok
+}
+
+// validID tells if the id can be used as file name
+func validID(id string) bool {
+	return id != "" && !strings.ContainsAny(id, `/\:`) && !strings.HasPrefix(id, ".")
+}
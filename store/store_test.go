@@ -0,0 +1,68 @@
+package store
+
+import (
+	"github.com/flothe/pinboard/web"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestImportFiles(t *testing.T) {
+	dir := t.TempDir()
+	received := time.Date(2016, 5, 1, 10, 0, 0, 0, time.UTC)
+	var files []string
+	for i, text := range []string{"Sommerfest", "Kantine geschlossen"} {
+		data := &web.MessageData{Type: web.EMAIL, SenderName: "hr", ShortText: text, Timestamp: received.Add(time.Duration(i) * time.Hour)}
+		buf, err := data.Encode()
+		if err != nil {
+			t.Fatal(err)
+		}
+		fn := filepath.Join(dir, text+".cmsg")
+		if err := ioutil.WriteFile(fn, buf, 0600); err != nil {
+			t.Fatal(err)
+		}
+		os.Chtimes(fn, received, received)
+		files = append(files, fn)
+	}
+	corrupt := filepath.Join(dir, "corrupt.cmsg")
+	if err := ioutil.WriteFile(corrupt, []byte("no message"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	s, err := Open(filepath.Join(dir, "store"), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n := s.ImportFiles(append(files, corrupt)); n != 2 {
+		t.Fatalf("imported %v files, want 2", n)
+	}
+	for _, fn := range files {
+		if _, err := os.Stat(fn + ImportedExt); err != nil {
+			t.Errorf("%v has not been renamed: %v", fn, err)
+		}
+	}
+	if _, err := os.Stat(corrupt); !os.IsNotExist(err) {
+		t.Errorf("corrupt file is still there: %v", err)
+	}
+	quarantined, _ := filepath.Glob(filepath.Join(dir, "store", quarantineDir, "*corrupt.cmsg"))
+	if len(quarantined) != 1 {
+		t.Errorf("quarantine contains %v", quarantined)
+	}
+
+	// the import survives reopening the store
+	s, err = Open(filepath.Join(dir, "store"), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	entries := s.Query(Query{})
+	if len(entries) != 2 {
+		t.Fatalf("store contains %v messages, want 2", len(entries))
+	}
+	for _, e := range entries {
+		if !e.Received.Equal(received) {
+			t.Errorf("message %v received at %v, want the time of the file %v", e.ID, e.Received, received)
+		}
+	}
+}
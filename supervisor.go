@@ -0,0 +1,260 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"github.com/flothe/pinboard/clock"
+	"github.com/flothe/pinboard/config"
+	"github.com/flothe/pinboard/grafic2d"
+	"github.com/flothe/pinboard/web"
+	"log"
+	"reflect"
+	"sync"
+	"time"
+)
+
+// a crawler that failed is started again after 5s, the waiting time doubles
+// with every failure in a row up to 10m
+const (
+	restartMin = 5 * time.Second
+	restartMax = 10 * time.Minute
+)
+
+// states of a source
+const (
+	SourceRunning    = "running"
+	SourceRestarting = "restarting"
+	SourceStopped    = "stopped"
+)
+
+// SourceStatus is the health of a source of the config
+type SourceStatus struct {
+	Name  string
+	Type  string
+	State string
+	// start of the running crawler
+	Started time.Time
+	// last successful crawling attempt or received entry
+	LastSuccess time.Time
+	// last failed attempt, crash or restart of the crawler
+	LastError     string
+	LastErrorTime time.Time
+	// entries received since the pinboard started
+	Items    int
+	Restarts int
+}
+
+// Supervisor runs the crawlers of the sources of the config and merges their
+// entries into one channel. A crawler that panics or fails is started again
+// with growing waiting times, the other crawlers keep running.
+type Supervisor struct {
+	clock clock.Clock
+	// creates the crawler of a source, replaced by tests
+	newCrawler func(s config.Source, limits web.ImageLimits) (web.Crawler, error)
+	fanIn      *web.FanIn
+	// the goroutines starting the crawlers
+	wg sync.WaitGroup
+	// guards the status of the sources
+	mu      sync.Mutex
+	sources []*supervised
+	stopped bool
+}
+
+// supervised is a source and the goroutine running its crawler
+type supervised struct {
+	source config.Source
+	limits web.ImageLimits
+	// stops the crawler
+	cancel context.CancelFunc
+	status SourceStatus
+}
+
+// NewSupervisor returns a supervisor without sources. The restarts wait on clk.
+func NewSupervisor(clk clock.Clock) *Supervisor {
+	clk = clock.Or(clk)
+	return &Supervisor{
+		clock:      clk,
+		newCrawler: newCrawler,
+		fanIn:      web.NewFanIn(),
+	}
+}
+
+// Entries returns the entries of all crawlers, their Source is the name of
+// the source. The channel is closed when the supervisor is stopped and all
+// crawlers are done.
+func (sup *Supervisor) Entries() <-chan web.MessageData {
+	return sup.fanIn.Entries()
+}
+
+// Update makes the crawlers match the sources of cfg. Crawlers whose source
+// is unchanged keep running, the others are stopped and the new ones started.
+// Stopping crawlers still deliver their entries until they are done.
+func (sup *Supervisor) Update(cfg *config.Config) {
+	limits := web.ImageLimits{
+		MaxWidth:  cfg.Images.MaxWidth,
+		MaxHeight: cfg.Images.MaxHeight,
+		Motion: grafic2d.MotionLimits{
+			MaxWidth:    cfg.Motion.MaxWidth,
+			MaxHeight:   cfg.Motion.MaxHeight,
+			FPS:         cfg.Motion.FPS,
+			MaxDuration: cfg.Motion.MaxDuration.Duration,
+		},
+		MaxDownload: int64(cfg.Images.MaxDownloadMB) << 20,
+	}
+
+	sup.mu.Lock()
+	defer sup.mu.Unlock()
+	if sup.stopped {
+		return
+	}
+	var running []*supervised
+	for _, sv := range sup.sources {
+		keep := false
+		if sv.limits == limits {
+			for _, s := range cfg.Sources {
+				keep = keep || reflect.DeepEqual(s, sv.source)
+			}
+		}
+		if keep {
+			running = append(running, sv)
+		} else {
+			log.Printf("Stopping crawler %v\n", sv.source.Name)
+			sv.cancel()
+		}
+	}
+
+	for _, s := range cfg.Sources {
+		found := false
+		for _, sv := range running {
+			found = found || reflect.DeepEqual(sv.source, s)
+		}
+		if found {
+			continue
+		}
+		ctx, cancel := context.WithCancel(context.Background())
+		sv := &supervised{
+			source: s,
+			limits: limits,
+			cancel: cancel,
+			status: SourceStatus{Name: s.Name, Type: s.Type},
+		}
+		running = append(running, sv)
+		sup.wg.Add(1)
+		go sup.run(ctx, sv)
+	}
+	sup.sources = running
+}
+
+// Stop stops all crawlers without waiting for them. The channel of the
+// entries is closed when they are done.
+func (sup *Supervisor) Stop() {
+	sup.mu.Lock()
+	defer sup.mu.Unlock()
+	if sup.stopped {
+		return
+	}
+	sup.stopped = true
+	for _, sv := range sup.sources {
+		log.Printf("Stopping crawler %v\n", sv.source.Name)
+		sv.cancel()
+	}
+	sup.sources = nil
+	go func() {
+		// no crawler is started anymore
+		sup.wg.Wait()
+		sup.fanIn.Close()
+	}()
+}
+
+// Status returns the health of the sources in the order of the config
+func (sup *Supervisor) Status() []SourceStatus {
+	sup.mu.Lock()
+	defer sup.mu.Unlock()
+	status := make([]SourceStatus, len(sup.sources))
+	for i, sv := range sup.sources {
+		status[i] = sv.status
+	}
+	return status
+}
+
+// run starts the crawler of the source again and again until ctx is done
+func (sup *Supervisor) run(ctx context.Context, sv *supervised) {
+	defer sup.wg.Done()
+	name := sv.source.Name
+	backoff := web.Backoff{Min: restartMin, Max: restartMax}
+	for {
+		started := sup.clock.Now()
+		sup.setStatus(sv, func(st *SourceStatus) {
+			st.State = SourceRunning
+			st.Started = started
+		})
+		log.Printf("Start crawler for source %v (%v)\n", name, sv.source.Type)
+
+		crawler, err := sup.newCrawler(sv.source, sv.limits)
+		if err == nil {
+			if r, ok := crawler.(web.AttemptReporter); ok {
+				r.ReportAttempts(func(err error) { sup.attempt(sv, err) })
+			}
+			result := make(chan error, 1)
+			sup.fanIn.Go(ctx, crawler, sv.source.Interval.Duration, func(e *web.MessageData) {
+				e.Source = name
+				now := sup.clock.Now()
+				sup.setStatus(sv, func(st *SourceStatus) {
+					st.Items++
+					st.LastSuccess = now
+				})
+			}, func(err error) { result <- err })
+			err = <-result
+			if err == nil && ctx.Err() == nil {
+				err = fmt.Errorf("Crawler stopped by itself")
+			}
+		}
+		if ctx.Err() != nil {
+			log.Printf("Crawler %v has stopped\n", name)
+			sup.setStatus(sv, func(st *SourceStatus) { st.State = SourceStopped })
+			return
+		}
+
+		// a crawler that ran for a while starts again soon, one that fails
+		// at once waits longer and longer
+		if sup.clock.Since(started) >= restartMax {
+			backoff.Reset()
+		}
+		wait := backoff.Next()
+		log.Printf("Crawler %v failed, starting it again in %v: %v\n", name, wait, err)
+		now := sup.clock.Now()
+		sup.setStatus(sv, func(st *SourceStatus) {
+			st.State = SourceRestarting
+			st.LastError = err.Error()
+			st.LastErrorTime = now
+			st.Restarts++
+		})
+
+		select {
+		case <-ctx.Done():
+			log.Printf("Crawler %v has stopped\n", name)
+			sup.setStatus(sv, func(st *SourceStatus) { st.State = SourceStopped })
+			return
+		case <-sup.clock.After(wait):
+		}
+	}
+}
+
+// attempt records the result of a crawling attempt
+func (sup *Supervisor) attempt(sv *supervised, err error) {
+	now := sup.clock.Now()
+	sup.setStatus(sv, func(st *SourceStatus) {
+		if err != nil {
+			st.LastError = err.Error()
+			st.LastErrorTime = now
+		} else {
+			st.LastSuccess = now
+		}
+	})
+}
+
+func (sup *Supervisor) setStatus(sv *supervised, f func(st *SourceStatus)) {
+	sup.mu.Lock()
+	defer sup.mu.Unlock()
+	f(&sv.status)
+}
@@ -0,0 +1,232 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"github.com/flothe/pinboard/clock"
+	"github.com/flothe/pinboard/config"
+	"github.com/flothe/pinboard/web"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeSources creates the fake crawlers of the sources and counts them
+type fakeSources struct {
+	mu      sync.Mutex
+	starts  map[string]int
+	running int
+}
+
+func (fs *fakeSources) newCrawler(s config.Source, limits web.ImageLimits) (web.Crawler, error) {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+	fs.starts[s.Name]++
+	return &fakeCrawler{sources: fs, source: s}, nil
+}
+
+func (fs *fakeSources) started(name string) int {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+	return fs.starts[name]
+}
+
+func (fs *fakeSources) runningCrawlers() int {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+	return fs.running
+}
+
+// fakeCrawler sends an entry with the name of its source. Then a crawler of
+// type "panic" panics, one of type "fail" fails and all others wait until
+// they are stopped.
+type fakeCrawler struct {
+	sources *fakeSources
+	source  config.Source
+}
+
+func (c *fakeCrawler) Crawl(ctx context.Context, entries chan<- web.MessageData, repeatDuration time.Duration) error {
+	c.sources.mu.Lock()
+	c.sources.running++
+	c.sources.mu.Unlock()
+	defer func() {
+		c.sources.mu.Lock()
+		c.sources.running--
+		c.sources.mu.Unlock()
+	}()
+
+	select {
+	case entries <- web.MessageData{ShortText: c.source.Name}:
+	case <-ctx.Done():
+		return nil
+	}
+	switch c.source.Type {
+	case "panic":
+		panic("boom")
+	case "fail":
+		return errors.New("no server")
+	}
+	<-ctx.Done()
+	return nil
+}
+
+// newTestSupervisor returns a supervisor of fake crawlers on a fake clock,
+// it is stopped with the test
+func newTestSupervisor(t *testing.T) (*Supervisor, *fakeSources, *clock.Fake) {
+	clk := clock.NewFake(time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC))
+	fs := &fakeSources{starts: make(map[string]int)}
+	sup := NewSupervisor(clk)
+	sup.newCrawler = fs.newCrawler
+	t.Cleanup(func() { stopSupervisor(t, sup, fs) })
+	return sup, fs, clk
+}
+
+// stopSupervisor stops the supervisor and reads the entries until they are
+// closed, then no crawler may run anymore
+func stopSupervisor(t *testing.T, sup *Supervisor, fs *fakeSources) int {
+	sup.Stop()
+	n := 0
+	timeout := time.After(5 * time.Second)
+	for {
+		select {
+		case _, ok := <-sup.Entries():
+			if !ok {
+				if r := fs.runningCrawlers(); r != 0 {
+					t.Errorf("%v crawlers still run after the entries are closed", r)
+				}
+				return n
+			}
+			n++
+		case <-timeout:
+			t.Fatal("the entries are not closed after Stop")
+		}
+	}
+}
+
+func sourcesConfig(sources ...config.Source) *config.Config {
+	cfg := config.Default()
+	for i := range sources {
+		sources[i].Interval.Duration = time.Minute
+	}
+	cfg.Sources = sources
+	return cfg
+}
+
+// recvSources receives n entries and returns how many came from each source
+func recvSources(t *testing.T, sup *Supervisor, n int) map[string]int {
+	got := make(map[string]int)
+	for i := 0; i < n; i++ {
+		select {
+		case e := <-sup.Entries():
+			if e.Source != e.ShortText {
+				t.Errorf("entry of %v has the source %q", e.ShortText, e.Source)
+			}
+			got[e.Source]++
+		case <-time.After(5 * time.Second):
+			t.Fatalf("received %v of %v entries", got, n)
+		}
+	}
+	return got
+}
+
+// waitUntil waits until cond is true, the crawlers run in the background
+func waitUntil(t *testing.T, what string, cond func() bool) {
+	deadline := time.Now().Add(5 * time.Second)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatalf("timeout waiting for %v", what)
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
+
+// restarting tells if the source at i waits for its n-th restart
+func restarting(sup *Supervisor, i, n int) bool {
+	st := sup.Status()
+	return st[i].State == SourceRestarting && st[i].Restarts == n
+}
+
+func TestSupervisorRestarts(t *testing.T) {
+	sup, fs, clk := newTestSupervisor(t)
+	sup.Update(sourcesConfig(
+		config.Source{Name: "ok", Type: "ok"},
+		config.Source{Name: "panic", Type: "panic"},
+		config.Source{Name: "fail", Type: "fail"}))
+
+	recvSources(t, sup, 3)
+	waitUntil(t, "the first failures", func() bool { return restarting(sup, 1, 1) && restarting(sup, 2, 1) })
+	st := sup.Status()
+	if st[0].State != SourceRunning || st[0].Items != 1 || st[0].Restarts != 0 {
+		t.Errorf("the good crawler is %v with %v items and %v restarts", st[0].State, st[0].Items, st[0].Restarts)
+	}
+	if st[1].LastError != "Crashed: boom" || st[2].LastError != "no server" {
+		t.Errorf("errors %q and %q", st[1].LastError, st[2].LastError)
+	}
+
+	// the waiting time doubles with every failure in a row, it is random
+	// between half and all of the step
+	for i, wait := range []time.Duration{restartMin, 2 * restartMin, 4 * restartMin} {
+		waitUntil(t, "the restarts to wait", func() bool { return clk.Waiters() == 2 })
+		clk.Advance(wait/2 - time.Millisecond)
+		if n := fs.started("panic") + fs.started("fail"); n != 2*(i+1) {
+			t.Fatalf("restarted before %v", wait/2)
+		}
+		clk.Advance(wait/2 + time.Millisecond)
+		if got := recvSources(t, sup, 2); got["panic"] != 1 || got["fail"] != 1 {
+			t.Errorf("the restarted crawlers sent %v", got)
+		}
+		waitUntil(t, "the next failures", func() bool { return restarting(sup, 1, i+2) && restarting(sup, 2, i+2) })
+	}
+	if n := fs.started("ok"); n != 1 {
+		t.Errorf("the good crawler has been started %v times", n)
+	}
+}
+
+func TestSupervisorUpdate(t *testing.T) {
+	sup, fs, _ := newTestSupervisor(t)
+	a, b := config.Source{Name: "a", Type: "ok"}, config.Source{Name: "b", Type: "ok"}
+	sup.Update(sourcesConfig(a, b))
+	recvSources(t, sup, 2)
+
+	// b is stopped, a keeps running and c is started
+	sup.Update(sourcesConfig(a, config.Source{Name: "c", Type: "ok"}))
+	if got := recvSources(t, sup, 1); got["c"] != 1 {
+		t.Errorf("got %v, want the entry of the new crawler", got)
+	}
+	waitUntil(t, "b to stop", func() bool { return fs.runningCrawlers() == 2 })
+	if st := sup.Status(); len(st) != 2 || st[0].Name != "a" || st[1].Name != "c" {
+		t.Errorf("status %v, want a and c", st)
+	}
+
+	// a changed source is started again
+	a.URL = "https://example.com"
+	sup.Update(sourcesConfig(a, config.Source{Name: "c", Type: "ok"}))
+	if got := recvSources(t, sup, 1); got["a"] != 1 {
+		t.Errorf("got %v, want the entry of the changed crawler", got)
+	}
+	if fs.started("a") != 2 || fs.started("b") != 1 || fs.started("c") != 1 {
+		t.Errorf("started %v", fs.starts)
+	}
+}
+
+func TestSupervisorStop(t *testing.T) {
+	sup, fs, _ := newTestSupervisor(t)
+	cfg := sourcesConfig(config.Source{Name: "a", Type: "ok"}, config.Source{Name: "b", Type: "fail"})
+	sup.Update(cfg)
+
+	// the entries are not read, so they are pending when it stops
+	waitUntil(t, "the crawlers to start", func() bool { return fs.started("a") == 1 && fs.started("b") == 1 })
+	if n := stopSupervisor(t, sup, fs); n > 2 {
+		t.Errorf("received %v entries after Stop, want at most 2", n)
+	}
+	if st := sup.Status(); len(st) != 0 {
+		t.Errorf("status %v after Stop", st)
+	}
+
+	// a stopped supervisor starts nothing
+	sup.Update(cfg)
+	sup.Stop()
+	if fs.started("a") != 1 || fs.started("b") != 1 {
+		t.Errorf("started %v", fs.starts)
+	}
+}
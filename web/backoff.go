@@ -0,0 +1,42 @@
+package web
+
+import (
+	"math/rand"
+	"time"
+)
+
+// Backoff returns the waiting times before retrying a failed operation. They
+// double with every failure up to Max and are randomized, so pinboards that
+// lost the server together do not all come back at the same moment.
+type Backoff struct {
+	// waiting time after the first failure and the upper limit
+	Min, Max time.Duration
+	failures uint
+}
+
+// Next returns the time to wait after another failure, a random time between
+// half and all of the current step
+func (b *Backoff) Next() time.Duration {
+	d := b.Min
+	for i := uint(0); i < b.failures && d < b.Max; i++ {
+		d *= 2
+	}
+	if d > b.Max {
+		d = b.Max
+	}
+	b.failures++
+	if d <= 1 {
+		return d
+	}
+	return d/2 + time.Duration(rand.Int63n(int64(d/2)+1))
+}
+
+// Failures returns the number of failures since the last success
+func (b *Backoff) Failures() int {
+	return int(b.failures)
+}
+
+// Reset starts again with Min after a success
+func (b *Backoff) Reset() {
+	b.failures = 0
+}
@@ -0,0 +1,618 @@
+package web
+
+import (
+	"context"
+	"crypto/sha1"
+	"crypto/tls"
+	"encoding/hex"
+	"fmt"
+	"github.com/emersion/go-ical"
+	"github.com/emersion/go-webdav"
+	"github.com/emersion/go-webdav/caldav"
+	"github.com/flothe/pinboard/clock"
+	"github.com/teambition/rrule-go"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"sort"
+	"strings"
+	"time"
+)
+
+// CalendarOptions select the events of the calendars that are shown
+type CalendarOptions struct {
+	// events of the next Days days are shown, 7 if 0
+	Days int
+	// HTTP basic auth, none if User is empty
+	User, Password string
+	// the URLs are CalDAV calendar collections, they are queried with REPORT
+	// for the events of the next days instead of downloading the whole file
+	CalDAV bool
+}
+
+type CalendarCrawler struct {
+	attempts
+	// TLS settings, if nil the system defaults are used
+	TLSConfig *tls.Config
+	calendars []*calendar
+	opts      CalendarOptions
+	clock     clock.Clock
+}
+
+// calendar is the state of a calendar between the crawls
+type calendar struct {
+	// URL or file name
+	url string
+	// file of the ids of the sent events, with the end of the event
+	sentFile string
+	sent     *SeenUIDs
+	// content of the sent events, so unchanged events are not sent again
+	sentContent map[string]string
+}
+
+// calendarEvent is an occurrence of an event
+type calendarEvent struct {
+	id                             string
+	summary, description, location string
+	start, end                     time.Time
+	allDay                         bool
+}
+
+// Windows names of the time zones used by Outlook and Exchange
+var windowsZones = map[string]string{
+	"UTC":                            "UTC",
+	"GMT Standard Time":              "Europe/London",
+	"W. Europe Standard Time":        "Europe/Berlin",
+	"Romance Standard Time":          "Europe/Paris",
+	"Central Europe Standard Time":   "Europe/Budapest",
+	"Central European Standard Time": "Europe/Warsaw",
+	"E. Europe Standard Time":        "Europe/Chisinau",
+	"FLE Standard Time":              "Europe/Kiev",
+	"GTB Standard Time":              "Europe/Bucharest",
+	"Russian Standard Time":          "Europe/Moscow",
+	"Eastern Standard Time":          "America/New_York",
+	"Central Standard Time":          "America/Chicago",
+	"Mountain Standard Time":         "America/Denver",
+	"Pacific Standard Time":          "America/Los_Angeles",
+	"India Standard Time":            "Asia/Kolkata",
+	"China Standard Time":            "Asia/Shanghai",
+	"Tokyo Standard Time":            "Asia/Tokyo",
+	"AUS Eastern Standard Time":      "Australia/Sydney",
+}
+
+// NewCalendarCrawler returns a crawler for the events of the iCalendar files
+// at urls, which are http(s) or webcal URLs or local files. Each event is
+// sent once as message of type EVENT, again if it changes and with ShowUntil
+// now if it is removed from the calendar. The ids of the sent events are
+// saved in the current directory, one file per calendar.
+func NewCalendarCrawler(urls []string, opts CalendarOptions, clk clock.Clock) *CalendarCrawler {
+	clk = clock.Or(clk)
+	if opts.Days <= 0 {
+		opts.Days = 7
+	}
+	// one file per calendar
+	r := strings.NewReplacer("http://", "", "https://", "", "webcal://", "", "webcals://", "", "/", "-", "\\", "-", ":", "-", "?", "-", "&", "-", "=", "-", "@", "-", " ", "")
+	crawler := &CalendarCrawler{
+		opts:  opts,
+		clock: clk,
+	}
+	for _, u := range urls {
+		crawler.calendars = append(crawler.calendars, &calendar{
+			url:         u,
+			sentFile:    ".calendar-" + strings.TrimLeft(r.Replace(u), "-") + ".sent",
+			sentContent: make(map[string]string),
+		})
+	}
+
+	return crawler
+}
+
+func (crawler *CalendarCrawler) Crawl(ctx context.Context, entries chan<- MessageData, repeatDuration time.Duration) error {
+
+	log.Printf("Start crawling %v calendars\n", len(crawler.calendars))
+
+	client := &http.Client{
+		Timeout:   time.Minute,
+		Transport: &http.Transport{Proxy: http.ProxyFromEnvironment, TLSClientConfig: crawler.TLSConfig},
+	}
+	for _, c := range crawler.calendars {
+		var err error
+		c.sent, err = LoadSeenUIDs(c.sentFile)
+		if err != nil {
+			log.Printf("Starting with an empty set of sent events of %v: %v\n", c.url, err)
+		}
+	}
+
+	// now we start crawling until ctx is done
+	for {
+		t0 := crawler.clock.Now()
+		log.Printf("Start new crawling attemp\n")
+		var failed error
+		for _, c := range crawler.calendars {
+			err := crawler.crawlCalendar(c, client, entries)
+			if err != nil {
+				log.Printf("Crawling calendar %v failed: %v\n", c.url, err)
+				failed = err
+			}
+		}
+		crawler.report(failed)
+
+		// wait some time
+		select {
+		case <-ctx.Done():
+			log.Printf("Stop crawling %v calendars\n", len(crawler.calendars))
+			return nil
+		case <-crawler.clock.After(repeatDuration - crawler.clock.Since(t0)):
+		}
+	}
+}
+
+// crawlCalendar sends the new and changed events of the next days and removes
+// the events that are no longer in the calendar
+func (crawler *CalendarCrawler) crawlCalendar(c *calendar, client *http.Client, entries chan<- MessageData) error {
+	now := crawler.clock.Now()
+	until := now.AddDate(0, 0, crawler.opts.Days)
+
+	var cals []*ical.Calendar
+	var err error
+	if crawler.opts.CalDAV {
+		cals, err = crawler.queryCalDAV(c.url, client, now, until)
+	} else {
+		var cal *ical.Calendar
+		cal, err = crawler.download(c.url, client)
+		cals = []*ical.Calendar{cal}
+	}
+	if err != nil {
+		return err
+	}
+
+	var events []calendarEvent
+	sender := ""
+	for _, cal := range cals {
+		events = append(events, expandEvents(cal, now, until)...)
+		if name, _ := cal.Props.Text("X-WR-CALNAME"); name != "" && sender == "" {
+			sender = name
+		}
+	}
+	if sender == "" {
+		sender = strings.TrimSuffix(path.Base(strings.TrimSuffix(c.url, "/")), ".ics")
+	}
+	sort.SliceStable(events, func(i, j int) bool { return events[i].start.Before(events[j].start) })
+	log.Printf("Number of events in calendar %v: %v\n", c.url, len(events))
+
+	ids := make([]string, len(events))
+	for i, e := range events {
+		ids[i] = e.id
+		content := fmt.Sprint(e.summary, e.description, e.location, e.start.Unix(), e.end.Unix(), e.allDay, sender)
+		if c.sentContent[e.id] == content {
+			continue
+		}
+		entry := e.messageData(sender)
+		log.Printf("Created entry from event: %v, %v, %v\n", entry.ShortText, entry.EventStart, entry.EventEnd)
+		// send message using the channel
+		entries <- *entry
+		c.sentContent[e.id] = content
+		c.sent.Add(e.id, e.end)
+		c.sent.Save()
+	}
+
+	// events that are gone before their end have been removed or moved out
+	// of the shown days
+	exists := make(map[string]bool, len(ids))
+	for _, id := range ids {
+		exists[id] = true
+	}
+	for _, id := range c.sent.UIDs() {
+		end, _ := c.sent.Crawled(id)
+		if exists[id] || !end.After(now) {
+			continue
+		}
+		log.Printf("Event %v has been removed from calendar %v\n", id, c.url)
+		entries <- MessageData{ID: id, Type: EVENT, Timestamp: now, SenderName: sender, ShowUntil: now}
+		delete(c.sentContent, id)
+	}
+	if n := c.sent.Retain(ids); n > 0 {
+		c.sent.Save()
+	}
+	return nil
+}
+
+// download reads the calendar from the URL or the file
+func (crawler *CalendarCrawler) download(u string, client *http.Client) (*ical.Calendar, error) {
+	var r io.Reader
+	switch {
+	case strings.HasPrefix(u, "http://"), strings.HasPrefix(u, "https://"), strings.HasPrefix(u, "webcal://"), strings.HasPrefix(u, "webcals://"):
+		// webcal is HTTP, webcals HTTPS
+		u = strings.Replace(strings.Replace(u, "webcals://", "https://", 1), "webcal://", "http://", 1)
+		req, err := http.NewRequest("GET", u, nil)
+		if err != nil {
+			return nil, err
+		}
+		if crawler.opts.User != "" {
+			req.SetBasicAuth(crawler.opts.User, crawler.opts.Password)
+		}
+		resp, err := client.Do(req)
+		if err != nil {
+			return nil, err
+		}
+		defer resp.Body.Close()
+		if resp.StatusCode != http.StatusOK {
+			return nil, fmt.Errorf("Get %v: %v", u, resp.Status)
+		}
+		r = resp.Body
+	default:
+		f, err := os.Open(u)
+		if err != nil {
+			return nil, err
+		}
+		defer f.Close()
+		r = f
+	}
+	cal, err := ical.NewDecoder(r).Decode()
+	if err != nil {
+		return nil, fmt.Errorf("Failed to parse calendar: %v", err)
+	}
+	return cal, nil
+}
+
+// queryCalDAV returns the calendar objects of the collection with events
+// between from and until. Recurring events are expanded by the crawler.
+func (crawler *CalendarCrawler) queryCalDAV(u string, client *http.Client, from, until time.Time) ([]*ical.Calendar, error) {
+	var hc webdav.HTTPClient = client
+	if crawler.opts.User != "" {
+		hc = webdav.HTTPClientWithBasicAuth(client, crawler.opts.User, crawler.opts.Password)
+	}
+	cl, err := caldav.NewClient(hc, u)
+	if err != nil {
+		return nil, err
+	}
+	pu, err := url.Parse(u)
+	if err != nil {
+		return nil, err
+	}
+	query := &caldav.CalendarQuery{
+		CompRequest: caldav.CalendarCompRequest{Name: ical.CompCalendar, AllProps: true, AllComps: true},
+		CompFilter: caldav.CompFilter{
+			Name:  ical.CompCalendar,
+			Comps: []caldav.CompFilter{{Name: ical.CompEvent, Start: from, End: until}},
+		},
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+	defer cancel()
+	objs, err := cl.QueryCalendar(ctx, pu.Path, query)
+	if err != nil {
+		return nil, err
+	}
+	cals := make([]*ical.Calendar, 0, len(objs))
+	for _, o := range objs {
+		if o.Data != nil {
+			cals = append(cals, o.Data)
+		}
+	}
+	return cals, nil
+}
+
+// expandEvents returns the occurrences of the events of the calendar that
+// have not ended at from and begin before until. Events that cannot be read
+// are logged and left out.
+func expandEvents(cal *ical.Calendar, from, until time.Time) []calendarEvent {
+	zones := newCalendarZones(cal)
+
+	// moved or cancelled occurrences of recurring events, by UID and the
+	// original start
+	overridden := make(map[string]map[int64]bool)
+	for _, ev := range cal.Events() {
+		if p := ev.Props.Get(ical.PropRecurrenceID); p != nil {
+			t, _, err := zones.propTime(p)
+			if err != nil {
+				continue
+			}
+			uid, _ := ev.Props.Text(ical.PropUID)
+			if overridden[uid] == nil {
+				overridden[uid] = make(map[int64]bool)
+			}
+			overridden[uid][t.Unix()] = true
+		}
+	}
+
+	var events []calendarEvent
+	for _, ev := range cal.Events() {
+		e, err := readEvent(ev, zones)
+		if err != nil {
+			log.Printf("Skip event %q: %v\n", e.summary, err)
+			continue
+		}
+		if status, _ := ev.Status(); status == ical.EventCancelled {
+			continue
+		}
+		uid, _ := ev.Props.Text(ical.PropUID)
+		if uid == "" {
+			uid = e.summary + " " + e.start.String()
+		}
+		shown := func(e calendarEvent) bool {
+			return e.end.After(from) && e.start.Before(until)
+		}
+
+		if p := ev.Props.Get(ical.PropRecurrenceID); p != nil {
+			// a moved occurrence keeps the id of the original one
+			t, _, err := zones.propTime(p)
+			if err == nil && shown(e) {
+				e.id = eventID(uid, t)
+				events = append(events, e)
+			}
+			continue
+		}
+		set, err := recurrenceSet(ev, e.start, zones)
+		if err != nil {
+			log.Printf("Skip event %q, the recurrence is invalid: %v\n", e.summary, err)
+			continue
+		}
+		if set == nil {
+			if shown(e) {
+				e.id = eventID(uid, time.Time{})
+				events = append(events, e)
+			}
+			continue
+		}
+
+		// occurrences that started before from may still last
+		days := int(e.end.Sub(e.start).Hours()/24 + 0.5)
+		duration := e.end.Sub(e.start)
+		for _, t := range set.Between(from.Add(-duration).AddDate(0, 0, -1), until, true) {
+			if overridden[uid][t.Unix()] {
+				continue
+			}
+			o := e
+			o.start = t
+			o.end = t.Add(duration)
+			if e.allDay {
+				// days may have 23 or 25 hours
+				o.end = t.AddDate(0, 0, days)
+			}
+			if shown(o) {
+				o.id = eventID(uid, t)
+				events = append(events, o)
+			}
+		}
+	}
+	return events
+}
+
+// readEvent reads the texts and the first occurrence of the event
+func readEvent(ev ical.Event, zones *calendarZones) (calendarEvent, error) {
+	var e calendarEvent
+	e.summary, _ = ev.Props.Text(ical.PropSummary)
+	e.description, _ = ev.Props.Text(ical.PropDescription)
+	e.location, _ = ev.Props.Text(ical.PropLocation)
+
+	p := ev.Props.Get(ical.PropDateTimeStart)
+	if p == nil {
+		return e, fmt.Errorf("DTSTART is missing")
+	}
+	var err error
+	e.start, e.allDay, err = zones.propTime(p)
+	if err != nil {
+		return e, err
+	}
+	switch {
+	case ev.Props.Get(ical.PropDateTimeEnd) != nil:
+		e.end, _, err = zones.propTime(ev.Props.Get(ical.PropDateTimeEnd))
+	case ev.Props.Get(ical.PropDuration) != nil:
+		var d time.Duration
+		d, err = ev.Props.Get(ical.PropDuration).Duration()
+		e.end = e.start.Add(d)
+	case e.allDay:
+		e.end = e.start.AddDate(0, 0, 1)
+	default:
+		e.end = e.start
+	}
+	if err != nil {
+		return e, err
+	}
+	if e.end.Before(e.start) {
+		return e, fmt.Errorf("it ends before it starts")
+	}
+	return e, nil
+}
+
+// recurrenceSet returns the occurrences of a recurring event, nil if it does
+// not recur
+func recurrenceSet(ev ical.Event, start time.Time, zones *calendarZones) (*rrule.Set, error) {
+	rp := ev.Props.Get(ical.PropRecurrenceRule)
+	rdates := ev.Props.Values(ical.PropRecurrenceDates)
+	if rp == nil && len(rdates) == 0 {
+		return nil, nil
+	}
+	set := &rrule.Set{}
+	if rp != nil {
+		// UNTIL without time zone is in the zone of the start
+		opt, err := rrule.StrToROptionInLocation(rp.Value, start.Location())
+		if err != nil {
+			return nil, err
+		}
+		opt.Dtstart = start
+		r, err := rrule.NewRRule(*opt)
+		if err != nil {
+			return nil, err
+		}
+		set.RRule(r)
+	} else {
+		set.RDate(start)
+	}
+	set.DTStart(start)
+	// the values are lists
+	for i := range rdates {
+		for _, t := range zones.propTimes(&rdates[i]) {
+			set.RDate(t)
+		}
+	}
+	exdates := ev.Props.Values(ical.PropExceptionDates)
+	for i := range exdates {
+		for _, t := range zones.propTimes(&exdates[i]) {
+			set.ExDate(t)
+		}
+	}
+	return set, nil
+}
+
+// eventID returns the id of the occurrence of the event at start, zero for
+// events that do not recur. The UID may contain any character, the id is
+// used in file names.
+func eventID(uid string, start time.Time) string {
+	s := uid
+	if !start.IsZero() {
+		s += "/" + start.UTC().Format("20060102T150405Z")
+	}
+	h := sha1.Sum([]byte(s))
+	return "event-" + hex.EncodeToString(h[:8])
+}
+
+func (e calendarEvent) messageData(sender string) *MessageData {
+	data := new(MessageData)
+	data.ID = e.id
+	data.Type = EVENT
+	data.Timestamp = e.start
+	data.SenderName = sender
+	data.ShortText = e.summary
+	data.LongText = e.description
+	if data.LongText == "" {
+		data.LongText = e.summary
+	}
+	data.EventStart = e.start
+	data.EventEnd = e.end
+	data.AllDay = e.allDay
+	data.Location = e.location
+	// it drops off the board when it has ended
+	data.ShowUntil = e.end
+	return data
+}
+
+// calendarZones resolves the time zones of the TZID parameters of a calendar
+type calendarZones struct {
+	timezones map[string]*ical.Component
+	locations map[string]*time.Location
+}
+
+func newCalendarZones(cal *ical.Calendar) *calendarZones {
+	z := &calendarZones{timezones: make(map[string]*ical.Component), locations: make(map[string]*time.Location)}
+	for _, c := range cal.Children {
+		if c.Name == ical.CompTimezone {
+			if id, _ := c.Props.Text(ical.PropTimezoneID); id != "" {
+				z.timezones[id] = c
+			}
+		}
+	}
+	return z
+}
+
+// location returns the time zone of the TZID. Besides the IANA names the
+// Windows names of Outlook and the X-LIC-LOCATION of the VTIMEZONE are known.
+// Otherwise the standard offset of the VTIMEZONE is used without daylight
+// saving time, or the local time zone.
+func (z *calendarZones) location(tzid string) *time.Location {
+	if loc, ok := z.locations[tzid]; ok {
+		return loc
+	}
+	names := []string{tzid, windowsZones[tzid]}
+	// e.g. /mozilla.org/20050126_1/Europe/Berlin
+	if parts := strings.Split(strings.Trim(tzid, "/"), "/"); len(parts) > 2 {
+		names = append(names, strings.Join(parts[len(parts)-2:], "/"))
+	}
+	var loc *time.Location
+	tz := z.timezones[tzid]
+	if tz != nil {
+		if l, _ := tz.Props.Text("X-LIC-LOCATION"); l != "" {
+			names = append(names, l)
+		}
+	}
+	for _, n := range names {
+		if n == "" {
+			continue
+		}
+		if l, err := time.LoadLocation(n); err == nil {
+			loc = l
+			break
+		}
+	}
+	if loc == nil && tz != nil {
+		for _, c := range tz.Children {
+			if c.Name != ical.CompTimezoneStandard {
+				continue
+			}
+			if p := c.Props.Get(ical.PropTimezoneOffsetTo); p != nil {
+				if offset, ok := parseUTCOffset(p.Value); ok {
+					log.Printf("Unknown time zone %q, using its standard offset %v\n", tzid, p.Value)
+					loc = time.FixedZone(tzid, offset)
+				}
+			}
+		}
+	}
+	if loc == nil {
+		log.Printf("Unknown time zone %q, using the local time\n", tzid)
+		loc = time.Local
+	}
+	z.locations[tzid] = loc
+	return loc
+}
+
+// propTime returns the date or date-time of the property and if it is a date.
+// Dates and floating times are local.
+func (z *calendarZones) propTime(p *ical.Prop) (time.Time, bool, error) {
+	v := p.Value
+	switch {
+	case p.ValueType() == ical.ValueDate || len(v) == len("20060102"):
+		t, err := time.ParseInLocation("20060102", v, time.Local)
+		return t, true, err
+	case strings.HasSuffix(v, "Z"):
+		t, err := time.Parse("20060102T150405Z", v)
+		return t, false, err
+	}
+	loc := time.Local
+	if tzid := p.Params.Get(ical.PropTimezoneID); tzid != "" {
+		loc = z.location(tzid)
+	}
+	t, err := time.ParseInLocation("20060102T150405", v, loc)
+	return t, false, err
+}
+
+// propTimes returns the times of a property with a list of values, like
+// EXDATE. Invalid values are left out.
+func (z *calendarZones) propTimes(p *ical.Prop) []time.Time {
+	var ts []time.Time
+	for _, v := range strings.Split(p.Value, ",") {
+		single := *p
+		single.Value = strings.TrimSpace(v)
+		t, _, err := z.propTime(&single)
+		if err != nil {
+			log.Printf("Invalid date %q in %v: %v\n", v, p.Name, err)
+			continue
+		}
+		ts = append(ts, t)
+	}
+	return ts
+}
+
+// parseUTCOffset parses an offset like +0100 or -053000 into seconds
+func parseUTCOffset(s string) (int, bool) {
+	if len(s) != 5 && len(s) != 7 || (s[0] != '+' && s[0] != '-') {
+		return 0, false
+	}
+	n := 0
+	for i, unit := range []int{3600, 60, 1} {
+		if 1+2*i+2 > len(s) {
+			break
+		}
+		var d int
+		if _, err := fmt.Sscanf(s[1+2*i:3+2*i], "%02d", &d); err != nil {
+			return 0, false
+		}
+		n += d * unit
+	}
+	if s[0] == '-' {
+		n = -n
+	}
+	return n, true
+}
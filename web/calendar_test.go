@@ -0,0 +1,189 @@
+package web
+
+import (
+	"fmt"
+	"github.com/emersion/go-ical"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+)
+
+// setLocal sets the local time zone for the test, dates and floating times
+// of the calendars are local
+func setLocal(t *testing.T, name string) {
+	loc, err := time.LoadLocation(name)
+	if err != nil {
+		t.Skipf("time zone %v is not installed: %v", name, err)
+	}
+	old := time.Local
+	time.Local = loc
+	t.Cleanup(func() { time.Local = old })
+}
+
+func loadCalendar(t *testing.T, name string) *ical.Calendar {
+	f, err := os.Open(filepath.Join("testdata", name))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	cal, err := ical.NewDecoder(f).Decode()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return cal
+}
+
+func TestExpandEvents(t *testing.T) {
+	setLocal(t, "Europe/Berlin")
+	berlin := time.Local
+	utc := func(s string) time.Time {
+		tm, err := time.Parse("2006-01-02 15:04", s)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return tm
+	}
+	day := func(s string) time.Time {
+		tm, err := time.ParseInLocation("2006-01-02", s, berlin)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return tm
+	}
+	type occurrence struct {
+		uid, summary string
+		start, end   time.Time
+		allDay       bool
+		// start of the occurrence in the recurrence, zero if the event does
+		// not recur
+		recurrence time.Time
+	}
+	for _, c := range []struct {
+		file        string
+		from, until time.Time
+		want        []occurrence
+	}{
+		{
+			// RRULE with EXDATE, a moved occurrence and the change to summer
+			// time on 29 March, a cancelled event is left out
+			"recurring.ics", utc("2020-03-01 00:00"), utc("2020-04-10 00:00"),
+			[]occurrence{
+				{"jourfixe@example.com", "Jour fixe", utc("2020-03-02 08:00"), utc("2020-03-02 08:30"), false, utc("2020-03-02 08:00")},
+				{"jourfixe@example.com", "Jour fixe (verschoben)", utc("2020-03-16 13:00"), utc("2020-03-16 13:30"), false, utc("2020-03-16 08:00")},
+				{"jourfixe@example.com", "Jour fixe", utc("2020-03-23 08:00"), utc("2020-03-23 08:30"), false, utc("2020-03-23 08:00")},
+				{"jourfixe@example.com", "Jour fixe", utc("2020-03-30 07:00"), utc("2020-03-30 07:30"), false, utc("2020-03-30 07:00")},
+				{"jourfixe@example.com", "Jour fixe", utc("2020-04-06 07:00"), utc("2020-04-06 07:30"), false, utc("2020-04-06 07:00")},
+			},
+		},
+		{
+			// an occurrence that started before from is shown while it lasts
+			"recurring.ics", utc("2020-03-23 08:15"), utc("2020-03-24 00:00"),
+			[]occurrence{
+				{"jourfixe@example.com", "Jour fixe", utc("2020-03-23 08:00"), utc("2020-03-23 08:30"), false, utc("2020-03-23 08:00")},
+			},
+		},
+		{
+			// the Windows name, the Mozilla TZID and a VTIMEZONE without a
+			// known name
+			"zones.ics", utc("2020-03-01 00:00"), utc("2020-04-01 00:00"),
+			[]occurrence{
+				{"mozilla@example.com", "Call New York", utc("2020-03-02 15:00"), utc("2020-03-02 16:00"), false, time.Time{}},
+				{"mumbai@example.com", "Call Mumbai", utc("2020-03-03 04:00"), utc("2020-03-03 05:00"), false, time.Time{}},
+				{"outlook@example.com", "Quartalszahlen", utc("2020-03-30 08:00"), utc("2020-03-30 09:00"), false, time.Time{}},
+			},
+		},
+		{
+			// days across the change to summer time, 29 March has 23 hours
+			"allday.ics", utc("2020-03-27 00:00"), utc("2020-04-05 00:00"),
+			[]occurrence{
+				{"messe@example.com", "Messe", day("2020-03-28"), day("2020-03-31"), true, time.Time{}},
+				{"notdienst@example.com", "Notdienst", day("2020-03-28"), day("2020-03-29"), true, day("2020-03-28")},
+				{"notdienst@example.com", "Notdienst", day("2020-03-29"), day("2020-03-30"), true, day("2020-03-29")},
+				{"notdienst@example.com", "Notdienst", day("2020-03-30"), day("2020-03-31"), true, day("2020-03-30")},
+			},
+		},
+	} {
+		name := fmt.Sprintf("%v %v - %v", c.file, c.from.Format("02.01. 15:04"), c.until.Format("02.01. 15:04"))
+		got := expandEvents(loadCalendar(t, c.file), c.from, c.until)
+		sort.SliceStable(got, func(i, j int) bool { return got[i].start.Before(got[j].start) })
+		if len(got) != len(c.want) {
+			var s []string
+			for _, e := range got {
+				s = append(s, fmt.Sprintf("%q %v", e.summary, e.start))
+			}
+			t.Errorf("%v: got %v events, want %v: %v", name, len(got), len(c.want), strings.Join(s, ", "))
+			continue
+		}
+		for i, w := range c.want {
+			e := got[i]
+			if e.summary != w.summary || !e.start.Equal(w.start) || !e.end.Equal(w.end) || e.allDay != w.allDay {
+				t.Errorf("%v: got %q %v - %v all day %v, want %q %v - %v all day %v", name,
+					e.summary, e.start, e.end, e.allDay, w.summary, w.start, w.end, w.allDay)
+			}
+			if id := eventID(w.uid, w.recurrence); e.id != id {
+				t.Errorf("%v: %q at %v has id %v, want %v", name, e.summary, e.start, e.id, id)
+			}
+		}
+	}
+}
+
+// calendarEntry is a VEVENT of a test calendar
+func calendarEntry(uid, summary string, start, end time.Time) string {
+	return fmt.Sprintf("BEGIN:VEVENT\r\nUID:%v\r\nDTSTAMP:20200101T000000Z\r\nSUMMARY:%v\r\nDTSTART:%v\r\nDTEND:%v\r\nEND:VEVENT\r\n",
+		uid, summary, start.UTC().Format("20060102T150405Z"), end.UTC().Format("20060102T150405Z"))
+}
+
+func writeCalendar(t *testing.T, fn string, events ...string) {
+	ics := "BEGIN:VCALENDAR\r\nVERSION:2.0\r\nPRODID:-//pinboard//test//DE\r\nX-WR-CALNAME:Betrieb\r\n" + strings.Join(events, "") + "END:VCALENDAR\r\n"
+	if err := ioutil.WriteFile(fn, []byte(ics), 0644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestCalendarCrawler(t *testing.T) {
+	fn := filepath.Join(chdirTemp(t), "betrieb.ics")
+	now := newFakeClock().Now()
+	runde := calendarEntry("runde", "Teamrunde", now.Add(34*time.Hour), now.Add(35*time.Hour))
+	ausflug := calendarEntry("ausflug", "Betriebsausflug", now.Add(60*time.Hour), now.Add(68*time.Hour))
+	kurz := calendarEntry("kurz", "Kurz", now.Add(10*time.Minute), now.Add(30*time.Minute))
+	writeCalendar(t, fn, runde, ausflug, kurz)
+	clk := newFakeClock()
+	cr := startCrawl(t, NewCalendarCrawler([]string{fn}, CalendarOptions{}, clk), clk)
+
+	// by start
+	ids := make(map[string]string)
+	for _, want := range []string{"Kurz", "Teamrunde", "Betriebsausflug"} {
+		e := cr.recv(t)
+		if e.Type != EVENT || e.ShortText != want || e.SenderName != "Betrieb" || !e.ShowUntil.Equal(e.EventEnd) {
+			t.Errorf("got %v %q from %q until %v, want %q", e.Type, e.ShortText, e.SenderName, e.ShowUntil, want)
+		}
+		ids[e.ShortText] = e.ID
+	}
+	cr.idle(t)
+
+	// unchanged events are not sent again
+	cr.next(t, time.Hour)
+	cr.idle(t)
+
+	// the moved event is sent again with its id, the removed one is taken
+	// off the board, the ended one is not
+	writeCalendar(t, fn, calendarEntry("runde", "Teamrunde", now.Add(36*time.Hour), now.Add(37*time.Hour)))
+	cr.clk.Advance(time.Minute)
+	e := cr.recv(t)
+	if e.ID != ids["Teamrunde"] || !e.EventStart.Equal(now.Add(36*time.Hour)) {
+		t.Errorf("got %q %v at %v, want the moved Teamrunde %v", e.ShortText, e.ID, e.EventStart, ids["Teamrunde"])
+	}
+	e = cr.recv(t)
+	if e.ID != ids["Betriebsausflug"] || !e.ShowUntil.Equal(cr.clk.Now()) {
+		t.Errorf("got %v until %v, want the removed Betriebsausflug %v until now", e.ID, e.ShowUntil, ids["Betriebsausflug"])
+	}
+	cr.idle(t)
+
+	// a removed event is only taken off once
+	cr.next(t, time.Minute)
+	cr.idle(t)
+}
@@ -1,13 +1,14 @@
 package web
 
 import (
-	"bytes"
-	"encoding/gob"
+	"context"
+	"crypto/tls"
 	"github.com/flothe/pinboard/grafic2d"
 	"fmt"
+	"github.com/flothe/pinboard/clock"
 	"github.com/jhillyerd/go.enmime"
-	"io/ioutil"
 	"log"
+	"net"
 	"net/mail"
 	"os"
 	"strings"
@@ -20,14 +21,29 @@ const (
 	UNDEF MessageDataType = iota
 	TWEET
 	EMAIL
+	FEED
+	TOOT
+	WEBHOOK
+	FILE
+	EVENT
 )
 
+// Crawler sends the crawled messages to entries every repeatDuration until
+// ctx is done, then it returns nil. An error is returned if the crawler
+// cannot go on. The channel belongs to the caller and may be shared with
+// other crawlers, so it is never closed by the crawler and nothing is sent
+// after Crawl has returned.
 type Crawler interface {
-	Crawl(chan<- MessageData, <-chan bool, time.Duration)
+	Crawl(ctx context.Context, entries chan<- MessageData, repeatDuration time.Duration) error
 }
 
 type MessageData struct {
+	// unique id, set by crawlers that report it, e.g. the webhook, otherwise
+	// by the store
+	ID         string
 	Type       MessageDataType
+	// name of the source in the config, set by the supervisor
+	Source     string
 	Timestamp  time.Time
 	SenderName string
 	ShortText  string
@@ -35,81 +51,111 @@ type MessageData struct {
 	ImageNames []string
 	VideoNames []string
 	AudioNames []string
+	// display window, a zero time is no limit
+	ShowFrom  time.Time
+	ShowUntil time.Time
+	// start and end of a calendar event, the end is not included
+	EventStart time.Time
+	EventEnd   time.Time
+	// the event lasts whole days, EventEnd is the start of the day after it
+	AllDay   bool
+	Location string
+	// receives the result of storing the message, see Stored
+	stored chan<- error
 }
 
-type MailCrawler struct {
-	client          Client
-	url, user, pass string
+// IsShown tells if t is in the display window of the message
+func (e *MessageData) IsShown(t time.Time) bool {
+	return (e.ShowFrom.IsZero() || !t.Before(e.ShowFrom)) && (e.ShowUntil.IsZero() || t.Before(e.ShowUntil))
 }
 
-func (e *MessageData) Save(filename string) error {
-
-	m := new(bytes.Buffer)
-	enc := gob.NewEncoder(m)
-
-	err := enc.Encode(e)
-	if err != nil {
-		log.Printf("Failed to create gob encoder for CrawlEntry: %v, %v, %v, %v\n", e.ShortText, e.Timestamp, e.SenderName, e.ImageNames)
-		log.Println(err)
-		return err
-	}
-
-	err = ioutil.WriteFile(filename, m.Bytes(), 0600)
-	if err != nil {
-		log.Printf("Failed to write CrawlEntry to %s: %v, %v, %v, %v\n", filename, e.ShortText, e.Timestamp, e.SenderName, e.ImageNames)
-		log.Println(err)
-		return err
+// Stored tells the crawler of the message if it has been stored. The mail
+// crawlers mark a mail as crawled only after it has been stored, so the
+// receiver of the entries has to call it. For the other crawlers it does
+// nothing.
+func (e *MessageData) Stored(err error) {
+	if e.stored != nil {
+		e.stored <- err
+		e.stored = nil
 	}
-	log.Printf("Saved CrawlEntry to %s: %v, %v, %v, %v\n", filename, e.ShortText, e.Timestamp, e.SenderName, e.ImageNames)
-	return nil
 }
 
-func (e *MessageData) Load(filename string) error {
-	n, err := ioutil.ReadFile(filename)
-	if err != nil {
-		log.Printf("Failed to read file %s: %v, %v, %v, %v\n", filename, e.ShortText, e.Timestamp, e.SenderName, e.ImageNames)
-		log.Println(err)
-		return err
+// sendStored sends the entry and waits until it has been stored, see Stored.
+// sent is false if ctx is done before the entry has been sent. If ctx is done
+// while waiting, ctx.Err() is returned, the entry may have been stored or not.
+func sendStored(ctx context.Context, entries chan<- MessageData, e *MessageData) (sent bool, err error) {
+	stored := make(chan error, 1)
+	e.stored = stored
+	select {
+	case entries <- *e:
+	case <-ctx.Done():
+		return false, ctx.Err()
+	}
+	select {
+	case err = <-stored:
+		return true, err
+	case <-ctx.Done():
+		return true, ctx.Err()
 	}
+}
 
-	p := bytes.NewBuffer(n)
-	dec := gob.NewDecoder(p)
+// ImageLimits is the maximum size of the images saved by the crawlers,
+// larger images are scaled down. Animated GIFs and videos are saved as clips
+// within Motion. Downloads of more than MaxDownload bytes fail, if 0 the
+// default applies.
+type ImageLimits struct {
+	MaxWidth, MaxHeight uint
+	Motion              grafic2d.MotionLimits
+	MaxDownload         int64
+}
 
-	err = dec.Decode(e)
-	if err != nil {
-		log.Printf("Failed to create gob decoder for CrawlEntry %s: %v, %v, %v, %v\n", filename, e.ShortText, e.Timestamp, e.SenderName, e.ImageNames)
-		log.Println(err)
-		return err
-	}
-	log.Printf("Loaded CrawlEntry from %s: %v, %v, %v, %v\n", filename, e.ShortText, e.Timestamp, e.SenderName, e.ImageNames)
-	return nil
+// DefaultImageLimits fits the images to a full HD display
+var DefaultImageLimits = ImageLimits{MaxWidth: 1920, MaxHeight: 1080, Motion: grafic2d.DefaultMotionLimits, MaxDownload: 32 << 20}
+
+// MailOptions are the connection settings of a POP3 mailbox
+type MailOptions struct {
+	// "tls" (default) for TLS from the start, "starttls" for the upgrade with
+	// STLS or "none" for a plain connection, only meant for local servers
+	Security string
+	// login mechanism, see Client.Login
+	Auth string
+	// TLS settings, if nil the system defaults are used
+	TLSConfig *tls.Config
+	// deadline of each command, DefaultTimeout if 0
+	Timeout time.Duration
+	// crawled messages are deleted after this time, never if 0
+	DeleteAfter time.Duration
 }
 
-func (e *MessageData) CreateFilename() string {
-	t := fmt.Sprintf("%d%02d%02d-%02d%02d%02d",
-		e.Timestamp.Year(),
-		e.Timestamp.Month(),
-		e.Timestamp.Day(),
-		e.Timestamp.Hour(),
-		e.Timestamp.Minute(),
-		e.Timestamp.Second())
-	fn := fmt.Sprintf("Pin-%s-%s", t, e.SenderName)
-	r := strings.NewReplacer(" ", "-", "@", "-", "<", "", ">", "", ".", "-", "--", "-")
-	fn = r.Replace(fn) + ".cmsg"
-
-	return fn
+// a rejected login is not tried again too often, servers lock the account
+const authRetryDuration = time.Hour
+
+// a message that cannot be processed is tried this many times, afterwards it
+// is skipped like a crawled one
+const maxMailAttempts = 3
+
+type MailCrawler struct {
+	attempts
+	url, user, pass string
+	opts            MailOptions
+	// file of the unique ids of the crawled messages
+	seenFile string
+	// failed attempts per unique id of the messages that cannot be processed
+	failures map[string]int
+	limits   ImageLimits
+	clock    clock.Clock
 }
 
 // saves the attachment if it is a image, audio or video.
 // Returns the filename, a type indicator ("image", "audio" or "video")
 // if the attachment is not saved nil is returned as  filename and type indicator
-func (data *MessageData) saveMultimediaAttachment(part enmime.MIMEPart) error {
+func (data *MessageData) saveMultimediaAttachment(part enmime.MIMEPart, limits ImageLimits) error {
 
 	t := part.ContentType()
 
 	log.Printf("Start saving of a %v attachment.", t)
 
-	if t == "image/jpeg" || t == "image/png" {
+	if isMediaType(t) {
 
 		var buf []byte
 		buf = part.Content()
@@ -121,14 +167,16 @@ func (data *MessageData) saveMultimediaAttachment(part enmime.MIMEPart) error {
 			fn = fn[:n]
 		}
 
-		fn = createUniqueFilename(fn, "rgba")
-		err := grafic2d.SaveScaledVGImage(buf, 1920, 1080, fn) 
+		_, err := data.saveMedia(buf, fn, t, limits)
 		if err != nil {
-			log.Printf("Failed to save attachment %v as %v: %v", t, fn, err)
+			log.Printf("Failed to save attachment %v %v: %v", t, fn, err)
+			if isVideoType(t) {
+				// without ffmpeg or with a broken clip the rest of the mail
+				// is shown anyway
+				return nil
+			}
 			return err
 		}
-		
-		data.ImageNames = append(data.ImageNames, fn)
 
 		return nil
 	}
@@ -137,145 +185,211 @@ func (data *MessageData) saveMultimediaAttachment(part enmime.MIMEPart) error {
 	return nil
 }
 
-func NewMailCrawler(url, username, password string) Crawler {
+// NewMailCrawler returns a crawler for the POP3 mailbox at url. The crawled
+// messages stay on the server, their unique ids are saved in the current
+// directory. If opts.DeleteAfter is greater than 0, messages are deleted
+// that long after they have been crawled. Images are scaled to fit into
+// limits.
+func NewMailCrawler(url, username, password string, opts MailOptions, limits ImageLimits, clk clock.Clock) Crawler {
+	clk = clock.Or(clk)
+	// one file per mailbox
+	r := strings.NewReplacer("/", "-", ":", "-", "@", "-", " ", "")
 	crawler := &MailCrawler{
-		url:  url,
-		user: username,
-		pass: password,
+		url:      url,
+		user:     username,
+		pass:     password,
+		opts:     opts,
+		seenFile: r.Replace(fmt.Sprintf(".pop3-%s-%s.seen", username, url)),
+		failures: make(map[string]int),
+		limits:   limits,
+		clock:    clk,
 	}
 
 	return crawler
 }
 
-func (crawler *MailCrawler) Crawl(entries chan<- MessageData, quit <-chan bool, repeatDuration time.Duration) {
+func (crawler *MailCrawler) Crawl(ctx context.Context, entries chan<- MessageData, repeatDuration time.Duration) error {
 
 	log.Printf("Start crawling mails from: %s", crawler.url)
-	loop := true
 
-	//wait in a separate goroutine for the quit message. if received stop the crawling loop
-	go func() {
-		<-quit
-		loop = false
-	}()
+	seen, err := LoadSeenUIDs(crawler.seenFile)
+	if err != nil {
+		// better crawl a message twice than never
+		log.Printf("Starting with an empty set of seen UIDs: %v\n", err)
+	}
 
-	// relogin every hour
-	reloginTime := time.Now().Add(1 * time.Hour)
+	// now we start crawling until ctx is done
+	for {
+		t0 := crawler.clock.Now()
+		log.Printf("Start new crawling attemp\n")
+		wait := repeatDuration
+		err := crawler.crawlMailbox(ctx, seen, entries)
+		if IsAuthError(err) {
+			log.Printf("Crawling attemp failed, trying again in %v: %v\n", authRetryDuration, err)
+			wait = authRetryDuration
+		} else if err != nil {
+			log.Printf("Crawling attemp failed: %v\n", err)
+		}
+		crawler.report(err)
 
-	// login to the server
-	client, er := crawler.login()
-	if er != nil {
-		reloginTime = time.Now()
-		log.Println("Going to sleep for 5 minutes. Afterwards trying again.")
-		time.Sleep(time.Minute * 5)
+		// wait some time
+		select {
+		case <-ctx.Done():
+			log.Printf("Stop crawling mails from: %s", crawler.url)
+			return nil
+		case <-crawler.clock.After(wait - crawler.clock.Since(t0)):
+		}
 	}
+}
 
-	// now we start crawling until an error occures or the channel is closed
-	for loop {
-		t0 := time.Now()
-		log.Printf("Start new crawling attemp\n")
+// crawlMailbox logs in, sends all messages that have not been crawled yet
+// to entries and deletes the messages whose retention time is over. POP3
+// servers show new messages only to new sessions, so every crawl has its own.
+// A message is marked as crawled when it has been stored. If ctx is done
+// while a message is sent, the crawl stops without marking it.
+func (crawler *MailCrawler) crawlMailbox(ctx context.Context, seen *SeenUIDs, entries chan<- MessageData) error {
+	client, err := crawler.login()
+	if err != nil {
+		return err
+	}
+	// the deletions are done by QUIT
+	defer client.Quit()
 
-		// get number of messages
-		msgNrs, _, er := client.ListAll()
-		if er != nil {
-			fmt.Print(er.Error())
-			close(entries)
-			return
+	msgNrs, uids, err := client.UidlAll()
+	if err != nil {
+		return err
+	}
+	log.Printf("Number of messages: %v\n", len(msgNrs))
+	if n := seen.Retain(uids); n > 0 {
+		log.Printf("Forgot %v UIDs of messages that are no longer on the server\n", n)
+		seen.Save()
+	}
+	onServer := make(map[string]bool)
+	for _, uid := range uids {
+		onServer[uid] = true
+	}
+	for uid := range crawler.failures {
+		if !onServer[uid] {
+			delete(crawler.failures, uid)
 		}
-		log.Printf("Number of messages: %v\n", msgNrs)
-
-		client.Stat()
-
-		// if it exists, get the first message ...
-		if len(msgNrs) > 0 {
-			msg, er := client.RetrMsg(msgNrs[0])
-			if er == nil {
-				log.Printf("Retrieve messages: %v\n", msgNrs[0])
-				// create a CrawlEntry out of the message
-				entry, er := processMailMessage(msg)
-				if er == nil {
-					log.Printf("Created entry from mail: %v, %v, %v\n", entry.SenderName, entry.ShortText, entry.ImageNames)
-					// ... and delete the message on the server
-					er = client.Dele(msgNrs[0])
-					if er == nil {
-						log.Printf("Delete message: %v\n", msgNrs[0])
-						// send message using the channel
-						entries <- *entry
-					}
+	}
+
+	for i, nr := range msgNrs {
+		uid := uids[i]
+		if crawled, ok := seen.Crawled(uid); ok {
+			if crawler.opts.DeleteAfter > 0 && crawler.clock.Since(crawled) >= crawler.opts.DeleteAfter {
+				if err := client.Dele(nr); err != nil {
+					return err
 				}
+				log.Printf("Delete message %v (%v), crawled at %v\n", nr, uid, crawled)
 			}
-			if er != nil {
-				log.Printf("Crawling attemp failed: %v\n", er)
-				//try to recover
-				reloginTime = time.Now()
-				time.Sleep(time.Minute * 1)
-			}
-
+			continue
 		}
 
-		// wait some time
-		t1 := time.Now()
-		duration := repeatDuration - (t1.Sub(t0))
-		for duration > 0 && loop {
-			// wait a second
-			time.Sleep(time.Second)
-			// recalculate the duration of this crawling attemp
-			t1 = time.Now()
-			duration = repeatDuration - (t1.Sub(t0))
+		msg, err := client.RetrMsg(nr)
+		if err != nil {
+			return err
 		}
-
-		// relogin to the server
-		if reloginTime.Before(time.Now()) {
-			log.Println("Relogin to the server ...")
-			client.Quit()
-			time.Sleep(time.Second * 3)
-			client, er = crawler.login()
-			if er != nil {
-				reloginTime = time.Now()
-				log.Println("Going to sleep for 5 minutes. Afterwards trying again to login.")
-				time.Sleep(time.Minute * 5)
-			} else {
-				// relogin every hour
-				reloginTime = time.Now().Add(1 * time.Hour)
-				log.Printf("Next relogin at: %v\n", reloginTime)
+		log.Printf("Retrieve message: %v (%v)\n", nr, uid)
+		// create a CrawlEntry out of the message
+		entry, err := processMailMessage(msg, crawler.limits)
+		if err != nil {
+			crawler.failures[uid]++
+			if crawler.failures[uid] < maxMailAttempts {
+				// try again with the next crawl
+				log.Printf("Failed to process message %v (%v): %v\n", nr, uid, err)
+				continue
 			}
+			log.Printf("Failed to process message %v (%v) %v times, skipping it: %v\n", nr, uid, maxMailAttempts, err)
+			delete(crawler.failures, uid)
+			seen.Add(uid, crawler.clock.Now())
+			seen.Save()
+			continue
 		}
-
+		delete(crawler.failures, uid)
+		log.Printf("Created entry from mail: %v, %v, %v\n", entry.SenderName, entry.ShortText, entry.ImageNames)
+		// send message using the channel, it is marked when it is stored
+		sent, err := sendStored(ctx, entries, entry)
+		if !sent {
+			removeImages(entry)
+			return nil
+		}
+		if ctx.Err() != nil {
+			// if it has been stored, the next crawl replaces it
+			return nil
+		}
+		if err != nil {
+			return fmt.Errorf("Message %v (%v) has not been stored: %v", nr, uid, err)
+		}
+		seen.Add(uid, crawler.clock.Now())
+		seen.Save()
 	}
-	client.Quit()
-	log.Printf("Stop crawling mails from: %s", crawler.url)
-	close(entries)
+	return nil
 }
 
 func (crawler *MailCrawler) login() (*Client, error) {
 	// create client
-	client, er := DialTLS(crawler.url)
+	client, er := crawler.dial()
 	if er == nil {
+		if crawler.opts.Timeout > 0 {
+			client.Timeout = crawler.opts.Timeout
+		}
 		// login to server
-		er = client.Auth(crawler.user, crawler.pass)
+		er = client.Login(crawler.opts.Auth, crawler.user, crawler.pass, crawler.opts.Security == "none")
+		if er != nil {
+			client.Quit()
+		}
 	}
 
 	if er != nil {
 		log.Printf("Login to server (%v) failed: %v\n", crawler.url, er)
-	} else {
-		log.Printf("Login to server (%v) successful.\n", crawler.url)
+		return nil, er
 	}
+	log.Printf("Login to server (%v) successful.\n", crawler.url)
+	return client, nil
+}
 
-	return client, er
+// dial connects to the server as configured by the security option
+func (crawler *MailCrawler) dial() (*Client, error) {
+	switch crawler.opts.Security {
+	case "", "tls":
+		return DialTLSWithConfig(crawler.url, crawler.opts.TLSConfig)
+	case "none":
+		return Dial(crawler.url)
+	case "starttls":
+		client, err := Dial(crawler.url)
+		if err != nil {
+			return nil, err
+		}
+		config := crawler.opts.TLSConfig.Clone()
+		if config == nil {
+			config = new(tls.Config)
+		}
+		if config.ServerName == "" {
+			config.ServerName, _, _ = net.SplitHostPort(crawler.url)
+		}
+		if err = client.StartTLS(config); err != nil {
+			client.connection.Close()
+			return nil, err
+		}
+		return client, nil
+	}
+	return nil, fmt.Errorf("Unknown security option: %v", crawler.opts.Security)
 }
 
-func processMailMessage(msg *mail.Message) (*MessageData, error) {
+func processMailMessage(msg *mail.Message, limits ImageLimits) (*MessageData, error) {
 
 	data := new(MessageData)
 	data.Type = EMAIL
 
 	mime, err := enmime.ParseMIMEBody(msg) // Parse message body with enmime
 	if err != nil {
-		return nil, fmt.Errorf("Failed to parse MIME body: ", err.Error())
+		return nil, fmt.Errorf("Failed to parse MIME body: %v", err)
 	}
 
 	data.Timestamp, err = msg.Header.Date()
 	if err != nil {
-		return nil, fmt.Errorf("Failed to get date from message: ", err.Error())
+		return nil, fmt.Errorf("Failed to get date from message: %v", err)
 	}
 	data.ShortText = mime.GetHeader("Subject")
 	data.SenderName = mime.GetHeader("From")
@@ -285,18 +399,20 @@ func processMailMessage(msg *mail.Message) (*MessageData, error) {
 	// handle attachments
 	log.Printf("MIME attachments:%v\n", len(mime.Attachments))
 	for _, a := range mime.Attachments {
-		err := data.saveMultimediaAttachment(a)
+		err := data.saveMultimediaAttachment(a, limits)
 		if err != nil {
-			return nil, fmt.Errorf("Failed to checkAndSaveAttachment: ", err.Error())
+			removeImages(data)
+			return nil, fmt.Errorf("Failed to checkAndSaveAttachment: %v", err)
 		}
 	}
 
 	// handle inlines
 	log.Printf("MIME inlines:%v\n", len(mime.Inlines))
 	for _, a := range mime.Inlines {
-		err := data.saveMultimediaAttachment(a)
+		err := data.saveMultimediaAttachment(a, limits)
 		if err != nil {
-			return nil, fmt.Errorf("Failed to checkAndSaveAttachment: ", err.Error())
+			removeImages(data)
+			return nil, fmt.Errorf("Failed to checkAndSaveAttachment: %v", err)
 		}
 	}
 
@@ -311,7 +427,7 @@ func processMailMessage(msg *mail.Message) (*MessageData, error) {
 			for _, a := range pics {
 				err := data.saveMultimediaAttachment(a)
 				if err != nil {
-					return nil, fmt.Errorf("Failed to checkAndSaveAttachment: ", err.Error())
+					return nil, fmt.Errorf("Failed to checkAndSaveAttachment: %v", err)
 				}
 			}
 		}
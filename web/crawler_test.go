@@ -0,0 +1,349 @@
+package web
+
+import (
+	"context"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"github.com/flothe/pinboard/clock"
+	"github.com/flothe/pinboard/grafic2d"
+	"github.com/flothe/pinboard/web/pop3test"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+// chdirTemp makes a temporary directory the current one for the test, the
+// crawlers save their files there
+func chdirTemp(t *testing.T) string {
+	dir := t.TempDir()
+	wd, err := os.Getwd()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chdir(dir); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.Chdir(wd) })
+	return dir
+}
+
+// testCrawl runs a crawler on a fake clock until the test ends
+type testCrawl struct {
+	clk     *clock.Fake
+	entries chan MessageData
+	cancel  context.CancelFunc
+	done    chan struct{}
+	err     error
+}
+
+func newFakeClock() *clock.Fake {
+	return clock.NewFake(time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC))
+}
+
+func startCrawl(t *testing.T, c Crawler, clk *clock.Fake) *testCrawl {
+	ctx, cancel := context.WithCancel(context.Background())
+	cr := &testCrawl{clk: clk, entries: make(chan MessageData), cancel: cancel, done: make(chan struct{})}
+	go func() {
+		cr.err = c.Crawl(ctx, cr.entries, time.Minute)
+		close(cr.done)
+	}()
+	t.Cleanup(func() { cr.stop(t) })
+	return cr
+}
+
+func startMailCrawl(t *testing.T, s *pop3test.Server, opts MailOptions) *testCrawl {
+	clk := newFakeClock()
+	return startCrawl(t, NewMailCrawler(s.Addr, "pinboard", "secret", opts, DefaultImageLimits, clk), clk)
+}
+
+// stop cancels the crawl and waits until Crawl has returned
+func (cr *testCrawl) stop(t *testing.T) {
+	cr.cancel()
+	select {
+	case <-cr.done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("Crawl did not return after the cancel")
+	}
+	if cr.err != nil {
+		t.Errorf("Crawl returned %v", cr.err)
+	}
+}
+
+// recv returns the next entry sent by the crawler, it is reported as stored
+func (cr *testCrawl) recv(t *testing.T) MessageData {
+	return cr.recvStored(t, nil)
+}
+
+// recvStored returns the next entry sent by the crawler and reports err as
+// the result of storing it
+func (cr *testCrawl) recvStored(t *testing.T, err error) MessageData {
+	select {
+	case e := <-cr.entries:
+		e.Stored(err)
+		return e
+	case <-time.After(5 * time.Second):
+		t.Fatal("no entry has been sent")
+	}
+	return MessageData{}
+}
+
+// idle waits until the crawler waits for the clock, so it has finished the
+// current crawl without sending anything else
+func (cr *testCrawl) idle(t *testing.T) {
+	waitFor(t, "the crawler to wait for the clock", func() bool { return cr.clk.Waiters() > 0 })
+}
+
+// next lets the crawler start the next crawl and waits until it is done
+func (cr *testCrawl) next(t *testing.T, d time.Duration) {
+	cr.idle(t)
+	cr.clk.Advance(d)
+	cr.idle(t)
+}
+
+// waitFor waits until cond is true, the crawlers do their work in the
+// background
+func waitFor(t *testing.T, what string, cond func() bool) {
+	deadline := time.Now().Add(5 * time.Second)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatalf("timeout waiting for %v", what)
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
+
+func count(commands []string, cmd string) int {
+	n := 0
+	for _, c := range commands {
+		if c == cmd {
+			n++
+		}
+	}
+	return n
+}
+
+func seenFile(s *pop3test.Server) string {
+	return ".pop3-pinboard-" + strings.Replace(s.Addr, ":", "-", -1) + ".seen"
+}
+
+func exists(fn string) bool {
+	_, err := os.Stat(fn)
+	return err == nil
+}
+
+func TestMailCrawler(t *testing.T) {
+	chdirTemp(t)
+	s := newPOP3Server(t)
+	uids := []string{
+		s.AddMessage(pop3test.PlainMail("Hallo", "Grillen am Freitag")),
+		s.AddMessage(pop3test.DotStuffedMail()),
+		s.AddMessage(pop3test.EncodedMail()),
+		s.AddMessage(pop3test.AttachmentMail("Foto vom Fest", 40, 30)),
+		s.AddMessage(pop3test.InlineMail("Lageplan", 20, 20)),
+	}
+	cr := startMailCrawl(t, s, MailOptions{Security: "none", DeleteAfter: 24 * time.Hour})
+
+	sent := time.Date(2006, 1, 2, 14, 4, 5, 0, time.UTC)
+	want := []struct {
+		subject, text string
+		images        []string
+	}{
+		{"Hallo", "Grillen am Freitag", nil},
+		{"Dots", "first line\n.\n..two dots\n.last line", nil},
+		{"Grüße aus Köln", "Grüße aus Köln", nil},
+		{"Photo", "Foto vom Fest", []string{"photo." + grafic2d.ImageFileExt}},
+		{"Photo", "Lageplan", []string{"photo-0000." + grafic2d.ImageFileExt}},
+	}
+	for _, w := range want {
+		e := cr.recv(t)
+		text := strings.TrimSpace(strings.Replace(e.LongText, "\r\n", "\n", -1))
+		if e.Type != EMAIL || e.SenderName != "Alice <alice@example.com>" || !e.Timestamp.Equal(sent) {
+			t.Errorf("%q: type %v, sender %q, time %v", w.subject, e.Type, e.SenderName, e.Timestamp)
+		}
+		if e.ShortText != w.subject || text != w.text {
+			t.Errorf("got %q %q, want %q %q", e.ShortText, text, w.subject, w.text)
+		}
+		if !reflect.DeepEqual(e.ImageNames, w.images) {
+			t.Errorf("%q: images %v, want %v", w.subject, e.ImageNames, w.images)
+		}
+	}
+	cr.idle(t)
+	for _, fn := range []string{"photo." + grafic2d.ImageFileExt, "photo-0000." + grafic2d.ImageFileExt} {
+		if !exists(fn) || !exists(grafic2d.SourceFile(fn)) {
+			t.Errorf("%v or its source has not been saved", fn)
+		}
+	}
+	seen, err := LoadSeenUIDs(seenFile(s))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, uid := range uids {
+		if _, ok := seen.Crawled(uid); !ok {
+			t.Errorf("%v is not marked as crawled", uid)
+		}
+	}
+
+	// nothing is crawled twice and the mails stay until their time is over
+	cr.next(t, time.Hour)
+	if n := len(s.Messages()); n != 5 {
+		t.Errorf("%v mails on the server, want 5", n)
+	}
+	cr.next(t, 24*time.Hour)
+	if n := len(s.Messages()); n != 0 {
+		t.Errorf("%v mails on the server, want none", n)
+	}
+	if n := count(s.Commands(), "RETR"); n != 5 {
+		t.Errorf("%v RETR commands, want 5", n)
+	}
+}
+
+func TestMailCrawlerRetries(t *testing.T) {
+	chdirTemp(t)
+	s := newPOP3Server(t)
+	s.AddMessage(pop3test.PlainMail("Hallo", "Grillen am Freitag"))
+	s.FailNext("RETR", "-ERR temporarily unavailable")
+	cr := startMailCrawl(t, s, MailOptions{Security: "none"})
+
+	cr.idle(t)
+	cr.clk.Advance(time.Minute)
+	if e := cr.recv(t); e.ShortText != "Hallo" {
+		t.Errorf("got %q, want the mail of the failed RETR", e.ShortText)
+	}
+
+	// the connection drops, the new mail comes with the crawl after
+	cr.idle(t)
+	s.AddMessage(pop3test.PlainMail("Später", "Grillen fällt aus"))
+	s.DropNext("UIDL")
+	cr.next(t, time.Minute)
+	cr.clk.Advance(time.Minute)
+	if e := cr.recv(t); e.ShortText != "Später" {
+		t.Errorf("got %q, want the mail after the dropped connection", e.ShortText)
+	}
+	cr.idle(t)
+	if n := count(s.Commands(), "RETR"); n != 3 {
+		t.Errorf("%v RETR commands, want 3", n)
+	}
+}
+
+func TestMailCrawlerStoreFails(t *testing.T) {
+	chdirTemp(t)
+	s := newPOP3Server(t)
+	uid := s.AddMessage(pop3test.PlainMail("Hallo", "Grillen am Freitag"))
+	cr := startMailCrawl(t, s, MailOptions{Security: "none"})
+
+	// the mail is not marked, so the next crawl sends it again
+	cr.recvStored(t, errors.New("disk full"))
+	cr.idle(t)
+	if exists(seenFile(s)) {
+		seen, _ := LoadSeenUIDs(seenFile(s))
+		if _, ok := seen.Crawled(uid); ok {
+			t.Errorf("the mail not stored is marked as crawled")
+		}
+	}
+	cr.clk.Advance(time.Minute)
+	if e := cr.recv(t); e.ShortText != "Hallo" {
+		t.Errorf("got %q, want the mail again", e.ShortText)
+	}
+	cr.idle(t)
+	seen, err := LoadSeenUIDs(seenFile(s))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := seen.Crawled(uid); !ok {
+		t.Errorf("the stored mail is not marked as crawled")
+	}
+}
+
+// brokenMail has a JPEG attachment and an inline PNG that cannot be decoded
+func brokenMail() []byte {
+	const boundary = "broken-boundary"
+	var b strings.Builder
+	fmt.Fprintf(&b, "From: Alice <alice@example.com>\r\nDate: Mon, 2 Jan 2006 15:04:05 +0100\r\nSubject: Kaputt\r\n")
+	fmt.Fprintf(&b, "MIME-Version: 1.0\r\nContent-Type: multipart/mixed; boundary=%q\r\n\r\n", boundary)
+	fmt.Fprintf(&b, "--%s\r\nContent-Type: text/plain; charset=utf-8\r\n\r\nZwei Bilder\r\n", boundary)
+	fmt.Fprintf(&b, "--%s\r\nContent-Type: image/jpeg; name=\"photo.jpg\"\r\n", boundary)
+	fmt.Fprintf(&b, "Content-Disposition: attachment; filename=\"photo.jpg\"\r\nContent-Transfer-Encoding: base64\r\n\r\n")
+	fmt.Fprintf(&b, "%s\r\n", base64.StdEncoding.EncodeToString(pop3test.JPEG(16, 16)))
+	fmt.Fprintf(&b, "--%s\r\nContent-Type: image/png; name=\"plan.png\"\r\n", boundary)
+	fmt.Fprintf(&b, "Content-Disposition: inline; filename=\"plan.png\"\r\nContent-Transfer-Encoding: base64\r\n\r\n")
+	fmt.Fprintf(&b, "%s\r\n", base64.StdEncoding.EncodeToString([]byte("no png")))
+	fmt.Fprintf(&b, "--%s--\r\n", boundary)
+	return []byte(b.String())
+}
+
+func TestMailCrawlerSkipsBrokenMail(t *testing.T) {
+	chdirTemp(t)
+	s := newPOP3Server(t)
+	broken := s.AddMessage(brokenMail())
+	s.AddMessage(pop3test.PlainMail("Hallo", "Grillen am Freitag"))
+	cr := startMailCrawl(t, s, MailOptions{Security: "none"})
+
+	if e := cr.recv(t); e.ShortText != "Hallo" {
+		t.Errorf("got %q, want the mail after the broken one", e.ShortText)
+	}
+	for i := 1; i < maxMailAttempts; i++ {
+		cr.next(t, time.Minute)
+	}
+	if files, _ := filepath.Glob("photo*"); len(files) != 0 {
+		t.Errorf("the images of the broken mail are left: %v", files)
+	}
+	seen, err := LoadSeenUIDs(seenFile(s))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := seen.Crawled(broken); !ok {
+		t.Errorf("the broken mail is not skipped after %v attempts", maxMailAttempts)
+	}
+	cr.next(t, time.Minute)
+	if n := count(s.Commands(), "RETR"); n != maxMailAttempts+1 {
+		t.Errorf("%v RETR commands, want %v", n, maxMailAttempts+1)
+	}
+}
+
+func TestMailCrawlerSkipsBrokenClip(t *testing.T) {
+	chdirTemp(t)
+	s := newPOP3Server(t)
+	const boundary = "clip-boundary"
+	var b strings.Builder
+	fmt.Fprintf(&b, "From: Alice <alice@example.com>\r\nDate: Mon, 2 Jan 2006 15:04:05 +0100\r\nSubject: Video\r\n")
+	fmt.Fprintf(&b, "MIME-Version: 1.0\r\nContent-Type: multipart/mixed; boundary=%q\r\n\r\n", boundary)
+	fmt.Fprintf(&b, "--%s\r\nContent-Type: text/plain; charset=utf-8\r\n\r\nFoto und Video\r\n", boundary)
+	fmt.Fprintf(&b, "--%s\r\nContent-Type: image/jpeg; name=\"photo.jpg\"\r\n", boundary)
+	fmt.Fprintf(&b, "Content-Disposition: attachment; filename=\"photo.jpg\"\r\nContent-Transfer-Encoding: base64\r\n\r\n")
+	fmt.Fprintf(&b, "%s\r\n", base64.StdEncoding.EncodeToString(pop3test.JPEG(16, 16)))
+	fmt.Fprintf(&b, "--%s\r\nContent-Type: video/mp4; name=\"clip.mp4\"\r\n", boundary)
+	fmt.Fprintf(&b, "Content-Disposition: attachment; filename=\"clip.mp4\"\r\nContent-Transfer-Encoding: base64\r\n\r\n")
+	fmt.Fprintf(&b, "%s\r\n", base64.StdEncoding.EncodeToString([]byte("no mp4")))
+	fmt.Fprintf(&b, "--%s--\r\n", boundary)
+	s.AddMessage([]byte(b.String()))
+	cr := startMailCrawl(t, s, MailOptions{Security: "none"})
+
+	// the clip cannot be converted, the mail is shown with the photo
+	e := cr.recv(t)
+	if e.ShortText != "Video" || len(e.ImageNames) != 1 || len(e.VideoNames) != 0 {
+		t.Errorf("got %q with images %v and clips %v, want the photo only", e.ShortText, e.ImageNames, e.VideoNames)
+	}
+	cr.idle(t)
+}
+
+func TestMailCrawlerCancelWhileSending(t *testing.T) {
+	chdirTemp(t)
+	s := newPOP3Server(t)
+	uid := s.AddMessage(pop3test.AttachmentMail("Foto vom Fest", 40, 30))
+	cr := startMailCrawl(t, s, MailOptions{Security: "none"})
+
+	// nobody receives, so the crawler blocks sending the entry
+	waitFor(t, "the saved image", func() bool { return exists("photo." + grafic2d.ImageFileExt) })
+	cr.stop(t)
+	if files, _ := filepath.Glob("photo*"); len(files) != 0 {
+		t.Errorf("the images of the entry not sent are left: %v", files)
+	}
+	seen, _ := LoadSeenUIDs(seenFile(s))
+	if _, ok := seen.Crawled(uid); ok {
+		t.Errorf("the mail not sent is marked as crawled")
+	}
+}
@@ -0,0 +1,352 @@
+package web
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"github.com/flothe/pinboard/clock"
+	"github.com/fsnotify/fsnotify"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+	"unicode/utf16"
+	"unicode/utf8"
+)
+
+// a file must not change for this time before it is crawled
+const defaultSettleTime = 10 * time.Second
+
+// changes come in bursts while a file is written, they are collected for
+// this time before the directory is read again
+const directoryEventDelay = 250 * time.Millisecond
+
+// DirectoryCrawler watches a directory, e.g. on a network share, for files
+// that are dropped onto the pinboard. Files that arrive together become one
+// message: the images and clips (JPEG, PNG, GIF, WebP, MP4, WebM), the text
+// from a .txt file and text, sender and display window from a .json file with
+// the fields of the webhook. The first line of a .txt file is the short text.
+// Crawled files are moved to the archive directory.
+//
+// Changes are reported by inotify, where that is not possible (e.g. on some
+// network file systems) the directory is read every repeatDuration. A file
+// is crawled when no file of the directory has changed for SettleTime, so
+// half-written files and files that are still being copied are left alone.
+type DirectoryCrawler struct {
+	attempts
+	// time without changes before the files are crawled, defaultSettleTime if 0
+	SettleTime time.Duration
+	// sender of messages without a .json file, the name of the directory if empty
+	Sender  string
+	dir     string
+	archive string
+	limits  ImageLimits
+	clock   clock.Clock
+	// the files of the directory at the last read, by name
+	files map[string]*droppedFile
+}
+
+// droppedFile is a file of the watched directory
+type droppedFile struct {
+	size    int64
+	modTime time.Time
+	// when the size and time were seen first
+	since time.Time
+	// the file was crawled, but could not be archived
+	crawled bool
+}
+
+// NewDirectoryCrawler returns a crawler for the files dropped into dir. The
+// crawled files are moved to archive, relative paths are relative to dir. If
+// archive is empty, the subdirectory "archive" is used. Images are scaled to
+// fit into limits.
+func NewDirectoryCrawler(dir, archive string, limits ImageLimits, clk clock.Clock) *DirectoryCrawler {
+	clk = clock.Or(clk)
+	if archive == "" {
+		archive = "archive"
+	}
+	if !filepath.IsAbs(archive) {
+		archive = filepath.Join(dir, archive)
+	}
+	crawler := &DirectoryCrawler{
+		dir:     dir,
+		archive: archive,
+		limits:  limits,
+		clock:   clk,
+		files:   make(map[string]*droppedFile),
+	}
+
+	return crawler
+}
+
+func (crawler *DirectoryCrawler) Crawl(ctx context.Context, entries chan<- MessageData, repeatDuration time.Duration) error {
+
+	log.Printf("Start watching directory %v\n", crawler.dir)
+
+	if err := os.MkdirAll(crawler.archive, 0755); err != nil {
+		log.Printf("Failed to create archive %v, crawled files stay in place: %v\n", crawler.archive, err)
+	}
+	var events <-chan fsnotify.Event
+	var errors <-chan error
+	watcher, err := fsnotify.NewWatcher()
+	if err == nil {
+		err = watcher.Add(crawler.dir)
+	}
+	if err != nil {
+		log.Printf("Failed to watch directory %v, reading it every %v: %v\n", crawler.dir, repeatDuration, err)
+	} else {
+		defer watcher.Close()
+		events = watcher.Events
+		errors = watcher.Errors
+	}
+
+	settleTime := crawler.SettleTime
+	if settleTime <= 0 {
+		settleTime = defaultSettleTime
+	}
+
+	// now we watch until ctx is done
+	for {
+		busy, err := crawler.crawl(entries, settleTime)
+		if err != nil {
+			log.Printf("Crawling directory %v failed: %v\n", crawler.dir, err)
+		}
+		crawler.report(err)
+
+		// files that are written are checked again when they may have settled
+		wait := repeatDuration
+		if busy && settleTime < wait {
+			wait = settleTime
+		}
+		timeout := crawler.clock.After(wait)
+		changed := false
+	waiting:
+		for {
+			select {
+			case <-ctx.Done():
+				log.Printf("Stop watching directory %v\n", crawler.dir)
+				return nil
+			case _, ok := <-events:
+				if !ok {
+					events = nil
+				} else if !changed {
+					changed = true
+					timeout = crawler.clock.After(directoryEventDelay)
+				}
+			case err, ok := <-errors:
+				if !ok {
+					errors = nil
+				} else {
+					log.Printf("Error while watching directory %v: %v\n", crawler.dir, err)
+				}
+			case <-timeout:
+				break waiting
+			}
+		}
+	}
+}
+
+// crawl reads the directory and sends the files as a message if none has
+// changed for settleTime. It returns true if files are still changing.
+func (crawler *DirectoryCrawler) crawl(entries chan<- MessageData, settleTime time.Duration) (bool, error) {
+	infos, err := ioutil.ReadDir(crawler.dir)
+	if err != nil {
+		return false, err
+	}
+
+	now := crawler.clock.Now()
+	busy := false
+	var names []string
+	files := make(map[string]*droppedFile)
+	for _, fi := range infos {
+		if !fi.Mode().IsRegular() || ignoreDroppedFile(fi.Name()) {
+			continue
+		}
+		// a new empty file is still edited, e.g. a new text document
+		if fi.Size() == 0 {
+			continue
+		}
+		f := crawler.files[fi.Name()]
+		if f == nil || f.size != fi.Size() || !f.modTime.Equal(fi.ModTime()) {
+			f = &droppedFile{size: fi.Size(), modTime: fi.ModTime(), since: now}
+		}
+		files[fi.Name()] = f
+		switch {
+		case f.crawled:
+		case now.Sub(f.since) < settleTime:
+			busy = true
+		default:
+			names = append(names, fi.Name())
+		}
+	}
+	// deleted files are forgotten
+	crawler.files = files
+
+	if busy || len(names) == 0 {
+		return busy, nil
+	}
+
+	log.Printf("Number of dropped files in %v: %v\n", crawler.dir, len(names))
+	entry := crawler.processFiles(names)
+	if entry != nil {
+		log.Printf("Created entry from dropped files: %v, %v, %v\n", entry.SenderName, entry.ShortText, entry.ImageNames)
+		// send message using the channel
+		entries <- *entry
+	}
+	for _, name := range names {
+		err := crawler.archiveFile(name)
+		if err != nil {
+			// it is not crawled again as long as it does not change
+			log.Printf("Failed to archive %v: %v\n", name, err)
+			files[name].crawled = true
+		}
+	}
+	return false, nil
+}
+
+// processFiles creates a message out of the files and saves the images. Files
+// that cannot be read, unknown files and invalid .json files are left out. If
+// there is neither text nor an image, nil is returned.
+func (crawler *DirectoryCrawler) processFiles(names []string) *MessageData {
+
+	data := new(MessageData)
+	data.Type = FILE
+	data.Timestamp = crawler.clock.Now()
+	data.SenderName = crawler.Sender
+	if data.SenderName == "" {
+		data.SenderName = filepath.Base(crawler.dir)
+	}
+
+	var texts []string
+	sort.Strings(names)
+	for _, name := range names {
+		fn := filepath.Join(crawler.dir, name)
+		buf, err := ioutil.ReadFile(fn)
+		if err != nil {
+			log.Printf("Failed to read %v: %v\n", fn, err)
+			continue
+		}
+		switch strings.ToLower(filepath.Ext(name)) {
+		case ".txt":
+			if text := strings.TrimSpace(decodeText(buf)); text != "" {
+				texts = append(texts, text)
+			}
+		case ".json":
+			var pin pinRequest
+			if err := json.Unmarshal(buf, &pin); err != nil {
+				log.Printf("Failed to parse %v: %v\n", fn, err)
+				continue
+			}
+			// checked like a pin of the webhook
+			if pin.ShowFrom != nil && pin.ShowUntil != nil && !pin.ShowUntil.After(*pin.ShowFrom) {
+				log.Printf("Skip %v, show_until must be after show_from\n", fn)
+				continue
+			}
+			if pin.Text != "" {
+				data.ShortText = pin.Text
+			}
+			if pin.LongText != "" {
+				data.LongText = pin.LongText
+			}
+			if pin.Sender != "" {
+				data.SenderName = pin.Sender
+			}
+			if pin.ShowFrom != nil {
+				data.ShowFrom = *pin.ShowFrom
+			}
+			if pin.ShowUntil != nil {
+				data.ShowUntil = *pin.ShowUntil
+			}
+		default:
+			t := http.DetectContentType(buf)
+			if !isMediaType(t) {
+				log.Printf("Skip %v, it is %v and no JPEG, PNG, GIF, WebP, MP4 or WebM\n", fn, t)
+				continue
+			}
+			_, err := data.saveMedia(buf, name, t, crawler.limits)
+			if err != nil {
+				log.Printf("Failed to save %v: %v\n", fn, err)
+			}
+		}
+	}
+
+	// the .json file wins over the .txt files
+	if len(texts) > 0 {
+		if data.ShortText == "" {
+			data.ShortText = strings.TrimSpace(strings.SplitN(texts[0], "\n", 2)[0])
+		}
+		if data.LongText == "" {
+			data.LongText = strings.Join(texts, "\n\n")
+		}
+	}
+	if data.LongText == "" {
+		data.LongText = data.ShortText
+	}
+	if data.ShortText == "" && len(data.ImageNames) == 0 && len(data.VideoNames) == 0 {
+		log.Printf("Dropped files %v contain neither text nor images\n", names)
+		return nil
+	}
+	return data
+}
+
+// archiveFile moves the file to the archive, the name gets the time as prefix
+func (crawler *DirectoryCrawler) archiveFile(name string) error {
+	prefix := crawler.clock.Now().Format("20060102-150405-")
+	fn := filepath.Join(crawler.archive, prefix+name)
+	for i := 1; ; i++ {
+		if _, err := os.Stat(fn); os.IsNotExist(err) {
+			break
+		}
+		fn = filepath.Join(crawler.archive, fmt.Sprintf("%v%v-%v", prefix, i, name))
+	}
+	return os.Rename(filepath.Join(crawler.dir, name), fn)
+}
+
+// ignoreDroppedFile tells if the file is hidden, temporary or created by the
+// file manager
+func ignoreDroppedFile(name string) bool {
+	lower := strings.ToLower(name)
+	switch {
+	case strings.HasPrefix(name, "."), strings.HasPrefix(name, "~"):
+		return true
+	case lower == "thumbs.db", lower == "desktop.ini":
+		return true
+	}
+	switch filepath.Ext(lower) {
+	case ".tmp", ".part", ".partial", ".crdownload":
+		return true
+	}
+	return false
+}
+
+// decodeText returns the text of a .txt file. Windows editors write UTF-16 or
+// UTF-8 with a byte order mark, other files that are not UTF-8 are read as
+// ISO 8859-1.
+func decodeText(buf []byte) string {
+	switch {
+	case bytes.HasPrefix(buf, []byte{0xef, 0xbb, 0xbf}):
+		buf = buf[3:]
+	case len(buf) >= 2 && (buf[0] == 0xff && buf[1] == 0xfe || buf[0] == 0xfe && buf[1] == 0xff):
+		u := make([]uint16, (len(buf)-2)/2)
+		for i := range u {
+			lo, hi := buf[2+2*i], buf[3+2*i]
+			if buf[0] == 0xfe {
+				lo, hi = hi, lo
+			}
+			u[i] = uint16(hi)<<8 | uint16(lo)
+		}
+		buf = []byte(string(utf16.Decode(u)))
+	case !utf8.Valid(buf):
+		r := make([]rune, len(buf))
+		for i, b := range buf {
+			r[i] = rune(b)
+		}
+		buf = []byte(string(r))
+	}
+	return strings.Replace(string(buf), "\r\n", "\n", -1)
+}
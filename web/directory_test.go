@@ -0,0 +1,211 @@
+package web
+
+import (
+	"github.com/flothe/pinboard/clock"
+	"github.com/flothe/pinboard/web/pop3test"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"testing"
+	"time"
+)
+
+// newTestDirectory returns a crawler of an empty directory on the fake clock,
+// its crawl is called directly
+func newTestDirectory(t *testing.T) (*DirectoryCrawler, *clock.Fake) {
+	dir := filepath.Join(chdirTemp(t), "drop")
+	clk := newFakeClock()
+	c := NewDirectoryCrawler(dir, "", DefaultImageLimits, clk)
+	if err := os.MkdirAll(c.archive, 0755); err != nil {
+		t.Fatal(err)
+	}
+	return c, clk
+}
+
+func dropFile(t *testing.T, c *DirectoryCrawler, name string, data []byte) {
+	if err := ioutil.WriteFile(filepath.Join(c.dir, name), data, 0644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// crawlDirectory crawls once and returns the entry sent, nil if there is none
+func crawlDirectory(t *testing.T, c *DirectoryCrawler, wantBusy bool) *MessageData {
+	entries := make(chan MessageData, 1)
+	busy, err := c.crawl(entries, defaultSettleTime)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if busy != wantBusy {
+		t.Errorf("busy %v, want %v", busy, wantBusy)
+	}
+	select {
+	case e := <-entries:
+		return &e
+	default:
+		return nil
+	}
+}
+
+// dirNames returns the sorted names of the files in dir
+func dirNames(t *testing.T, dir string) []string {
+	infos, err := ioutil.ReadDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var names []string
+	for _, fi := range infos {
+		if fi.Mode().IsRegular() {
+			names = append(names, fi.Name())
+		}
+	}
+	sort.Strings(names)
+	return names
+}
+
+func TestDirectorySettleTime(t *testing.T) {
+	c, clk := newTestDirectory(t)
+	dropFile(t, c, "note.txt", []byte("Grillen"))
+	dropFile(t, c, "photo.jpg", pop3test.JPEG(30, 20))
+	// ignored: empty, hidden and partial files
+	dropFile(t, c, "leer.txt", nil)
+	dropFile(t, c, ".~lock.note.txt#", []byte("lock"))
+	dropFile(t, c, "video.mp4.part", []byte("halb"))
+
+	if e := crawlDirectory(t, c, true); e != nil {
+		t.Fatalf("new files are crawled at once: %q", e.ShortText)
+	}
+	// a change starts the settle time again
+	clk.Advance(5 * time.Second)
+	dropFile(t, c, "note.txt", []byte("Grillen am Freitag"))
+	if e := crawlDirectory(t, c, true); e != nil {
+		t.Fatalf("changed files are crawled: %q", e.ShortText)
+	}
+	clk.Advance(defaultSettleTime - time.Second)
+	if e := crawlDirectory(t, c, true); e != nil {
+		t.Fatalf("crawled %v after the change", defaultSettleTime-time.Second)
+	}
+	clk.Advance(time.Second)
+	e := crawlDirectory(t, c, false)
+	if e == nil {
+		t.Fatal("the settled files are not crawled")
+	}
+	if e.Type != FILE || e.ShortText != "Grillen am Freitag" || e.SenderName != "drop" || len(e.ImageNames) != 1 {
+		t.Errorf("got %v %q from %q with %v", e.Type, e.ShortText, e.SenderName, e.ImageNames)
+	}
+	if got, want := dirNames(t, c.dir), []string{".~lock.note.txt#", "leer.txt", "video.mp4.part"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("left in the directory %v, want %v", got, want)
+	}
+	if n := len(dirNames(t, c.archive)); n != 2 {
+		t.Errorf("%v files archived, want 2", n)
+	}
+	// nothing is left to crawl
+	if e := crawlDirectory(t, c, false); e != nil {
+		t.Errorf("crawled again: %q", e.ShortText)
+	}
+}
+
+func TestDirectoryGrouping(t *testing.T) {
+	c, clk := newTestDirectory(t)
+	c.Sender = "Empfang"
+	dropFile(t, c, "b.txt", []byte("Zweiter Text"))
+	dropFile(t, c, "a.txt", []byte("Erste Zeile\nmehr dazu"))
+	dropFile(t, c, "bild.png", pop3test.PNG(20, 20))
+	dropFile(t, c, "liste.xlsx", []byte("PK\x03\x04 kein Bild"))
+	crawlDirectory(t, c, true)
+	clk.Advance(defaultSettleTime)
+
+	// the first line of the first .txt file is the ticker text
+	e := crawlDirectory(t, c, false)
+	if e == nil {
+		t.Fatal("no entry")
+	}
+	if e.ShortText != "Erste Zeile" || e.LongText != "Erste Zeile\nmehr dazu\n\nZweiter Text" || e.SenderName != "Empfang" {
+		t.Errorf("got %q %q from %q", e.ShortText, e.LongText, e.SenderName)
+	}
+	if len(e.ImageNames) != 1 {
+		t.Errorf("images %v, want the PNG", e.ImageNames)
+	}
+	// the unknown file is archived with the others
+	if n := len(dirNames(t, c.archive)); n != 4 {
+		t.Errorf("%v files archived, want 4", n)
+	}
+
+	// the .json file wins over the .txt file
+	dropFile(t, c, "pin.json", []byte(`{"text": "Sommerfest", "sender": "Team",
+		"show_from": "2024-07-01T08:00:00Z", "show_until": "2024-07-02T00:00:00Z"}`))
+	dropFile(t, c, "text.txt", []byte("Langer Text"))
+	crawlDirectory(t, c, true)
+	clk.Advance(defaultSettleTime)
+	e = crawlDirectory(t, c, false)
+	if e == nil {
+		t.Fatal("no entry for the .json file")
+	}
+	from := time.Date(2024, 7, 1, 8, 0, 0, 0, time.UTC)
+	if e.ShortText != "Sommerfest" || e.LongText != "Langer Text" || e.SenderName != "Team" {
+		t.Errorf("got %q %q from %q", e.ShortText, e.LongText, e.SenderName)
+	}
+	if !e.ShowFrom.Equal(from) || !e.ShowUntil.Equal(from.Add(16*time.Hour)) {
+		t.Errorf("display window %v - %v", e.ShowFrom, e.ShowUntil)
+	}
+}
+
+func TestDirectoryRejectsWindow(t *testing.T) {
+	c, clk := newTestDirectory(t)
+	dropFile(t, c, "pin.json", []byte(`{"text": "Verkehrt", "sender": "Team",
+		"show_from": "2024-07-02T00:00:00Z", "show_until": "2024-07-01T08:00:00Z"}`))
+	dropFile(t, c, "photo.jpg", pop3test.JPEG(30, 20))
+	crawlDirectory(t, c, true)
+	clk.Advance(defaultSettleTime)
+
+	// the photo is shown without the invalid .json file
+	e := crawlDirectory(t, c, false)
+	if e == nil {
+		t.Fatal("no entry for the photo")
+	}
+	if e.ShortText != "" || e.SenderName != "drop" || !e.ShowFrom.IsZero() || !e.ShowUntil.IsZero() || len(e.ImageNames) != 1 {
+		t.Errorf("got %q from %q shown %v - %v with %v", e.ShortText, e.SenderName, e.ShowFrom, e.ShowUntil, e.ImageNames)
+	}
+
+	// without the photo nothing is left
+	dropFile(t, c, "pin.json", []byte(`{"text": "Verkehrt", "show_from": "2024-07-02T00:00:00Z", "show_until": "2024-07-02T00:00:00Z"}`))
+	crawlDirectory(t, c, true)
+	clk.Advance(defaultSettleTime)
+	if e := crawlDirectory(t, c, false); e != nil {
+		t.Errorf("got %q for an empty display window", e.ShortText)
+	}
+}
+
+func TestDirectoryArchiveCollision(t *testing.T) {
+	c, _ := newTestDirectory(t)
+	for i := 0; i < 3; i++ {
+		dropFile(t, c, "note.txt", []byte("Text"))
+		if err := c.archiveFile("note.txt"); err != nil {
+			t.Fatal(err)
+		}
+	}
+	want := []string{"20200101-000000-1-note.txt", "20200101-000000-2-note.txt", "20200101-000000-note.txt"}
+	if got := dirNames(t, c.archive); !reflect.DeepEqual(got, want) {
+		t.Errorf("archived as %v, want %v", got, want)
+	}
+}
+
+func TestDecodeText(t *testing.T) {
+	for _, c := range []struct {
+		name string
+		in   []byte
+		want string
+	}{
+		{"UTF-8", []byte("Grüße\r\naus Köln"), "Grüße\naus Köln"},
+		{"UTF-8 BOM", []byte("\xef\xbb\xbfGrüße"), "Grüße"},
+		{"UTF-16LE", []byte{0xff, 0xfe, 'G', 0, 0xfc, 0, '\r', 0, '\n', 0, 0x3d, 0xd8, 0x00, 0xde}, "Gü\n😀"},
+		{"UTF-16BE", []byte{0xfe, 0xff, 0, 'G', 0, 0xfc, 0x20, 0xac}, "Gü€"},
+		{"Latin-1", []byte("Gr\xfc\xdfe aus K\xf6ln"), "Grüße aus Köln"},
+		{"empty", nil, ""},
+	} {
+		if got := decodeText(c.in); got != c.want {
+			t.Errorf("%v: got %q, want %q", c.name, got, c.want)
+		}
+	}
+}
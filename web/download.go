@@ -0,0 +1,124 @@
+package web
+
+import (
+	"fmt"
+	"github.com/flothe/pinboard/grafic2d"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+)
+
+// saveImageURL downloads the image and saves it scaled to limits
+func (data *MessageData) saveImageURL(imageURL string, limits ImageLimits, client *http.Client) error {
+	resp, err := client.Get(imageURL)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("Get %v: %v", imageURL, resp.Status)
+	}
+	buf, err := readLimited(resp.Body, limits.MaxDownload)
+	if err != nil {
+		return fmt.Errorf("Get %v: %v", imageURL, err)
+	}
+
+	name := "image"
+	if u, err := url.Parse(imageURL); err == nil && path.Base(u.Path) != "/" && path.Base(u.Path) != "." {
+		name = path.Base(u.Path)
+	}
+	// animated GIFs are saved as clip
+	fn, err := data.saveMedia(buf, name, http.DetectContentType(buf), limits)
+	if err != nil {
+		return err
+	}
+	log.Printf("Saved image %v as %v\n", imageURL, fn)
+	return nil
+}
+
+// readLimited reads r up to max bytes, DefaultImageLimits.MaxDownload if max
+// is 0. If r is longer an error is returned.
+func readLimited(r io.Reader, max int64) ([]byte, error) {
+	if max <= 0 {
+		max = DefaultImageLimits.MaxDownload
+	}
+	buf, err := ioutil.ReadAll(io.LimitReader(r, max+1))
+	if err != nil {
+		return nil, err
+	}
+	if int64(len(buf)) > max {
+		return nil, fmt.Errorf("Download is larger than %v bytes", max)
+	}
+	return buf, nil
+}
+
+// saveImage saves the image file scaled to limits under a unique name derived
+// from name and returns the filename
+func (data *MessageData) saveImage(buf []byte, name string, limits ImageLimits) (string, error) {
+	fn := createUniqueFilename(name, grafic2d.ImageFileExt)
+	err := grafic2d.SaveScaledVGImage(buf, limits.MaxWidth, limits.MaxHeight, fn)
+	if err != nil {
+		return "", err
+	}
+	data.ImageNames = append(data.ImageNames, fn)
+	return fn, nil
+}
+
+// removeImages deletes the saved images and clips of a message that is not
+// sent
+func removeImages(data *MessageData) {
+	for _, fn := range append(data.ImageNames, data.VideoNames...) {
+		os.Remove(fn)
+		os.Remove(grafic2d.SourceFile(fn))
+	}
+}
+
+// mediaTypes are the content types the crawlers save, animated GIFs and
+// videos as clip
+var mediaTypes = []string{"image/jpeg", "image/png", "image/gif", "image/webp", "video/mp4", "video/webm"}
+
+// isMediaType tells if the crawlers save content of type t
+func isMediaType(t string) bool {
+	for _, m := range mediaTypes {
+		if t == m {
+			return true
+		}
+	}
+	return false
+}
+
+// isVideoType tells if t is a video, it is converted to a clip by ffmpeg
+func isVideoType(t string) bool {
+	return t == "video/mp4" || t == "video/webm"
+}
+
+// saveMedia saves buf of content type t as image or, if it is an animated
+// GIF or a video, as clip. It returns the filename.
+func (data *MessageData) saveMedia(buf []byte, name, t string, limits ImageLimits) (string, error) {
+	switch t {
+	case "video/mp4", "video/webm":
+		return data.saveMotion(buf, name, limits)
+	case "image/gif":
+		fn, err := data.saveMotion(buf, name, limits)
+		if err != grafic2d.ErrNotAnimated {
+			return fn, err
+		}
+	}
+	return data.saveImage(buf, name, limits)
+}
+
+// saveMotion saves the animated GIF or video as clip scaled to limits under
+// a unique name derived from name and returns the filename
+func (data *MessageData) saveMotion(buf []byte, name string, limits ImageLimits) (string, error) {
+	fn := createUniqueFilename(name, grafic2d.MotionFileExt)
+	err := grafic2d.SaveMotion(buf, limits.Motion, fn)
+	if err != nil {
+		return "", err
+	}
+	data.VideoNames = append(data.VideoNames, fn)
+	return fn, nil
+}
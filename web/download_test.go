@@ -0,0 +1,38 @@
+package web
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestSaveImageURLLimit(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write(make([]byte, 2000))
+	}))
+	defer ts.Close()
+
+	var data MessageData
+	limits := DefaultImageLimits
+	limits.MaxDownload = 1000
+	err := data.saveImageURL(ts.URL+"/big.jpg", limits, ts.Client())
+	if err == nil || !strings.Contains(err.Error(), "larger than 1000 bytes") {
+		t.Fatalf("saveImageURL returned %v, want the download limit", err)
+	}
+	if len(data.ImageNames) != 0 || len(data.VideoNames) != 0 {
+		t.Errorf("saved %v %v", data.ImageNames, data.VideoNames)
+	}
+}
+
+func TestReadLimited(t *testing.T) {
+	for _, n := range []int{0, 999, 1000} {
+		buf, err := readLimited(strings.NewReader(strings.Repeat("x", n)), 1000)
+		if err != nil || len(buf) != n {
+			t.Errorf("%v bytes: read %v bytes, %v", n, len(buf), err)
+		}
+	}
+	if _, err := readLimited(strings.NewReader(strings.Repeat("x", 1001)), 1000); err == nil {
+		t.Errorf("1001 bytes: no error")
+	}
+}
@@ -0,0 +1,95 @@
+package web
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"runtime/debug"
+	"sync"
+	"time"
+)
+
+// FanIn runs crawlers and merges their entries into one channel. The channel
+// belongs to the FanIn: the crawlers only send to it and it is closed by
+// Close when all of them have returned, so no crawler sends to a closed
+// channel and the reader knows when the last entry has arrived.
+type FanIn struct {
+	entries chan MessageData
+	wg      sync.WaitGroup
+	mu      sync.Mutex
+	closed  bool
+}
+
+// NewFanIn returns a FanIn without crawlers
+func NewFanIn() *FanIn {
+	return &FanIn{entries: make(chan MessageData)}
+}
+
+// Entries returns the merged entries of the crawlers. It must be read until
+// it is closed, otherwise the crawlers block.
+func (f *FanIn) Entries() <-chan MessageData {
+	return f.entries
+}
+
+// Go runs the crawler on its own goroutine until ctx is done or it fails.
+// Every entry is passed to sent before it is merged, e.g. to count it, and
+// done is called with the result of Crawl when the crawler has returned. A
+// panic of the crawler is returned as error. sent and done may be nil. Go
+// must not be called after Close.
+func (f *FanIn) Go(ctx context.Context, crawler Crawler, repeatDuration time.Duration, sent func(e *MessageData), done func(err error)) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.closed {
+		panic("web: FanIn.Go called after Close")
+	}
+	f.wg.Add(1)
+
+	// the crawler gets its own channel, so sent sees its entries
+	in := make(chan MessageData)
+	result := make(chan error, 1)
+	go func() {
+		// the crawler does not send anymore
+		defer close(in)
+		result <- crawl(ctx, crawler, in, repeatDuration)
+	}()
+	go func() {
+		defer f.wg.Done()
+		for e := range in {
+			if sent != nil {
+				sent(&e)
+			}
+			f.entries <- e
+		}
+		// the last entry has been merged
+		err := <-result
+		if done != nil {
+			done(err)
+		}
+	}()
+}
+
+// crawl runs the crawler, a panic is returned as error
+func crawl(ctx context.Context, crawler Crawler, entries chan<- MessageData, repeatDuration time.Duration) (err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			log.Printf("Crawler crashed: %v\n%s", r, debug.Stack())
+			err = fmt.Errorf("Crashed: %v", r)
+		}
+	}()
+	return crawler.Crawl(ctx, entries, repeatDuration)
+}
+
+// Close closes the channel of the entries when all crawlers have returned,
+// it does not wait for them.
+func (f *FanIn) Close() {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.closed {
+		return
+	}
+	f.closed = true
+	go func() {
+		f.wg.Wait()
+		close(f.entries)
+	}()
+}
@@ -0,0 +1,122 @@
+package web
+
+import (
+	"context"
+	"errors"
+	"reflect"
+	"sort"
+	"testing"
+	"time"
+)
+
+// sendCrawler sends n entries, then it returns err, panics or waits until it
+// is stopped
+type sendCrawler struct {
+	name  string
+	n     int
+	err   error
+	panic bool
+	wait  bool
+}
+
+func (c *sendCrawler) Crawl(ctx context.Context, entries chan<- MessageData, repeatDuration time.Duration) error {
+	for i := 0; i < c.n; i++ {
+		select {
+		case entries <- MessageData{Source: c.name}:
+		case <-ctx.Done():
+			return nil
+		}
+	}
+	switch {
+	case c.panic:
+		panic("boom")
+	case c.wait:
+		<-ctx.Done()
+	}
+	return c.err
+}
+
+// readAll reads the entries until they are closed
+func readAll(t *testing.T, entries <-chan MessageData) map[string]int {
+	got := make(map[string]int)
+	timeout := time.After(5 * time.Second)
+	for {
+		select {
+		case e, ok := <-entries:
+			if !ok {
+				return got
+			}
+			got[e.Source]++
+		case <-timeout:
+			t.Fatalf("the entries are not closed, received %v", got)
+		}
+	}
+}
+
+func TestFanIn(t *testing.T) {
+	f := NewFanIn()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	sent := make(chan string, 10)
+	results := make(chan string, 3)
+	done := func(err error) {
+		if err == nil {
+			results <- "nil"
+		} else {
+			results <- err.Error()
+		}
+	}
+	f.Go(ctx, &sendCrawler{name: "a", n: 3}, time.Minute, func(e *MessageData) { sent <- e.Source }, done)
+	f.Go(ctx, &sendCrawler{name: "b", n: 2, err: errors.New("no server")}, time.Minute, nil, done)
+	f.Go(ctx, &sendCrawler{name: "c", n: 1, panic: true}, time.Minute, nil, done)
+	f.Close()
+
+	got := readAll(t, f.Entries())
+	if got["a"] != 3 || got["b"] != 2 || got["c"] != 1 {
+		t.Errorf("received %v", got)
+	}
+	if len(sent) != 3 {
+		t.Errorf("sent has been called %v times, want 3", len(sent))
+	}
+	// done is called before the entries are closed
+	var errs []string
+	for i := 0; i < 3; i++ {
+		errs = append(errs, <-results)
+	}
+	sort.Strings(errs)
+	if want := []string{"Crashed: boom", "nil", "no server"}; !reflect.DeepEqual(errs, want) {
+		t.Errorf("results %q, want %q", errs, want)
+	}
+
+	defer func() {
+		if recover() == nil {
+			t.Errorf("Go after Close does not panic")
+		}
+	}()
+	f.Go(ctx, &sendCrawler{name: "d"}, time.Minute, nil, nil)
+}
+
+func TestFanInCancel(t *testing.T) {
+	f := NewFanIn()
+	ctx, cancel := context.WithCancel(context.Background())
+	results := make(chan error, 2)
+	done := func(err error) { results <- err }
+	f.Go(ctx, &sendCrawler{name: "a", n: 1, wait: true}, time.Minute, nil, done)
+	// blocks sending, nobody reads
+	f.Go(ctx, &sendCrawler{name: "b", n: 5}, time.Minute, nil, done)
+	f.Close()
+
+	select {
+	case <-f.Entries():
+	case <-time.After(5 * time.Second):
+		t.Fatal("no entry has been sent")
+	}
+	cancel()
+	readAll(t, f.Entries())
+	for i := 0; i < 2; i++ {
+		if err := <-results; err != nil {
+			t.Errorf("a stopped crawler returned %v", err)
+		}
+	}
+}
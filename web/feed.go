@@ -0,0 +1,306 @@
+package web
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"fmt"
+	"github.com/flothe/pinboard/clock"
+	"github.com/mmcdole/gofeed"
+	"log"
+	"net/http"
+	"net/url"
+	"path"
+	"sort"
+	"strings"
+	"time"
+)
+
+// FeedOptions limit the items of the feeds that are shown
+type FeedOptions struct {
+	// items published longer ago are skipped, no limit if 0
+	MaxAge time.Duration
+	// only the newest items of each feed are shown, all if 0
+	MaxItems int
+	// HTTP basic auth, e.g. for the intranet, none if User is empty
+	User, Password string
+}
+
+type FeedCrawler struct {
+	attempts
+	// TLS settings, if nil the system defaults are used
+	TLSConfig *tls.Config
+	feeds     []*feed
+	opts      FeedOptions
+	limits    ImageLimits
+	clock     clock.Clock
+}
+
+// feed is the state of a feed URL between the crawls
+type feed struct {
+	url string
+	// file of the GUIDs of the crawled items
+	seenFile string
+	seen     *SeenUIDs
+	// validators of the last response, so unchanged feeds are not downloaded
+	etag, lastModified string
+}
+
+// NewFeedCrawler returns a crawler for the RSS and Atom feeds at urls. The
+// GUIDs of the crawled items are saved in the current directory, one file per
+// feed, so no item is shown twice. Images are scaled to fit into limits.
+func NewFeedCrawler(urls []string, opts FeedOptions, limits ImageLimits, clk clock.Clock) *FeedCrawler {
+	clk = clock.Or(clk)
+	// one file per feed
+	r := strings.NewReplacer("http://", "", "https://", "", "/", "-", ":", "-", "?", "-", "&", "-", "=", "-", "@", "-", " ", "")
+	crawler := &FeedCrawler{
+		opts:   opts,
+		limits: limits,
+		clock:  clk,
+	}
+	for _, u := range urls {
+		crawler.feeds = append(crawler.feeds, &feed{
+			url:      u,
+			seenFile: ".feed-" + r.Replace(u) + ".seen",
+		})
+	}
+
+	return crawler
+}
+
+func (crawler *FeedCrawler) Crawl(ctx context.Context, entries chan<- MessageData, repeatDuration time.Duration) error {
+
+	log.Printf("Start crawling %v feeds\n", len(crawler.feeds))
+
+	client := &http.Client{
+		Timeout:   time.Minute,
+		Transport: &http.Transport{Proxy: http.ProxyFromEnvironment, TLSClientConfig: crawler.TLSConfig},
+	}
+	for _, f := range crawler.feeds {
+		var err error
+		f.seen, err = LoadSeenUIDs(f.seenFile)
+		if err != nil {
+			// better show an item twice than never
+			log.Printf("Starting with an empty set of seen items of %v: %v\n", f.url, err)
+		}
+	}
+
+	// now we start crawling until ctx is done
+	for {
+		t0 := crawler.clock.Now()
+		log.Printf("Start new crawling attemp\n")
+		var failed error
+		for _, f := range crawler.feeds {
+			err := crawler.crawlFeed(f, client, entries)
+			if err != nil {
+				log.Printf("Crawling feed %v failed: %v\n", f.url, err)
+				failed = err
+			}
+		}
+		crawler.report(failed)
+
+		// wait some time
+		select {
+		case <-ctx.Done():
+			log.Printf("Stop crawling %v feeds\n", len(crawler.feeds))
+			return nil
+		case <-crawler.clock.After(repeatDuration - crawler.clock.Since(t0)):
+		}
+	}
+}
+
+// crawlFeed downloads the feed if it has changed and sends the new items to entries
+func (crawler *FeedCrawler) crawlFeed(f *feed, client *http.Client, entries chan<- MessageData) error {
+	req, err := http.NewRequest("GET", f.url, nil)
+	if err != nil {
+		return err
+	}
+	if f.etag != "" {
+		req.Header.Set("If-None-Match", f.etag)
+	}
+	if f.lastModified != "" {
+		req.Header.Set("If-Modified-Since", f.lastModified)
+	}
+	if crawler.opts.User != "" {
+		req.SetBasicAuth(crawler.opts.User, crawler.opts.Password)
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode == http.StatusNotModified {
+		log.Printf("Feed %v has not changed\n", f.url)
+		return nil
+	}
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("Get %v: %v", f.url, resp.Status)
+	}
+	buf, err := readLimited(resp.Body, crawler.limits.MaxDownload)
+	if err != nil {
+		return fmt.Errorf("Get %v: %v", f.url, err)
+	}
+	parsed, err := gofeed.NewParser().Parse(bytes.NewReader(buf))
+	if err != nil {
+		return fmt.Errorf("Failed to parse feed: %v", err)
+	}
+	f.etag = resp.Header.Get("ETag")
+	f.lastModified = resp.Header.Get("Last-Modified")
+	log.Printf("Number of items in feed %v: %v\n", f.url, len(parsed.Items))
+
+	// items that left the feed do not come back
+	ids := make([]string, len(parsed.Items))
+	for i, item := range parsed.Items {
+		ids[i] = itemID(item)
+	}
+	if n := f.seen.Retain(ids); n > 0 {
+		log.Printf("Forgot %v items that are no longer in the feed\n", n)
+		f.seen.Save()
+	}
+
+	// newest first to apply the item limit, then sent oldest first
+	now := crawler.clock.Now()
+	items := parsed.Items
+	sort.SliceStable(items, func(i, j int) bool { return itemTime(items[i], now).After(itemTime(items[j], now)) })
+	if crawler.opts.MaxItems > 0 && len(items) > crawler.opts.MaxItems {
+		items = items[:crawler.opts.MaxItems]
+	}
+	for i := len(items) - 1; i >= 0; i-- {
+		item := items[i]
+		id := itemID(item)
+		if _, ok := f.seen.Crawled(id); ok {
+			continue
+		}
+		t := itemTime(item, now)
+		if crawler.opts.MaxAge > 0 && now.Sub(t) > crawler.opts.MaxAge {
+			continue
+		}
+		entry := processFeedItem(parsed, item, t, f.url, crawler.limits, client)
+		log.Printf("Created entry from feed item: %v, %v, %v\n", entry.SenderName, entry.ShortText, entry.ImageNames)
+		// send message using the channel
+		entries <- *entry
+		f.seen.Add(id, crawler.clock.Now())
+		f.seen.Save()
+	}
+	return nil
+}
+
+// itemID returns the GUID of the item, if the feed has none the link
+func itemID(item *gofeed.Item) string {
+	switch {
+	case item.GUID != "":
+		return item.GUID
+	case item.Link != "":
+		return item.Link
+	}
+	return item.Title + " " + item.Published
+}
+
+// itemTime returns when the item was published, if the feed does not tell
+// it is now
+func itemTime(item *gofeed.Item, now time.Time) time.Time {
+	switch {
+	case item.PublishedParsed != nil:
+		return *item.PublishedParsed
+	case item.UpdatedParsed != nil:
+		return *item.UpdatedParsed
+	}
+	return now
+}
+
+// processFeedItem creates a message out of the item and saves its images. An
+// image that cannot be saved is left out.
+func processFeedItem(parsed *gofeed.Feed, item *gofeed.Item, t time.Time, feedURL string, limits ImageLimits, client *http.Client) *MessageData {
+
+	data := new(MessageData)
+	data.Type = FEED
+	data.Timestamp = t
+
+	var authors []string
+	for _, a := range item.Authors {
+		if a.Name != "" {
+			authors = append(authors, a.Name)
+		}
+	}
+	data.SenderName = strings.Join(authors, ", ")
+	if data.SenderName == "" {
+		data.SenderName = parsed.Title
+	}
+	data.ShortText = htmlToText(item.Title)
+	data.LongText = htmlToText(item.Description)
+	if data.LongText == "" {
+		data.LongText = htmlToText(item.Content)
+	}
+
+	// relative links are relative to the item or the feed
+	base, err := url.Parse(item.Link)
+	if err != nil || !base.IsAbs() {
+		base, _ = url.Parse(feedURL)
+	}
+	for _, u := range itemImages(item) {
+		ref, err := url.Parse(u)
+		if err != nil {
+			log.Printf("Invalid image URL %v: %v\n", u, err)
+			continue
+		}
+		if base != nil {
+			ref = base.ResolveReference(ref)
+		}
+		err = data.saveImageURL(ref.String(), limits, client)
+		if err != nil {
+			log.Printf("Failed to save image %v: %v\n", ref, err)
+		}
+	}
+
+	return data
+}
+
+// itemImages returns the URLs of the images of the item: image enclosures,
+// media:content and media:thumbnail, also inside a media:group, and the item image
+func itemImages(item *gofeed.Item) []string {
+	var urls []string
+	add := func(u, mediaType, medium string) {
+		if u == "" {
+			return
+		}
+		isImage := medium == "image" || strings.HasPrefix(mediaType, "image/")
+		if medium == "" && mediaType == "" {
+			switch strings.ToLower(path.Ext(strings.SplitN(u, "?", 2)[0])) {
+			case ".jpg", ".jpeg", ".png", ".gif":
+				isImage = true
+			}
+		}
+		if !isImage {
+			return
+		}
+		for _, v := range urls {
+			if v == u {
+				return
+			}
+		}
+		urls = append(urls, u)
+	}
+
+	for _, e := range item.Enclosures {
+		add(e.URL, e.Type, "")
+	}
+	media := item.Extensions["media"]
+	for _, g := range media["group"] {
+		for _, c := range g.Children["content"] {
+			add(c.Attrs["url"], c.Attrs["type"], c.Attrs["medium"])
+		}
+	}
+	for _, c := range media["content"] {
+		add(c.Attrs["url"], c.Attrs["type"], c.Attrs["medium"])
+	}
+	// the thumbnail is only needed if there is no full image
+	if len(urls) == 0 {
+		for _, c := range media["thumbnail"] {
+			add(c.Attrs["url"], "", "image")
+		}
+	}
+	if len(urls) == 0 && item.Image != nil {
+		add(item.Image.URL, "", "image")
+	}
+	return urls
+}
@@ -0,0 +1,228 @@
+package web
+
+import (
+	"fmt"
+	"github.com/flothe/pinboard/web/pop3test"
+	"github.com/mmcdole/gofeed"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// feedServer serves an RSS feed at /feed.xml with ETag and Last-Modified, a
+// request with the validators of the current version gets 304. The photo is
+// served at /photo.jpg.
+type feedServer struct {
+	*httptest.Server
+	mu    sync.Mutex
+	items []string
+	// the feed changes with every item
+	version int
+	// no ETag is sent, only Last-Modified
+	noETag bool
+	// the conditional headers of the feed requests
+	conditions [][2]string
+}
+
+func newFeedServer(t *testing.T) *feedServer {
+	s := &feedServer{}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/feed.xml", s.feed)
+	mux.HandleFunc("/photo.jpg", func(w http.ResponseWriter, r *http.Request) {
+		w.Write(pop3test.JPEG(30, 20))
+	})
+	s.Server = httptest.NewServer(mux)
+	t.Cleanup(s.Close)
+	return s
+}
+
+// addItem adds an item published at pub, extra is added to its XML
+func (s *feedServer) addItem(guid, title string, pub time.Time, extra string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.items = append(s.items, fmt.Sprintf("<item><guid>%v</guid><title>%v</title><link>%v/items/%v</link><pubDate>%v</pubDate>%v</item>",
+		guid, title, s.URL, guid, pub.Format(time.RFC1123Z), extra))
+	s.version++
+}
+
+func (s *feedServer) feed(w http.ResponseWriter, r *http.Request) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	inm, ims := r.Header.Get("If-None-Match"), r.Header.Get("If-Modified-Since")
+	s.conditions = append(s.conditions, [2]string{inm, ims})
+	etag := fmt.Sprintf(`"v%v"`, s.version)
+	modified := time.Date(2019, 12, 1, 0, 0, 0, 0, time.UTC).Add(time.Duration(s.version) * time.Hour).Format(http.TimeFormat)
+	if !s.noETag && inm == etag || s.noETag && ims == modified {
+		w.WriteHeader(http.StatusNotModified)
+		return
+	}
+	if !s.noETag {
+		w.Header().Set("ETag", etag)
+	}
+	w.Header().Set("Last-Modified", modified)
+	w.Header().Set("Content-Type", "application/rss+xml")
+	fmt.Fprintf(w, `<?xml version="1.0"?><rss version="2.0" xmlns:media="http://search.yahoo.com/mrss/"><channel><title>Intranet</title>%v</channel></rss>`,
+		strings.Join(s.items, ""))
+}
+
+// requests returns the conditional headers of the feed requests
+func (s *feedServer) requests() [][2]string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([][2]string(nil), s.conditions...)
+}
+
+func startFeedCrawl(t *testing.T, s *feedServer, opts FeedOptions) *testCrawl {
+	clk := newFakeClock()
+	return startCrawl(t, NewFeedCrawler([]string{s.URL + "/feed.xml"}, opts, DefaultImageLimits, clk), clk)
+}
+
+func TestFeedCrawlerConditionalGet(t *testing.T) {
+	chdirTemp(t)
+	s := newFeedServer(t)
+	now := newFakeClock().Now()
+	s.addItem("a", "Kantine &amp; Menü", now.Add(-2*time.Hour), `<enclosure url="/photo.jpg" type="image/jpeg" length="1"/>`)
+	s.addItem("b", "Neuer Drucker", now.Add(-time.Hour), "")
+	cr := startFeedCrawl(t, s, FeedOptions{})
+
+	// oldest first, the relative enclosure is loaded from the server
+	e := cr.recv(t)
+	if e.Type != FEED || e.ShortText != "Kantine & Menü" || e.SenderName != "Intranet" || !e.Timestamp.Equal(now.Add(-2*time.Hour)) {
+		t.Errorf("got %v %q from %q at %v", e.Type, e.ShortText, e.SenderName, e.Timestamp)
+	}
+	if len(e.ImageNames) != 1 {
+		t.Errorf("images %v, want the enclosure", e.ImageNames)
+	}
+	if e := cr.recv(t); e.ShortText != "Neuer Drucker" {
+		t.Errorf("got %q, want the second item", e.ShortText)
+	}
+
+	// the unchanged feed is not downloaded again
+	cr.next(t, time.Minute)
+	req := s.requests()
+	if got := req[len(req)-1]; got[0] != `"v2"` || got[1] == "" {
+		t.Errorf("request with If-None-Match %q and If-Modified-Since %q, want the validators", got[0], got[1])
+	}
+	s.addItem("c", "Feueralarm", now, "")
+	cr.clk.Advance(time.Minute)
+	if e := cr.recv(t); e.ShortText != "Feueralarm" {
+		t.Errorf("got %q, want the new item only", e.ShortText)
+	}
+	cr.idle(t)
+}
+
+func TestFeedCrawlerIfModifiedSince(t *testing.T) {
+	chdirTemp(t)
+	s := newFeedServer(t)
+	s.noETag = true
+	s.addItem("a", "Erster", newFakeClock().Now(), "")
+	cr := startFeedCrawl(t, s, FeedOptions{})
+
+	cr.recv(t)
+	cr.next(t, time.Minute)
+	cr.next(t, time.Minute)
+	req := s.requests()
+	if len(req) != 3 {
+		t.Fatalf("%v requests, want 3", len(req))
+	}
+	for _, got := range req[1:] {
+		if got[0] != "" || got[1] != "Sun, 01 Dec 2019 01:00:00 GMT" {
+			t.Errorf("request with If-None-Match %q and If-Modified-Since %q", got[0], got[1])
+		}
+	}
+}
+
+func TestFeedCrawlerRestart(t *testing.T) {
+	chdirTemp(t)
+	s := newFeedServer(t)
+	now := newFakeClock().Now()
+	s.addItem("a", "Erster", now.Add(-time.Hour), "")
+	s.addItem("b", "Zweiter", now, "")
+	cr := startFeedCrawl(t, s, FeedOptions{})
+	cr.recv(t)
+	cr.recv(t)
+	cr.idle(t)
+	cr.stop(t)
+
+	// the GUIDs are saved, the restarted crawler only sends the new item
+	s.addItem("c", "Dritter", now, "")
+	cr = startFeedCrawl(t, s, FeedOptions{})
+	if e := cr.recv(t); e.ShortText != "Dritter" {
+		t.Errorf("got %q after the restart, want the new item", e.ShortText)
+	}
+	cr.idle(t)
+	// the validators are not saved, the feed is downloaded after a restart
+	if req := s.requests(); req[1][0] != "" {
+		t.Errorf("the first request after the restart has If-None-Match %q", req[1][0])
+	}
+}
+
+func TestFeedCrawlerLimits(t *testing.T) {
+	chdirTemp(t)
+	s := newFeedServer(t)
+	now := newFakeClock().Now()
+	s.addItem("alt", "Zu alt", now.Add(-3*24*time.Hour), "")
+	s.addItem("c", "Vor drei Stunden", now.Add(-3*time.Hour), "")
+	s.addItem("a", "Vor einer Stunde", now.Add(-time.Hour), "")
+	s.addItem("b", "Vor zwei Stunden", now.Add(-2*time.Hour), "")
+	cr := startFeedCrawl(t, s, FeedOptions{MaxAge: 24 * time.Hour, MaxItems: 2})
+
+	// the two newest items, oldest first
+	for _, want := range []string{"Vor zwei Stunden", "Vor einer Stunde"} {
+		if e := cr.recv(t); e.ShortText != want {
+			t.Errorf("got %q, want %q", e.ShortText, want)
+		}
+	}
+	cr.idle(t)
+
+	// without the item limit only the age counts
+	cr.stop(t)
+	cr = startFeedCrawl(t, s, FeedOptions{MaxAge: 24 * time.Hour})
+	if e := cr.recv(t); e.ShortText != "Vor drei Stunden" {
+		t.Errorf("got %q, want the item within MaxAge", e.ShortText)
+	}
+	cr.idle(t)
+}
+
+func TestItemImages(t *testing.T) {
+	const rss = `<?xml version="1.0"?>
+<rss version="2.0" xmlns:media="http://search.yahoo.com/mrss/"><channel><title>Bilder</title>
+<item><title>Alle Arten</title>
+  <enclosure url="https://example.com/enc.jpg" type="image/jpeg" length="1"/>
+  <enclosure url="https://example.com/talk.mp3" type="audio/mpeg" length="1"/>
+  <media:content url="https://example.com/content.png" medium="image"/>
+  <media:content url="https://example.com/clip.mp4" type="video/mp4"/>
+  <media:content url="https://example.com/enc.jpg" type="image/jpeg"/>
+  <media:group><media:content url="https://example.com/group.webp" type="image/webp"/></media:group>
+  <media:thumbnail url="https://example.com/thumb.jpg"/>
+</item>
+<item><title>Nur Vorschau</title>
+  <media:content url="https://example.com/clip.mp4" type="video/mp4"/>
+  <media:thumbnail url="https://example.com/thumb.jpg"/>
+</item>
+<item><title>Ohne Typ</title>
+  <media:content url="https://example.com/foto.PNG?size=large"/>
+  <media:content url="https://example.com/plan.pdf"/>
+</item>
+<item><title>Ohne Bild</title></item>
+</channel></rss>`
+	feed, err := gofeed.NewParser().ParseString(rss)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := [][]string{
+		{"https://example.com/enc.jpg", "https://example.com/group.webp", "https://example.com/content.png"},
+		{"https://example.com/thumb.jpg"},
+		{"https://example.com/foto.PNG?size=large"},
+		nil,
+	}
+	for i, item := range feed.Items {
+		if got := itemImages(item); !reflect.DeepEqual(got, want[i]) {
+			t.Errorf("%v: got %v, want %v", item.Title, got, want[i])
+		}
+	}
+}
@@ -0,0 +1,216 @@
+package web
+
+import (
+	"bytes"
+	"encoding/gob"
+	"encoding/json"
+	"fmt"
+	"time"
+)
+
+// Messages are saved as JSON:
+//
+//	{"format": "pinboard-message", "version": 1, "message": {...}}
+//
+// The fields of the message have fixed names and the type is saved by name,
+// e.g. "email", so the files do not depend on the Go names and can be read
+// by other programs. The rules for changes of the format:
+//
+//   - fields may be added without a new version, readers ignore the fields
+//     they do not know and a missing field has its zero value
+//   - a new type of message needs no new version, older readers load it as
+//     UNDEF
+//   - renaming or removing a field or changing its meaning needs a new
+//     version, readers refuse files of a newer version than they know and
+//     leave them untouched
+//
+// Files of older versions and the gob files written before the format
+// existed are still read.
+const (
+	MessageFormat        = "pinboard-message"
+	MessageFormatVersion = 1
+)
+
+// names of the types in the files, they must never change
+var messageTypeNames = map[MessageDataType]string{
+	UNDEF:   "undef",
+	TWEET:   "tweet",
+	EMAIL:   "email",
+	FEED:    "feed",
+	TOOT:    "toot",
+	WEBHOOK: "webhook",
+	FILE:    "file",
+	EVENT:   "event",
+}
+
+// String returns the name of the type in the files
+func (t MessageDataType) String() string {
+	if name, ok := messageTypeNames[t]; ok {
+		return name
+	}
+	return fmt.Sprintf("type-%d", int(t))
+}
+
+// MarshalJSON writes the type by name
+func (t MessageDataType) MarshalJSON() ([]byte, error) {
+	return json.Marshal(t.String())
+}
+
+// UnmarshalJSON reads the type by name, an unknown type is UNDEF. The number
+// of the type is read as well.
+func (t *MessageDataType) UnmarshalJSON(buf []byte) error {
+	var n int
+	if json.Unmarshal(buf, &n) == nil {
+		*t = MessageDataType(n)
+		return nil
+	}
+	var name string
+	if err := json.Unmarshal(buf, &name); err != nil {
+		return err
+	}
+	*t = UNDEF
+	for typ, n := range messageTypeNames {
+		if n == name {
+			*t = typ
+		}
+	}
+	return nil
+}
+
+// NewerFormatError is returned for a file written in a newer version of the
+// format
+type NewerFormatError struct {
+	Version int
+}
+
+func (e *NewerFormatError) Error() string {
+	return fmt.Sprintf("Message format version %v is newer than the supported version %v", e.Version, MessageFormatVersion)
+}
+
+// messageFile is the content of a file
+type messageFile struct {
+	Format  string          `json:"format"`
+	Version int             `json:"version"`
+	Message json.RawMessage `json:"message"`
+}
+
+// messageJSON are the fields of version 1, times that are not set are left
+// out
+type messageJSON struct {
+	ID         string          `json:"id,omitempty"`
+	Type       MessageDataType `json:"type"`
+	Source     string          `json:"source,omitempty"`
+	Timestamp  *time.Time      `json:"timestamp,omitempty"`
+	SenderName string          `json:"sender,omitempty"`
+	ShortText  string          `json:"text,omitempty"`
+	LongText   string          `json:"long_text,omitempty"`
+	ImageNames []string        `json:"images,omitempty"`
+	VideoNames []string        `json:"videos,omitempty"`
+	AudioNames []string        `json:"audios,omitempty"`
+	ShowFrom   *time.Time      `json:"show_from,omitempty"`
+	ShowUntil  *time.Time      `json:"show_until,omitempty"`
+	EventStart *time.Time      `json:"event_start,omitempty"`
+	EventEnd   *time.Time      `json:"event_end,omitempty"`
+	AllDay     bool            `json:"all_day,omitempty"`
+	Location   string          `json:"location,omitempty"`
+}
+
+func optionalTime(t time.Time) *time.Time {
+	if t.IsZero() {
+		return nil
+	}
+	return &t
+}
+
+func fromOptionalTime(t *time.Time) time.Time {
+	if t == nil {
+		return time.Time{}
+	}
+	return *t
+}
+
+// Encode returns the message in the current version of the format
+func (e *MessageData) Encode() ([]byte, error) {
+	m, err := json.Marshal(messageJSON{
+		ID:         e.ID,
+		Type:       e.Type,
+		Source:     e.Source,
+		Timestamp:  optionalTime(e.Timestamp),
+		SenderName: e.SenderName,
+		ShortText:  e.ShortText,
+		LongText:   e.LongText,
+		ImageNames: e.ImageNames,
+		VideoNames: e.VideoNames,
+		AudioNames: e.AudioNames,
+		ShowFrom:   optionalTime(e.ShowFrom),
+		ShowUntil:  optionalTime(e.ShowUntil),
+		EventStart: optionalTime(e.EventStart),
+		EventEnd:   optionalTime(e.EventEnd),
+		AllDay:     e.AllDay,
+		Location:   e.Location,
+	})
+	if err != nil {
+		return nil, err
+	}
+	return json.MarshalIndent(messageFile{Format: MessageFormat, Version: MessageFormatVersion, Message: m}, "", "  ")
+}
+
+// IsLegacyMessage tells if buf is not JSON, i.e. a gob file of the time
+// before the format
+func IsLegacyMessage(buf []byte) bool {
+	trimmed := bytes.TrimLeft(buf, " \t\r\n")
+	return len(trimmed) == 0 || trimmed[0] != '{' || !json.Valid(buf)
+}
+
+// DecodeMessage reads a message in any version of the format or a legacy
+// gob file. A file of a newer version returns a *NewerFormatError.
+func DecodeMessage(buf []byte) (*MessageData, error) {
+	e := new(MessageData)
+	if IsLegacyMessage(buf) {
+		err := gob.NewDecoder(bytes.NewReader(buf)).Decode(e)
+		if err == nil {
+			return e, nil
+		}
+		// a broken JSON file is reported as such
+		if trimmed := bytes.TrimLeft(buf, " \t\r\n"); len(trimmed) == 0 || trimmed[0] != '{' {
+			return nil, err
+		}
+	}
+
+	var f messageFile
+	if err := json.Unmarshal(buf, &f); err != nil {
+		return nil, err
+	}
+	if f.Format != MessageFormat {
+		return nil, fmt.Errorf("Not a message: format %q", f.Format)
+	}
+	if f.Version > MessageFormatVersion {
+		return nil, &NewerFormatError{Version: f.Version}
+	}
+	if f.Version < 1 || len(f.Message) == 0 {
+		return nil, fmt.Errorf("Invalid message version %v", f.Version)
+	}
+	var m messageJSON
+	if err := json.Unmarshal(f.Message, &m); err != nil {
+		return nil, err
+	}
+	*e = MessageData{
+		ID:         m.ID,
+		Type:       m.Type,
+		Source:     m.Source,
+		Timestamp:  fromOptionalTime(m.Timestamp),
+		SenderName: m.SenderName,
+		ShortText:  m.ShortText,
+		LongText:   m.LongText,
+		ImageNames: m.ImageNames,
+		VideoNames: m.VideoNames,
+		AudioNames: m.AudioNames,
+		ShowFrom:   fromOptionalTime(m.ShowFrom),
+		ShowUntil:  fromOptionalTime(m.ShowUntil),
+		EventStart: fromOptionalTime(m.EventStart),
+		EventEnd:   fromOptionalTime(m.EventEnd),
+		AllDay:     m.AllDay,
+		Location:   m.Location,
+	}
+	return e, nil
+}
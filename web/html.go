@@ -0,0 +1,47 @@
+package web
+
+import (
+	"golang.org/x/net/html"
+	"strings"
+)
+
+// htmlToText returns the text of the HTML fragment as it would be read:
+// paragraphs and line breaks become new lines, scripts and styles are
+// dropped, all other whitespace is collapsed
+func htmlToText(s string) string {
+	var text []string
+	var line strings.Builder
+	newLine := func() {
+		if l := strings.Join(strings.Fields(line.String()), " "); l != "" {
+			text = append(text, l)
+		}
+		line.Reset()
+	}
+
+	z := html.NewTokenizer(strings.NewReader(s))
+	skip := 0
+	for {
+		tt := z.Next()
+		switch tt {
+		case html.ErrorToken:
+			newLine()
+			return strings.Join(text, "\n")
+		case html.TextToken:
+			if skip == 0 {
+				line.Write(z.Text())
+			}
+		case html.StartTagToken, html.EndTagToken, html.SelfClosingTagToken:
+			name, _ := z.TagName()
+			switch string(name) {
+			case "script", "style":
+				if tt == html.StartTagToken {
+					skip++
+				} else if tt == html.EndTagToken && skip > 0 {
+					skip--
+				}
+			case "br", "p", "div", "li", "h1", "h2", "h3", "h4", "h5", "h6", "blockquote", "tr":
+				newLine()
+			}
+		}
+	}
+}
@@ -0,0 +1,22 @@
+package web
+
+import "testing"
+
+func TestHTMLToText(t *testing.T) {
+	tests := []struct {
+		html, text string
+	}{
+		{"<p>Hallo &amp; willkommen</p>", "Hallo & willkommen"},
+		{"<p>Erste Zeile<br>zweite Zeile</p><p>Absatz</p>", "Erste Zeile\nzweite Zeile\nAbsatz"},
+		{"<p>Link: <a href=\"https://example.com/x\"><span class=\"invisible\">https://</span><span>example.com/x</span></a></p>", "Link: https://example.com/x"},
+		{"<p>  viel \n\t Platz </p>", "viel Platz"},
+		{"<style>p { color: red }</style><p>Text</p><script>alert(1)</script>", "Text"},
+		{"<ul><li>eins</li><li>zwei</li></ul>", "eins\nzwei"},
+		{"", ""},
+	}
+	for _, tt := range tests {
+		if got := htmlToText(tt.html); got != tt.text {
+			t.Errorf("htmlToText(%q) = %q, want %q", tt.html, got, tt.text)
+		}
+	}
+}
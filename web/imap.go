@@ -0,0 +1,314 @@
+package web
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"github.com/emersion/go-imap"
+	"github.com/emersion/go-imap/client"
+	"github.com/flothe/pinboard/clock"
+	"log"
+	"net/mail"
+	"time"
+)
+
+// IMAPCrawler crawls the unseen mails of an IMAP folder. New mails are pushed
+// by the server with IDLE. Crawled mails are marked as seen or moved to
+// another folder, they are never deleted.
+type IMAPCrawler struct {
+	attempts
+	url, user, pass string
+	// folder that is crawled
+	folder string
+	// crawled mails are moved to this folder, if empty they are marked as seen
+	moveTo string
+	// TLS settings of the connection, if nil the system defaults are used
+	TLSConfig *tls.Config
+	limits    ImageLimits
+	clock     clock.Clock
+	// waiting time before the next login after a failure
+	retry Backoff
+	// failed attempts per UID of the mails that cannot be processed
+	failures map[uint32]int
+}
+
+// the login is tried again after 10s, then the waiting time doubles up to 10m
+const (
+	imapRetryMin = 10 * time.Second
+	imapRetryMax = 10 * time.Minute
+)
+
+// imapSession is a logged in connection with the folder selected
+type imapSession struct {
+	c       *client.Client
+	updates chan client.Update
+	// receives a value when the server reports new mails
+	newMail chan bool
+}
+
+// NewIMAPCrawler returns a crawler for the folder of the IMAP mailbox at url.
+// If moveTo is not empty, crawled mails are moved to this folder, it is
+// created if needed. Images are scaled to fit into limits.
+func NewIMAPCrawler(url, username, password, folder, moveTo string, limits ImageLimits, clk clock.Clock) *IMAPCrawler {
+	clk = clock.Or(clk)
+	if folder == "" {
+		folder = "INBOX"
+	}
+	return &IMAPCrawler{
+		url:      url,
+		user:     username,
+		pass:     password,
+		folder:   folder,
+		moveTo:   moveTo,
+		limits:   limits,
+		clock:    clk,
+		retry:    Backoff{Min: imapRetryMin, Max: imapRetryMax},
+		failures: make(map[uint32]int),
+	}
+}
+
+func (crawler *IMAPCrawler) Crawl(ctx context.Context, entries chan<- MessageData, repeatDuration time.Duration) error {
+	log.Printf("Start crawling mails from: %s/%s", crawler.url, crawler.folder)
+
+	for {
+		s, err := crawler.login()
+		if err == nil {
+			err = crawler.crawlFolder(ctx, s, entries, repeatDuration)
+			s.logout()
+		}
+		if ctx.Err() != nil {
+			log.Printf("Stop crawling mails from: %s/%s", crawler.url, crawler.folder)
+			return nil
+		}
+		log.Printf("Crawling attemp failed: %v\n", err)
+		crawler.report(err)
+
+		// try again later, the longer the server fails the later
+		wait := crawler.retry.Next()
+		log.Printf("Going to sleep for %v. Afterwards trying again to login.\n", wait)
+		select {
+		case <-ctx.Done():
+			log.Printf("Stop crawling mails from: %s/%s", crawler.url, crawler.folder)
+			return nil
+		case <-crawler.clock.After(wait):
+		}
+	}
+}
+
+// crawlFolder fetches the unseen mails, then waits for new mails and fetches
+// again until ctx is done (nil is returned) or an error occurs. Without new
+// mails the folder is fetched every repeatDuration anyway.
+func (crawler *IMAPCrawler) crawlFolder(ctx context.Context, s *imapSession, entries chan<- MessageData, repeatDuration time.Duration) error {
+	for {
+		if err := crawler.fetchUnseen(ctx, s, entries); err != nil {
+			return err
+		}
+		if ctx.Err() != nil {
+			return nil
+		}
+		crawler.retry.Reset()
+		crawler.report(nil)
+
+		// wait for the push of the server
+		stop := make(chan struct{})
+		idleDone := make(chan error, 1)
+		go func() {
+			idleDone <- s.c.Idle(stop, nil)
+		}()
+
+		select {
+		case <-s.newMail:
+			log.Printf("New mails in %s/%s\n", crawler.url, crawler.folder)
+		case <-crawler.clock.After(repeatDuration):
+		case <-ctx.Done():
+		case err := <-idleDone:
+			return fmt.Errorf("IDLE failed: %v", err)
+		}
+		close(stop)
+		if err := <-idleDone; err != nil {
+			return fmt.Errorf("IDLE failed: %v", err)
+		}
+		if ctx.Err() != nil {
+			return nil
+		}
+	}
+}
+
+// fetchUnseen sends all unseen mails of the folder to entries and marks them
+// as crawled when they have been stored. Mails that cannot be processed stay
+// unseen and are tried again the next time, after maxMailAttempts they are
+// marked anyway. If ctx is done while a mail is sent, the fetch stops and the
+// mail stays unseen.
+func (crawler *IMAPCrawler) fetchUnseen(ctx context.Context, s *imapSession, entries chan<- MessageData) error {
+	criteria := imap.NewSearchCriteria()
+	criteria.WithoutFlags = []string{imap.SeenFlag}
+	uids, err := s.c.UidSearch(criteria)
+	if err != nil {
+		return err
+	}
+	log.Printf("Number of unseen messages: %v\n", len(uids))
+	unseen := make(map[uint32]bool)
+	for _, uid := range uids {
+		unseen[uid] = true
+	}
+	for uid := range crawler.failures {
+		if !unseen[uid] {
+			delete(crawler.failures, uid)
+		}
+	}
+
+	for _, uid := range uids {
+		seqset := new(imap.SeqSet)
+		seqset.AddNum(uid)
+
+		msg, err := crawler.fetch(s, seqset)
+		if err != nil {
+			return err
+		}
+		if msg == nil {
+			log.Printf("Message %v has vanished\n", uid)
+			continue
+		}
+		log.Printf("Retrieve message: %v\n", uid)
+
+		// create a CrawlEntry out of the message
+		entry, err := processMailMessage(msg, crawler.limits)
+		if err != nil {
+			crawler.failures[uid]++
+			if crawler.failures[uid] < maxMailAttempts {
+				// try again with the next fetch
+				log.Printf("Failed to process message %v: %v\n", uid, err)
+				continue
+			}
+			log.Printf("Failed to process message %v %v times, skipping it: %v\n", uid, maxMailAttempts, err)
+			delete(crawler.failures, uid)
+			if err := crawler.markCrawled(s, seqset); err != nil {
+				return err
+			}
+			continue
+		}
+		delete(crawler.failures, uid)
+		log.Printf("Created entry from mail: %v, %v, %v\n", entry.SenderName, entry.ShortText, entry.ImageNames)
+		// send message using the channel ...
+		sent, err := sendStored(ctx, entries, entry)
+		if !sent {
+			removeImages(entry)
+			return nil
+		}
+		if ctx.Err() != nil {
+			// if it has been stored, the next fetch replaces it
+			return nil
+		}
+		if err != nil {
+			return fmt.Errorf("Message %v has not been stored: %v", uid, err)
+		}
+
+		// ... and mark the message on the server when it is stored
+		if err := crawler.markCrawled(s, seqset); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// markCrawled moves the mails to moveTo or marks them as seen
+func (crawler *IMAPCrawler) markCrawled(s *imapSession, seqset *imap.SeqSet) error {
+	if crawler.moveTo != "" {
+		log.Printf("Move message %v to %v\n", seqset, crawler.moveTo)
+		return s.c.UidMove(seqset, crawler.moveTo)
+	}
+	log.Printf("Mark message %v as seen\n", seqset)
+	return s.c.UidStore(seqset, imap.FormatFlagsOp(imap.AddFlags, true), []interface{}{imap.SeenFlag}, nil)
+}
+
+// fetch returns the mail without marking it as seen, or nil if it does not exist
+func (crawler *IMAPCrawler) fetch(s *imapSession, seqset *imap.SeqSet) (*mail.Message, error) {
+	section := &imap.BodySectionName{Peek: true}
+	msgs := make(chan *imap.Message, 1)
+	done := make(chan error, 1)
+	go func() {
+		done <- s.c.UidFetch(seqset, []imap.FetchItem{section.FetchItem()}, msgs)
+	}()
+
+	var body imap.Literal
+	for m := range msgs {
+		if b := m.GetBody(section); b != nil {
+			body = b
+		}
+	}
+	if err := <-done; err != nil {
+		return nil, err
+	}
+	if body == nil {
+		return nil, nil
+	}
+	return mail.ReadMessage(body)
+}
+
+func (crawler *IMAPCrawler) login() (*imapSession, error) {
+	// create client
+	c, err := client.DialTLS(crawler.url, crawler.TLSConfig)
+	if err != nil {
+		log.Printf("Login to server (%v) failed: %v\n", crawler.url, err)
+		return nil, err
+	}
+	s := &imapSession{c: c, updates: make(chan client.Update, 16), newMail: make(chan bool, 1)}
+	c.Updates = s.updates
+	// the client blocks if the updates are not read
+	go func() {
+		for u := range s.updates {
+			if _, ok := u.(*client.MailboxUpdate); ok {
+				select {
+				case s.newMail <- true:
+				default:
+					// there is already a notification
+				}
+			}
+		}
+	}()
+
+	// login to server
+	err = c.Login(crawler.user, crawler.pass)
+	if err == nil && crawler.moveTo != "" {
+		err = crawler.createFolder(c, crawler.moveTo)
+	}
+	if err == nil {
+		_, err = c.Select(crawler.folder, false)
+	}
+	if err != nil {
+		log.Printf("Login to server (%v) failed: %v\n", crawler.url, err)
+		s.logout()
+		return nil, err
+	}
+	log.Printf("Login to server (%v) successful.\n", crawler.url)
+	return s, nil
+}
+
+// createFolder creates the folder if it does not exist
+func (crawler *IMAPCrawler) createFolder(c *client.Client, name string) error {
+	mailboxes := make(chan *imap.MailboxInfo, 10)
+	done := make(chan error, 1)
+	go func() {
+		done <- c.List("", name, mailboxes)
+	}()
+	exists := false
+	for _ = range mailboxes {
+		exists = true
+	}
+	if err := <-done; err != nil {
+		return err
+	}
+	if exists {
+		return nil
+	}
+	log.Printf("Create folder %v\n", name)
+	return c.Create(name)
+}
+
+func (s *imapSession) logout() {
+	if err := s.c.Logout(); err != nil {
+		s.c.Terminate()
+	}
+	<-s.c.LoggedOut()
+	close(s.updates)
+}
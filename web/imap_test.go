@@ -0,0 +1,146 @@
+package web
+
+import (
+	"github.com/emersion/go-imap"
+	"github.com/flothe/pinboard/web/imaptest"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+const (
+	imapMail1 = "From: Anna <anna@example.com>\r\nTo: pinboard@example.com\r\n" +
+		"Subject: =?UTF-8?Q?Kuchen_in_der_K=C3=BCche?=\r\nDate: Thu, 15 May 2014 12:30:00 +0200\r\n" +
+		"Content-Type: text/plain; charset=utf-8\r\n\r\nHallo zusammen\r\n"
+	imapMail2 = "From: Bob <bob@example.com>\r\nTo: pinboard@example.com\r\n" +
+		"Subject: Zweite\r\nDate: Thu, 15 May 2014 13:30:00 +0200\r\n" +
+		"Content-Type: text/plain\r\n\r\nNoch eine\r\n"
+)
+
+// newIMAPServer starts a stand-in for user "pinboard" that is closed with
+// the test
+func newIMAPServer(t *testing.T) *imaptest.Server {
+	s, err := imaptest.NewServer("pinboard", "secret")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { s.Close() })
+	return s
+}
+
+func startIMAPCrawl(t *testing.T, s *imaptest.Server, password, moveTo string) *testCrawl {
+	clk := newFakeClock()
+	c := NewIMAPCrawler(s.Addr, "pinboard", password, "INBOX", moveTo, DefaultImageLimits, clk)
+	c.TLSConfig = s.ClientTLSConfig
+	return startCrawl(t, c, clk)
+}
+
+func deliver(t *testing.T, s *imaptest.Server, mail string) {
+	if err := s.Deliver("INBOX", []byte(mail)); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// seenMails returns how many mails of the folder are marked as seen and how
+// many it has
+func seenMails(t *testing.T, s *imaptest.Server, folder string) (seen, all int) {
+	msgs, err := s.Messages(folder)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, m := range msgs {
+		for _, f := range m.Flags {
+			if f == imap.SeenFlag {
+				seen++
+			}
+		}
+	}
+	return seen, len(msgs)
+}
+
+func TestIMAPCrawlerMarksSeen(t *testing.T) {
+	chdirTemp(t)
+	s := newIMAPServer(t)
+	deliver(t, s, imapMail1)
+	cr := startIMAPCrawl(t, s, "secret", "")
+
+	e := cr.recv(t)
+	sent := time.Date(2014, 5, 15, 10, 30, 0, 0, time.UTC)
+	if e.Type != EMAIL || e.ShortText != "Kuchen in der Küche" || e.SenderName != "Anna <anna@example.com>" || !e.Timestamp.Equal(sent) {
+		t.Errorf("got %v %q from %q at %v", e.Type, e.ShortText, e.SenderName, e.Timestamp)
+	}
+	waitFor(t, "the mail to be marked as seen", func() bool {
+		seen, _ := seenMails(t, s, "INBOX")
+		return seen == 1
+	})
+
+	// the new mail is pushed while the crawler idles, the clock stays
+	cr.idle(t)
+	deliver(t, s, imapMail2)
+	if e := cr.recv(t); e.ShortText != "Zweite" {
+		t.Errorf("got %q, want the pushed mail", e.ShortText)
+	}
+	waitFor(t, "both mails to be marked as seen", func() bool {
+		seen, all := seenMails(t, s, "INBOX")
+		return seen == 2 && all == 2
+	})
+}
+
+func TestIMAPCrawlerMoves(t *testing.T) {
+	chdirTemp(t)
+	s := newIMAPServer(t)
+	deliver(t, s, imapMail1)
+	cr := startIMAPCrawl(t, s, "secret", "Pinned")
+
+	if e := cr.recv(t); e.ShortText != "Kuchen in der Küche" {
+		t.Errorf("got %q", e.ShortText)
+	}
+	cr.idle(t)
+	deliver(t, s, imapMail2)
+	if e := cr.recv(t); e.ShortText != "Zweite" {
+		t.Errorf("got %q, want the pushed mail", e.ShortText)
+	}
+	waitFor(t, "the mails to be moved", func() bool {
+		_, inbox := seenMails(t, s, "INBOX")
+		_, pinned := seenMails(t, s, "Pinned")
+		return inbox == 0 && pinned == 2
+	})
+}
+
+func TestIMAPCrawlerWrongPassword(t *testing.T) {
+	chdirTemp(t)
+	s := newIMAPServer(t)
+	deliver(t, s, imapMail1)
+	cr := startIMAPCrawl(t, s, "wrong", "")
+
+	// the login is tried again later, nothing is sent
+	cr.next(t, imapRetryMin)
+	cr.next(t, 2*imapRetryMin)
+	if seen, all := seenMails(t, s, "INBOX"); seen != 0 || all != 1 {
+		t.Errorf("%v of %v mails are seen, want the mail unseen", seen, all)
+	}
+}
+
+func TestIMAPCrawlerSkipsBrokenMail(t *testing.T) {
+	chdirTemp(t)
+	s := newIMAPServer(t)
+	deliver(t, s, string(brokenMail()))
+	cr := startIMAPCrawl(t, s, "secret", "")
+
+	// it is tried again with the next fetches, the push after the login may
+	// add one
+	cr.idle(t)
+	if seen, _ := seenMails(t, s, "INBOX"); seen != 0 {
+		t.Errorf("the broken mail is seen after the first fetch")
+	}
+	for i := 1; i < maxMailAttempts; i++ {
+		cr.next(t, time.Minute)
+	}
+	// after the last attempt it is marked like a crawled one
+	if seen, _ := seenMails(t, s, "INBOX"); seen != 1 {
+		t.Errorf("the broken mail is not marked after %v attempts", maxMailAttempts)
+	}
+	if files, _ := filepath.Glob("photo*"); len(files) != 0 {
+		t.Errorf("the images of the broken mail are left: %v", files)
+	}
+}
@@ -0,0 +1,219 @@
+package imaptest
+
+import (
+	"errors"
+	"github.com/emersion/go-imap"
+	"github.com/emersion/go-imap/backend"
+	"github.com/emersion/go-imap/backend/memory"
+	"sync"
+	"time"
+)
+
+// the memory backend has a single fixed user
+const memUsername, memPassword = "username", "password"
+
+// lockedBackend guards the memory backend with a mutex, so the mails can be
+// changed while clients are connected, and sends the updates for IDLE.
+type lockedBackend struct {
+	mu                 sync.Mutex
+	mem                *memory.Backend
+	username, password string
+	updates            chan backend.Update
+}
+
+func (be *lockedBackend) Login(_ *imap.ConnInfo, username, password string) (backend.User, error) {
+	if username != be.username || password != be.password {
+		return nil, errors.New("Bad username or password")
+	}
+	return &lockedUser{be}, nil
+}
+
+func (be *lockedBackend) Updates() <-chan backend.Update {
+	return be.updates
+}
+
+// memUser returns the user of the memory backend, the lock must be held
+func (be *lockedBackend) memUser() (backend.User, error) {
+	return be.mem.Login(nil, memUsername, memPassword)
+}
+
+// mailbox returns the folder of the memory backend, the lock must be held
+func (be *lockedBackend) mailbox(name string) (*memory.Mailbox, error) {
+	u, err := be.memUser()
+	if err != nil {
+		return nil, err
+	}
+	mbox, err := u.GetMailbox(name)
+	if err != nil {
+		return nil, err
+	}
+	return mbox.(*memory.Mailbox), nil
+}
+
+type lockedUser struct {
+	be *lockedBackend
+}
+
+func (u *lockedUser) Username() string {
+	return u.be.username
+}
+
+func (u *lockedUser) ListMailboxes(subscribed bool) ([]backend.Mailbox, error) {
+	u.be.mu.Lock()
+	defer u.be.mu.Unlock()
+	mu, err := u.be.memUser()
+	if err != nil {
+		return nil, err
+	}
+	list, err := mu.ListMailboxes(subscribed)
+	if err != nil {
+		return nil, err
+	}
+	var mailboxes []backend.Mailbox
+	for _, mbox := range list {
+		mailboxes = append(mailboxes, &lockedMailbox{u.be, mbox.(*memory.Mailbox)})
+	}
+	return mailboxes, nil
+}
+
+func (u *lockedUser) GetMailbox(name string) (backend.Mailbox, error) {
+	u.be.mu.Lock()
+	defer u.be.mu.Unlock()
+	mbox, err := u.be.mailbox(name)
+	if err != nil {
+		return nil, err
+	}
+	return &lockedMailbox{u.be, mbox}, nil
+}
+
+func (u *lockedUser) CreateMailbox(name string) error {
+	u.be.mu.Lock()
+	defer u.be.mu.Unlock()
+	mu, err := u.be.memUser()
+	if err != nil {
+		return err
+	}
+	return mu.CreateMailbox(name)
+}
+
+func (u *lockedUser) DeleteMailbox(name string) error {
+	u.be.mu.Lock()
+	defer u.be.mu.Unlock()
+	mu, err := u.be.memUser()
+	if err != nil {
+		return err
+	}
+	return mu.DeleteMailbox(name)
+}
+
+func (u *lockedUser) RenameMailbox(existingName, newName string) error {
+	u.be.mu.Lock()
+	defer u.be.mu.Unlock()
+	mu, err := u.be.memUser()
+	if err != nil {
+		return err
+	}
+	return mu.RenameMailbox(existingName, newName)
+}
+
+func (u *lockedUser) Logout() error {
+	return nil
+}
+
+type lockedMailbox struct {
+	be   *lockedBackend
+	mbox *memory.Mailbox
+}
+
+func (m *lockedMailbox) Name() string {
+	return m.mbox.Name()
+}
+
+func (m *lockedMailbox) Info() (*imap.MailboxInfo, error) {
+	m.be.mu.Lock()
+	defer m.be.mu.Unlock()
+	return m.mbox.Info()
+}
+
+func (m *lockedMailbox) Status(items []imap.StatusItem) (*imap.MailboxStatus, error) {
+	m.be.mu.Lock()
+	defer m.be.mu.Unlock()
+	return m.mbox.Status(items)
+}
+
+func (m *lockedMailbox) SetSubscribed(subscribed bool) error {
+	m.be.mu.Lock()
+	defer m.be.mu.Unlock()
+	return m.mbox.SetSubscribed(subscribed)
+}
+
+func (m *lockedMailbox) Check() error {
+	return nil
+}
+
+func (m *lockedMailbox) ListMessages(uid bool, seqset *imap.SeqSet, items []imap.FetchItem, ch chan<- *imap.Message) error {
+	// the messages are collected first, so the lock is not held while the
+	// server writes them to the connection
+	all := make(chan *imap.Message)
+	done := make(chan error, 1)
+	m.be.mu.Lock()
+	go func() {
+		defer m.be.mu.Unlock()
+		// closes all
+		done <- m.mbox.ListMessages(uid, seqset, items, all)
+	}()
+	var msgs []*imap.Message
+	for msg := range all {
+		msgs = append(msgs, msg)
+	}
+	err := <-done
+	for _, msg := range msgs {
+		ch <- msg
+	}
+	close(ch)
+	return err
+}
+
+func (m *lockedMailbox) SearchMessages(uid bool, criteria *imap.SearchCriteria) ([]uint32, error) {
+	m.be.mu.Lock()
+	defer m.be.mu.Unlock()
+	return m.mbox.SearchMessages(uid, criteria)
+}
+
+func (m *lockedMailbox) CreateMessage(flags []string, date time.Time, body imap.Literal) error {
+	m.be.mu.Lock()
+	defer m.be.mu.Unlock()
+	return m.mbox.CreateMessage(flags, date, body)
+}
+
+func (m *lockedMailbox) UpdateMessagesFlags(uid bool, seqset *imap.SeqSet, op imap.FlagsOp, flags []string) error {
+	m.be.mu.Lock()
+	defer m.be.mu.Unlock()
+	return m.mbox.UpdateMessagesFlags(uid, seqset, op, flags)
+}
+
+func (m *lockedMailbox) CopyMessages(uid bool, seqset *imap.SeqSet, dest string) error {
+	m.be.mu.Lock()
+	defer m.be.mu.Unlock()
+	return m.mbox.CopyMessages(uid, seqset, dest)
+}
+
+// MoveMessages copies the messages and expunges them, the memory backend
+// cannot move
+func (m *lockedMailbox) MoveMessages(uid bool, seqset *imap.SeqSet, dest string) error {
+	m.be.mu.Lock()
+	defer m.be.mu.Unlock()
+	if err := m.mbox.CopyMessages(uid, seqset, dest); err != nil {
+		return err
+	}
+	if err := m.mbox.UpdateMessagesFlags(uid, seqset, imap.AddFlags, []string{imap.DeletedFlag}); err != nil {
+		return err
+	}
+	return m.mbox.Expunge()
+}
+
+func (m *lockedMailbox) Expunge() error {
+	m.be.mu.Lock()
+	defer m.be.mu.Unlock()
+	return m.mbox.Expunge()
+}
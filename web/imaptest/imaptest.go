@@ -0,0 +1,131 @@
+// Package imaptest runs a small IMAP server on a loopback port, so the IMAP
+// crawler can be tried without a real mailbox. The server speaks TLS with a
+// self-signed certificate, supports IDLE and MOVE and keeps the mails in
+// memory.
+package imaptest
+
+import (
+	"bytes"
+	"crypto/tls"
+	"github.com/emersion/go-imap"
+	"github.com/emersion/go-imap/backend"
+	"github.com/emersion/go-imap/backend/memory"
+	"github.com/emersion/go-imap/server"
+	"github.com/flothe/pinboard/web/internal/testcert"
+	"io/ioutil"
+	"log"
+	"time"
+)
+
+// Server is a running IMAP stand-in with a single user.
+type Server struct {
+	// address of the server, e.g. "127.0.0.1:34567"
+	Addr string
+	// TLS config for clients that trusts the certificate of the server
+	ClientTLSConfig *tls.Config
+	srv             *server.Server
+	backend         *lockedBackend
+}
+
+// Message is a mail stored in the server.
+type Message struct {
+	UID   uint32
+	Flags []string
+	Body  []byte
+}
+
+// NewServer starts a server on a loopback port. The user has an empty INBOX.
+func NewServer(username, password string) (*Server, error) {
+	serverTLS, clientTLS, err := testcert.New()
+	if err != nil {
+		return nil, err
+	}
+	l, err := tls.Listen("tcp", "127.0.0.1:0", serverTLS)
+	if err != nil {
+		return nil, err
+	}
+
+	be := &lockedBackend{
+		mem:      memory.New(),
+		username: username,
+		password: password,
+		updates:  make(chan backend.Update, 16),
+	}
+	// the memory backend starts with a demo mail
+	inbox, err := be.mailbox("INBOX")
+	if err != nil {
+		l.Close()
+		return nil, err
+	}
+	inbox.Messages = nil
+
+	s := &Server{
+		Addr:            l.Addr().String(),
+		ClientTLSConfig: clientTLS,
+		srv:             server.New(be),
+		backend:         be,
+	}
+	s.srv.ErrorLog = log.New(ioutil.Discard, "", 0)
+	go s.srv.Serve(l)
+	return s, nil
+}
+
+// Close stops the server and closes all connections.
+func (s *Server) Close() error {
+	return s.srv.Close()
+}
+
+// CreateFolder creates an empty folder.
+func (s *Server) CreateFolder(folder string) error {
+	s.backend.mu.Lock()
+	defer s.backend.mu.Unlock()
+	u, err := s.backend.memUser()
+	if err != nil {
+		return err
+	}
+	return u.CreateMailbox(folder)
+}
+
+// Deliver stores the RFC 5322 mail in the folder as unseen and notifies the
+// clients that idle in this folder.
+func (s *Server) Deliver(folder string, msg []byte) error {
+	s.backend.mu.Lock()
+	mbox, err := s.backend.mailbox(folder)
+	if err == nil {
+		err = mbox.CreateMessage(nil, time.Now(), bytes.NewReader(msg))
+	}
+	var status *imap.MailboxStatus
+	if err == nil {
+		status, err = mbox.Status([]imap.StatusItem{imap.StatusMessages})
+	}
+	s.backend.mu.Unlock()
+	if err != nil {
+		return err
+	}
+
+	update := &backend.MailboxUpdate{Update: backend.NewUpdate(s.backend.username, folder), MailboxStatus: status}
+	// the done channel is created lazily, so it must exist before sending
+	done := update.Done()
+	s.backend.updates <- update
+	<-done
+	return nil
+}
+
+// Messages returns a copy of the mails in the folder.
+func (s *Server) Messages(folder string) ([]Message, error) {
+	s.backend.mu.Lock()
+	defer s.backend.mu.Unlock()
+	mbox, err := s.backend.mailbox(folder)
+	if err != nil {
+		return nil, err
+	}
+	var msgs []Message
+	for _, m := range mbox.Messages {
+		msgs = append(msgs, Message{
+			UID:   m.Uid,
+			Flags: append([]string(nil), m.Flags...),
+			Body:  append([]byte(nil), m.Body...),
+		})
+	}
+	return msgs, nil
+}
@@ -0,0 +1,376 @@
+package web
+
+import (
+	"bufio"
+	"context"
+	"crypto/tls"
+	"encoding/json"
+	"fmt"
+	"github.com/flothe/pinboard/clock"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// MastodonTimeline selects the statuses that are crawled, exactly one of the
+// fields is set
+type MastodonTimeline struct {
+	// hashtag without #
+	Hashtag string
+	// statuses of this account, "user" or "user@domain"
+	Account string
+}
+
+func (t MastodonTimeline) String() string {
+	if t.Hashtag != "" {
+		return "#" + t.Hashtag
+	}
+	return "@" + t.Account
+}
+
+// the first crawl only fetches the latest statuses
+const firstCrawlStatuses = 10
+
+// maximum page size of the Mastodon API
+const mastodonPageSize = 40
+
+// a broken stream is opened again after this time
+const streamRetryDuration = time.Minute
+
+type MastodonCrawler struct {
+	attempts
+	// TLS settings, if nil the system defaults are used
+	TLSConfig *tls.Config
+	// listen to the streaming API, so new statuses of a hashtag are crawled
+	// at once and not only every repeatDuration
+	Streaming bool
+	server    string
+	token     string
+	timeline  MastodonTimeline
+	// file of the id of the last crawled status
+	sinceFile string
+	limits    ImageLimits
+	clock     clock.Clock
+	client    *http.Client
+	// id of the account of the timeline
+	accountID string
+}
+
+// mastodonStatus is the part of a status of the Mastodon API used by the crawler
+type mastodonStatus struct {
+	ID          string    `json:"id"`
+	CreatedAt   time.Time `json:"created_at"`
+	Content     string    `json:"content"`
+	SpoilerText string    `json:"spoiler_text"`
+	Sensitive   bool      `json:"sensitive"`
+	Visibility  string    `json:"visibility"`
+	Account     struct {
+		Acct        string `json:"acct"`
+		DisplayName string `json:"display_name"`
+	} `json:"account"`
+	MediaAttachments []struct {
+		Type       string `json:"type"`
+		URL        string `json:"url"`
+		PreviewURL string `json:"preview_url"`
+	} `json:"media_attachments"`
+	Reblog *mastodonStatus `json:"reblog"`
+}
+
+// mastodonRateLimit is returned by the API when too many requests are made
+type mastodonRateLimit struct {
+	reset time.Time
+}
+
+func (e *mastodonRateLimit) Error() string {
+	return fmt.Sprintf("Rate limit reached until %v", e.reset)
+}
+
+// NewMastodonCrawler returns a crawler for the statuses of the timeline on the
+// server, e.g. "https://social.example.com". The access token may be empty for
+// public timelines. The id of the last crawled status is saved in the current
+// directory. Images are scaled to fit into limits.
+func NewMastodonCrawler(server, accessToken string, timeline MastodonTimeline, limits ImageLimits, clk clock.Clock) *MastodonCrawler {
+	clk = clock.Or(clk)
+	// one file per timeline
+	r := strings.NewReplacer("http://", "", "https://", "", "/", "-", ":", "-", "@", "-", "#", "", " ", "")
+	server = strings.TrimSuffix(server, "/")
+	crawler := &MastodonCrawler{
+		server:    server,
+		token:     accessToken,
+		timeline:  timeline,
+		sinceFile: r.Replace(fmt.Sprintf(".mastodon-%s-%s.since", server, timeline)),
+		limits:    limits,
+		clock:     clk,
+	}
+
+	return crawler
+}
+
+func (crawler *MastodonCrawler) Crawl(ctx context.Context, entries chan<- MessageData, repeatDuration time.Duration) error {
+
+	log.Printf("Start crawling statuses of %v from %v\n", crawler.timeline, crawler.server)
+
+	// the stream has no timeout, it is stopped by the context
+	transport := &http.Transport{Proxy: http.ProxyFromEnvironment, TLSClientConfig: crawler.TLSConfig}
+	crawler.client = &http.Client{Timeout: time.Minute, Transport: transport}
+	newStatus := make(chan bool, 1)
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	if crawler.Streaming {
+		go crawler.stream(ctx, &http.Client{Transport: transport}, newStatus)
+	}
+
+	sinceID := loadLastID(crawler.sinceFile)
+
+	// now we start crawling until ctx is done
+	for {
+		t0 := crawler.clock.Now()
+		log.Printf("Start new crawling attemp\n")
+		wait := repeatDuration
+		wake := newStatus
+
+		statuses, err := crawler.fetch(sinceID)
+		if rl, ok := err.(*mastodonRateLimit); ok {
+			log.Printf("Crawling attemp failed, trying again at %v: %v\n", rl.reset, err)
+			wait = rl.reset.Sub(t0)
+			// new statuses have to wait as well
+			wake = nil
+		} else if err != nil {
+			log.Printf("Crawling attemp failed: %v\n", err)
+		}
+		crawler.report(err)
+		log.Printf("Number of statuses: %v\n", len(statuses))
+
+		for i := range statuses {
+			entry := processStatus(&statuses[i], crawler.limits, crawler.client)
+			if entry != nil {
+				log.Printf("Created entry from status: %v, %v, %v\n", entry.SenderName, entry.ShortText, entry.ImageNames)
+				// send message using the channel
+				entries <- *entry
+			}
+			sinceID = statuses[i].ID
+			saveLastID(crawler.sinceFile, sinceID)
+		}
+
+		// wait some time or until the stream reports a new status
+		select {
+		case <-ctx.Done():
+			log.Printf("Stop crawling statuses of %v from %v\n", crawler.timeline, crawler.server)
+			return nil
+		case <-wake:
+		case <-crawler.clock.After(wait - crawler.clock.Since(t0)):
+		}
+	}
+}
+
+// fetch returns the statuses of the timeline newer than sinceID, oldest first
+func (crawler *MastodonCrawler) fetch(sinceID string) ([]mastodonStatus, error) {
+	var path string
+	if crawler.timeline.Hashtag != "" {
+		path = "/api/v1/timelines/tag/" + url.PathEscape(crawler.timeline.Hashtag)
+	} else {
+		if crawler.accountID == "" {
+			var account struct {
+				ID string `json:"id"`
+			}
+			v := url.Values{"acct": {crawler.timeline.Account}}
+			if err := crawler.get("/api/v1/accounts/lookup", v, &account); err != nil {
+				return nil, err
+			}
+			crawler.accountID = account.ID
+		}
+		path = "/api/v1/accounts/" + crawler.accountID + "/statuses"
+	}
+
+	var statuses []mastodonStatus
+	if sinceID == "" {
+		v := url.Values{"limit": {strconv.Itoa(firstCrawlStatuses)}}
+		if err := crawler.get(path, v, &statuses); err != nil {
+			return nil, err
+		}
+	} else {
+		// min_id pages forward from sinceID, so no status is missed if there
+		// are more than a page
+		for {
+			var page []mastodonStatus
+			v := url.Values{"min_id": {sinceID}, "limit": {strconv.Itoa(mastodonPageSize)}}
+			if err := crawler.get(path, v, &page); err != nil {
+				// the statuses so far are sent anyway
+				sortStatuses(statuses)
+				return statuses, err
+			}
+			statuses = append(statuses, page...)
+			if len(page) < mastodonPageSize {
+				break
+			}
+			sortStatuses(page)
+			sinceID = page[len(page)-1].ID
+		}
+	}
+	sortStatuses(statuses)
+	return statuses, nil
+}
+
+// get requests the API and decodes the JSON response into data
+func (crawler *MastodonCrawler) get(path string, v url.Values, data interface{}) error {
+	req, err := http.NewRequest("GET", crawler.server+path+"?"+v.Encode(), nil)
+	if err != nil {
+		return err
+	}
+	if crawler.token != "" {
+		req.Header.Set("Authorization", "Bearer "+crawler.token)
+	}
+	resp, err := crawler.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode == http.StatusTooManyRequests {
+		reset, err := time.Parse(time.RFC3339, resp.Header.Get("X-RateLimit-Reset"))
+		if err != nil {
+			reset = crawler.clock.Now().Add(5 * time.Minute)
+		}
+		return &mastodonRateLimit{reset}
+	}
+	if resp.StatusCode != http.StatusOK {
+		// only the start of the error page
+		body, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 512))
+		return fmt.Errorf("Get %v: %v %s", req.URL.Path, resp.Status, body)
+	}
+	buf, err := readLimited(resp.Body, crawler.limits.MaxDownload)
+	if err != nil {
+		return fmt.Errorf("Get %v: %v", req.URL.Path, err)
+	}
+	return json.Unmarshal(buf, data)
+}
+
+// stream listens to the streaming API of the hashtag and signals new statuses
+// on newStatus until ctx is done. Streams of accounts need the user's token,
+// so accounts are only polled.
+func (crawler *MastodonCrawler) stream(ctx context.Context, client *http.Client, newStatus chan<- bool) {
+	if crawler.timeline.Hashtag == "" {
+		log.Printf("Streaming is only supported for hashtags, polling %v\n", crawler.timeline)
+		return
+	}
+	v := url.Values{"tag": {crawler.timeline.Hashtag}}
+	for {
+		req, err := http.NewRequest("GET", crawler.server+"/api/v1/streaming/hashtag?"+v.Encode(), nil)
+		if err != nil {
+			log.Printf("Failed to create stream request: %v\n", err)
+			return
+		}
+		if crawler.token != "" {
+			req.Header.Set("Authorization", "Bearer "+crawler.token)
+		}
+		resp, err := client.Do(req.WithContext(ctx))
+		if err == nil {
+			if resp.StatusCode == http.StatusOK {
+				log.Printf("Listening to the stream of %v\n", crawler.timeline)
+				// server-sent events, a new status is an update event
+				s := bufio.NewScanner(resp.Body)
+				s.Buffer(nil, 1<<20)
+				for s.Scan() {
+					if s.Text() == "event: update" {
+						select {
+						case newStatus <- true:
+						default:
+							// the crawler has not yet seen the last signal
+						}
+					}
+				}
+				err = s.Err()
+			} else {
+				err = fmt.Errorf("Stream returned %v", resp.Status)
+			}
+			resp.Body.Close()
+		}
+		if ctx.Err() != nil {
+			return
+		}
+		log.Printf("Stream of %v ended, opening it again in %v: %v\n", crawler.timeline, streamRetryDuration, err)
+		select {
+		case <-ctx.Done():
+			return
+		case <-crawler.clock.After(streamRetryDuration):
+		}
+	}
+}
+
+// processStatus creates a message out of the status and saves its images.
+// Statuses with a content warning and non-public statuses are not shown, nil
+// is returned for them. The media of sensitive statuses is left out.
+func processStatus(status *mastodonStatus, limits ImageLimits, client *http.Client) *MessageData {
+
+	data := new(MessageData)
+	data.Type = TOOT
+	data.Timestamp = status.CreatedAt
+	data.SenderName = fmt.Sprintf("%v (@%v)", status.Account.DisplayName, status.Account.Acct)
+
+	// a boost has the content of the original status
+	s := status
+	prefix := ""
+	if status.Reblog != nil {
+		s = status.Reblog
+		prefix = fmt.Sprintf("Boost @%v: ", s.Account.Acct)
+	}
+	if s.SpoilerText != "" {
+		log.Printf("Skip status %v with content warning: %v\n", status.ID, s.SpoilerText)
+		return nil
+	}
+	if s.Visibility != "" && s.Visibility != "public" && s.Visibility != "unlisted" {
+		log.Printf("Skip status %v with visibility %v\n", status.ID, s.Visibility)
+		return nil
+	}
+
+	text := prefix + htmlToText(s.Content)
+	data.ShortText = text
+	data.LongText = text
+
+	if s.Sensitive {
+		log.Printf("Leave out the media of sensitive status %v\n", status.ID)
+		return data
+	}
+	for _, m := range s.MediaAttachments {
+		u := m.URL
+		switch m.Type {
+		case "image":
+		case "gifv":
+			// GIFs are converted to short videos, they are saved as clip
+			err := data.saveImageURL(u, limits, client)
+			if err == nil {
+				continue
+			}
+			log.Printf("Failed to save GIF %v, taking its preview: %v\n", u, err)
+			u = m.PreviewURL
+		case "video":
+			// the preview is a still image
+			u = m.PreviewURL
+		default:
+			continue
+		}
+		err := data.saveImageURL(u, limits, client)
+		if err != nil {
+			log.Printf("Failed to save image %v: %v\n", u, err)
+		}
+	}
+
+	return data
+}
+
+// sortStatuses sorts the statuses oldest first. The ids are numbers that may
+// not fit into an int64, so they are compared by length first.
+func sortStatuses(statuses []mastodonStatus) {
+	sort.Slice(statuses, func(i, j int) bool {
+		a, b := statuses[i].ID, statuses[j].ID
+		if len(a) != len(b) {
+			return len(a) < len(b)
+		}
+		return a < b
+	})
+}
@@ -0,0 +1,131 @@
+package web
+
+import (
+	"github.com/flothe/pinboard/grafic2d"
+	"github.com/flothe/pinboard/web/mastodontest"
+	"github.com/flothe/pinboard/web/pop3test"
+	"io/ioutil"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func newMastodonServer(t *testing.T) *mastodontest.Server {
+	s, err := mastodontest.NewServer()
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(s.Close)
+	return s
+}
+
+func startMastodonCrawl(t *testing.T, s *mastodontest.Server, streaming bool) *testCrawl {
+	clk := newFakeClock()
+	c := NewMastodonCrawler(s.URL, "", MastodonTimeline{Hashtag: "Pinboard"}, DefaultImageLimits, clk)
+	c.Streaming = streaming
+	return startCrawl(t, c, clk)
+}
+
+// recvRecorded receives the statuses of the recorded timeline that are shown
+func recvRecorded(t *testing.T, cr *testCrawl) {
+	want := []struct {
+		sender, text string
+		images       []string
+		created      time.Time
+	}{
+		{"Team (@team)", "Guten Morgen!\nHeute ist Teammeeting um 10 Uhr, Agenda: https://wiki.example.com/agenda #pinboard",
+			nil, time.Date(2023, 11, 1, 8, 0, 0, 0, time.UTC)},
+		{"Alice (@alice)", "Kuchen in der Kaffeeküche & Kaffee #pinboard",
+			[]string{"kuchen." + grafic2d.ImageFileExt, "clip." + grafic2d.ImageFileExt}, time.Date(2023, 11, 1, 12, 0, 0, 0, time.UTC)},
+		{"Team (@team)", "Boost @carol@other.example: Release 2.0 ist draußen! #pinboard",
+			nil, time.Date(2023, 11, 1, 16, 0, 0, 0, time.UTC)},
+		// sensitive, without the photo
+		{"Team (@team)", "Vom Sommerfest #pinboard", nil, time.Date(2023, 11, 2, 9, 0, 0, 0, time.UTC)},
+	}
+	for _, w := range want {
+		e := cr.recv(t)
+		if e.Type != TOOT || e.SenderName != w.sender || e.ShortText != w.text || !e.Timestamp.Equal(w.created) {
+			t.Errorf("got %v %q %q at %v, want %q %q at %v", e.Type, e.SenderName, e.ShortText, e.Timestamp, w.sender, w.text, w.created)
+		}
+		if !reflect.DeepEqual(e.ImageNames, w.images) {
+			t.Errorf("%q: images %v, want %v", w.text, e.ImageNames, w.images)
+		}
+	}
+}
+
+func TestMastodonCrawler(t *testing.T) {
+	chdirTemp(t)
+	s := newMastodonServer(t)
+	cr := startMastodonCrawl(t, s, false)
+
+	// the status with content warning and the private one are left out
+	recvRecorded(t, cr)
+	cr.idle(t)
+	if files, _ := filepath.Glob("fest*"); len(files) != 0 {
+		t.Errorf("the photo of the sensitive status has been saved: %v", files)
+	}
+	since, _ := filepath.Glob(".mastodon-*-Pinboard.since")
+	if len(since) != 1 {
+		t.Fatalf("since files %v", since)
+	}
+	b, _ := ioutil.ReadFile(since[0])
+	if id := strings.TrimSpace(string(b)); id != "111000000000000006" {
+		t.Errorf("since id %v, want the one of the last status", id)
+	}
+
+	s.Post("alice", "<p>Neu &lt;3 <a href=\"x\">#<span>pinboard</span></a></p>", []string{"pinboard"})
+	cr.clk.Advance(time.Minute)
+	if e := cr.recv(t); e.ShortText != "Neu <3 #pinboard" {
+		t.Errorf("got %q, want the new status", e.ShortText)
+	}
+	cr.idle(t)
+}
+
+func TestMastodonCrawlerStream(t *testing.T) {
+	chdirTemp(t)
+	s := newMastodonServer(t)
+	cr := startMastodonCrawl(t, s, true)
+	recvRecorded(t, cr)
+	cr.idle(t)
+	waitFor(t, "the stream", func() bool {
+		for _, r := range s.Requests() {
+			if strings.HasPrefix(r, "/api/v1/streaming/hashtag") {
+				return true
+			}
+		}
+		return false
+	})
+
+	// pushed by the stream, the clock stays
+	s.Post("alice", "<p>Other</p>", []string{"other"})
+	s.Post("alice", "<p>Live</p>", []string{"pinboard"}, pop3test.JPEG(10, 10))
+	if e := cr.recv(t); e.ShortText != "Live" || len(e.ImageNames) != 1 {
+		t.Errorf("got %q %v, want the pushed status with its image", e.ShortText, e.ImageNames)
+	}
+	cr.idle(t)
+}
+
+func TestMastodonCrawlerRateLimit(t *testing.T) {
+	chdirTemp(t)
+	s := newMastodonServer(t)
+	cr := startMastodonCrawl(t, s, false)
+	recvRecorded(t, cr)
+
+	// the crawl after the limit waits for the reset
+	cr.idle(t)
+	s.RateLimit(1, cr.clk.Now().Add(10*time.Minute))
+	cr.next(t, time.Minute)
+	s.Post("alice", "<p>Nach dem Limit</p>", []string{"pinboard"})
+	n := len(s.Requests())
+	cr.clk.Advance(time.Minute)
+	if len(s.Requests()) != n {
+		t.Errorf("requested %v before the reset", s.Requests()[n:])
+	}
+	cr.clk.Advance(8 * time.Minute)
+	if e := cr.recv(t); e.ShortText != "Nach dem Limit" {
+		t.Errorf("got %q after the reset", e.ShortText)
+	}
+	cr.idle(t)
+}
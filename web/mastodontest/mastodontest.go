@@ -0,0 +1,354 @@
+// Package mastodontest runs a stand-in for the REST and streaming API of a
+// Mastodon instance on a loopback port, so the Mastodon crawler can be tried
+// without an instance. It starts with a recorded #pinboard timeline, new
+// statuses are posted with Post and pushed to the open streams.
+package mastodontest
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"image"
+	"image/color"
+	"image/jpeg"
+	"image/png"
+	"net/http"
+	"net/http/httptest"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Server is a running Mastodon API stand-in.
+type Server struct {
+	// base URL of the instance, e.g. "http://127.0.0.1:34567"
+	URL string
+	srv *httptest.Server
+
+	mu          sync.Mutex
+	statuses    []status
+	media       map[string][]byte
+	streams     map[chan []byte]string
+	nextID      int64
+	rateLimited int
+	reset       time.Time
+	requests    []string
+	closing     chan bool
+}
+
+// status is a status as JSON with the fields needed to select it
+type status struct {
+	id        string
+	accountID string
+	tags      []string
+	json      json.RawMessage
+}
+
+// the parts of a status that are decoded to select it
+type statusFields struct {
+	ID      string `json:"id"`
+	Account struct {
+		ID string `json:"id"`
+	} `json:"account"`
+	Tags []struct {
+		Name string `json:"name"`
+	} `json:"tags"`
+	Reblog *statusFields `json:"reblog"`
+}
+
+// accounts of the recorded timeline by acct
+var accounts = map[string]string{"team": "1", "bob": "2", "carol@other.example": "3", "alice": "4"}
+
+// NewServer starts a server with the recorded timeline.
+func NewServer() (*Server, error) {
+	s := &Server{
+		media:   make(map[string][]byte),
+		streams: make(map[chan []byte]string),
+		nextID:  112000000000000000,
+		closing: make(chan bool),
+	}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/api/v1/timelines/tag/", s.timeline)
+	mux.HandleFunc("/api/v1/accounts/", s.accounts)
+	mux.HandleFunc("/api/v1/streaming/hashtag", s.stream)
+	mux.HandleFunc("/system/media_attachments/", s.file)
+	s.srv = httptest.NewServer(mux)
+	s.URL = s.srv.URL
+
+	var list []json.RawMessage
+	err := json.Unmarshal([]byte(strings.Replace(recorded, "{{server}}", s.URL, -1)), &list)
+	if err != nil {
+		s.srv.Close()
+		return nil, err
+	}
+	for i := len(list) - 1; i >= 0; i-- {
+		if err := s.add(list[i]); err != nil {
+			s.srv.Close()
+			return nil, err
+		}
+	}
+	return s, nil
+}
+
+// Close closes the streams and stops the server.
+func (s *Server) Close() {
+	close(s.closing)
+	s.srv.CloseClientConnections()
+	s.srv.Close()
+}
+
+// add stores the status, the lock must be held or the server not running
+func (s *Server) add(raw json.RawMessage) error {
+	var f statusFields
+	if err := json.Unmarshal(raw, &f); err != nil {
+		return err
+	}
+	st := status{id: f.ID, accountID: f.Account.ID, json: raw}
+	for _, fs := range []*statusFields{&f, f.Reblog} {
+		if fs == nil {
+			continue
+		}
+		for _, t := range fs.Tags {
+			st.tags = append(st.tags, strings.ToLower(t.Name))
+		}
+	}
+	s.statuses = append(s.statuses, st)
+	return nil
+}
+
+// Post publishes a public status of the account of the recorded timeline with
+// the HTML content, the hashtags without # and the images, given as JPEG or
+// PNG files, and pushes it to the streams of the hashtags. It returns the id.
+func (s *Server) Post(acct, content string, tags []string, images ...[]byte) (string, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.nextID++
+	id := strconv.FormatInt(s.nextID, 10)
+
+	var media []map[string]interface{}
+	for i, img := range images {
+		p := fmt.Sprintf("/system/media_attachments/files/%v/original/%v.jpg", id, i)
+		s.media[p] = img
+		media = append(media, map[string]interface{}{
+			"id": fmt.Sprintf("%v%v", id, i), "type": "image", "url": s.URL + p, "preview_url": s.URL + p,
+		})
+	}
+	var tagList []map[string]string
+	for _, t := range tags {
+		tagList = append(tagList, map[string]string{"name": t, "url": s.URL + "/tags/" + t})
+	}
+	raw, err := json.Marshal(map[string]interface{}{
+		"id":                id,
+		"created_at":        time.Now().UTC().Format("2006-01-02T15:04:05.000Z"),
+		"sensitive":         false,
+		"spoiler_text":      "",
+		"visibility":        "public",
+		"content":           content,
+		"reblog":            nil,
+		"account":           map[string]string{"id": accounts[acct], "acct": acct, "username": acct, "display_name": strings.Title(acct)},
+		"media_attachments": media,
+		"tags":              tagList,
+	})
+	if err != nil {
+		return "", err
+	}
+	if err := s.add(raw); err != nil {
+		return "", err
+	}
+
+	event := []byte(fmt.Sprintf("event: update\ndata: %s\n\n", raw))
+	for ch, tag := range s.streams {
+		for _, t := range tags {
+			if strings.EqualFold(t, tag) {
+				ch <- event
+				break
+			}
+		}
+	}
+	return id, nil
+}
+
+// RateLimit makes the next n API requests fail with status 429 and a reset
+// header of the time.
+func (s *Server) RateLimit(n int, reset time.Time) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.rateLimited = n
+	s.reset = reset
+}
+
+// Requests returns the API requests received so far, with query.
+func (s *Server) Requests() []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]string(nil), s.requests...)
+}
+
+// request logs the request and answers it with the rate limit error if one is
+// due, the lock must be held
+func (s *Server) request(w http.ResponseWriter, r *http.Request) bool {
+	s.requests = append(s.requests, r.URL.RequestURI())
+	if s.rateLimited > 0 {
+		s.rateLimited--
+		w.Header().Set("X-RateLimit-Remaining", "0")
+		w.Header().Set("X-RateLimit-Reset", s.reset.UTC().Format(time.RFC3339))
+		http.Error(w, `{"error":"Too many requests"}`, http.StatusTooManyRequests)
+		return false
+	}
+	return true
+}
+
+func (s *Server) timeline(w http.ResponseWriter, r *http.Request) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if !s.request(w, r) {
+		return
+	}
+	tag := strings.ToLower(strings.TrimPrefix(r.URL.Path, "/api/v1/timelines/tag/"))
+	s.writeStatuses(w, r, func(st status) bool {
+		for _, t := range st.tags {
+			if t == tag {
+				return true
+			}
+		}
+		return false
+	})
+}
+
+func (s *Server) accounts(w http.ResponseWriter, r *http.Request) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if !s.request(w, r) {
+		return
+	}
+	if r.URL.Path == "/api/v1/accounts/lookup" {
+		id, ok := accounts[r.URL.Query().Get("acct")]
+		if !ok {
+			http.Error(w, `{"error":"Record not found"}`, http.StatusNotFound)
+			return
+		}
+		fmt.Fprintf(w, `{"id":%q,"acct":%q}`, id, r.URL.Query().Get("acct"))
+		return
+	}
+	// /api/v1/accounts/:id/statuses
+	parts := strings.Split(r.URL.Path, "/")
+	if len(parts) != 6 || parts[5] != "statuses" {
+		http.NotFound(w, r)
+		return
+	}
+	s.writeStatuses(w, r, func(st status) bool { return st.accountID == parts[4] })
+}
+
+// writeStatuses writes the selected statuses newest first, paged like
+// Mastodon by since_id, min_id, max_id and limit. The lock must be held.
+func (s *Server) writeStatuses(w http.ResponseWriter, r *http.Request, selected func(status) bool) {
+	q := r.URL.Query()
+	limit, err := strconv.Atoi(q.Get("limit"))
+	if err != nil || limit > 40 {
+		limit = 20
+	}
+	var list []status
+	for _, st := range s.statuses {
+		if selected(st) && (q.Get("since_id") == "" || less(q.Get("since_id"), st.id)) &&
+			(q.Get("min_id") == "" || less(q.Get("min_id"), st.id)) &&
+			(q.Get("max_id") == "" || less(st.id, q.Get("max_id"))) {
+			list = append(list, st)
+		}
+	}
+	sort.Slice(list, func(i, j int) bool { return less(list[j].id, list[i].id) })
+	if len(list) > limit {
+		if q.Get("min_id") != "" {
+			// the statuses right after min_id
+			list = list[len(list)-limit:]
+		} else {
+			list = list[:limit]
+		}
+	}
+	raws := make([]json.RawMessage, len(list))
+	for i, st := range list {
+		raws[i] = st.json
+	}
+	if raws == nil {
+		raws = []json.RawMessage{}
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(raws)
+}
+
+func (s *Server) stream(w http.ResponseWriter, r *http.Request) {
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		http.Error(w, "streaming not supported", http.StatusInternalServerError)
+		return
+	}
+	ch := make(chan []byte, 16)
+	s.mu.Lock()
+	ok = s.request(w, r)
+	if ok {
+		s.streams[ch] = r.URL.Query().Get("tag")
+	}
+	s.mu.Unlock()
+	if !ok {
+		return
+	}
+	defer func() {
+		s.mu.Lock()
+		delete(s.streams, ch)
+		s.mu.Unlock()
+	}()
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Write([]byte(":)\n"))
+	flusher.Flush()
+	for {
+		select {
+		case event := <-ch:
+			w.Write(event)
+			flusher.Flush()
+		case <-r.Context().Done():
+			return
+		case <-s.closing:
+			return
+		}
+	}
+}
+
+// file serves the posted images and generates the recorded ones
+func (s *Server) file(w http.ResponseWriter, r *http.Request) {
+	s.mu.Lock()
+	img, ok := s.media[r.URL.Path]
+	s.mu.Unlock()
+	if ok {
+		w.Write(img)
+		return
+	}
+
+	m := image.NewRGBA(image.Rect(0, 0, 32, 24))
+	for y := 0; y < 24; y++ {
+		for x := 0; x < 32; x++ {
+			m.Set(x, y, color.RGBA{uint8(8 * x), uint8(10 * y), 200, 255})
+		}
+	}
+	var b bytes.Buffer
+	switch path.Ext(r.URL.Path) {
+	case ".png":
+		png.Encode(&b, m)
+	case ".jpg":
+		jpeg.Encode(&b, m, nil)
+	default:
+		http.NotFound(w, r)
+		return
+	}
+	w.Write(b.Bytes())
+}
+
+// less compares the numeric ids of two statuses
+func less(a, b string) bool {
+	if len(a) != len(b) {
+		return len(a) < len(b)
+	}
+	return a < b
+}
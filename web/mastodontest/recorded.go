@@ -0,0 +1,15 @@
+package mastodontest
+
+// recorded is the tag timeline of #pinboard as returned by a Mastodon 4
+// instance, newest first, shortened to the fields the crawler reads and a few
+// more. The host of the instance is replaced by {{server}}. It has a plain
+// status with a link, a status with a photo, a boost, a status with a content
+// warning, a sensitive photo and a private status.
+const recorded = `[
+{"id":"111000000000000006","created_at":"2023-11-02T09:30:00.000Z","in_reply_to_id":null,"sensitive":false,"spoiler_text":"","visibility":"private","language":"de","uri":"{{server}}/users/team/statuses/111000000000000006","url":"{{server}}/@team/111000000000000006","content":"<p>Nur für Follower</p>","reblog":null,"account":{"id":"1","username":"team","acct":"team","display_name":"Team","url":"{{server}}/@team"},"media_attachments":[],"tags":[{"name":"pinboard","url":"{{server}}/tags/pinboard"}]},
+{"id":"111000000000000005","created_at":"2023-11-02T09:00:00.000Z","in_reply_to_id":null,"sensitive":true,"spoiler_text":"","visibility":"public","language":"de","uri":"{{server}}/users/team/statuses/111000000000000005","url":"{{server}}/@team/111000000000000005","content":"<p>Vom Sommerfest <a href=\"{{server}}/tags/pinboard\" class=\"mention hashtag\" rel=\"tag\">#<span>pinboard</span></a></p>","reblog":null,"account":{"id":"1","username":"team","acct":"team","display_name":"Team","url":"{{server}}/@team"},"media_attachments":[{"id":"3","type":"image","url":"{{server}}/system/media_attachments/files/000/000/003/original/fest.png","preview_url":"{{server}}/system/media_attachments/files/000/000/003/small/fest.png","description":"Sommerfest"}],"tags":[{"name":"pinboard","url":"{{server}}/tags/pinboard"}]},
+{"id":"111000000000000004","created_at":"2023-11-02T08:00:00.000Z","in_reply_to_id":null,"sensitive":true,"spoiler_text":"Spoiler zur Serie","visibility":"public","language":"de","uri":"{{server}}/users/bob/statuses/111000000000000004","url":"{{server}}/@bob/111000000000000004","content":"<p>Das Ende ist überraschend <a href=\"{{server}}/tags/pinboard\" class=\"mention hashtag\" rel=\"tag\">#<span>pinboard</span></a></p>","reblog":null,"account":{"id":"2","username":"bob","acct":"bob","display_name":"Bob","url":"{{server}}/@bob"},"media_attachments":[],"tags":[{"name":"pinboard","url":"{{server}}/tags/pinboard"}]},
+{"id":"111000000000000003","created_at":"2023-11-01T16:00:00.000Z","in_reply_to_id":null,"sensitive":false,"spoiler_text":"","visibility":"public","language":null,"uri":"{{server}}/users/team/statuses/111000000000000003/activity","url":"{{server}}/users/team/statuses/111000000000000003/activity","content":"","reblog":{"id":"111000000000000001","created_at":"2023-11-01T10:00:00.000Z","in_reply_to_id":null,"sensitive":false,"spoiler_text":"","visibility":"public","language":"de","uri":"https://other.example/users/carol/statuses/111000000000000001","url":"https://other.example/@carol/111000000000000001","content":"<p>Release 2.0 ist draußen! <a href=\"{{server}}/tags/pinboard\" class=\"mention hashtag\" rel=\"tag\">#<span>pinboard</span></a></p>","reblog":null,"account":{"id":"3","username":"carol","acct":"carol@other.example","display_name":"Carol","url":"https://other.example/@carol"},"media_attachments":[],"tags":[{"name":"pinboard","url":"{{server}}/tags/pinboard"}]},"account":{"id":"1","username":"team","acct":"team","display_name":"Team","url":"{{server}}/@team"},"media_attachments":[],"tags":[]},
+{"id":"111000000000000002","created_at":"2023-11-01T12:00:00.000Z","in_reply_to_id":null,"sensitive":false,"spoiler_text":"","visibility":"public","language":"de","uri":"{{server}}/users/alice/statuses/111000000000000002","url":"{{server}}/@alice/111000000000000002","content":"<p>Kuchen in der Kaffeeküche &amp; Kaffee <a href=\"{{server}}/tags/pinboard\" class=\"mention hashtag\" rel=\"tag\">#<span>pinboard</span></a></p>","reblog":null,"account":{"id":"4","username":"alice","acct":"alice","display_name":"Alice","url":"{{server}}/@alice"},"media_attachments":[{"id":"2","type":"image","url":"{{server}}/system/media_attachments/files/000/000/002/original/kuchen.jpg","preview_url":"{{server}}/system/media_attachments/files/000/000/002/small/kuchen.jpg","description":"Kuchen"},{"id":"4","type":"video","url":"{{server}}/system/media_attachments/files/000/000/004/original/clip.mp4","preview_url":"{{server}}/system/media_attachments/files/000/000/004/small/clip.png","description":null}],"tags":[{"name":"pinboard","url":"{{server}}/tags/pinboard"}]},
+{"id":"111000000000000000","created_at":"2023-11-01T08:00:00.000Z","in_reply_to_id":null,"sensitive":false,"spoiler_text":"","visibility":"public","language":"de","uri":"{{server}}/users/team/statuses/111000000000000000","url":"{{server}}/@team/111000000000000000","content":"<p>Guten Morgen!<br>Heute ist Teammeeting um 10 Uhr, Agenda: <a href=\"https://wiki.example.com/agenda\" rel=\"nofollow noopener noreferrer\" target=\"_blank\"><span class=\"invisible\">https://</span><span class=\"\">wiki.example.com/agenda</span><span class=\"invisible\"></span></a> <a href=\"{{server}}/tags/pinboard\" class=\"mention hashtag\" rel=\"tag\">#<span>pinboard</span></a></p>","reblog":null,"account":{"id":"1","username":"team","acct":"team","display_name":"Team","url":"{{server}}/@team"},"media_attachments":[],"tags":[{"name":"pinboard","url":"{{server}}/tags/pinboard"}]}
+]`
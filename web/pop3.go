@@ -3,24 +3,77 @@ package web
 
 import (
 	"bufio"
+	"crypto/md5"
 	"crypto/tls"
+	"encoding/base64"
+	"encoding/hex"
 	"errors"
 	"fmt"
+	"io"
 	"log"
 	"net"
 	"net/mail"
 	"strconv"
 	"strings"
+	"time"
 )
 
+// DefaultTimeout is the time a command may take before the connection is
+// considered dead.
+const DefaultTimeout = time.Minute
+
 // The POP3 client.
 type Client struct {
 	connection net.Conn
 	data       *bufio.Reader
+	// timestamp of the greeting used by APOP, empty if the server has none
+	timestamp string
+	isTLS     bool
+	// Timeout is the deadline for sending a command and reading its reply
+	Timeout time.Duration
+}
+
+// ServerError is a -ERR reply of the server.
+type ServerError struct {
+	Command string
+	Message string
+}
+
+func (e *ServerError) Error() string {
+	if e.Message == "" {
+		return fmt.Sprintf("%v failed", e.Command)
+	}
+	return fmt.Sprintf("%v failed: %v", e.Command, e.Message)
+}
+
+// AuthError is returned if the server rejects the login. Unlike network
+// errors it does not go away by trying again.
+type AuthError struct {
+	Mechanism string
+	Err       error
+}
+
+func (e *AuthError) Error() string {
+	return fmt.Sprintf("Login with %v rejected: %v", e.Mechanism, e.Err)
+}
+
+// ProtocolError is returned if the reply of the server cannot be parsed.
+type ProtocolError struct {
+	Reply string
+}
+
+func (e *ProtocolError) Error() string {
+	return fmt.Sprintf("Invalid server response: %q", e.Reply)
+}
+
+// IsAuthError reports whether the error is a rejected login.
+func IsAuthError(err error) bool {
+	_, ok := err.(*AuthError)
+	return ok
 }
 
 func Dial(addr string) (*Client, error) {
-	connection, err := net.Dial("tcp", addr)
+	connection, err := net.DialTimeout("tcp", addr, DefaultTimeout)
 	if err != nil {
 		return nil, err
 	}
@@ -30,28 +83,44 @@ func Dial(addr string) (*Client, error) {
 // DialTLS creates a TLS-secured connection to the POP3 server at the given
 // address and returns the corresponding Client.
 func DialTLS(addr string) (*Client, error) {
-	connection, err := tls.Dial("tcp", addr, nil)
+	return DialTLSWithConfig(addr, nil)
+}
+
+// DialTLSWithConfig is DialTLS with a custom TLS config, e.g. to trust a
+// company CA. If config is nil the system defaults are used.
+func DialTLSWithConfig(addr string, config *tls.Config) (*Client, error) {
+	dialer := &net.Dialer{Timeout: DefaultTimeout}
+	connection, err := tls.DialWithDialer(dialer, "tcp", addr, config)
 	if err != nil {
 		return nil, err
 	}
 	return NewClient(connection)
 }
 
-// NewClient returns a new Client object using an existing connection. if log is not nil
-// logging output is written to it
+// NewClient returns a new Client object using an existing connection and
+// reads the greeting of the server.
 func NewClient(con net.Conn) (*Client, error) {
 
 	var client *Client
 	client = &Client{
 		data:       bufio.NewReader(con),
 		connection: con,
+		Timeout:    DefaultTimeout,
 	}
+	_, client.isTLS = con.(*tls.Conn)
 
 	// send dud command, to read a line
-	_, err := client.Cmd("")
+	greeting, err := client.Cmd("")
 	if err != nil {
+		con.Close()
 		return nil, err
 	}
+	// the timestamp for APOP looks like <1896.697170952@dbc.mtview.ca.us>
+	if i := strings.Index(greeting, "<"); i >= 0 {
+		if j := strings.Index(greeting[i:], ">"); j > 0 {
+			client.timestamp = greeting[i : i+j+1]
+		}
+	}
 	return client, nil
 }
 
@@ -60,41 +129,237 @@ func NewClient(con net.Conn) (*Client, error) {
 //
 // Output sent after the first line must be retrieved via readLines.
 func (c *Client) Cmd(format string, args ...interface{}) (string, error) {
-	// do some logging
-	log.Printf("SEND: %q\n", fmt.Sprintf(format, args...))
-
-	fmt.Fprintf(c.connection, format, args...)
-	line, _, err := c.data.ReadLine()
-	log.Printf("RECEIVE (only first line is shown): %q\n", string(line))
+	cmd := fmt.Sprintf(format, args...)
+	name := strings.TrimSpace(cmd)
+	if i := strings.Index(name, " "); i > 0 {
+		name = name[:i]
+	}
+	// do some logging, without passwords
+	switch name {
+	case "PASS", "APOP", "AUTH":
+		log.Printf("SEND: %q\n", name+" ...")
+	default:
+		log.Printf("SEND: %q\n", cmd)
+	}
 
+	c.setDeadline()
+	if cmd != "" {
+		if _, err := io.WriteString(c.connection, cmd); err != nil {
+			return "", err
+		}
+	}
+	l, err := c.readLine()
+	log.Printf("RECEIVE (only first line is shown): %q\n", l)
 	if err != nil {
 		return "", err
 	}
-	l := string(line)
-	if l[0:3] != "+OK" {
-		err = errors.New(l[5:])
+	if cmd == "" {
+		name = "Greeting"
+	} else if name == "" {
+		name = "SASL response"
+	}
+
+	switch {
+	case l == "+OK" || strings.HasPrefix(l, "+OK "):
+		return strings.TrimPrefix(l[3:], " "), nil
+	case l == "-ERR" || strings.HasPrefix(l, "-ERR "):
+		return "", &ServerError{Command: name, Message: strings.TrimPrefix(l[4:], " ")}
+	case l == "+" || strings.HasPrefix(l, "+ "):
+		// continuation of a SASL exchange
+		return strings.TrimPrefix(l[1:], " "), errContinue
 	}
-	if len(l) >= 4 {
-		return l[4:], err
+	return "", &ProtocolError{l}
+}
+
+// errContinue is returned by Cmd if the server waits for more SASL data
+var errContinue = errors.New("Server waits for SASL continuation")
+
+// setDeadline gives the next command Timeout to complete
+func (c *Client) setDeadline() {
+	if c.Timeout > 0 {
+		c.connection.SetDeadline(time.Now().Add(c.Timeout))
+	} else {
+		c.connection.SetDeadline(time.Time{})
+	}
+}
+
+// readLine reads a whole line without the CRLF, also if it is longer than the buffer
+func (c *Client) readLine() (string, error) {
+	var line []byte
+	for {
+		l, isPrefix, err := c.data.ReadLine()
+		if err != nil {
+			return string(line), err
+		}
+		line = append(line, l...)
+		if !isPrefix {
+			return string(line), nil
+		}
 	}
-	return "", err
 }
 
 func (c *Client) ReadLines() (lines []string, err error) {
 	lines = make([]string, 0)
-	l, _, err := c.data.ReadLine()
-	line := string(l)
+	c.setDeadline()
+	line, err := c.readLine()
 	for err == nil && line != "." {
 		if len(line) > 0 && line[0] == '.' {
 			line = line[1:]
 		}
 		lines = append(lines, line)
-		l, _, err = c.data.ReadLine()
-		line = string(l)
+		line, err = c.readLine()
 	}
 	return
 }
 
+// Capa returns the capabilities of the server with their arguments, e.g.
+// "SASL": ["PLAIN", "XOAUTH2"]. Servers without CAPA return an error.
+func (c *Client) Capa() (map[string][]string, error) {
+	_, err := c.Cmd("CAPA\r\n")
+	if err != nil {
+		return nil, err
+	}
+	lines, err := c.ReadLines()
+	if err != nil {
+		return nil, err
+	}
+	caps := make(map[string][]string)
+	for _, l := range lines {
+		fs := strings.Fields(l)
+		if len(fs) > 0 {
+			caps[strings.ToUpper(fs[0])] = fs[1:]
+		}
+	}
+	return caps, nil
+}
+
+// StartTLS upgrades the plain connection to TLS with the STLS command. The
+// ServerName of config must be set, the client does not know the host name.
+func (c *Client) StartTLS(config *tls.Config) error {
+	if c.isTLS {
+		return errors.New("Connection is already secured by TLS")
+	}
+	_, err := c.Cmd("STLS\r\n")
+	if err != nil {
+		return err
+	}
+	tlsConn := tls.Client(c.connection, config)
+	c.setDeadline()
+	if err := tlsConn.Handshake(); err != nil {
+		return err
+	}
+	c.connection = tlsConn
+	c.data = bufio.NewReader(tlsConn)
+	c.isTLS = true
+	return nil
+}
+
+// IsTLS reports whether the connection is secured by TLS.
+func (c *Client) IsTLS() bool {
+	return c.isTLS
+}
+
+// Apop logs in with a MD5 digest of the timestamp in the greeting and the
+// password, so the password is not sent.
+func (c *Client) Apop(username, password string) error {
+	if c.timestamp == "" {
+		return &AuthError{"APOP", errors.New("Server does not support APOP")}
+	}
+	digest := md5.Sum([]byte(c.timestamp + password))
+	_, err := c.Cmd("APOP %s %s\r\n", username, hex.EncodeToString(digest[:]))
+	return authError("APOP", err)
+}
+
+// AuthPlain logs in with SASL PLAIN. The password is sent unencrypted unless
+// the connection is secured by TLS.
+func (c *Client) AuthPlain(username, password string) error {
+	ir := base64.StdEncoding.EncodeToString([]byte("\x00" + username + "\x00" + password))
+	return authError("PLAIN", c.auth("PLAIN", ir))
+}
+
+// AuthXOAuth2 logs in with SASL XOAUTH2 and an OAuth 2 access token.
+func (c *Client) AuthXOAuth2(username, token string) error {
+	ir := base64.StdEncoding.EncodeToString([]byte("user=" + username + "\x01auth=Bearer " + token + "\x01\x01"))
+	return authError("XOAUTH2", c.auth("XOAUTH2", ir))
+}
+
+// auth sends the AUTH command with the initial response
+func (c *Client) auth(mechanism, ir string) error {
+	_, err := c.Cmd("AUTH %s %s\r\n", mechanism, ir)
+	if err == errContinue {
+		// the server sends details of the error as challenge, an empty
+		// response ends the exchange with -ERR
+		_, err = c.Cmd("\r\n")
+		if err == errContinue {
+			err = &ProtocolError{"+"}
+		}
+	}
+	return err
+}
+
+// authError turns a -ERR reply into an AuthError
+func authError(mechanism string, err error) error {
+	if _, ok := err.(*ServerError); ok {
+		return &AuthError{mechanism, err}
+	}
+	return err
+}
+
+// Login authenticates with the mechanism "user", "apop", "plain" or
+// "xoauth2" (the password is the access token). If mechanism is empty the
+// best one the server supports is used: PLAIN, APOP, or USER/PASS. If the
+// server rejects the selected APOP, PLAIN or USER/PASS is tried next.
+// Passwords are never sent unencrypted without TLS, unless allowPlaintext is set.
+func (c *Client) Login(mechanism, username, password string, allowPlaintext bool) error {
+	mechanism = strings.ToLower(mechanism)
+	if mechanism != "" {
+		return c.login(mechanism, username, password, allowPlaintext)
+	}
+
+	plain := false
+	if caps, err := c.Capa(); err == nil {
+		for _, m := range caps["SASL"] {
+			if strings.ToUpper(m) == "PLAIN" {
+				plain = true
+			}
+		}
+	}
+	next := "user"
+	if plain {
+		next = "plain"
+	}
+	mechanism = next
+	if c.timestamp != "" && !(plain && c.isTLS) {
+		mechanism = "apop"
+	}
+	log.Printf("Selected login mechanism: %v\n", mechanism)
+	err := c.login(mechanism, username, password, allowPlaintext)
+	if mechanism == "apop" && IsAuthError(err) && (c.isTLS || allowPlaintext) {
+		// some servers announce APOP without a password for it
+		log.Printf("%v, trying %v\n", err, next)
+		err = c.login(next, username, password, allowPlaintext)
+	}
+	return err
+}
+
+// login authenticates with the mechanism, see Login
+func (c *Client) login(mechanism, username, password string, allowPlaintext bool) error {
+	if !c.isTLS && !allowPlaintext && mechanism != "apop" {
+		return &AuthError{mechanism, errors.New("Refusing to send the password without TLS")}
+	}
+	switch mechanism {
+	case "user":
+		return c.Auth(username, password)
+	case "apop":
+		return c.Apop(username, password)
+	case "plain":
+		return c.AuthPlain(username, password)
+	case "xoauth2":
+		return c.AuthXOAuth2(username, password)
+	}
+	return fmt.Errorf("Unknown login mechanism: %v", mechanism)
+}
+
 // User sends the given username to the server. Generally, there is no reason
 // not to use the Auth convenience method.
 func (c *Client) User(username string) (err error) {
@@ -116,10 +381,10 @@ func (c *Client) Pass(password string) (err error) {
 func (c *Client) Auth(username, password string) (err error) {
 	err = c.User(username)
 	if err != nil {
-		return
+		return authError("USER", err)
 	}
 	err = c.Pass(password)
-	return
+	return authError("USER", err)
 }
 
 // Stat retrieves a drop listing for the current maildrop, consisting of the
@@ -133,13 +398,16 @@ func (c *Client) Stat() (count, size int, err error) {
 		return 0, 0, err
 	}
 	parts := strings.Fields(l)
+	if len(parts) < 2 {
+		return 0, 0, &ProtocolError{l}
+	}
 	count, err = strconv.Atoi(parts[0])
 	if err != nil {
-		return 0, 0, errors.New("Invalid server response")
+		return 0, 0, &ProtocolError{l}
 	}
 	size, err = strconv.Atoi(parts[1])
 	if err != nil {
-		return 0, 0, errors.New("Invalid server response")
+		return 0, 0, &ProtocolError{l}
 	}
 	return
 }
@@ -152,9 +420,13 @@ func (c *Client) List(msg int) (size int, err error) {
 	if err != nil {
 		return 0, err
 	}
-	size, err = strconv.Atoi(strings.Fields(l)[1])
+	fs := strings.Fields(l)
+	if len(fs) < 2 {
+		return 0, &ProtocolError{l}
+	}
+	size, err = strconv.Atoi(fs[1])
 	if err != nil {
-		return 0, errors.New("Invalid server response")
+		return 0, &ProtocolError{l}
 	}
 	return size, nil
 }
@@ -174,13 +446,16 @@ func (c *Client) ListAll() (msgs []int, sizes []int, err error) {
 	for i, l := range lines {
 		var m, s int
 		fs := strings.Fields(l)
+		if len(fs) < 2 {
+			return nil, nil, &ProtocolError{l}
+		}
 		m, err = strconv.Atoi(fs[0])
 		if err != nil {
-			return
+			return nil, nil, &ProtocolError{l}
 		}
 		s, err = strconv.Atoi(fs[1])
 		if err != nil {
-			return
+			return nil, nil, &ProtocolError{l}
 		}
 		msgs[i] = m
 		sizes[i] = s
@@ -188,6 +463,58 @@ func (c *Client) ListAll() (msgs []int, sizes []int, err error) {
 	return
 }
 
+// Uidl returns the unique id of the given message. Unlike the message number
+// the unique id stays the same across sessions.
+func (c *Client) Uidl(msg int) (uid string, err error) {
+	l, err := c.Cmd("UIDL %d\r\n", msg)
+	if err != nil {
+		return "", err
+	}
+	fs := strings.Fields(l)
+	if len(fs) < 2 {
+		return "", &ProtocolError{l}
+	}
+	return fs[1], nil
+}
+
+// UidlAll returns a list of all messages and their unique ids.
+func (c *Client) UidlAll() (msgs []int, uids []string, err error) {
+	_, err = c.Cmd("UIDL\r\n")
+	if err != nil {
+		return
+	}
+	lines, err := c.ReadLines()
+	if err != nil {
+		return
+	}
+	msgs = make([]int, len(lines), len(lines))
+	uids = make([]string, len(lines), len(lines))
+	for i, l := range lines {
+		fs := strings.Fields(l)
+		if len(fs) < 2 {
+			return nil, nil, &ProtocolError{l}
+		}
+		msgs[i], err = strconv.Atoi(fs[0])
+		if err != nil {
+			return nil, nil, &ProtocolError{l}
+		}
+		uids[i] = fs[1]
+	}
+	return
+}
+
+// Top downloads the header and the first n lines of the body of the given
+// message. The lines are separated by LF, whatever the server sent.
+func (c *Client) Top(msg, n int) (text string, err error) {
+	_, err = c.Cmd("TOP %d %d\r\n", msg, n)
+	if err != nil {
+		return "", err
+	}
+	lines, err := c.ReadLines()
+	text = strings.Join(lines, "\n")
+	return
+}
+
 // Retr downloads and returns the given message. The lines are separated by LF,
 // whatever the server sent.
 func (c *Client) Retr(msg int) (text string, err error) {
@@ -233,11 +560,9 @@ func (c *Client) Rset() (err error) {
 }
 
 // Quit sends the QUIT message to the POP3 server and closes the connection.
+// The messages marked as deleted are only deleted if QUIT succeeds.
 func (c *Client) Quit() error {
 	_, err := c.Cmd("QUIT\r\n")
-	if err != nil {
-		return err
-	}
 	c.connection.Close()
-	return nil
+	return err
 }
@@ -0,0 +1,195 @@
+package web
+
+import (
+	"flag"
+	"github.com/flothe/pinboard/web/pop3test"
+	"io/ioutil"
+	"log"
+	"os"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestMain(m *testing.M) {
+	flag.Parse()
+	if !testing.Verbose() {
+		log.SetOutput(ioutil.Discard)
+	}
+	os.Exit(m.Run())
+}
+
+// newPOP3Server starts a stand-in for user "pinboard" that is closed with
+// the test
+func newPOP3Server(t *testing.T) *pop3test.Server {
+	s, err := pop3test.NewServer("pinboard", "secret")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { s.Close() })
+	return s
+}
+
+func dialPOP3(t *testing.T, s *pop3test.Server) *Client {
+	c, err := Dial(s.Addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { c.Quit() })
+	return c
+}
+
+func TestLoginFallsBackFromAPOP(t *testing.T) {
+	tests := []struct {
+		name           string
+		mechanism      string
+		allowPlaintext bool
+		ok             bool
+		commands       []string
+	}{
+		{"auto", "", true, true, []string{"CAPA", "APOP", "AUTH"}},
+		{"auto without plaintext", "", false, false, []string{"CAPA", "APOP"}},
+		{"apop", "apop", true, false, []string{"APOP"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := newPOP3Server(t)
+			s.FailNext("APOP", "-ERR [AUTH] APOP is not enabled")
+			c := dialPOP3(t, s)
+
+			err := c.Login(tt.mechanism, "pinboard", "secret", tt.allowPlaintext)
+			if tt.ok && err != nil {
+				t.Fatalf("Login: %v", err)
+			}
+			if !tt.ok {
+				if e, ok := err.(*AuthError); !ok || e.Mechanism != "APOP" {
+					t.Fatalf("Login returned %v, want the rejected APOP", err)
+				}
+			}
+			if got := s.Commands(); !reflect.DeepEqual(got, tt.commands) {
+				t.Errorf("commands %v, want %v", got, tt.commands)
+			}
+		})
+	}
+}
+
+func TestClientRetr(t *testing.T) {
+	s := newPOP3Server(t)
+	mails := [][]byte{pop3test.DotStuffedMail(), pop3test.PlainMail("Hallo", "Grillen am Freitag")}
+	var uids []string
+	size := 0
+	for _, m := range mails {
+		uids = append(uids, s.AddMessage(m))
+		size += len(m)
+	}
+	c := dialPOP3(t, s)
+	if err := c.Login("", "pinboard", "secret", true); err != nil {
+		t.Fatal(err)
+	}
+
+	n, sz, err := c.Stat()
+	if err != nil || n != 2 || sz != size {
+		t.Errorf("Stat returned %v %v %v, want 2 %v", n, sz, err, size)
+	}
+	nrs, got, err := c.UidlAll()
+	if err != nil || !reflect.DeepEqual(nrs, []int{1, 2}) || !reflect.DeepEqual(got, uids) {
+		t.Errorf("UidlAll returned %v %v %v, want [1 2] %v", nrs, got, err, uids)
+	}
+
+	msg, err := c.RetrMsg(1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if s := msg.Header.Get("Subject"); s != "Dots" {
+		t.Errorf("subject %q, want Dots", s)
+	}
+	body, _ := ioutil.ReadAll(msg.Body)
+	want := "first line\n.\n..two dots\n.last line"
+	if got := strings.Replace(string(body), "\r\n", "\n", -1); got != want {
+		t.Errorf("body %q, want %q", got, want)
+	}
+
+	// the reply of the first RETR has been read completely
+	text, err := c.Retr(2)
+	if err != nil || !strings.HasSuffix(text, "\n\nGrillen am Freitag") {
+		t.Errorf("Retr returned %q %v", text, err)
+	}
+}
+
+func TestClientServerError(t *testing.T) {
+	s := newPOP3Server(t)
+	s.AddMessage(pop3test.PlainMail("Hallo", "Grillen am Freitag"))
+	c := dialPOP3(t, s)
+	if err := c.Login("", "pinboard", "secret", true); err != nil {
+		t.Fatal(err)
+	}
+
+	s.FailNext("STAT", "-ERR mailbox locked")
+	_, _, err := c.Stat()
+	if e, ok := err.(*ServerError); !ok || e.Command != "STAT" || e.Message != "mailbox locked" {
+		t.Errorf("Stat returned %#v, want the server error", err)
+	}
+	if _, err := c.Retr(2); err == nil {
+		t.Errorf("Retr of a missing message returned no error")
+	} else if _, ok := err.(*ServerError); !ok {
+		t.Errorf("Retr of a missing message returned %v, want a server error", err)
+	}
+	// the session goes on after -ERR
+	if n, _, err := c.Stat(); err != nil || n != 1 {
+		t.Errorf("Stat returned %v %v, want 1 message", n, err)
+	}
+}
+
+func TestClientDroppedConnection(t *testing.T) {
+	s := newPOP3Server(t)
+	s.AddMessage(pop3test.PlainMail("Hallo", "Grillen am Freitag"))
+	c := dialPOP3(t, s)
+	if err := c.Login("", "pinboard", "secret", true); err != nil {
+		t.Fatal(err)
+	}
+
+	s.DropNext("UIDL")
+	_, _, err := c.UidlAll()
+	if err == nil {
+		t.Fatal("UidlAll returned no error")
+	}
+	if _, ok := err.(*ServerError); ok || IsAuthError(err) {
+		t.Errorf("UidlAll returned %v, want a connection error", err)
+	}
+}
+
+func TestClientWrongPassword(t *testing.T) {
+	for _, mechanism := range []string{"", "user", "apop", "plain"} {
+		t.Run(mechanism, func(t *testing.T) {
+			s := newPOP3Server(t)
+			c := dialPOP3(t, s)
+			err := c.Login(mechanism, "pinboard", "wrong", true)
+			if !IsAuthError(err) {
+				t.Errorf("Login returned %v, want an auth error", err)
+			}
+		})
+	}
+}
+
+func TestClientStartTLS(t *testing.T) {
+	s := newPOP3Server(t)
+	c := dialPOP3(t, s)
+	config := s.ClientTLSConfig.Clone()
+	config.ServerName = "127.0.0.1"
+	if err := c.StartTLS(config); err != nil {
+		t.Fatal(err)
+	}
+	if !c.IsTLS() {
+		t.Errorf("the connection is not secured after STLS")
+	}
+	// PLAIN is chosen over APOP with TLS
+	if err := c.Login("", "pinboard", "secret", false); err != nil {
+		t.Fatal(err)
+	}
+	if got, want := s.Commands(), []string{"STLS", "CAPA", "AUTH"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("commands %v, want %v", got, want)
+	}
+	if err := c.StartTLS(config); err == nil {
+		t.Errorf("the second StartTLS returned no error")
+	}
+}
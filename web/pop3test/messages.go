@@ -0,0 +1,93 @@
+package pop3test
+
+import (
+	"bytes"
+	"encoding/base64"
+	"fmt"
+	"image"
+	"image/color"
+	"image/jpeg"
+	"image/png"
+)
+
+// canned mails for the usual cases, the images are generated so the files
+// stay small
+
+const from = "Alice <alice@example.com>"
+const date = "Mon, 2 Jan 2006 15:04:05 +0100"
+
+// PlainMail is a mail with a text body only.
+func PlainMail(subject, body string) []byte {
+	return []byte(fmt.Sprintf("From: %s\r\nTo: pinboard@example.com\r\nDate: %s\r\nSubject: %s\r\n"+
+		"Content-Type: text/plain; charset=utf-8\r\n\r\n%s\r\n", from, date, subject, body))
+}
+
+// DotStuffedMail is a text mail with lines starting with dots, one of them a
+// single dot that would end the reply if it was not stuffed.
+func DotStuffedMail() []byte {
+	return PlainMail("Dots", "first line\r\n.\r\n..two dots\r\n.last line")
+}
+
+// EncodedMail has an RFC 2047 encoded subject and an ISO-8859-1 quoted-printable
+// body. The decoded body is "Grüße aus Köln".
+func EncodedMail() []byte {
+	return []byte(fmt.Sprintf("From: %s\r\nDate: %s\r\n"+
+		"Subject: =?ISO-8859-1?Q?Gr=FC=DFe_aus_K=F6ln?=\r\n"+
+		"MIME-Version: 1.0\r\n"+
+		"Content-Type: text/plain; charset=ISO-8859-1\r\n"+
+		"Content-Transfer-Encoding: quoted-printable\r\n\r\n"+
+		"Gr=FC=DFe aus K=F6ln\r\n", from, date))
+}
+
+// AttachmentMail has a text part and a JPEG image of width x height as attachment.
+func AttachmentMail(body string, width, height int) []byte {
+	return multipartMail("mixed", body, "image/jpeg", "attachment", "photo.jpg", JPEG(width, height))
+}
+
+// InlineMail has a text part and a PNG image of width x height shown inline.
+func InlineMail(body string, width, height int) []byte {
+	return multipartMail("related", body, "image/png", "inline", "photo.png", PNG(width, height))
+}
+
+func multipartMail(kind, body, contentType, disposition, filename string, img []byte) []byte {
+	const boundary = "pop3test-boundary"
+	var b bytes.Buffer
+	fmt.Fprintf(&b, "From: %s\r\nDate: %s\r\nSubject: Photo\r\nMIME-Version: 1.0\r\n", from, date)
+	fmt.Fprintf(&b, "Content-Type: multipart/%s; boundary=%q\r\n\r\n", kind, boundary)
+	fmt.Fprintf(&b, "--%s\r\nContent-Type: text/plain; charset=utf-8\r\n\r\n%s\r\n", boundary, body)
+	fmt.Fprintf(&b, "--%s\r\nContent-Type: %s; name=%q\r\n", boundary, contentType, filename)
+	fmt.Fprintf(&b, "Content-Disposition: %s; filename=%q\r\n", disposition, filename)
+	fmt.Fprintf(&b, "Content-ID: <%s>\r\nContent-Transfer-Encoding: base64\r\n\r\n", filename)
+	enc := base64.StdEncoding.EncodeToString(img)
+	for len(enc) > 76 {
+		b.WriteString(enc[:76] + "\r\n")
+		enc = enc[76:]
+	}
+	b.WriteString(enc + "\r\n")
+	fmt.Fprintf(&b, "--%s--\r\n", boundary)
+	return b.Bytes()
+}
+
+// JPEG returns a JPEG image with a color gradient.
+func JPEG(width, height int) []byte {
+	var b bytes.Buffer
+	jpeg.Encode(&b, gradient(width, height), nil)
+	return b.Bytes()
+}
+
+// PNG returns a PNG image with a color gradient.
+func PNG(width, height int) []byte {
+	var b bytes.Buffer
+	png.Encode(&b, gradient(width, height))
+	return b.Bytes()
+}
+
+func gradient(width, height int) image.Image {
+	img := image.NewRGBA(image.Rect(0, 0, width, height))
+	for y := 0; y < height; y++ {
+		for x := 0; x < width; x++ {
+			img.Set(x, y, color.RGBA{uint8(255 * x / width), uint8(255 * y / height), 128, 255})
+		}
+	}
+	return img
+}
@@ -0,0 +1,428 @@
+// Package pop3test runs a scripted POP3 server on a loopback port, so the
+// POP3 client and the mail crawler can be tested without a real mailbox.
+// The server serves canned mails and injects faults like -ERR replies and
+// dropped connections on request.
+package pop3test
+
+import (
+	"bufio"
+	"crypto/md5"
+	"crypto/tls"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"github.com/flothe/pinboard/web/internal/testcert"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// Server is a running POP3 stand-in with a single mailbox.
+type Server struct {
+	// address of the server, e.g. "127.0.0.1:34567"
+	Addr string
+	// TLS config for clients that trusts the certificate of the server, used
+	// for implicit TLS and STLS
+	ClientTLSConfig *tls.Config
+	serverTLS       *tls.Config
+	listener        net.Listener
+	username        string
+	password        string
+
+	mu       sync.Mutex
+	msgs     []*Message
+	faults   []fault
+	commands []string
+	conns    map[net.Conn]bool
+	nextID   int
+}
+
+// Message is a mail in the mailbox.
+type Message struct {
+	UID  string
+	Data []byte
+}
+
+// fault is a reply or a dropped connection instead of the normal reply
+type fault struct {
+	command string
+	reply   string
+	drop    bool
+}
+
+// the greeting contains the timestamp for APOP
+const timestamp = "<1896.697170952@pop3test>"
+
+// NewServer starts a server without TLS. STLS is offered.
+func NewServer(username, password string) (*Server, error) {
+	return newServer(username, password, false)
+}
+
+// NewTLSServer starts a server that speaks TLS from the start, like on port 995.
+func NewTLSServer(username, password string) (*Server, error) {
+	return newServer(username, password, true)
+}
+
+func newServer(username, password string, implicitTLS bool) (*Server, error) {
+	serverTLS, clientTLS, err := testcert.New()
+	if err != nil {
+		return nil, err
+	}
+	var l net.Listener
+	if implicitTLS {
+		l, err = tls.Listen("tcp", "127.0.0.1:0", serverTLS)
+	} else {
+		l, err = net.Listen("tcp", "127.0.0.1:0")
+	}
+	if err != nil {
+		return nil, err
+	}
+	s := &Server{
+		Addr:            l.Addr().String(),
+		ClientTLSConfig: clientTLS,
+		serverTLS:       serverTLS,
+		listener:        l,
+		username:        username,
+		password:        password,
+		conns:           make(map[net.Conn]bool),
+	}
+	go s.serve()
+	return s, nil
+}
+
+// Close stops the server and drops all connections.
+func (s *Server) Close() error {
+	err := s.listener.Close()
+	s.mu.Lock()
+	for c := range s.conns {
+		c.Close()
+	}
+	s.mu.Unlock()
+	return err
+}
+
+// AddMessage puts the RFC 5322 mail into the mailbox and returns its UID.
+// Lines may end with LF or CRLF.
+func (s *Server) AddMessage(data []byte) string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.nextID++
+	uid := fmt.Sprintf("uid-%04d", s.nextID)
+	s.msgs = append(s.msgs, &Message{UID: uid, Data: data})
+	return uid
+}
+
+// Messages returns the mails in the mailbox. Deleted mails are removed when
+// the client quits.
+func (s *Server) Messages() []Message {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var msgs []Message
+	for _, m := range s.msgs {
+		msgs = append(msgs, *m)
+	}
+	return msgs
+}
+
+// Commands returns the commands received so far, without arguments.
+func (s *Server) Commands() []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]string(nil), s.commands...)
+}
+
+// FailNext makes the server answer the next command (e.g. "RETR") with
+// reply instead, e.g. "-ERR mailbox locked".
+func (s *Server) FailNext(command, reply string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.faults = append(s.faults, fault{command: strings.ToUpper(command), reply: reply})
+}
+
+// DropNext makes the server close the connection when it receives the
+// command, without a reply.
+func (s *Server) DropNext(command string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.faults = append(s.faults, fault{command: strings.ToUpper(command), drop: true})
+}
+
+// takeFault returns the first fault for the command and removes it
+func (s *Server) takeFault(command string) (fault, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.commands = append(s.commands, command)
+	for i, f := range s.faults {
+		if f.command == command {
+			s.faults = append(s.faults[:i], s.faults[i+1:]...)
+			return f, true
+		}
+	}
+	return fault{}, false
+}
+
+func (s *Server) serve() {
+	for {
+		c, err := s.listener.Accept()
+		if err != nil {
+			return
+		}
+		s.mu.Lock()
+		s.conns[c] = true
+		s.mu.Unlock()
+		go s.handle(c)
+	}
+}
+
+// session is the state of a connection
+type session struct {
+	conn     net.Conn
+	r        *bufio.Reader
+	user     string
+	loggedIn bool
+	// the mails at login and the numbers marked as deleted
+	msgs    []*Message
+	deleted map[int]bool
+}
+
+func (s *Server) handle(c net.Conn) {
+	ss := &session{conn: c, r: bufio.NewReader(c), deleted: make(map[int]bool)}
+	defer func() {
+		s.mu.Lock()
+		delete(s.conns, ss.conn)
+		s.mu.Unlock()
+		ss.conn.Close()
+	}()
+
+	ss.reply("+OK pop3test ready " + timestamp)
+	for {
+		line, err := ss.r.ReadString('\n')
+		if err != nil {
+			return
+		}
+		line = strings.TrimRight(line, "\r\n")
+		fs := strings.Fields(line)
+		cmd := ""
+		if len(fs) > 0 {
+			cmd = strings.ToUpper(fs[0])
+		}
+
+		if f, ok := s.takeFault(cmd); ok {
+			if f.drop {
+				return
+			}
+			ss.reply(f.reply)
+			continue
+		}
+		if !s.command(ss, cmd, fs[min(1, len(fs)):]) {
+			return
+		}
+	}
+}
+
+// command handles one command and returns false if the connection ends
+func (s *Server) command(ss *session, cmd string, args []string) bool {
+	switch {
+	case cmd == "QUIT":
+		if ss.loggedIn {
+			s.expunge(ss)
+		}
+		ss.reply("+OK bye")
+		return false
+	case cmd == "CAPA":
+		capa := []string{"USER", "UIDL", "TOP", "SASL PLAIN"}
+		if _, ok := ss.conn.(*tls.Conn); !ok {
+			capa = append(capa, "STLS")
+		}
+		ss.multiline("+OK capabilities follow", capa)
+	case cmd == "NOOP":
+		ss.reply("+OK")
+	case !ss.loggedIn:
+		s.authorization(ss, cmd, args)
+	default:
+		s.transaction(ss, cmd, args)
+	}
+	return true
+}
+
+// authorization handles the commands before the login
+func (s *Server) authorization(ss *session, cmd string, args []string) {
+	switch cmd {
+	case "STLS":
+		if _, ok := ss.conn.(*tls.Conn); ok {
+			ss.reply("-ERR already using TLS")
+			return
+		}
+		ss.reply("+OK begin TLS negotiation")
+		c := tls.Server(ss.conn, s.serverTLS)
+		s.mu.Lock()
+		delete(s.conns, ss.conn)
+		s.conns[c] = true
+		s.mu.Unlock()
+		ss.conn = c
+		ss.r = bufio.NewReader(c)
+	case "USER":
+		if len(args) != 1 {
+			ss.reply("-ERR usage: USER name")
+			return
+		}
+		ss.user = args[0]
+		ss.reply("+OK")
+	case "PASS":
+		s.login(ss, ss.user == s.username && strings.Join(args, " ") == s.password)
+	case "APOP":
+		digest := md5.Sum([]byte(timestamp + s.password))
+		s.login(ss, len(args) == 2 && args[0] == s.username && args[1] == hex.EncodeToString(digest[:]))
+	case "AUTH":
+		if len(args) != 2 || strings.ToUpper(args[0]) != "PLAIN" {
+			ss.reply("-ERR only AUTH PLAIN with initial response")
+			return
+		}
+		ir, err := base64.StdEncoding.DecodeString(args[1])
+		parts := strings.Split(string(ir), "\x00")
+		s.login(ss, err == nil && len(parts) == 3 && parts[1] == s.username && parts[2] == s.password)
+	default:
+		ss.reply("-ERR unknown command or not logged in")
+	}
+}
+
+func (s *Server) login(ss *session, ok bool) {
+	if !ok {
+		ss.reply("-ERR [AUTH] invalid user or password")
+		return
+	}
+	s.mu.Lock()
+	ss.msgs = append([]*Message(nil), s.msgs...)
+	s.mu.Unlock()
+	ss.loggedIn = true
+	ss.reply(fmt.Sprintf("+OK %v messages", len(ss.msgs)))
+}
+
+// transaction handles the commands after the login
+func (s *Server) transaction(ss *session, cmd string, args []string) {
+	var nr int
+	var m *Message
+	if len(args) > 0 {
+		var err error
+		nr, err = strconv.Atoi(args[0])
+		if err != nil || nr < 1 || nr > len(ss.msgs) || ss.deleted[nr] {
+			ss.reply("-ERR no such message")
+			return
+		}
+		m = ss.msgs[nr-1]
+	}
+
+	switch cmd {
+	case "STAT":
+		count, size := 0, 0
+		for i, m := range ss.msgs {
+			if !ss.deleted[i+1] {
+				count++
+				size += len(m.Data)
+			}
+		}
+		ss.reply(fmt.Sprintf("+OK %v %v", count, size))
+	case "LIST", "UIDL":
+		value := func(m *Message) string {
+			if cmd == "LIST" {
+				return strconv.Itoa(len(m.Data))
+			}
+			return m.UID
+		}
+		if m != nil {
+			ss.reply(fmt.Sprintf("+OK %v %v", nr, value(m)))
+			return
+		}
+		var lines []string
+		for i, m := range ss.msgs {
+			if !ss.deleted[i+1] {
+				lines = append(lines, fmt.Sprintf("%v %v", i+1, value(m)))
+			}
+		}
+		ss.multiline("+OK", lines)
+	case "RETR":
+		if m == nil {
+			ss.reply("-ERR usage: RETR msg")
+			return
+		}
+		ss.multiline(fmt.Sprintf("+OK %v octets", len(m.Data)), splitLines(m.Data))
+	case "TOP":
+		n := -1
+		if len(args) == 2 {
+			n, _ = strconv.Atoi(args[1])
+		}
+		if m == nil || n < 0 {
+			ss.reply("-ERR usage: TOP msg n")
+			return
+		}
+		lines := splitLines(m.Data)
+		for i, l := range lines {
+			if l == "" {
+				lines = lines[:min(len(lines), i+1+n)]
+				break
+			}
+		}
+		ss.multiline("+OK", lines)
+	case "DELE":
+		if m == nil {
+			ss.reply("-ERR usage: DELE msg")
+			return
+		}
+		ss.deleted[nr] = true
+		ss.reply("+OK marked as deleted")
+	case "RSET":
+		ss.deleted = make(map[int]bool)
+		ss.reply("+OK")
+	default:
+		ss.reply("-ERR unknown command")
+	}
+}
+
+// expunge removes the mails marked as deleted from the mailbox
+func (s *Server) expunge(ss *session) {
+	gone := make(map[*Message]bool)
+	for nr := range ss.deleted {
+		gone[ss.msgs[nr-1]] = true
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var msgs []*Message
+	for _, m := range s.msgs {
+		if !gone[m] {
+			msgs = append(msgs, m)
+		}
+	}
+	s.msgs = msgs
+}
+
+func (ss *session) reply(line string) {
+	fmt.Fprintf(ss.conn, "%s\r\n", line)
+}
+
+// multiline sends a reply with the lines dot-stuffed and terminated by "."
+func (ss *session) multiline(first string, lines []string) {
+	w := bufio.NewWriter(ss.conn)
+	fmt.Fprintf(w, "%s\r\n", first)
+	for _, l := range lines {
+		if strings.HasPrefix(l, ".") {
+			l = "." + l
+		}
+		fmt.Fprintf(w, "%s\r\n", l)
+	}
+	fmt.Fprint(w, ".\r\n")
+	w.Flush()
+}
+
+// splitLines splits a mail with LF or CRLF line ends
+func splitLines(data []byte) []string {
+	text := strings.Replace(string(data), "\r\n", "\n", -1)
+	return strings.Split(strings.TrimSuffix(text, "\n"), "\n")
+}
+
+func min(a, b int) int {
+	if a < b {
+		return a
+	}
+	return b
+}
@@ -0,0 +1,33 @@
+package web
+
+import "sync"
+
+// AttemptReporter is implemented by crawlers that tell the result of every
+// crawling attempt, so the health of the sources can be watched
+type AttemptReporter interface {
+	// ReportAttempts calls f after every attempt with its error, nil if
+	// the attempt succeeded. f is called by the goroutine of the crawler.
+	ReportAttempts(f func(err error))
+}
+
+// attempts is embedded by the crawlers to implement AttemptReporter
+type attempts struct {
+	mu sync.Mutex
+	f  func(err error)
+}
+
+func (a *attempts) ReportAttempts(f func(err error)) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.f = f
+}
+
+// report tells the result of an attempt
+func (a *attempts) report(err error) {
+	a.mu.Lock()
+	f := a.f
+	a.mu.Unlock()
+	if f != nil {
+		f(err)
+	}
+}
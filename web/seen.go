@@ -0,0 +1,120 @@
+package web
+
+import (
+	"bytes"
+	"encoding/gob"
+	"github.com/flothe/pinboard/internal/atomicfile"
+	"io/ioutil"
+	"log"
+	"os"
+	"strings"
+	"time"
+)
+
+// SeenUIDs remembers when the messages of a mailbox have been crawled, by
+// their unique id. The set is saved to a file, so no message is crawled twice,
+// also after a restart.
+type SeenUIDs struct {
+	filename string
+	crawled  map[string]time.Time
+}
+
+// LoadSeenUIDs reads the set from the file. If the file does not exist yet
+// the set is empty.
+func LoadSeenUIDs(filename string) (*SeenUIDs, error) {
+	s := &SeenUIDs{filename: filename, crawled: make(map[string]time.Time)}
+	n, err := ioutil.ReadFile(filename)
+	if os.IsNotExist(err) {
+		return s, nil
+	}
+	if err != nil {
+		log.Printf("Failed to read seen UIDs from %s: %v\n", filename, err)
+		return s, err
+	}
+	err = gob.NewDecoder(bytes.NewBuffer(n)).Decode(&s.crawled)
+	if err != nil {
+		log.Printf("Failed to decode seen UIDs from %s: %v\n", filename, err)
+		return s, err
+	}
+	log.Printf("Loaded %v seen UIDs from %s\n", len(s.crawled), filename)
+	return s, nil
+}
+
+// Save writes the set to its file atomically, so the old set stays intact if
+// writing fails.
+func (s *SeenUIDs) Save() error {
+	m := new(bytes.Buffer)
+	err := gob.NewEncoder(m).Encode(s.crawled)
+	if err != nil {
+		log.Printf("Failed to encode seen UIDs for %s: %v\n", s.filename, err)
+		return err
+	}
+	err = atomicfile.WriteFile(s.filename, m.Bytes(), 0600)
+	if err != nil {
+		log.Printf("Failed to write seen UIDs to %s: %v\n", s.filename, err)
+		return err
+	}
+	return nil
+}
+
+// Crawled returns when the message has been crawled and if it has been crawled at all.
+func (s *SeenUIDs) Crawled(uid string) (time.Time, bool) {
+	t, ok := s.crawled[uid]
+	return t, ok
+}
+
+// Add marks the message as crawled at t.
+func (s *SeenUIDs) Add(uid string, t time.Time) {
+	s.crawled[uid] = t
+}
+
+// UIDs returns the unique ids of all crawled messages.
+func (s *SeenUIDs) UIDs() []string {
+	uids := make([]string, 0, len(s.crawled))
+	for uid := range s.crawled {
+		uids = append(uids, uid)
+	}
+	return uids
+}
+
+// Retain forgets all messages that are no longer in the mailbox and returns
+// how many have been forgotten.
+func (s *SeenUIDs) Retain(uids []string) int {
+	exists := make(map[string]bool, len(uids))
+	for _, uid := range uids {
+		exists[uid] = true
+	}
+	n := 0
+	for uid := range s.crawled {
+		if !exists[uid] {
+			delete(s.crawled, uid)
+			n++
+		}
+	}
+	return n
+}
+
+// loadLastID returns the id of the last crawled message of a timeline, saved
+// by saveLastID. If there is none, "" is returned.
+func loadLastID(filename string) string {
+	b, err := ioutil.ReadFile(filename)
+	if os.IsNotExist(err) {
+		return ""
+	}
+	if err != nil {
+		log.Printf("Failed to read the last crawled id from %s: %v\n", filename, err)
+		return ""
+	}
+	id := strings.TrimSpace(string(b))
+	log.Printf("Crawling since %v\n", id)
+	return id
+}
+
+// saveLastID writes the id of the last crawled message atomically, so the
+// old id stays intact if writing fails.
+func saveLastID(filename, id string) {
+	err := atomicfile.WriteFile(filename, []byte(id+"\n"), 0600)
+	if err != nil {
+		log.Printf("Failed to write the last crawled id to %s: %v\n", filename, err)
+	}
+}
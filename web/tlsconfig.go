@@ -0,0 +1,34 @@
+package web
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"io/ioutil"
+)
+
+// NewTLSConfig returns a TLS config that trusts the CA certificates in the
+// PEM file caFile in addition to the system CAs and checks the certificate of
+// the server for serverName instead of the host name of the address. Empty
+// arguments keep the defaults. If both are empty nil is returned.
+func NewTLSConfig(caFile, serverName string) (*tls.Config, error) {
+	if caFile == "" && serverName == "" {
+		return nil, nil
+	}
+	config := &tls.Config{ServerName: serverName}
+	if caFile != "" {
+		pem, err := ioutil.ReadFile(caFile)
+		if err != nil {
+			return nil, err
+		}
+		pool, err := x509.SystemCertPool()
+		if err != nil {
+			pool = x509.NewCertPool()
+		}
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("No certificates found in %v", caFile)
+		}
+		config.RootCAs = pool
+	}
+	return config, nil
+}
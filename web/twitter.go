@@ -1,226 +1,228 @@
 package web
 
 import (
-	"bytes"
-	"encoding/gob"
-	"github.com/flothe/pinboard/grafic2d"
+	"context"
 	"fmt"
 	"github.com/ChimeraCoder/anaconda"
-	"io/ioutil"
+	"github.com/flothe/pinboard/clock"
+	"html"
 	"log"
-	"net/mail"
-	"os"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
 	"strings"
 	"time"
 )
 
+// TwitterTimeline selects the tweets that are crawled, exactly one of the
+// fields is set
+type TwitterTimeline struct {
+	// list as "owner/slug" or as numeric id
+	List string
+	// search query, e.g. a hashtag
+	Search string
+	// tweets of this user
+	ScreenName string
+}
 
-type TwitterCrawler struct {
-	api  anaconda.TwitterApi
-	consumerKey, consumerSecret, accessToken, accessTokenSecret string	
+func (t TwitterTimeline) String() string {
+	switch {
+	case t.List != "":
+		return "list " + t.List
+	case t.Search != "":
+		return "search " + t.Search
+	}
+	return "user " + t.ScreenName
 }
 
+// the first crawl only fetches the latest tweets, later crawls everything
+// since the last one
+const firstCrawlTweets = 10
+
+type TwitterCrawler struct {
+	attempts
+	// base URL of the API, e.g. of a local stand-in. The Twitter API if empty.
+	BaseURL                                                     string
+	consumerKey, consumerSecret, accessToken, accessTokenSecret string
+	timeline                                                    TwitterTimeline
+	// file of the id of the last crawled tweet
+	sinceFile  string
+	limits     ImageLimits
+	clock      clock.Clock
+	httpClient *http.Client
+}
 
-func NewTwitterCrawler(consumerKey, consumerSecret, accessToken, accessTokenSecret string) Crawler {
+// NewTwitterCrawler returns a crawler for the tweets of the timeline. The id
+// of the last crawled tweet is saved in the current directory, so no tweet
+// is crawled twice. Photos are scaled to fit into limits.
+func NewTwitterCrawler(consumerKey, consumerSecret, accessToken, accessTokenSecret string, timeline TwitterTimeline, limits ImageLimits, clk clock.Clock) *TwitterCrawler {
+	clk = clock.Or(clk)
+	// one file per timeline
+	r := strings.NewReplacer("/", "-", ":", "-", "@", "-", "#", "", " ", "")
 	crawler := &TwitterCrawler{
-		consumerKey:  consumerKey,
-		consumerSecret: consumerSecret,
-		accessToken: accessToken,
+		consumerKey:       consumerKey,
+		consumerSecret:    consumerSecret,
+		accessToken:       accessToken,
 		accessTokenSecret: accessTokenSecret,
+		timeline:          timeline,
+		sinceFile:         r.Replace(fmt.Sprintf(".twitter-%s.since", timeline)),
+		limits:            limits,
+		clock:             clk,
+		httpClient:        &http.Client{Timeout: time.Minute},
 	}
-	
-	anaconda.SetConsumerKey(consumerKey)
-	anaconda.SetConsumerSecret(consumerSecret)
 
 	return crawler
 }
 
-func (crawler *TwitterCrawler) Crawl(entries chan<- MessageData, quit <-chan bool, repeatDuration time.Duration) {
+func (crawler *TwitterCrawler) Crawl(ctx context.Context, entries chan<- MessageData, repeatDuration time.Duration) error {
 
-	log.Println("Start crawling tweets.")
-	loop := true
+	log.Printf("Start crawling tweets of %v\n", crawler.timeline)
 
-	//wait in a separate goroutine for the quit message. if received stop the crawling loop
-	go func() {
-		<-quit
-		loop = false
-	}()
+	api := anaconda.NewTwitterApiWithCredentials(crawler.accessToken, crawler.accessTokenSecret, crawler.consumerKey, crawler.consumerSecret)
+	if crawler.BaseURL != "" {
+		api.SetBaseUrl(crawler.BaseURL)
+	}
+	// anaconda would block until the rate limit window ends, but the crawler
+	// must stay responsive to the quit message
+	api.ReturnRateLimitError(true)
+	defer api.Close()
 
-	// relogin every hour
-	reloginTime := time.Now().Add(1 * time.Hour)
+	sinceID, _ := strconv.ParseInt(loadLastID(crawler.sinceFile), 10, 64)
 
-	// login to the server
-	crawler.api := anaconda.NewTwitterApi(crawler.accessToken, crawler.accessTokenSecret)
-	tweets, err := crawler.api.GetHomeTimeline()
-	if err != nil {
-		fmt.Print(err.Error())
-		return
-	}
-	
-	for _, tweet := range tweets {
-	    fmt.Print(tweet.Text)
-	}
-	
-/*	
-	
-	// now we start crawling until an error occures or the channel is closed
-	for loop {
-		t0 := time.Now()
+	// now we start crawling until ctx is done
+	for {
+		t0 := crawler.clock.Now()
 		log.Printf("Start new crawling attemp\n")
+		wait := repeatDuration
 
-		// get number of messages
-		msgNrs, _, er := client.ListAll()
-		if er != nil {
-			fmt.Print(er.Error())
-			close(entries)
-			return
-		}
-		log.Printf("Number of messages: %v\n", msgNrs)
-
-		client.Stat()
-
-		// if it exists, get the first message ...
-		if len(msgNrs) > 0 {
-			msg, er := client.RetrMsg(msgNrs[0])
-			if er == nil {
-				log.Printf("Retrieve messages: %v\n", msgNrs[0])
-				// create a CrawlEntry out of the message
-				entry, er := processMailMessage(msg)
-				if er == nil {
-					log.Printf("Created entry from mail: %v, %v, %v\n", entry.SenderName, entry.ShortText, entry.ImageNames)
-					// ... and delete the message on the server
-					er = client.Dele(msgNrs[0])
-					if er == nil {
-						log.Printf("Delete message: %v\n", msgNrs[0])
-						// send message using the channel
-						entries <- *entry
-					}
+		tweets, err := crawler.fetch(api, sinceID)
+		if err != nil {
+			log.Printf("Crawling attemp failed: %v\n", err)
+			if aerr, ok := err.(*anaconda.ApiError); ok {
+				if isRateLimit, nextWindow := aerr.RateLimitCheck(); isRateLimit {
+					log.Printf("Rate limit reached, trying again at %v\n", nextWindow)
+					wait = nextWindow.Sub(t0)
 				}
 			}
-			if er != nil {
-				log.Printf("Crawling attemp failed: %v\n", er)
-				//try to recover
-				reloginTime = time.Now()
-				time.Sleep(time.Minute * 1)
-			}
-
-		}
-
-		// wait some time
-		t1 := time.Now()
-		duration := repeatDuration - (t1.Sub(t0))
-		for duration > 0 && loop {
-			// wait a second
-			time.Sleep(time.Second)
-			// recalculate the duration of this crawling attemp
-			t1 = time.Now()
-			duration = repeatDuration - (t1.Sub(t0))
 		}
-
-		// relogin to the server
-		if reloginTime.Before(time.Now()) {
-			log.Println("Relogin to the server ...")
-			client.Quit()
-			time.Sleep(time.Second * 3)
-			client, er = crawler.login()
-			if er != nil {
-				reloginTime = time.Now()
-				log.Println("Going to sleep for 5 minutes. Afterwards trying again to login.")
-				time.Sleep(time.Minute * 5)
+		crawler.report(err)
+		log.Printf("Number of tweets: %v\n", len(tweets))
+
+		// oldest first, so the since id only moves forward
+		sort.Slice(tweets, func(i, j int) bool { return tweets[i].Id < tweets[j].Id })
+		for i := range tweets {
+			entry, err := processTweet(&tweets[i], crawler.limits, crawler.httpClient)
+			if err != nil {
+				// the since id cannot skip a tweet, so it is lost
+				log.Printf("Failed to process tweet %v: %v\n", tweets[i].IdStr, err)
 			} else {
-				// relogin every hour
-				reloginTime = time.Now().Add(1 * time.Hour)
-				log.Printf("Next relogin at: %v\n", reloginTime)
+				log.Printf("Created entry from tweet: %v, %v, %v\n", entry.SenderName, entry.ShortText, entry.ImageNames)
+				// send message using the channel
+				entries <- *entry
 			}
+			sinceID = tweets[i].Id
+			saveLastID(crawler.sinceFile, strconv.FormatInt(sinceID, 10))
 		}
 
+		// wait some time
+		select {
+		case <-ctx.Done():
+			log.Printf("Stop crawling tweets of %v\n", crawler.timeline)
+			return nil
+		case <-crawler.clock.After(wait - crawler.clock.Since(t0)):
+		}
 	}
-	client.Quit()
-	log.Printf("Stop crawling mails from: %s", crawler.url)
-	close(entries)
-	
-	*/
 }
 
+// fetch returns the tweets of the timeline newer than sinceID
+func (crawler *TwitterCrawler) fetch(api *anaconda.TwitterApi, sinceID int64) ([]anaconda.Tweet, error) {
+	v := url.Values{}
+	// tweets with more than 140 characters are truncated otherwise
+	v.Set("tweet_mode", "extended")
+	if sinceID > 0 {
+		v.Set("since_id", strconv.FormatInt(sinceID, 10))
+		v.Set("count", "200")
+	} else {
+		v.Set("count", strconv.Itoa(firstCrawlTweets))
+	}
 
-func processTweet(tweet *anaconda.Tweet) (*MessageData, error) {
+	t := crawler.timeline
+	switch {
+	case t.List != "":
+		if id, err := strconv.ParseInt(t.List, 10, 64); err == nil {
+			return api.GetListTweets(id, true, v)
+		}
+		n := strings.Index(t.List, "/")
+		if n < 0 {
+			return nil, fmt.Errorf("Invalid list %q, use owner/slug or the id", t.List)
+		}
+		return api.GetListTweetsBySlug(t.List[n+1:], t.List[:n], true, v)
+	case t.Search != "":
+		v.Set("result_type", "recent")
+		sr, err := api.GetSearch(t.Search, v)
+		return sr.Statuses, err
+	default:
+		v.Set("screen_name", t.ScreenName)
+		return api.GetUserTimeline(v)
+	}
+}
 
+// processTweet creates a message out of the tweet and saves its photos,
+// photos that cannot be saved are left out
+func processTweet(tweet *anaconda.Tweet, limits ImageLimits, client *http.Client) (*MessageData, error) {
 
-	/*
 	data := new(MessageData)
-	data.Type = EMAIL
+	data.Type = TWEET
 
-	mime, err := enmime.ParseMIMEBody(msg) // Parse message body with enmime
+	var err error
+	data.Timestamp, err = tweet.CreatedAtTime()
 	if err != nil {
-		return nil, fmt.Errorf("Failed to parse MIME body: ", err.Error())
+		return nil, fmt.Errorf("Failed to get date from tweet: %v", err)
 	}
-
-	data.Timestamp, err = msg.Header.Date()
-	if err != nil {
-		return nil, fmt.Errorf("Failed to get date from message: ", err.Error())
+	data.SenderName = fmt.Sprintf("%v (@%v)", tweet.User.Name, tweet.User.ScreenName)
+
+	// a retweet is truncated, the original has the full text and the media
+	t := tweet
+	prefix := ""
+	if tweet.RetweetedStatus != nil {
+		t = tweet.RetweetedStatus
+		prefix = fmt.Sprintf("RT @%v: ", t.User.ScreenName)
 	}
-	data.ShortText = mime.GetHeader("Subject")
-	data.SenderName = mime.GetHeader("From")
-	data.LongText = mime.Text
-	log.Printf("MIME Text:%v\n", mime.Text)
-
-	// handle attachments
-	log.Printf("MIME attachments:%v\n", len(mime.Attachments))
-	for _, a := range mime.Attachments {
-		err := data.saveMultimediaAttachment(a)
-		if err != nil {
-			return nil, fmt.Errorf("Failed to checkAndSaveAttachment: ", err.Error())
-		}
+	media := t.ExtendedEntities.Media
+	if len(media) == 0 {
+		media = t.Entities.Media
 	}
 
-	// handle inlines
-	log.Printf("MIME inlines:%v\n", len(mime.Inlines))
-	for _, a := range mime.Inlines {
-		err := data.saveMultimediaAttachment(a)
-		if err != nil {
-			return nil, fmt.Errorf("Failed to checkAndSaveAttachment: ", err.Error())
-		}
+	text := t.FullText
+	if text == "" {
+		text = t.Text
 	}
-	*/
-
-	/*
-		log.Printf("mime.Root = %v\n", mime.Root)
-		if mime.Root != nil {
-			pics := enmime.BreadthMatchAll(mime.Root, func(pt enmime.MIMEPart) bool {
-				log.Printf("BreadthMatchAll: %s\n‚", pt.ContentType())
-				return pt.ContentType() == "image/jpeg" || pt.ContentType() == "image/png" || pt.ContentType() == "image/jpg"
-			})
-			log.Printf("MIME BreadthMatchAll found %v images.\n", len(pics))
-			for _, a := range pics {
-				err := data.saveMultimediaAttachment(a)
-				if err != nil {
-					return nil, fmt.Errorf("Failed to checkAndSaveAttachment: ", err.Error())
-				}
-			}
-		}
-
-	*/
-	return nil, nil
-
-}
-
-func createUniqueFilename(filename, extension string) string {
-
-	// remove file extemsion
-	fn := filename
-	n := strings.LastIndex(filename, ".")
-	if n>0 {
-		fn = filename[:n]
+	// the photos are shown, their links are not needed. Other links are shown
+	// as Twitter displays them.
+	for _, m := range media {
+		text = strings.Replace(text, m.Url, "", -1)
 	}
-
-	fnRes := fn+"."+extension
-	_, err := os.Stat(fnRes)
-	i := 0
-	for (err == nil) && i < 10000 {
-		fnRes = fmt.Sprintf("%v%04v.%v", fn, i, extension)
-		_, err = os.Stat(fnRes)
-		i++
+	for _, u := range t.Entities.Urls {
+		text = strings.Replace(text, u.Url, u.Display_url, -1)
+	}
+	text = prefix + strings.TrimSpace(html.UnescapeString(text))
+	data.ShortText = text
+	data.LongText = text
+
+	log.Printf("Tweet media:%v\n", len(media))
+	for _, m := range media {
+		// videos and GIFs have a photo as preview
+		u := m.Media_url_https
+		if u == "" {
+			u = m.Media_url
+		}
+		err := data.saveImageURL(u, limits, client)
+		if err != nil {
+			// the since id moves on, so the tweet is shown without it
+			log.Printf("Failed to save media %v: %v\n", m.Id_str, err)
+		}
 	}
-	return fnRes
 
+	return data, nil
 }
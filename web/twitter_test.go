@@ -0,0 +1,126 @@
+package web
+
+import (
+	"fmt"
+	"github.com/flothe/pinboard/web/pop3test"
+	"github.com/flothe/pinboard/web/twittertest"
+	"io/ioutil"
+	"strings"
+	"testing"
+	"time"
+)
+
+func newTwitterServer(t *testing.T) *twittertest.Server {
+	s := twittertest.NewServer()
+	t.Cleanup(s.Close)
+	return s
+}
+
+func startTwitterCrawl(t *testing.T, s *twittertest.Server, timeline TwitterTimeline) *testCrawl {
+	clk := newFakeClock()
+	c := NewTwitterCrawler("ck", "cs", "at", "as", timeline, DefaultImageLimits, clk)
+	c.BaseURL = s.URL
+	return startCrawl(t, c, clk)
+}
+
+func TestTwitterCrawler(t *testing.T) {
+	chdirTemp(t)
+	s := newTwitterServer(t)
+	posted := time.Date(2019, 12, 31, 12, 0, 0, 0, time.UTC)
+	s.AddTweet("bob", "Hallo #Pinboard &amp; Freunde", posted, pop3test.JPEG(30, 20))
+	s.AddTweet("alice", "ohne Tag", posted)
+	cr := startTwitterCrawl(t, s, TwitterTimeline{Search: "#pinboard"})
+
+	e := cr.recv(t)
+	if e.Type != TWEET || e.SenderName != "Bob (@bob)" || !e.Timestamp.Equal(posted) {
+		t.Errorf("got %v from %q at %v", e.Type, e.SenderName, e.Timestamp)
+	}
+	// the link of the photo is removed
+	if e.ShortText != "Hallo #Pinboard & Freunde" || len(e.ImageNames) != 1 {
+		t.Errorf("got %q %v, want the text without link and the photo", e.ShortText, e.ImageNames)
+	}
+	cr.idle(t)
+}
+
+func TestTwitterCrawlerBrokenPhoto(t *testing.T) {
+	chdirTemp(t)
+	s := newTwitterServer(t)
+	posted := time.Date(2019, 12, 31, 12, 0, 0, 0, time.UTC)
+	tweet := s.AddTweet("bob", "Kaputtes Foto", posted, []byte("no jpeg"), pop3test.JPEG(30, 20))
+	cr := startTwitterCrawl(t, s, TwitterTimeline{ScreenName: "bob"})
+
+	// the tweet is shown with the photo that could be saved
+	if e := cr.recv(t); e.ShortText != "Kaputtes Foto" || len(e.ImageNames) != 1 {
+		t.Errorf("got %q %v, want the tweet with one photo", e.ShortText, e.ImageNames)
+	}
+	cr.idle(t)
+	b, _ := ioutil.ReadFile(".twitter-userbob.since")
+	if strings.TrimSpace(string(b)) != tweet.IdStr {
+		t.Errorf("since file contains %q, want %v", b, tweet.IdStr)
+	}
+}
+
+func TestTwitterCrawlerSinceID(t *testing.T) {
+	chdirTemp(t)
+	s := newTwitterServer(t)
+	posted := time.Date(2019, 12, 31, 12, 0, 0, 0, time.UTC)
+	for i := 0; i < firstCrawlTweets+2; i++ {
+		s.AddTweet("alice", fmt.Sprintf("Tweet %v", i), posted)
+	}
+	timeline := TwitterTimeline{ScreenName: "alice"}
+	cr := startTwitterCrawl(t, s, timeline)
+
+	// the first crawl only takes the latest tweets, oldest first
+	for i := 2; i < firstCrawlTweets+2; i++ {
+		if e := cr.recv(t); e.ShortText != fmt.Sprintf("Tweet %v", i) {
+			t.Errorf("got %q, want Tweet %v", e.ShortText, i)
+		}
+	}
+	cr.idle(t)
+	last := s.AddTweet("alice", "Tweet 12", posted)
+	cr.clk.Advance(time.Minute)
+	if e := cr.recv(t); e.ShortText != "Tweet 12" {
+		t.Errorf("got %q, want the new tweet", e.ShortText)
+	}
+	cr.idle(t)
+	b, _ := ioutil.ReadFile(".twitter-useralice.since")
+	if strings.TrimSpace(string(b)) != last.IdStr {
+		t.Errorf("since file contains %q, want %v", b, last.IdStr)
+	}
+
+	// a restarted crawler goes on after the last tweet
+	cr.stop(t)
+	s.AddTweet("alice", "Tweet 13", posted)
+	cr = startTwitterCrawl(t, s, timeline)
+	if e := cr.recv(t); e.ShortText != "Tweet 13" {
+		t.Errorf("got %q after the restart, want Tweet 13", e.ShortText)
+	}
+	cr.idle(t)
+	requests := s.Requests()
+	want := "since_id=" + last.IdStr
+	if r := requests[len(requests)-1]; !strings.Contains(r, want) || !strings.Contains(r, "count=200") {
+		t.Errorf("request %v, want %v and count=200", r, want)
+	}
+}
+
+func TestTwitterCrawlerRateLimit(t *testing.T) {
+	chdirTemp(t)
+	s := newTwitterServer(t)
+	cr := startTwitterCrawl(t, s, TwitterTimeline{Search: "#pinboard"})
+
+	// the crawl after the limit waits for the reset
+	cr.idle(t)
+	s.RateLimit(1, cr.clk.Now().Add(5*time.Minute))
+	cr.next(t, time.Minute)
+	s.AddTweet("dave", "nach dem Limit #pinboard", cr.clk.Now())
+	n := len(s.Requests())
+	cr.clk.Advance(time.Minute)
+	if len(s.Requests()) != n {
+		t.Errorf("requested %v before the reset", s.Requests()[n:])
+	}
+	cr.clk.Advance(4 * time.Minute)
+	if e := cr.recv(t); e.ShortText != "nach dem Limit #pinboard" {
+		t.Errorf("got %q after the reset", e.ShortText)
+	}
+	cr.idle(t)
+}
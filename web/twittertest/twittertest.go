@@ -0,0 +1,149 @@
+// Package twittertest runs a small stand-in for the Twitter REST API on a
+// loopback port, so the Twitter crawler can be tried without an account. It
+// serves the list, search and user timelines with since_id and count, the
+// photos of the tweets and rate limit errors on request.
+package twittertest
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/ChimeraCoder/anaconda"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Server is a running Twitter API stand-in.
+type Server struct {
+	// base URL of the API, for TwitterCrawler.BaseURL
+	URL string
+	srv *httptest.Server
+
+	mu          sync.Mutex
+	tweets      []anaconda.Tweet
+	photos      map[string][]byte
+	rateLimited int
+	reset       time.Time
+	requests    []string
+}
+
+// NewServer starts a server without tweets.
+func NewServer() *Server {
+	s := &Server{photos: make(map[string][]byte)}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/lists/statuses.json", s.timeline)
+	mux.HandleFunc("/search/tweets.json", s.timeline)
+	mux.HandleFunc("/statuses/user_timeline.json", s.timeline)
+	mux.HandleFunc("/media/", s.media)
+	s.srv = httptest.NewServer(mux)
+	s.URL = s.srv.URL
+	return s
+}
+
+// Close stops the server.
+func (s *Server) Close() {
+	s.srv.Close()
+}
+
+// AddTweet posts a tweet of the user at t with the photos, given as JPEG or
+// PNG files, and returns it. Like on Twitter each photo adds a t.co link to
+// the text.
+func (s *Server) AddTweet(screenName, text string, t time.Time, photos ...[]byte) anaconda.Tweet {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	id := int64(1000 + len(s.tweets))
+	tweet := anaconda.Tweet{
+		Id:        id,
+		IdStr:     strconv.FormatInt(id, 10),
+		CreatedAt: t.Format(time.RubyDate),
+		User:      anaconda.User{Name: strings.Title(screenName), ScreenName: screenName},
+	}
+	for i, p := range photos {
+		name := fmt.Sprintf("%v-%v.jpg", id, i)
+		s.photos[name] = p
+		link := fmt.Sprintf("https://t.co/p%v%v", id, i)
+		text += " " + link
+		tweet.ExtendedEntities.Media = append(tweet.ExtendedEntities.Media, anaconda.EntityMedia{
+			Id_str:          name,
+			Media_url_https: s.URL + "/media/" + name,
+			Url:             link,
+			Type:            "photo",
+		})
+	}
+	tweet.Entities.Media = tweet.ExtendedEntities.Media
+	tweet.FullText = text
+	s.tweets = append(s.tweets, tweet)
+	return tweet
+}
+
+// RateLimit makes the next n timeline requests fail with status 429 and a
+// reset header of the time.
+func (s *Server) RateLimit(n int, reset time.Time) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.rateLimited = n
+	s.reset = reset
+}
+
+// Requests returns the timeline requests received so far, with query.
+func (s *Server) Requests() []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]string(nil), s.requests...)
+}
+
+func (s *Server) timeline(w http.ResponseWriter, r *http.Request) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.requests = append(s.requests, r.URL.RequestURI())
+
+	if s.rateLimited > 0 {
+		s.rateLimited--
+		w.Header().Set("X-Rate-Limit-Remaining", "0")
+		w.Header().Set("X-Rate-Limit-Reset", strconv.FormatInt(s.reset.Unix(), 10))
+		http.Error(w, `{"errors":[{"code":88,"message":"Rate limit exceeded"}]}`, 429)
+		return
+	}
+
+	q := r.URL.Query()
+	sinceID, _ := strconv.ParseInt(q.Get("since_id"), 10, 64)
+	count, err := strconv.Atoi(q.Get("count"))
+	if err != nil {
+		count = 20
+	}
+	// newest first, like the real API
+	var tweets []anaconda.Tweet
+	for i := len(s.tweets) - 1; i >= 0 && len(tweets) < count; i-- {
+		t := s.tweets[i]
+		if t.Id <= sinceID {
+			break
+		}
+		switch {
+		case r.URL.Path == "/statuses/user_timeline.json" && t.User.ScreenName != q.Get("screen_name"):
+		case r.URL.Path == "/search/tweets.json" && !strings.Contains(strings.ToLower(t.FullText), strings.ToLower(q.Get("q"))):
+		default:
+			tweets = append(tweets, t)
+		}
+	}
+
+	var body interface{} = tweets
+	if r.URL.Path == "/search/tweets.json" {
+		body = anaconda.SearchResponse{Statuses: tweets}
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(body)
+}
+
+func (s *Server) media(w http.ResponseWriter, r *http.Request) {
+	s.mu.Lock()
+	p, ok := s.photos[strings.TrimPrefix(r.URL.Path, "/media/")]
+	s.mu.Unlock()
+	if !ok {
+		http.NotFound(w, r)
+		return
+	}
+	w.Write(p)
+}
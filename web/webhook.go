@@ -0,0 +1,347 @@
+package web
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"github.com/flothe/pinboard/clock"
+	"io/ioutil"
+	"log"
+	"mime"
+	"net/http"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+// maximum size of a posted pin, images included
+const maxPinSize = 32 << 20
+
+// how long running requests may take when the server stops
+const webhookShutdownTimeout = 5 * time.Second
+
+// WebhookCrawler receives pins that are posted over HTTP, so CI systems, chat
+// bots and scripts can publish messages. A pin is posted to /pins as JSON or
+// multipart form with a bearer token:
+//
+//	POST /pins
+//	Authorization: Bearer <token>
+//	Content-Type: application/json
+//
+//	{"text": "Build is green", "sender": "CI", "long_text": "...",
+//	 "images": [{"filename": "chart.png", "data": "<base64>"}],
+//	 "show_from": "2024-05-01T08:00:00+02:00", "show_until": "2024-05-01T18:00:00+02:00"}
+//
+// The multipart form has the same fields, the images are files of the field
+// "image". The response is 201 Created with {"id": "<message id>"}.
+type WebhookCrawler struct {
+	attempts
+	// TLS certificate and key, plain HTTP if empty
+	CertFile, KeyFile string
+	addr              string
+	tokens            []string
+	limits            ImageLimits
+	clock             clock.Clock
+}
+
+// pinRequest is a pin posted as JSON
+type pinRequest struct {
+	Text     string `json:"text"`
+	LongText string `json:"long_text"`
+	Sender   string `json:"sender"`
+	Images   []struct {
+		Filename string `json:"filename"`
+		// base64 encoded JPEG, PNG, GIF, WebP, MP4 or WebM
+		Data string `json:"data"`
+	} `json:"images"`
+	ShowFrom  *time.Time `json:"show_from"`
+	ShowUntil *time.Time `json:"show_until"`
+}
+
+// webhookError is answered as JSON with the HTTP status
+type webhookError struct {
+	status int
+	msg    string
+}
+
+func (e *webhookError) Error() string {
+	return e.msg
+}
+
+// errPinTooLarge is answered if the body is larger than maxPinSize
+var errPinTooLarge = &webhookError{http.StatusRequestEntityTooLarge, fmt.Sprintf("The pin is larger than %v MB", maxPinSize>>20)}
+
+// tooLarge tells if reading the body failed because of the limit of
+// http.MaxBytesReader
+func tooLarge(err error) bool {
+	return err != nil && strings.Contains(err.Error(), "http: request body too large")
+}
+
+// NewWebhookCrawler returns a crawler that listens on addr, e.g. ":8080", for
+// pins posted with one of the tokens. Images are scaled to fit into limits. The
+// timestamps of the pins are taken from clk.
+func NewWebhookCrawler(addr string, tokens []string, limits ImageLimits, clk clock.Clock) *WebhookCrawler {
+	clk = clock.Or(clk)
+	crawler := &WebhookCrawler{
+		addr:   addr,
+		tokens: tokens,
+		limits: limits,
+		clock:  clk,
+	}
+
+	return crawler
+}
+
+// Crawl serves the pins until ctx is done. If the server fails, e.g. because
+// the port is in use, it is started again after repeatDuration.
+func (crawler *WebhookCrawler) Crawl(ctx context.Context, entries chan<- MessageData, repeatDuration time.Duration) error {
+
+	log.Printf("Start webhook server on %v\n", crawler.addr)
+
+	// nothing must be sent after Crawl has returned, so it waits for the
+	// requests that are still running
+	var requests sync.WaitGroup
+	for {
+		srv := &http.Server{Addr: crawler.addr, Handler: &webhookHandler{crawler, entries, ctx.Done(), &requests}}
+		failed := make(chan error, 1)
+		go func() {
+			if crawler.CertFile != "" {
+				failed <- srv.ListenAndServeTLS(crawler.CertFile, crawler.KeyFile)
+			} else {
+				failed <- srv.ListenAndServe()
+			}
+		}()
+
+		select {
+		case <-ctx.Done():
+			shutdownCtx, cancel := context.WithTimeout(context.Background(), webhookShutdownTimeout)
+			if err := srv.Shutdown(shutdownCtx); err != nil {
+				// slow clients are cut off
+				srv.Close()
+			}
+			cancel()
+			requests.Wait()
+			log.Printf("Stop webhook server on %v\n", crawler.addr)
+			return nil
+		case err := <-failed:
+			log.Printf("Webhook server failed, starting again in %v: %v\n", repeatDuration, err)
+			crawler.report(err)
+			select {
+			case <-ctx.Done():
+				requests.Wait()
+				log.Printf("Stop webhook server on %v\n", crawler.addr)
+				return nil
+			case <-crawler.clock.After(repeatDuration):
+			}
+		}
+	}
+}
+
+type webhookHandler struct {
+	crawler *WebhookCrawler
+	entries chan<- MessageData
+	done    <-chan struct{}
+	// the running requests
+	requests *sync.WaitGroup
+}
+
+func (h *webhookHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	h.requests.Add(1)
+	defer h.requests.Done()
+	if r.URL.Path != "/pins" {
+		writeWebhookError(w, &webhookError{http.StatusNotFound, "Not found, post pins to /pins"})
+		return
+	}
+	if r.Method != "POST" {
+		w.Header().Set("Allow", "POST")
+		writeWebhookError(w, &webhookError{http.StatusMethodNotAllowed, "Only POST is allowed"})
+		return
+	}
+	if !h.crawler.authorized(r) {
+		log.Printf("Rejected pin from %v: unauthorized\n", r.RemoteAddr)
+		w.Header().Set("WWW-Authenticate", `Bearer realm="pinboard"`)
+		writeWebhookError(w, &webhookError{http.StatusUnauthorized, "Invalid or missing token"})
+		return
+	}
+
+	r.Body = http.MaxBytesReader(w, r.Body, maxPinSize)
+	data, err := h.crawler.readPin(r)
+	if err != nil {
+		log.Printf("Rejected pin from %v: %v\n", r.RemoteAddr, err)
+		writeWebhookError(w, err)
+		return
+	}
+
+	select {
+	case h.entries <- *data:
+	case <-h.done:
+		removeImages(data)
+		writeWebhookError(w, &webhookError{http.StatusServiceUnavailable, "Pinboard is shutting down"})
+		return
+	}
+	log.Printf("Created entry from webhook: %v, %v, %v, %v\n", data.ID, data.SenderName, data.ShortText, data.ImageNames)
+	h.crawler.report(nil)
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(map[string]string{"id": data.ID})
+}
+
+// authorized checks the bearer token of the request
+func (crawler *WebhookCrawler) authorized(r *http.Request) bool {
+	auth := r.Header.Get("Authorization")
+	if !strings.HasPrefix(auth, "Bearer ") {
+		return false
+	}
+	token := []byte(strings.TrimPrefix(auth, "Bearer "))
+	ok := false
+	for _, t := range crawler.tokens {
+		// no early exit, the time must not tell how much of a token matched
+		if subtle.ConstantTimeCompare(token, []byte(t)) == 1 {
+			ok = true
+		}
+	}
+	return ok
+}
+
+// readPin creates a message out of the posted pin and saves its images
+func (crawler *WebhookCrawler) readPin(r *http.Request) (*MessageData, error) {
+	var pin pinRequest
+	var files [][]byte
+	var names []string
+
+	mediaType, _, err := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	if err != nil {
+		return nil, &webhookError{http.StatusUnsupportedMediaType, "Missing or invalid Content-Type"}
+	}
+	switch mediaType {
+	case "application/json":
+		err := json.NewDecoder(r.Body).Decode(&pin)
+		if tooLarge(err) {
+			return nil, errPinTooLarge
+		}
+		if err != nil {
+			return nil, &webhookError{http.StatusBadRequest, fmt.Sprintf("Invalid JSON: %v", err)}
+		}
+		for i, img := range pin.Images {
+			buf, err := base64.StdEncoding.DecodeString(img.Data)
+			if err != nil {
+				return nil, &webhookError{http.StatusBadRequest, fmt.Sprintf("Image %v is not base64: %v", i+1, err)}
+			}
+			files = append(files, buf)
+			names = append(names, img.Filename)
+		}
+	case "multipart/form-data":
+		err := r.ParseMultipartForm(maxPinSize)
+		if tooLarge(err) {
+			return nil, errPinTooLarge
+		}
+		if err != nil {
+			return nil, &webhookError{http.StatusBadRequest, fmt.Sprintf("Invalid multipart form: %v", err)}
+		}
+		pin.Text = r.FormValue("text")
+		pin.LongText = r.FormValue("long_text")
+		pin.Sender = r.FormValue("sender")
+		for _, f := range []struct {
+			key string
+			t   **time.Time
+		}{{"show_from", &pin.ShowFrom}, {"show_until", &pin.ShowUntil}} {
+			if v := r.FormValue(f.key); v != "" {
+				t, err := time.Parse(time.RFC3339, v)
+				if err != nil {
+					return nil, &webhookError{http.StatusBadRequest, fmt.Sprintf("Invalid %v, use RFC 3339: %v", f.key, err)}
+				}
+				*f.t = &t
+			}
+		}
+		for _, fh := range r.MultipartForm.File["image"] {
+			f, err := fh.Open()
+			if err != nil {
+				return nil, err
+			}
+			buf, err := ioutil.ReadAll(f)
+			f.Close()
+			if err != nil {
+				return nil, err
+			}
+			files = append(files, buf)
+			names = append(names, fh.Filename)
+		}
+	default:
+		return nil, &webhookError{http.StatusUnsupportedMediaType, "Use application/json or multipart/form-data"}
+	}
+
+	if strings.TrimSpace(pin.Text) == "" {
+		return nil, &webhookError{http.StatusBadRequest, "The text is missing"}
+	}
+	if pin.ShowFrom != nil && pin.ShowUntil != nil && !pin.ShowUntil.After(*pin.ShowFrom) {
+		return nil, &webhookError{http.StatusBadRequest, "show_until must be after show_from"}
+	}
+	for i, buf := range files {
+		t := http.DetectContentType(buf)
+		if !isMediaType(t) {
+			return nil, &webhookError{http.StatusUnsupportedMediaType, fmt.Sprintf("Image %v is %v, only JPEG, PNG, GIF, WebP, MP4 and WebM are supported", i+1, t)}
+		}
+	}
+
+	data := new(MessageData)
+	data.ID, err = newPinID()
+	if err != nil {
+		return nil, err
+	}
+	data.Type = WEBHOOK
+	data.Timestamp = crawler.clock.Now()
+	data.SenderName = pin.Sender
+	if data.SenderName == "" {
+		data.SenderName = "Webhook"
+	}
+	data.ShortText = pin.Text
+	data.LongText = pin.LongText
+	if data.LongText == "" {
+		data.LongText = pin.Text
+	}
+	if pin.ShowFrom != nil {
+		data.ShowFrom = *pin.ShowFrom
+	}
+	if pin.ShowUntil != nil {
+		data.ShowUntil = *pin.ShowUntil
+	}
+
+	for i, buf := range files {
+		// the name is chosen by the client, it must not leave the directory
+		name := filepath.Base(strings.Replace(names[i], "\\", "/", -1))
+		if name == "." || name == "/" || strings.HasPrefix(name, ".") {
+			name = "pin"
+		}
+		_, err := data.saveMedia(buf, name, http.DetectContentType(buf), crawler.limits)
+		if err != nil {
+			removeImages(data)
+			return nil, fmt.Errorf("Failed to save image %v: %v", i+1, err)
+		}
+	}
+	return data, nil
+}
+
+// newPinID returns a random id
+func newPinID() (string, error) {
+	b := make([]byte, 8)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
+}
+
+func writeWebhookError(w http.ResponseWriter, err error) {
+	status := http.StatusInternalServerError
+	if e, ok := err.(*webhookError); ok {
+		status = e.status
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(map[string]string{"error": err.Error()})
+}
@@ -0,0 +1,231 @@
+package web
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"github.com/flothe/pinboard/web/pop3test"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// webhookTest calls the handler of a webhook crawler directly, the entries
+// are kept in a buffered channel
+type webhookTest struct {
+	handler *webhookHandler
+	entries chan MessageData
+}
+
+func newWebhookTest(t *testing.T) *webhookTest {
+	chdirTemp(t)
+	c := NewWebhookCrawler("127.0.0.1:0", []string{"geheim", "zweites"}, DefaultImageLimits, newFakeClock())
+	entries := make(chan MessageData, 1)
+	return &webhookTest{&webhookHandler{c, entries, make(chan struct{}), new(sync.WaitGroup)}, entries}
+}
+
+// post sends the body with the token and returns the response
+func (wt *webhookTest) post(token, contentType string, body []byte) *httptest.ResponseRecorder {
+	r := httptest.NewRequest("POST", "/pins", bytes.NewReader(body))
+	r.Header.Set("Content-Type", contentType)
+	if token != "" {
+		r.Header.Set("Authorization", "Bearer "+token)
+	}
+	w := httptest.NewRecorder()
+	wt.handler.ServeHTTP(w, r)
+	return w
+}
+
+// entry returns the entry of the last pin, it has to be created
+func (wt *webhookTest) entry(t *testing.T, w *httptest.ResponseRecorder) MessageData {
+	if w.Code != http.StatusCreated {
+		t.Fatalf("status %v %s, want 201", w.Code, w.Body)
+	}
+	var resp map[string]string
+	json.Unmarshal(w.Body.Bytes(), &resp)
+	select {
+	case e := <-wt.entries:
+		if e.ID == "" || e.ID != resp["id"] {
+			t.Errorf("entry %q, response %s", e.ID, w.Body)
+		}
+		return e
+	default:
+		t.Fatal("no entry has been sent")
+	}
+	return MessageData{}
+}
+
+func jsonPin(t *testing.T, pin map[string]interface{}) []byte {
+	buf, err := json.Marshal(pin)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return buf
+}
+
+func TestWebhookToken(t *testing.T) {
+	wt := newWebhookTest(t)
+	body := jsonPin(t, map[string]interface{}{"text": "Hallo"})
+	for _, token := range []string{"", "falsch", "geheim2", "gehei"} {
+		w := wt.post(token, "application/json", body)
+		if w.Code != http.StatusUnauthorized || w.Header().Get("WWW-Authenticate") == "" {
+			t.Errorf("token %q: status %v, want 401 with WWW-Authenticate", token, w.Code)
+		}
+	}
+	// every configured token is accepted
+	for _, token := range []string{"geheim", "zweites"} {
+		if e := wt.entry(t, wt.post(token, "application/json", body)); e.ShortText != "Hallo" {
+			t.Errorf("token %q: got %q", token, e.ShortText)
+		}
+	}
+}
+
+func TestWebhookJSON(t *testing.T) {
+	wt := newWebhookTest(t)
+	from := time.Date(2024, 5, 1, 8, 0, 0, 0, time.UTC)
+	body := jsonPin(t, map[string]interface{}{
+		"text":      "Build ist grün",
+		"sender":    "CI",
+		"long_text": "Alle Tests laufen",
+		"images": []map[string]string{
+			{"filename": "chart.jpg", "data": base64.StdEncoding.EncodeToString(pop3test.JPEG(30, 20))},
+		},
+		"show_from":  from,
+		"show_until": from.Add(10 * time.Hour),
+	})
+	e := wt.entry(t, wt.post("geheim", "application/json", body))
+	if e.Type != WEBHOOK || e.ShortText != "Build ist grün" || e.SenderName != "CI" || e.LongText != "Alle Tests laufen" {
+		t.Errorf("got %v %q from %q: %q", e.Type, e.ShortText, e.SenderName, e.LongText)
+	}
+	if !e.ShowFrom.Equal(from) || !e.ShowUntil.Equal(from.Add(10*time.Hour)) {
+		t.Errorf("display window %v - %v", e.ShowFrom, e.ShowUntil)
+	}
+	if len(e.ImageNames) != 1 || !exists(e.ImageNames[0]) {
+		t.Errorf("images %v, want the saved chart", e.ImageNames)
+	}
+
+	// without sender the webhook is named
+	e = wt.entry(t, wt.post("geheim", "application/json", jsonPin(t, map[string]interface{}{"text": "Kurz"})))
+	if e.SenderName != "Webhook" || e.LongText != "Kurz" {
+		t.Errorf("got %q from %q", e.LongText, e.SenderName)
+	}
+}
+
+// multipartPin returns the body and the content type of a form with the
+// fields and the images as files of the field "image"
+func multipartPin(t *testing.T, fields map[string]string, images map[string][]byte) ([]byte, string) {
+	var b bytes.Buffer
+	mw := multipart.NewWriter(&b)
+	for k, v := range fields {
+		mw.WriteField(k, v)
+	}
+	for name, img := range images {
+		f, err := mw.CreateFormFile("image", name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		f.Write(img)
+	}
+	if err := mw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return b.Bytes(), mw.FormDataContentType()
+}
+
+func TestWebhookMultipart(t *testing.T) {
+	wt := newWebhookTest(t)
+	body, ct := multipartPin(t, map[string]string{
+		"text":       "Foto vom Fest",
+		"sender":     "Bot",
+		"show_until": "2024-05-01T18:00:00+02:00",
+	}, map[string][]byte{"fest.png": pop3test.PNG(20, 20)})
+	e := wt.entry(t, wt.post("geheim", ct, body))
+	if e.ShortText != "Foto vom Fest" || e.SenderName != "Bot" || len(e.ImageNames) != 1 {
+		t.Errorf("got %q from %q with %v", e.ShortText, e.SenderName, e.ImageNames)
+	}
+	if want := time.Date(2024, 5, 1, 16, 0, 0, 0, time.UTC); !e.ShowUntil.Equal(want) || !e.ShowFrom.IsZero() {
+		t.Errorf("display window %v - %v, want until %v", e.ShowFrom, e.ShowUntil, want)
+	}
+
+	body, ct = multipartPin(t, map[string]string{"text": "Falsch", "show_from": "morgen"}, nil)
+	if w := wt.post("geheim", ct, body); w.Code != http.StatusBadRequest {
+		t.Errorf("status %v for an invalid show_from, want 400", w.Code)
+	}
+}
+
+func TestWebhookFilenames(t *testing.T) {
+	wt := newWebhookTest(t)
+	img := pop3test.JPEG(16, 16)
+	names := []string{"../../etc/passwd.jpg", `..\..\boot.jpg`, "/abs/ok.jpg", ".hidden.jpg", "..", ""}
+	var images []map[string]string
+	for _, name := range names {
+		images = append(images, map[string]string{"filename": name, "data": base64.StdEncoding.EncodeToString(img)})
+	}
+	e := wt.entry(t, wt.post("geheim", "application/json", jsonPin(t, map[string]interface{}{"text": "Namen", "images": images})))
+	if len(e.ImageNames) != len(names) {
+		t.Fatalf("images %v, want %v", e.ImageNames, len(names))
+	}
+	// all files are in the current directory under a name that is not hidden
+	for i, fn := range e.ImageNames {
+		if filepath.Dir(fn) != "." || strings.HasPrefix(fn, ".") || !exists(fn) {
+			t.Errorf("%q is saved as %q", names[i], fn)
+		}
+	}
+	for i, want := range []string{"passwd.", "boot.", "ok.", "pin"} {
+		if !strings.HasPrefix(e.ImageNames[i], want) {
+			t.Errorf("%q is saved as %q, want %v...", names[i], e.ImageNames[i], want)
+		}
+	}
+}
+
+func TestWebhookRejects(t *testing.T) {
+	wt := newWebhookTest(t)
+	from := time.Date(2024, 5, 1, 8, 0, 0, 0, time.UTC)
+	for _, c := range []struct {
+		name        string
+		contentType string
+		body        []byte
+		status      int
+	}{
+		{"no text", "application/json", jsonPin(t, map[string]interface{}{"text": "  "}), http.StatusBadRequest},
+		{"invalid JSON", "application/json", []byte(`{"text": `), http.StatusBadRequest},
+		{"window ends before it starts", "application/json",
+			jsonPin(t, map[string]interface{}{"text": "x", "show_from": from, "show_until": from.Add(-time.Hour)}), http.StatusBadRequest},
+		{"empty window", "application/json",
+			jsonPin(t, map[string]interface{}{"text": "x", "show_from": from, "show_until": from}), http.StatusBadRequest},
+		{"no image", "application/json", jsonPin(t, map[string]interface{}{"text": "x",
+			"images": []map[string]string{{"filename": "a.jpg", "data": base64.StdEncoding.EncodeToString([]byte("text"))}}}),
+			http.StatusUnsupportedMediaType},
+		{"text/plain", "text/plain", []byte("Hallo"), http.StatusUnsupportedMediaType},
+	} {
+		if w := wt.post("geheim", c.contentType, c.body); w.Code != c.status {
+			t.Errorf("%v: status %v %s, want %v", c.name, w.Code, w.Body, c.status)
+		}
+	}
+	select {
+	case e := <-wt.entries:
+		t.Errorf("the rejected pin %q has been sent", e.ShortText)
+	default:
+	}
+}
+
+func TestWebhookTooLarge(t *testing.T) {
+	wt := newWebhookTest(t)
+	long := strings.Repeat("a", maxPinSize)
+	body := jsonPin(t, map[string]interface{}{"text": "Groß", "long_text": long})
+	if w := wt.post("geheim", "application/json", body); w.Code != http.StatusRequestEntityTooLarge {
+		t.Errorf("status %v %s for JSON, want 413", w.Code, w.Body)
+	}
+	body, ct := multipartPin(t, map[string]string{"text": "Groß"}, map[string][]byte{"a.jpg": []byte(long)})
+	if w := wt.post("geheim", ct, body); w.Code != http.StatusRequestEntityTooLarge {
+		t.Errorf("status %v %s for the form, want 413", w.Code, w.Body)
+	}
+	if n := len(wt.entries); n != 0 {
+		t.Errorf("%v entries sent", n)
+	}
+}